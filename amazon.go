@@ -2,15 +2,80 @@ package storage
 
 import (
 	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"go.uber.org/zap"
+	"io"
 	"io/ioutil"
+	"net/http"
+	"os"
 	"path"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
+type AWSOptions struct {
+	Logger *zap.SugaredLogger
+	Bucket string
+	Prefix string
+	Region string
+	// Endpoint of an S3 compatible service, path-style addressing is used with custom endpoints
+	Endpoint string
+	// SSE is the server-side encryption algorithm of uploaded objects
+	SSE string
+	// Static credentials, the default credential chain is used if AccessKey is not set
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	// Profile of the shared config and credentials files
+	Profile string
+	// RoleARN is assumed with the credentials above, STSEndpoint overrides the regional STS endpoint
+	RoleARN         string
+	ExternalID      string
+	RoleSessionName string
+	STSEndpoint     string
+	// TLS client certificate, CA certificate to verify the endpoint with and whether to skip the verification
+	TLSCertFile           string
+	TLSKeyFile            string
+	TLSCAFile             string
+	TLSInsecureSkipVerify bool
+	// VirtualHostedStyle keeps bucket names in the host with a custom Endpoint
+	VirtualHostedStyle bool
+	// DisableContentMD5 skips Content-MD5 and body hash headers of uploads
+	// and response validation, for services that reject or miscompute them
+	DisableContentMD5 bool
+	// Disable100Continue sends upload bodies without waiting for 100 Continue
+	Disable100Continue bool
+	// PartSize and Concurrency of multipart uploads and ranged downloads, default to s3manager defaults
+	PartSize    int64
+	Concurrency int
+	// ResumeUploads keeps parts of failed multipart uploads, the next upload of the key reuses
+	// its parts matching data by size and MD5 ETag. Parts encrypted with SSE-KMS are uploaded again
+	ResumeUploads bool
+	// HideExpiredOnList hides objects written with a TTL from ListObjects once they expire.
+	// It sends a HEAD request per listed object, without it expired objects are listed until swept
+	HideExpiredOnList bool
+	// HTTPClient defaults to the SDK client, its transport must be an *http.Transport with TLS options
+	HTTPClient *http.Client
+}
+
 type AWSStorage struct {
 	Bucket     string
 	Client     *s3.S3
@@ -18,36 +83,164 @@ type AWSStorage struct {
 	Prefix     string
 	Uploader   *s3manager.Uploader
 	SSE        string
+	logger     *zap.SugaredLogger
+	resume     bool
+	// hideExpired checks expiration of every listed object
+	hideExpired bool
 }
 
 func NewAWSStorage(bucket string, prefix string, region string, endpoint string, sse string) (*AWSStorage, error) {
+	return NewAWSStorageWithOptions(AWSOptions{
+		Bucket:   bucket,
+		Prefix:   prefix,
+		Region:   region,
+		Endpoint: endpoint,
+		SSE:      sse,
+	})
+}
+
+func NewAWSStorageWithOptions(opts AWSOptions) (*AWSStorage, error) {
+	if opts.Logger == nil {
+		opts.Logger = zap.S()
+	}
+	if opts.PartSize != 0 && opts.PartSize < s3manager.MinUploadPartSize {
+		return nil, fmt.Errorf("part size must be at least %d bytes", s3manager.MinUploadPartSize)
+	}
+
 	conf := &aws.Config{
-		Region:           aws.String(region),
-		Endpoint:         aws.String(endpoint),
-		DisableSSL:       aws.Bool(strings.HasPrefix(endpoint, "http://")),
-		S3ForcePathStyle: aws.Bool(endpoint != ""),
+		Region: aws.String(opts.Region),
+		Logger: aws.LoggerFunc(func(args ...interface{}) {
+			opts.Logger.Debug(args...)
+		}),
+	}
+	if opts.AccessKey != "" {
+		conf.Credentials = credentials.NewStaticCredentials(opts.AccessKey, opts.SecretKey, opts.SessionToken)
+	}
+	if opts.HTTPClient != nil {
+		conf.HTTPClient = opts.HTTPClient
+	} else if opts.TLSInsecureSkipVerify {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		conf.HTTPClient = &http.Client{Transport: transport}
+	}
+
+	sessionOpts := session.Options{
+		Config:  *conf,
+		Profile: opts.Profile,
+	}
+	if opts.Profile != "" {
+		sessionOpts.SharedConfigState = session.SharedConfigEnable
+	}
+	if opts.TLSCAFile != "" {
+		ca, err := ioutil.ReadFile(opts.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		sessionOpts.CustomCABundle = bytes.NewReader(ca)
+	}
+	if opts.TLSCertFile != "" && opts.TLSKeyFile != "" {
+		cert, err := ioutil.ReadFile(opts.TLSCertFile)
+		if err != nil {
+			return nil, err
+		}
+		key, err := ioutil.ReadFile(opts.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		sessionOpts.ClientTLSCert = bytes.NewReader(cert)
+		sessionOpts.ClientTLSKey = bytes.NewReader(key)
 	}
 
-	sess, err := session.NewSession(conf)
+	sess, err := session.NewSessionWithOptions(sessionOpts)
 	if err != nil {
 		return nil, err
 	}
 
-	service := s3.New(sess, conf)
+	s3Conf := &aws.Config{
+		Endpoint:                      aws.String(opts.Endpoint),
+		DisableSSL:                    aws.Bool(strings.HasPrefix(opts.Endpoint, "http://")),
+		S3ForcePathStyle:              aws.Bool(opts.Endpoint != "" && !opts.VirtualHostedStyle),
+		S3DisableContentMD5Validation: aws.Bool(opts.DisableContentMD5),
+		S3Disable100Continue:          aws.Bool(opts.Disable100Continue),
+	}
+	if opts.RoleARN != "" {
+		stsConf := &aws.Config{}
+		if opts.STSEndpoint != "" {
+			stsConf.Endpoint = aws.String(opts.STSEndpoint)
+			stsConf.DisableSSL = aws.Bool(strings.HasPrefix(opts.STSEndpoint, "http://"))
+		}
+		s3Conf.Credentials = stscreds.NewCredentialsWithClient(sts.New(sess, stsConf), opts.RoleARN, func(p *stscreds.AssumeRoleProvider) {
+			if opts.ExternalID != "" {
+				p.ExternalID = aws.String(opts.ExternalID)
+			}
+			if opts.RoleSessionName != "" {
+				p.RoleSessionName = opts.RoleSessionName
+			}
+		})
+	}
+
+	service := s3.New(sess, s3Conf)
 
 	return &AWSStorage{
-		Bucket:     bucket,
-		Client:     service,
-		Downloader: s3manager.NewDownloaderWithClient(service),
-		Prefix:     cleanPrefix(prefix),
-		Uploader:   s3manager.NewUploaderWithClient(service),
-		SSE:        sse,
+		Bucket: opts.Bucket,
+		Client: service,
+		Downloader: s3manager.NewDownloaderWithClient(service, func(d *s3manager.Downloader) {
+			if opts.PartSize > 0 {
+				d.PartSize = opts.PartSize
+			}
+			if opts.Concurrency > 0 {
+				d.Concurrency = opts.Concurrency
+			}
+		}),
+		Prefix: cleanPrefix(opts.Prefix),
+		Uploader: s3manager.NewUploaderWithClient(service, func(u *s3manager.Uploader) {
+			if opts.PartSize > 0 {
+				u.PartSize = opts.PartSize
+			}
+			if opts.Concurrency > 0 {
+				u.Concurrency = opts.Concurrency
+			}
+		}),
+		SSE:         opts.SSE,
+		logger:      opts.Logger,
+		resume:      opts.ResumeUploads,
+		hideExpired: opts.HideExpiredOnList,
 	}, nil
 }
 
+// ListObjects lists objects right under prefix, expired objects are listed
+// until swept unless HideExpiredOnList is set
 func (s *AWSStorage) ListObjects(prefix string) ([]Object, error) {
+	objects, err := s.listObjects(prefix)
+	if err != nil || !s.hideExpired {
+		return objects, err
+	}
+
+	expired, err := s.expiredObjects(prefix, objects)
+	if err != nil {
+		return nil, err
+	}
+	if len(expired) == 0 {
+		return objects, nil
+	}
+
+	var visible []Object
+	for _, o := range objects {
+		if !expired[o.Path] {
+			visible = append(visible, o)
+		}
+	}
+	return visible, nil
+}
+
+func (s *AWSStorage) listObjects(prefix string) ([]Object, error) {
 	var objects []Object
 
+	prefix, err := defaultKeyRules.validatePrefix(prefix)
+	if err != nil {
+		return objects, err
+	}
+
 	prefix = path.Join(s.Prefix, prefix)
 	s3Input := &s3.ListObjectsInput{
 		Bucket: aws.String(s.Bucket),
@@ -79,30 +272,134 @@ func (s *AWSStorage) ListObjects(prefix string) ([]Object, error) {
 }
 
 func (s *AWSStorage) GetObject(key string) (Object, error) {
-	var object Object
-	object.Path = key
-	var content []byte
-	s3Input := &s3.GetObjectInput{
-		Bucket: aws.String(s.Bucket),
-		Key:    aws.String(path.Join(s.Prefix, key)),
-	}
-	s3Result, err := s.Client.GetObject(s3Input)
+	buf := aws.NewWriteAtBuffer([]byte{})
+	object, err := s.DownloadObject(context.Background(), key, buf)
 	if err != nil {
 		return object, err
 	}
-	content, err = ioutil.ReadAll(s3Result.Body)
+	content := buf.Bytes()
+	object.Meta.Checksum, err = objectChecksum(key, content, object.Meta.Checksum)
 	if err != nil {
 		return object, err
 	}
 	object.Data = content
-	object.LastModified = *s3Result.LastModified
+	return object, nil
+}
+
+// DownloadObject writes object content to w with ranged requests of the Downloader part size run in parallel,
+// parts after the first one are fetched only if the object has not changed since.
+// It returns the object with metadata and without data, its checksum is not verified
+func (s *AWSStorage) DownloadObject(ctx context.Context, key string, w io.WriterAt) (Object, error) {
+	object := Object{Path: key, Data: []byte{}}
+	objectKey, err := s.objectKey(key)
+	if err != nil {
+		return object, err
+	}
+
+	// the first part is fetched before the others are started
+	var first *s3.GetObjectOutput
+	_, err = s.Downloader.DownloadWithContext(ctx, w, &s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(objectKey),
+	}, s3manager.WithDownloaderRequestOptions(func(r *request.Request) {
+		if first != nil {
+			if etag := aws.StringValue(first.ETag); etag != "" {
+				r.HTTPRequest.Header.Set("If-Match", etag)
+			}
+			return
+		}
+		r.Handlers.Complete.PushBack(func(r *request.Request) {
+			if r.Error == nil {
+				first = r.Data.(*s3.GetObjectOutput)
+			}
+		})
+	}))
+	if err != nil {
+		return object, s3NotExist(key, err)
+	}
+	if first == nil {
+		// ranged requests of empty objects are not satisfiable
+		res, err := s.Client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(s.Bucket),
+			Key:    aws.String(objectKey),
+		})
+		if err != nil {
+			return object, s3NotExist(key, err)
+		}
+		first = &s3.GetObjectOutput{ContentType: res.ContentType, Metadata: res.Metadata, LastModified: res.LastModified}
+	}
+	if isExpired(s3ExpiresAt(first.Metadata)) {
+		return object, &os.PathError{Op: "open", Path: key, Err: os.ErrNotExist}
+	}
+
+	object.Meta = s3ObjectMeta(key, first.ContentType, first.Metadata)
+	object.LastModified = aws.TimeValue(first.LastModified)
+	return object, nil
+}
+
+// StatObject returns object metadata with a HEAD request
+func (s *AWSStorage) StatObject(key string) (Object, error) {
+	object := Object{Path: key, Data: []byte{}}
+	objectKey, err := s.objectKey(key)
+	if err != nil {
+		return object, err
+	}
+
+	res, err := s.Client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(objectKey),
+	})
+	if err != nil {
+		return object, s3NotExist(key, err)
+	}
+	if isExpired(s3ExpiresAt(res.Metadata)) {
+		return object, &os.PathError{Op: "open", Path: key, Err: os.ErrNotExist}
+	}
+
+	object.Meta = s3ObjectMeta(key, res.ContentType, res.Metadata)
+	object.LastModified = aws.TimeValue(res.LastModified)
 	return object, nil
 }
 
 func (s *AWSStorage) PutObject(key string, data []byte) error {
+	return s.putObject(context.Background(), key, data, time.Time{}, Metadata{})
+}
+
+// PutObjectWithMetadata uploads an object with content type and user metadata,
+// SHA-256 checksum of data is stored in user metadata as well
+func (s *AWSStorage) PutObjectWithMetadata(key string, data []byte, meta Metadata) error {
+	return s.UploadObject(context.Background(), key, data, meta)
+}
+
+// UploadObject is PutObjectWithMetadata with a context canceling the upload
+func (s *AWSStorage) UploadObject(ctx context.Context, key string, data []byte, meta Metadata) error {
+	checksum, err := objectChecksum(key, data, meta.Checksum)
+	if err != nil {
+		return err
+	}
+	meta.Checksum = checksum
+	return s.putObject(ctx, key, data, time.Time{}, meta)
+}
+
+// PutObjectWithTTL uploads an object with expiration time stored in its metadata,
+// expired objects are hidden until SweepExpired or a bucket lifecycle rule removes them
+func (s *AWSStorage) PutObjectWithTTL(key string, data []byte, ttl time.Duration) error {
+	expires, err := expiresAt(ttl)
+	if err != nil {
+		return err
+	}
+	return s.putObject(context.Background(), key, data, expires, Metadata{})
+}
+
+func (s *AWSStorage) putObject(ctx context.Context, key string, data []byte, expires time.Time, meta Metadata) error {
+	objectKey, err := s.objectKey(key)
+	if err != nil {
+		return err
+	}
+
 	s3Input := &s3manager.UploadInput{
 		Bucket: aws.String(s.Bucket),
-		Key:    aws.String(path.Join(s.Prefix, key)),
+		Key:    aws.String(objectKey),
 		Body:   bytes.NewBuffer(data),
 	}
 
@@ -110,15 +407,654 @@ func (s *AWSStorage) PutObject(key string, data []byte) error {
 		s3Input.ServerSideEncryption = aws.String(s.SSE)
 	}
 
-	_, err := s.Uploader.Upload(s3Input)
+	if meta.ContentType != "" {
+		s3Input.ContentType = aws.String(meta.ContentType)
+	}
+
+	metadata := aws.StringMap(meta.UserMetadata)
+	if meta.Checksum != "" {
+		metadata[checksumMetadataKey] = aws.String(meta.Checksum)
+	}
+	if !expires.IsZero() {
+		s3Input.Expires = aws.Time(expires)
+		metadata[expiresMetadataKey] = aws.String(expires.Format(time.RFC3339Nano))
+	}
+	if len(metadata) > 0 {
+		s3Input.Metadata = metadata
+	}
+
+	if s.resume && int64(len(data)) > s.Uploader.PartSize {
+		return s.resumeUpload(ctx, s3Input, data)
+	}
+	_, err = s.Uploader.UploadWithContext(ctx, s3Input)
 	return err
 }
 
+// resumeUpload uploads data in parts of the Uploader part size with the latest incomplete
+// multipart upload of the key started for the same data and metadata, or a new one.
+// Parts are kept if the upload fails
+func (s *AWSStorage) resumeUpload(ctx context.Context, input *s3manager.UploadInput, data []byte) error {
+	digest := uploadDigest(input, data)
+	uploadID, uploaded, err := s.incompleteUpload(ctx, aws.StringValue(input.Key), digest)
+	if err != nil {
+		return err
+	}
+	if uploadID == "" {
+		res, err := s.Client.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
+			Bucket:               input.Bucket,
+			Key:                  input.Key,
+			ContentType:          input.ContentType,
+			Expires:              input.Expires,
+			Metadata:             input.Metadata,
+			ServerSideEncryption: input.ServerSideEncryption,
+		})
+		if err != nil {
+			return err
+		}
+		uploadID = aws.StringValue(res.UploadId)
+
+		// S3 does not return metadata of incomplete uploads, the digest is kept in a marker object
+		_, err = s.Client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+			Bucket: aws.String(s.Bucket),
+			Key:    aws.String(s.uploadMarkerKey(uploadID)),
+			Body:   strings.NewReader(digest),
+		})
+		if err != nil {
+			s.abortUpload(ctx, input.Key, uploadID)
+			return err
+		}
+	} else {
+		s.logger.Debugf("Resuming upload of %s with %d uploaded parts", aws.StringValue(input.Key), len(uploaded))
+	}
+
+	partSize := s.Uploader.PartSize
+	parts := make([]*s3.CompletedPart, (int64(len(data))+partSize-1)/partSize)
+
+	var mu sync.Mutex
+	var firstErr error
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, s.Uploader.Concurrency)
+	for i := range parts {
+		start := int64(i) * partSize
+		end := start + partSize
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		part := data[start:end]
+		number := int64(i + 1)
+
+		sum := md5.Sum(part)
+		if p, ok := uploaded[number]; ok && aws.Int64Value(p.Size) == int64(len(part)) &&
+			aws.StringValue(p.ETag) == `"`+hex.EncodeToString(sum[:])+`"` {
+			parts[i] = &s3.CompletedPart{ETag: p.ETag, PartNumber: p.PartNumber}
+			continue
+		}
+
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed {
+			break
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, number int64, part []byte) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			res, err := s.Client.UploadPartWithContext(ctx, &s3.UploadPartInput{
+				Bucket:     input.Bucket,
+				Key:        input.Key,
+				UploadId:   aws.String(uploadID),
+				PartNumber: aws.Int64(number),
+				Body:       bytes.NewReader(part),
+			})
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			parts[i] = &s3.CompletedPart{ETag: res.ETag, PartNumber: aws.Int64(number)}
+		}(i, number, part)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+
+	_, err = s.Client.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          input.Bucket,
+		Key:             input.Key,
+		UploadId:        aws.String(uploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		return err
+	}
+	s.deleteUploadMarker(ctx, uploadID)
+	return nil
+}
+
+// uploadDigest is the SHA-256 digest of data and of the object attributes set by CreateMultipartUpload
+func uploadDigest(input *s3manager.UploadInput, data []byte) string {
+	var keys []string
+	for k := range input.Metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	h := sha256.New()
+	h.Write(data)
+	fmt.Fprintf(h, "\x00%q\x00%q\x00%q", aws.StringValue(input.ContentType),
+		aws.StringValue(input.ServerSideEncryption), aws.TimeValue(input.Expires).Format(time.RFC3339Nano))
+	for _, k := range keys {
+		fmt.Fprintf(h, "\x00%q=%q", k, aws.StringValue(input.Metadata[k]))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// uploadMarkerKey is the key of the object holding the digest of an incomplete multipart upload
+func (s *AWSStorage) uploadMarkerKey(uploadID string) string {
+	return path.Join(s.Prefix, lockDir, "uploads", uploadID)
+}
+
+func (s *AWSStorage) deleteUploadMarker(ctx context.Context, uploadID string) {
+	_, err := s.Client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(s.uploadMarkerKey(uploadID)),
+	})
+	if err != nil {
+		s.logger.Warnf("Unable to delete marker of upload %s: %s", uploadID, err)
+	}
+}
+
+// abortUpload aborts a multipart upload and deletes its marker
+func (s *AWSStorage) abortUpload(ctx context.Context, objectKey *string, uploadID string) error {
+	_, err := s.Client.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.Bucket),
+		Key:      objectKey,
+		UploadId: aws.String(uploadID),
+	})
+	if err == nil || isNoSuchUpload(err) {
+		s.deleteUploadMarker(ctx, uploadID)
+	}
+	return err
+}
+
+// isNoSuchUpload reports whether the upload has been completed or aborted in the meantime
+func isNoSuchUpload(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == s3.ErrCodeNoSuchUpload
+}
+
+// incompleteUpload returns the ID and uploaded parts of the latest incomplete multipart upload of objectKey
+// with the digest, empty ID is returned if there is none. Other uploads of objectKey may be in progress
+// and are left to AbortStaleUploads
+func (s *AWSStorage) incompleteUpload(ctx context.Context, objectKey string, digest string) (string, map[int64]*s3.Part, error) {
+	var uploads []*s3.MultipartUpload
+	err := s.Client.ListMultipartUploadsPagesWithContext(ctx, &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(s.Bucket),
+		Prefix: aws.String(objectKey),
+	}, func(page *s3.ListMultipartUploadsOutput, lastPage bool) bool {
+		for _, upload := range page.Uploads {
+			if aws.StringValue(upload.Key) == objectKey {
+				uploads = append(uploads, upload)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	sort.SliceStable(uploads, func(i, j int) bool {
+		return aws.TimeValue(uploads[i].Initiated).After(aws.TimeValue(uploads[j].Initiated))
+	})
+
+	var latest *s3.MultipartUpload
+	for _, upload := range uploads {
+		res, err := s.Client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(s.Bucket),
+			Key:    aws.String(s.uploadMarkerKey(aws.StringValue(upload.UploadId))),
+		})
+		if errors.Is(s3NotExist(objectKey, err), os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		marker, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return "", nil, err
+		}
+		if string(marker) == digest {
+			latest = upload
+			break
+		}
+	}
+	if latest == nil {
+		return "", nil, nil
+	}
+
+	parts := make(map[int64]*s3.Part)
+	err = s.Client.ListPartsPagesWithContext(ctx, &s3.ListPartsInput{
+		Bucket:   aws.String(s.Bucket),
+		Key:      latest.Key,
+		UploadId: latest.UploadId,
+	}, func(page *s3.ListPartsOutput, lastPage bool) bool {
+		for _, part := range page.Parts {
+			parts[aws.Int64Value(part.PartNumber)] = part
+		}
+		return true
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return aws.StringValue(latest.UploadId), parts, nil
+}
+
+// AbortStaleUploads aborts incomplete multipart uploads under the prefix initiated more than olderThan ago
+// and returns keys of their objects
+func (s *AWSStorage) AbortStaleUploads(ctx context.Context, olderThan time.Duration) ([]string, error) {
+	prefix := ""
+	if s.Prefix != "" {
+		prefix = s.Prefix + "/"
+	}
+	initiatedBefore := time.Now().Add(-olderThan)
+
+	var stale []*s3.MultipartUpload
+	err := s.Client.ListMultipartUploadsPagesWithContext(ctx, &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(s.Bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListMultipartUploadsOutput, lastPage bool) bool {
+		for _, upload := range page.Uploads {
+			if aws.TimeValue(upload.Initiated).Before(initiatedBefore) {
+				stale = append(stale, upload)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var aborted []string
+	for _, upload := range stale {
+		if err := s.abortUpload(ctx, upload.Key, aws.StringValue(upload.UploadId)); err != nil {
+			// completed or aborted since it has been listed
+			if isNoSuchUpload(err) {
+				continue
+			}
+			return aborted, err
+		}
+		aborted = append(aborted, strings.TrimPrefix(aws.StringValue(upload.Key), prefix))
+	}
+	return aborted, nil
+}
+
+// RunUploadJanitor aborts stale incomplete multipart uploads every interval until the context is canceled
+func (s *AWSStorage) RunUploadJanitor(ctx context.Context, interval time.Duration, olderThan time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			aborted, err := s.AbortStaleUploads(ctx, olderThan)
+			if err != nil && ctx.Err() == nil {
+				s.logger.Errorf("Unable to abort stale uploads: %s", err)
+			}
+			if len(aborted) > 0 {
+				s.logger.Debugf("Aborted %d stale uploads", len(aborted))
+			}
+		}
+	}
+}
+
 func (s *AWSStorage) DeleteObject(key string) error {
+	objectKey, err := s.objectKey(key)
+	if err != nil {
+		return err
+	}
+
 	s3Input := &s3.DeleteObjectInput{
 		Bucket: aws.String(s.Bucket),
-		Key:    aws.String(path.Join(s.Prefix, key)),
+		Key:    aws.String(objectKey),
+	}
+	_, err = s.Client.DeleteObject(s3Input)
+	return err
+}
+
+// DeletePrefix removes objects under prefix with batch DeleteObjects requests of up to 1000 keys
+func (s *AWSStorage) DeletePrefix(prefix string) error {
+	prefix, err := defaultKeyRules.validate(prefix)
+	if err != nil {
+		return err
+	}
+
+	var deleteErr error
+	listInput := &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.Bucket),
+		Prefix: aws.String(path.Join(s.Prefix, prefix) + "/"),
+	}
+	err = s.Client.ListObjectsV2Pages(listInput, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		if len(page.Contents) == 0 {
+			return true
+		}
+
+		objects := make([]*s3.ObjectIdentifier, 0, len(page.Contents))
+		for _, obj := range page.Contents {
+			objects = append(objects, &s3.ObjectIdentifier{Key: obj.Key})
+		}
+
+		res, err := s.Client.DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: aws.String(s.Bucket),
+			Delete: &s3.Delete{
+				Objects: objects,
+				Quiet:   aws.Bool(true),
+			},
+		})
+		if err == nil && len(res.Errors) > 0 {
+			e := res.Errors[0]
+			err = fmt.Errorf("unable to delete %d objects, %s: %s", len(res.Errors), aws.StringValue(e.Key), aws.StringValue(e.Message))
+		}
+		deleteErr = err
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	return deleteErr
+}
+
+// objectKey validates key and returns the name of its object in the bucket
+func (s *AWSStorage) objectKey(key string) (string, error) {
+	normalized, err := defaultKeyRules.validate(key)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(s.Prefix, normalized), nil
+}
+
+// SweepExpired removes expired objects right under prefix
+func (s *AWSStorage) SweepExpired(prefix string) ([]string, error) {
+	objects, err := s.listObjects(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	expired, err := s.expiredObjects(prefix, objects)
+	if err != nil {
+		return nil, err
+	}
+
+	var swept []string
+	for _, o := range objects {
+		if !expired[o.Path] {
+			continue
+		}
+		key := joinObjectPath(prefix, o.Path)
+		if err := s.DeleteObject(key); err != nil {
+			return swept, err
+		}
+		swept = append(swept, key)
+	}
+
+	return swept, nil
+}
+
+// expiredObjects looks up expiration time of listed objects,
+// as S3 listing does not return user metadata
+func (s *AWSStorage) expiredObjects(prefix string, objects []Object) (map[string]bool, error) {
+	var mu sync.Mutex
+	var firstErr error
+	expired := make(map[string]bool)
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, 8)
+	for _, o := range objects {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(o Object) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			res, err := s.Client.HeadObject(&s3.HeadObjectInput{
+				Bucket: aws.String(s.Bucket),
+				Key:    aws.String(path.Join(s.Prefix, prefix, o.Path)),
+			})
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				// object removed since it has been listed
+				if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NotFound" {
+					expired[o.Path] = true
+				} else if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			if isExpired(s3ExpiresAt(res.Metadata)) {
+				expired[o.Path] = true
+			}
+		}(o)
+	}
+	wg.Wait()
+
+	return expired, firstErr
+}
+
+func s3ObjectMeta(key string, contentType *string, metadata map[string]*string) Metadata {
+	values := aws.StringValueMap(metadata)
+	return Metadata{
+		Name:         path.Base(key),
+		ContentType:  aws.StringValue(contentType),
+		UserMetadata: userMetadata(values),
+		Checksum:     reservedMetadata(values, checksumMetadataKey),
+	}
+}
+
+// s3NotExist converts errors of missing objects to ones matching os.ErrNotExist,
+// HEAD requests report them with NotFound code as there is no response body
+func s3NotExist(key string, err error) error {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case s3.ErrCodeNoSuchKey, "NotFound":
+			return &os.PathError{Op: "open", Path: key, Err: os.ErrNotExist}
+		}
 	}
-	_, err := s.Client.DeleteObject(s3Input)
 	return err
 }
+
+func s3ExpiresAt(metadata map[string]*string) time.Time {
+	for k, v := range metadata {
+		if strings.EqualFold(k, expiresMetadataKey) && v != nil {
+			expires, _ := time.Parse(time.RFC3339, *v)
+			return expires
+		}
+	}
+	return time.Time{}
+}
+
+// Watch polls objects at prefix every DefaultPollInterval
+func (s *AWSStorage) Watch(ctx context.Context, prefix string) <-chan Event {
+	return PollObjects(ctx, s, prefix, DefaultPollInterval)
+}
+
+// s3LockState is the content of a lock object, it is kept after unlock
+// so the fencing token keeps growing with every acquisition
+type s3LockState struct {
+	Owner   string    `json:"owner,omitempty"`
+	Token   int64     `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+type s3Lock struct {
+	mu      sync.Mutex
+	storage *AWSStorage
+	key     string
+	etag    string
+	state   s3LockState
+}
+
+// Lock acquires a lock object under lockDir with conditional writes,
+// a lock of a holder that stopped refreshing it is taken over after ttl
+func (s *AWSStorage) Lock(ctx context.Context, name string, ttl time.Duration) (Lock, error) {
+	name, err := defaultKeyRules.validate(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := expiresAt(ttl); err != nil {
+		return nil, err
+	}
+
+	owner, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+
+	lock := &s3Lock{storage: s, key: path.Join(s.Prefix, lockDir, name)}
+	err = retryLock(ctx, DefaultLockRetryInterval, func() (bool, error) {
+		etag, state, err := s.getLockState(ctx, lock.key)
+		if err != nil {
+			return false, err
+		}
+		if state.Owner != "" && !isExpired(state.Expires) {
+			return false, nil
+		}
+
+		expires, _ := expiresAt(ttl)
+		state = s3LockState{Owner: owner, Token: state.Token + 1, Expires: expires}
+		etag, err = s.putLockState(ctx, lock.key, etag, state)
+		if err == ErrLockLost {
+			// another holder has written the lock object since it was read
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+
+		lock.etag = etag
+		lock.state = state
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return lock, nil
+}
+
+// getLockState returns zero state and empty etag if the lock object does not exist
+func (s *AWSStorage) getLockState(ctx context.Context, key string) (string, s3LockState, error) {
+	var state s3LockState
+	res, err := s.Client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			err = nil
+		}
+		return "", state, err
+	}
+	defer res.Body.Close()
+
+	if err := json.NewDecoder(res.Body).Decode(&state); err != nil {
+		return "", state, err
+	}
+	return aws.StringValue(res.ETag), state, nil
+}
+
+// putLockState writes the lock object only if it has not changed since etag has been read,
+// empty etag requires the object not to exist. ErrLockLost is returned if the condition fails
+func (s *AWSStorage) putLockState(ctx context.Context, key string, etag string, state s3LockState) (string, error) {
+	content, err := json.Marshal(state)
+	if err != nil {
+		return "", err
+	}
+
+	s3Input := &s3.PutObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(content),
+	}
+	if s.SSE != "" {
+		s3Input.ServerSideEncryption = aws.String(s.SSE)
+	}
+
+	req, res := s.Client.PutObjectRequest(s3Input)
+	req.SetContext(ctx)
+	// conditional writes are not modeled by the SDK version in use
+	if etag == "" {
+		req.HTTPRequest.Header.Set("If-None-Match", "*")
+	} else {
+		req.HTTPRequest.Header.Set("If-Match", etag)
+	}
+
+	if err := req.Send(); err != nil {
+		if aerr, ok := err.(awserr.RequestFailure); ok &&
+			(aerr.StatusCode() == http.StatusPreconditionFailed || aerr.StatusCode() == http.StatusConflict) {
+			return "", ErrLockLost
+		}
+		return "", err
+	}
+	return aws.StringValue(res.ETag), nil
+}
+
+func (l *s3Lock) Token() int64 {
+	return l.state.Token
+}
+
+func (l *s3Lock) Refresh(ctx context.Context, ttl time.Duration) error {
+	expires, err := expiresAt(ttl)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	state := l.state
+	state.Expires = expires
+	return l.update(ctx, state)
+}
+
+// Unlock clears the owner and keeps the token for the next holder
+func (l *s3Lock) Unlock(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.update(ctx, s3LockState{Token: l.state.Token})
+}
+
+func (l *s3Lock) update(ctx context.Context, state s3LockState) error {
+	if l.etag == "" || isExpired(l.state.Expires) {
+		return ErrLockLost
+	}
+
+	etag, err := l.storage.putLockState(ctx, l.key, l.etag, state)
+	if err != nil {
+		return err
+	}
+
+	l.etag = etag
+	l.state = state
+	if state.Owner == "" {
+		l.etag = ""
+	}
+	return nil
+}
@@ -1,11 +1,537 @@
 package storage
 
 import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/stretchr/testify/suite"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
+const (
+	fakeAWSBucket       = "charts"
+	fakeAWSRegion       = "us-east-1"
+	fakeAWSAccessKey    = "AKIAFAKEACCESSKEY"
+	fakeAWSSecretKey    = "fake secret key"
+	fakeAWSRoleARN      = "arn:aws:iam::123456789012:role/charts"
+	fakeAWSAssumedKey   = "ASIAFAKEASSUMEDKEY"
+	fakeAWSAssumedToken = "fake session token"
+)
+
+type fakeS3Object struct {
+	data     []byte
+	header   http.Header
+	etag     string
+	modified time.Time
+}
+
+type fakeS3Upload struct {
+	key       string
+	header    http.Header
+	initiated time.Time
+	parts     map[int]*fakeS3Object
+}
+
+// fakeS3Server implements the subset of S3 REST API used by AWSStorage in memory,
+// serving a single bucket with path-style or virtual hosted-style addressing.
+// AssumeRole requests of STS are served at the root path
+type fakeS3Server struct {
+	*httptest.Server
+	mu       sync.Mutex
+	objects  map[string]*fakeS3Object
+	uploads  map[string]*fakeS3Upload
+	pageSize int
+	// failPart fails uploads of a part number, partUploads and ranges count part uploads and ranged gets
+	failPart    int
+	partUploads int
+	ranges      int
+	uploadCount int
+	// credentials maps access keys to their session tokens
+	credentials map[string]string
+	// externalID of the last AssumeRole request
+	externalID string
+	// rejectContentMD5 mimics services that do not support Content-MD5 headers
+	rejectContentMD5 bool
+	// lastHost is the Host header of the last S3 request
+	lastHost string
+	// heads counts HEAD requests
+	heads int
+}
+
+func newFakeS3Server() *fakeS3Server {
+	f := &fakeS3Server{
+		objects:     make(map[string]*fakeS3Object),
+		uploads:     make(map[string]*fakeS3Upload),
+		pageSize:    2,
+		credentials: map[string]string{fakeAWSAccessKey: ""},
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	return f
+}
+
+func (f *fakeS3Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	auth := r.Header.Get("Authorization")
+	accessKey := auth
+	if i := strings.Index(auth, "Credential="); i >= 0 {
+		accessKey = strings.SplitN(auth[i+len("Credential="):], "/", 2)[0]
+	}
+	token, ok := f.credentials[accessKey]
+	if !ok {
+		fakeS3Error(w, http.StatusForbidden, "InvalidAccessKeyId", "The AWS access key Id you provided does not exist in our records.")
+		return
+	}
+	if token != r.Header.Get("X-Amz-Security-Token") {
+		fakeS3Error(w, http.StatusForbidden, "InvalidToken", "The provided token is malformed or otherwise invalid.")
+		return
+	}
+
+	bucket, key := "", strings.TrimPrefix(r.URL.Path, "/")
+	if host, _, err := net.SplitHostPort(r.Host); err == nil && strings.HasSuffix(host, ".localhost") {
+		bucket = strings.TrimSuffix(host, ".localhost")
+	} else if key == "" && r.Method == http.MethodPost {
+		f.assumeRole(w, r)
+		return
+	} else {
+		parts := strings.SplitN(key, "/", 2)
+		bucket, key = parts[0], ""
+		if len(parts) == 2 {
+			key = parts[1]
+		}
+	}
+	if bucket != fakeAWSBucket {
+		fakeS3Error(w, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		return
+	}
+	f.lastHost = r.Host
+	if r.Method == http.MethodHead {
+		f.heads++
+	}
+
+	query := r.URL.Query()
+	switch {
+	case key == "" && r.Method == http.MethodGet && query.Has("uploads"):
+		f.listUploads(w, r)
+	case key == "" && r.Method == http.MethodGet:
+		f.list(w, r)
+	case key == "" && r.Method == http.MethodPost && query.Has("delete"):
+		f.deleteObjects(w, r)
+	case key != "" && (query.Has("uploads") || query.Has("uploadId")):
+		f.multipart(w, r, key)
+	case key != "" && r.Method == http.MethodPut:
+		f.put(w, r, key)
+	case key != "" && (r.Method == http.MethodGet || r.Method == http.MethodHead):
+		f.get(w, r, key)
+	case key != "" && r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		fakeS3Error(w, http.StatusNotImplemented, "NotImplemented", "A header you provided implies functionality that is not implemented")
+	}
+}
+
+// get serves objects and single byte ranges of them, ranges of empty objects are not satisfiable like on S3
+func (f *fakeS3Server) get(w http.ResponseWriter, r *http.Request, key string) {
+	object, ok := f.objects[key]
+	if !ok {
+		fakeS3Error(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return
+	}
+	if etag := r.Header.Get("If-Match"); etag != "" && etag != object.etag {
+		fakeS3Error(w, http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the pre-conditions you specified did not hold")
+		return
+	}
+
+	data, status := object.data, http.StatusOK
+	if rng := r.Header.Get("Range"); rng != "" {
+		var start, end int
+		if _, err := fmt.Sscanf(rng, "bytes=%d-%d", &start, &end); err != nil || start >= len(data) {
+			fakeS3Error(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The requested range is not satisfiable")
+			return
+		}
+		if end >= len(data) {
+			end = len(data) - 1
+		}
+		f.ranges++
+		data, status = data[start:end+1], http.StatusPartialContent
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(object.data)))
+	}
+
+	for k, v := range object.header {
+		w.Header()[k] = v
+	}
+	w.Header().Set("ETag", object.etag)
+	w.Header().Set("Last-Modified", object.modified.Format(http.TimeFormat))
+	w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+	w.WriteHeader(status)
+	if r.Method == http.MethodGet {
+		w.Write(data)
+	}
+}
+
+func (f *fakeS3Server) put(w http.ResponseWriter, r *http.Request, key string) {
+	object, ok := f.newObject(w, r)
+	if !ok {
+		return
+	}
+
+	existing, ok := f.objects[key]
+	if r.Header.Get("If-None-Match") == "*" && ok ||
+		r.Header.Get("If-Match") != "" && (!ok || existing.etag != r.Header.Get("If-Match")) {
+		fakeS3Error(w, http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the pre-conditions you specified did not hold")
+		return
+	}
+
+	object.header = fakeS3ObjectHeader(r)
+	f.objects[key] = object
+	w.Header().Set("ETag", object.etag)
+}
+
+// newObject reads an object or part from the request body and verifies its Content-MD5
+func (f *fakeS3Server) newObject(w http.ResponseWriter, r *http.Request) (*fakeS3Object, bool) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		fakeS3Error(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return nil, false
+	}
+	if !f.validContentMD5(w, r, data) {
+		return nil, false
+	}
+	sum := md5.Sum(data)
+	return &fakeS3Object{
+		data:     data,
+		etag:     `"` + hex.EncodeToString(sum[:]) + `"`,
+		modified: time.Now().UTC().Truncate(time.Second),
+	}, true
+}
+
+func fakeS3ObjectHeader(r *http.Request) http.Header {
+	header := http.Header{}
+	for k, v := range r.Header {
+		if strings.HasPrefix(k, "X-Amz-Meta-") || k == "Content-Type" || k == "X-Amz-Server-Side-Encryption" {
+			header[k] = v
+		}
+	}
+	return header
+}
+
+// multipart serves creation, part uploads, listing of parts, completion and abortion of multipart uploads
+func (f *fakeS3Server) multipart(w http.ResponseWriter, r *http.Request, key string) {
+	query := r.URL.Query()
+	if r.Method == http.MethodPost && query.Has("uploads") {
+		f.uploadCount++
+		id := fmt.Sprintf("upload-%d", f.uploadCount)
+		f.uploads[id] = &fakeS3Upload{
+			key:       key,
+			header:    fakeS3ObjectHeader(r),
+			initiated: time.Now().UTC(),
+			parts:     make(map[int]*fakeS3Object),
+		}
+		fakeS3XML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: fakeAWSBucket, Key: key, UploadId: id})
+		return
+	}
+
+	id := query.Get("uploadId")
+	upload, ok := f.uploads[id]
+	if !ok || upload.key != key {
+		fakeS3Error(w, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist.")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		var number int
+		fmt.Sscan(query.Get("partNumber"), &number)
+		if number == f.failPart {
+			fakeS3Error(w, http.StatusBadRequest, "InjectedFailure", fmt.Sprintf("part %d failed", number))
+			return
+		}
+		part, ok := f.newObject(w, r)
+		if !ok {
+			return
+		}
+		f.partUploads++
+		upload.parts[number] = part
+		w.Header().Set("ETag", part.etag)
+	case http.MethodGet:
+		type part struct {
+			PartNumber   int
+			LastModified string
+			ETag         string
+			Size         int
+		}
+		result := struct {
+			XMLName  xml.Name `xml:"ListPartsResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+			Part     []part
+		}{Bucket: fakeAWSBucket, Key: key, UploadId: id}
+		var numbers []int
+		for number := range upload.parts {
+			numbers = append(numbers, number)
+		}
+		sort.Ints(numbers)
+		for _, number := range numbers {
+			p := upload.parts[number]
+			result.Part = append(result.Part, part{
+				PartNumber:   number,
+				LastModified: p.modified.Format("2006-01-02T15:04:05.000Z"),
+				ETag:         p.etag,
+				Size:         len(p.data),
+			})
+		}
+		fakeS3XML(w, result)
+	case http.MethodPost:
+		var req struct {
+			Part []struct {
+				PartNumber int
+				ETag       string
+			}
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+			fakeS3Error(w, http.StatusBadRequest, "MalformedXML", err.Error())
+			return
+		}
+		var data []byte
+		for i, p := range req.Part {
+			part, ok := upload.parts[p.PartNumber]
+			if !ok || part.etag != p.ETag || i > 0 && p.PartNumber <= req.Part[i-1].PartNumber {
+				fakeS3Error(w, http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found.")
+				return
+			}
+			if i < len(req.Part)-1 && len(part.data) < 5*1024*1024 {
+				fakeS3Error(w, http.StatusBadRequest, "EntityTooSmall", "Your proposed upload is smaller than the minimum allowed object size.")
+				return
+			}
+			data = append(data, part.data...)
+		}
+		sum := md5.Sum(data)
+		f.objects[key] = &fakeS3Object{
+			data:     data,
+			header:   upload.header,
+			etag:     fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(sum[:]), len(req.Part)),
+			modified: time.Now().UTC().Truncate(time.Second),
+		}
+		delete(f.uploads, id)
+		fakeS3XML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket  string
+			Key     string
+			ETag    string
+		}{Bucket: fakeAWSBucket, Key: key, ETag: f.objects[key].etag})
+	case http.MethodDelete:
+		delete(f.uploads, id)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (f *fakeS3Server) listUploads(w http.ResponseWriter, r *http.Request) {
+	type upload struct {
+		Key       string
+		UploadId  string
+		Initiated string
+	}
+	prefix := r.URL.Query().Get("prefix")
+	result := struct {
+		XMLName xml.Name `xml:"ListMultipartUploadsResult"`
+		Bucket  string
+		Prefix  string
+		Upload  []upload
+	}{Bucket: fakeAWSBucket, Prefix: prefix}
+	for id, u := range f.uploads {
+		if strings.HasPrefix(u.key, prefix) {
+			result.Upload = append(result.Upload, upload{
+				Key:       u.key,
+				UploadId:  id,
+				Initiated: u.initiated.Format("2006-01-02T15:04:05.000Z"),
+			})
+		}
+	}
+	sort.Slice(result.Upload, func(i, j int) bool {
+		return result.Upload[i].Key < result.Upload[j].Key
+	})
+	fakeS3XML(w, result)
+}
+
+// validContentMD5 verifies the Content-MD5 header of a request if it is set
+func (f *fakeS3Server) validContentMD5(w http.ResponseWriter, r *http.Request, data []byte) bool {
+	contentMD5 := r.Header.Get("Content-Md5")
+	if contentMD5 == "" {
+		return true
+	}
+	if f.rejectContentMD5 {
+		fakeS3Error(w, http.StatusNotImplemented, "NotImplemented", "Content-MD5 is not supported")
+		return false
+	}
+	sum := md5.Sum(data)
+	if contentMD5 != base64.StdEncoding.EncodeToString(sum[:]) {
+		fakeS3Error(w, http.StatusBadRequest, "BadDigest", "The Content-MD5 you specified did not match what we received.")
+		return false
+	}
+	return true
+}
+
+type fakeS3Contents struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int
+}
+
+type fakeS3ListResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Name                  string
+	Prefix                string
+	IsTruncated           bool
+	KeyCount              int    `xml:",omitempty"`
+	NextContinuationToken string `xml:",omitempty"`
+	Contents              []fakeS3Contents
+}
+
+// list serves ListObjects and ListObjectsV2 pages of up to pageSize objects,
+// continuation tokens of V2 are the last listed keys
+func (f *fakeS3Server) list(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	after := query.Get("marker")
+	if query.Get("list-type") == "2" {
+		after = query.Get("continuation-token")
+	}
+
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	result := fakeS3ListResult{Name: fakeAWSBucket, Prefix: prefix}
+	if len(keys) > f.pageSize {
+		keys = keys[:f.pageSize]
+		result.IsTruncated = true
+		if query.Get("list-type") == "2" {
+			result.NextContinuationToken = keys[len(keys)-1]
+		}
+	}
+	for _, key := range keys {
+		object := f.objects[key]
+		result.Contents = append(result.Contents, fakeS3Contents{
+			Key:          key,
+			LastModified: object.modified.Format("2006-01-02T15:04:05.000Z"),
+			ETag:         object.etag,
+			Size:         len(object.data),
+		})
+	}
+	result.KeyCount = len(result.Contents)
+	fakeS3XML(w, result)
+}
+
+func (f *fakeS3Server) deleteObjects(w http.ResponseWriter, r *http.Request) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		fakeS3Error(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+	if r.Header.Get("Content-Md5") == "" && !f.rejectContentMD5 {
+		fakeS3Error(w, http.StatusBadRequest, "InvalidRequest", "Missing required header for this request: Content-Md5.")
+		return
+	}
+	if !f.validContentMD5(w, r, data) {
+		return
+	}
+
+	var req struct {
+		Object []struct {
+			Key string
+		}
+	}
+	if err := xml.Unmarshal(data, &req); err != nil {
+		fakeS3Error(w, http.StatusBadRequest, "MalformedXML", err.Error())
+		return
+	}
+	for _, object := range req.Object {
+		delete(f.objects, object.Key)
+	}
+	fakeS3XML(w, struct {
+		XMLName xml.Name `xml:"DeleteResult"`
+	}{})
+}
+
+func (f *fakeS3Server) assumeRole(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil || r.Form.Get("Action") != "AssumeRole" {
+		fakeS3Error(w, http.StatusBadRequest, "InvalidAction", "Could not find operation")
+		return
+	}
+	if r.Form.Get("RoleArn") != fakeAWSRoleARN {
+		fakeS3Error(w, http.StatusForbidden, "AccessDenied", "Not authorized to perform sts:AssumeRole")
+		return
+	}
+	f.externalID = r.Form.Get("ExternalId")
+	f.credentials[fakeAWSAssumedKey] = fakeAWSAssumedToken
+
+	type credentials struct {
+		AccessKeyId     string
+		SecretAccessKey string
+		SessionToken    string
+		Expiration      string
+	}
+	fakeS3XML(w, struct {
+		XMLName     xml.Name    `xml:"AssumeRoleResponse"`
+		Credentials credentials `xml:"AssumeRoleResult>Credentials"`
+	}{Credentials: credentials{
+		AccessKeyId:     fakeAWSAssumedKey,
+		SecretAccessKey: fakeAWSSecretKey,
+		SessionToken:    fakeAWSAssumedToken,
+		Expiration:      time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+	}})
+}
+
+func fakeS3XML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(v)
+}
+
+func fakeS3Error(w http.ResponseWriter, status int, code string, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{Code: code, Message: message})
+}
+
 type AmazonTestSuite struct {
 	suite.Suite
 	BrokenAWSStorage   *AWSStorage
@@ -74,3 +600,358 @@ func TestAmazonStorageTestSuite(t *testing.T) {
 		suite.Run(t, new(AmazonTestSuite))
 	}
 }
+
+type AWSFakeTestSuite struct {
+	suite.Suite
+	Fixture *testFixture
+	server  *fakeS3Server
+	Backend *AWSStorage
+}
+
+func (suite *AWSFakeTestSuite) SetupTest() {
+	suite.Fixture = newTestFixture("aws")
+	suite.server = newFakeS3Server()
+	suite.Backend = suite.newStorage(AWSOptions{})
+}
+
+func (suite *AWSFakeTestSuite) TearDownTest() {
+	suite.server.Close()
+	suite.Fixture.Close()
+}
+
+// newStorage creates a backend of the fake server bucket, static credentials are used if none are set
+func (suite *AWSFakeTestSuite) newStorage(opts AWSOptions) *AWSStorage {
+	opts.Bucket = fakeAWSBucket
+	opts.Region = fakeAWSRegion
+	if opts.Endpoint == "" {
+		opts.Endpoint = suite.server.URL
+	}
+	if opts.AccessKey == "" && opts.Profile == "" {
+		opts.AccessKey, opts.SecretKey = fakeAWSAccessKey, fakeAWSSecretKey
+	}
+	backend, err := NewAWSStorageWithOptions(opts)
+	suite.Nil(err)
+	return backend
+}
+
+func (suite *AWSFakeTestSuite) TestPutGetObject() {
+	suite.Nil(suite.Backend.PutObject("charts/nginx-1.0.0.tgz", []byte("nginx")))
+	suite.Equal(suite.server.Listener.Addr().String(), suite.server.lastHost, "path-style addressing with custom endpoint")
+
+	object, err := suite.Backend.GetObject("/charts/nginx-1.0.0.tgz")
+	suite.Nil(err)
+	suite.Equal([]byte("nginx"), object.Data)
+	suite.Equal("nginx-1.0.0.tgz", object.Meta.Name)
+	suite.WithinDuration(time.Now(), object.LastModified, 2*time.Second)
+
+	_, err = suite.Backend.GetObject("charts/missing.tgz")
+	suite.True(errors.Is(err, os.ErrNotExist), "missing object not found")
+}
+
+func (suite *AWSFakeTestSuite) TestMetadata() {
+	meta := Metadata{ContentType: "application/gzip", UserMetadata: map[string]string{"chart": "nginx"}}
+	suite.Nil(suite.Backend.PutObjectWithMetadata("nginx-1.0.0.tgz", []byte("nginx"), meta))
+
+	object, err := suite.Backend.StatObject("nginx-1.0.0.tgz")
+	suite.Nil(err)
+	suite.Equal("application/gzip", object.Meta.ContentType)
+	suite.Equal(map[string]string{"Chart": "nginx"}, object.Meta.UserMetadata, "keys are canonical header names")
+	suite.Equal(sha256Digest([]byte("nginx")), object.Meta.Checksum)
+
+	suite.server.objects["nginx-1.0.0.tgz"].data = []byte("tampered")
+	_, err = suite.Backend.GetObject("nginx-1.0.0.tgz")
+	var mismatch *DigestMismatchError
+	suite.True(errors.As(err, &mismatch), "checksum is verified")
+}
+
+func (suite *AWSFakeTestSuite) TestListAndDelete() {
+	backend := suite.newStorage(AWSOptions{Prefix: "repo"})
+	for _, key := range []string{"a.tgz", "b.tgz", "c.tgz", "nested/d.tgz", "nested/deeper/e.tgz"} {
+		suite.Nil(backend.PutObject(key, []byte(key)))
+	}
+
+	objects, err := backend.ListObjects("")
+	suite.Nil(err)
+	suite.Len(objects, 3, "listed across pages, nested objects skipped")
+	suite.Equal("c.tgz", objects[2].Path)
+
+	suite.Nil(backend.DeleteObject("a.tgz"))
+	suite.Nil(backend.DeletePrefix("nested"))
+	suite.Len(suite.server.objects, 2)
+	_, ok := suite.server.objects["repo/b.tgz"]
+	suite.True(ok, "objects are stored under prefix")
+}
+
+func (suite *AWSFakeTestSuite) TestListExpired() {
+	suite.Nil(suite.Backend.PutObjectWithTTL("tokens/short", []byte("secret"), time.Millisecond))
+	suite.Nil(suite.Backend.PutObject("tokens/permanent", []byte("secret")))
+	time.Sleep(10 * time.Millisecond)
+
+	objects, err := suite.Backend.ListObjects("tokens")
+	suite.Nil(err)
+	suite.Len(objects, 2, "expired object listed until swept")
+	suite.Zero(suite.server.heads, "listing does not send a request per object")
+
+	hiding := suite.newStorage(AWSOptions{HideExpiredOnList: true})
+	objects, err = hiding.ListObjects("tokens")
+	suite.Nil(err)
+	suite.Len(objects, 1, "expired object hidden")
+	suite.Equal("permanent", objects[0].Path)
+
+	swept, err := suite.Backend.SweepExpired("tokens")
+	suite.Nil(err)
+	suite.Equal([]string{"tokens/short"}, swept)
+}
+
+func (suite *AWSFakeTestSuite) TestStaticCredentials() {
+	backend := suite.newStorage(AWSOptions{AccessKey: "AKIAUNKNOWN", SecretKey: fakeAWSSecretKey})
+	err := backend.PutObject("index.yaml", []byte{})
+	var aerr awserr.Error
+	suite.True(errors.As(err, &aerr))
+	suite.Equal("InvalidAccessKeyId", aerr.Code())
+
+	backend = suite.newStorage(AWSOptions{AccessKey: fakeAWSAccessKey, SecretKey: fakeAWSSecretKey, SessionToken: "token"})
+	suite.NotNil(backend.PutObject("index.yaml", []byte{}), "session token is sent")
+}
+
+func (suite *AWSFakeTestSuite) TestProfile() {
+	suite.Nil(os.MkdirAll(suite.Fixture.Dir, 0777))
+	credentialsFile := filepath.Join(suite.Fixture.Dir, "credentials")
+	suite.Nil(ioutil.WriteFile(credentialsFile, []byte(fmt.Sprintf(
+		"[charts]\naws_access_key_id = %s\naws_secret_access_key = %s\n", fakeAWSAccessKey, fakeAWSSecretKey)), 0600))
+	suite.T().Setenv("AWS_SHARED_CREDENTIALS_FILE", credentialsFile)
+	suite.T().Setenv("AWS_CONFIG_FILE", filepath.Join(suite.Fixture.Dir, "config"))
+
+	backend := suite.newStorage(AWSOptions{Profile: "charts"})
+	suite.Nil(backend.PutObject("index.yaml", []byte{}), "profile credentials are used")
+
+	backend = suite.newStorage(AWSOptions{Profile: "missing"})
+	suite.NotNil(backend.PutObject("index.yaml", []byte{}))
+}
+
+func (suite *AWSFakeTestSuite) TestAssumeRole() {
+	backend := suite.newStorage(AWSOptions{
+		RoleARN:     fakeAWSRoleARN,
+		ExternalID:  "external-id",
+		STSEndpoint: suite.server.URL,
+	})
+	suite.Nil(backend.PutObject("index.yaml", []byte{}))
+	suite.Equal("external-id", suite.server.externalID)
+
+	delete(suite.server.credentials, fakeAWSAccessKey)
+	suite.Nil(backend.PutObject("index.yaml", []byte{}), "assumed role credentials are used")
+
+	backend = suite.newStorage(AWSOptions{RoleARN: "arn:aws:iam::123456789012:role/other", STSEndpoint: suite.server.URL})
+	suite.NotNil(backend.PutObject("index.yaml", []byte{}))
+}
+
+func (suite *AWSFakeTestSuite) TestTLS() {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(suite.server.serveHTTP))
+	server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	server.StartTLS()
+	suite.server.Close()
+	suite.server.Server = server
+
+	backend := suite.newStorage(AWSOptions{})
+	suite.NotNil(backend.PutObject("index.yaml", []byte{}), "unknown certificate authority")
+
+	backend = suite.newStorage(AWSOptions{TLSInsecureSkipVerify: true})
+	suite.Nil(backend.PutObject("index.yaml", []byte{}))
+
+	suite.Nil(os.MkdirAll(suite.Fixture.Dir, 0777))
+	caFile := filepath.Join(suite.Fixture.Dir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: suite.server.Certificate().Raw})
+	suite.Nil(ioutil.WriteFile(caFile, ca, 0600))
+	backend = suite.newStorage(AWSOptions{TLSCAFile: caFile})
+	suite.Nil(backend.PutObject("index.yaml", []byte{}), "endpoint verified with custom CA bundle")
+
+	_, err := NewAWSStorageWithOptions(AWSOptions{TLSCAFile: filepath.Join(suite.Fixture.Dir, "missing.pem")})
+	suite.True(os.IsNotExist(err))
+}
+
+func (suite *AWSFakeTestSuite) TestVendorQuirks() {
+	suite.server.rejectContentMD5 = true
+	suite.NotNil(suite.Backend.PutObject("charts/nginx-1.0.0.tgz", []byte("nginx")), "Content-MD5 is sent by default")
+
+	backend := suite.newStorage(AWSOptions{DisableContentMD5: true, Disable100Continue: true})
+	suite.Nil(backend.PutObject("charts/nginx-1.0.0.tgz", []byte("nginx")))
+	suite.Nil(backend.PutObject("charts/redis-1.0.0.tgz", []byte("redis")))
+	suite.Nil(backend.DeleteObject("charts/redis-1.0.0.tgz"))
+
+	// bucket names in the host resolve to the fake server
+	dialer := &net.Dialer{}
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, suite.server.Listener.Addr().String())
+		},
+	}}
+	_, port, _ := net.SplitHostPort(suite.server.Listener.Addr().String())
+	backend = suite.newStorage(AWSOptions{
+		Endpoint:           "http://localhost:" + port,
+		VirtualHostedStyle: true,
+		HTTPClient:         client,
+	})
+	object, err := backend.GetObject("charts/nginx-1.0.0.tgz")
+	suite.Nil(err)
+	suite.Equal([]byte("nginx"), object.Data)
+	suite.Equal(fakeAWSBucket+".localhost:"+port, suite.server.lastHost)
+}
+
+func (suite *AWSFakeTestSuite) TestPartSize() {
+	_, err := NewAWSStorageWithOptions(AWSOptions{PartSize: 1024})
+	suite.NotNil(err, "parts are at least 5 MiB")
+
+	backend := suite.newStorage(AWSOptions{PartSize: 6 * 1024 * 1024, Concurrency: 3})
+	suite.Equal(int64(6*1024*1024), backend.Uploader.PartSize)
+	suite.Equal(3, backend.Uploader.Concurrency)
+	suite.Equal(int64(6*1024*1024), backend.Downloader.PartSize)
+	suite.Equal(3, backend.Downloader.Concurrency)
+}
+
+func (suite *AWSFakeTestSuite) TestDownloadObject() {
+	backend := suite.newStorage(AWSOptions{PartSize: s3manager.MinUploadPartSize, Concurrency: 2})
+	data := bytes.Repeat([]byte("0123456789"), 1100*1024)
+	meta := Metadata{ContentType: "application/gzip"}
+	suite.Nil(backend.PutObjectWithMetadata("charts/big-1.0.0.tgz", data, meta))
+	suite.Empty(suite.server.uploads, "multipart upload completed")
+	suite.Contains(suite.server.objects["charts/big-1.0.0.tgz"].etag, "-3", "uploaded in 3 parts")
+
+	object, err := backend.GetObject("charts/big-1.0.0.tgz")
+	suite.Nil(err)
+	suite.True(bytes.Equal(data, object.Data))
+	suite.Equal("application/gzip", object.Meta.ContentType)
+	suite.Equal(3, suite.server.ranges, "downloaded in 3 ranges")
+
+	buf := aws.NewWriteAtBuffer([]byte{})
+	object, err = backend.DownloadObject(context.Background(), "charts/big-1.0.0.tgz", buf)
+	suite.Nil(err)
+	suite.True(bytes.Equal(data, buf.Bytes()))
+	suite.Empty(object.Data)
+	suite.Equal(sha256Digest(data), object.Meta.Checksum)
+
+	suite.Nil(backend.PutObject("empty.txt", []byte{}))
+	object, err = backend.GetObject("empty.txt")
+	suite.Nil(err, "empty objects are downloaded")
+	suite.Empty(object.Data)
+	suite.False(object.LastModified.IsZero())
+
+	_, err = backend.DownloadObject(context.Background(), "missing.tgz", aws.NewWriteAtBuffer([]byte{}))
+	suite.True(errors.Is(err, os.ErrNotExist), "missing object not found")
+}
+
+func (suite *AWSFakeTestSuite) TestResumeUpload() {
+	backend := suite.newStorage(AWSOptions{PartSize: s3manager.MinUploadPartSize, ResumeUploads: true})
+	data := bytes.Repeat([]byte("0123456789"), 1100*1024)
+
+	suite.server.failPart = 2
+	suite.NotNil(backend.PutObject("charts/big-1.0.0.tgz", data))
+	suite.Len(suite.server.uploads, 1, "parts of failed upload are kept")
+	suite.Equal(2, suite.server.partUploads)
+
+	suite.server.failPart = 0
+	suite.Nil(backend.PutObject("charts/big-1.0.0.tgz", data))
+	suite.Equal(3, suite.server.partUploads, "only the failed part is uploaded again")
+	suite.Empty(suite.server.uploads)
+
+	object, err := backend.GetObject("charts/big-1.0.0.tgz")
+	suite.Nil(err)
+	suite.True(bytes.Equal(data, object.Data))
+
+	suite.server.failPart = 2
+	suite.NotNil(backend.PutObject("charts/big-1.0.0.tgz", data))
+	suite.server.failPart = 0
+	changed := bytes.Repeat([]byte("9876543210"), 1100*1024)
+	suite.Nil(backend.PutObject("charts/big-1.0.0.tgz", changed))
+	suite.Equal(8, suite.server.partUploads, "parts not matching data are uploaded again")
+	suite.Len(suite.server.uploads, 1, "upload started for other data is left alone")
+
+	object, err = backend.GetObject("charts/big-1.0.0.tgz")
+	suite.Nil(err)
+	suite.True(bytes.Equal(changed, object.Data))
+
+	suite.server.failPart = 2
+	suite.NotNil(backend.PutObject("charts/big-1.0.0.tgz", data))
+	suite.Equal(8, suite.server.partUploads, "upload of the same data is resumed")
+	suite.server.failPart = 0
+	suite.Nil(backend.PutObjectWithTTL("charts/big-1.0.0.tgz", data, time.Hour))
+	suite.Equal(11, suite.server.partUploads, "uploads started with other metadata are not resumed")
+	suite.Len(suite.server.uploads, 1)
+	suite.NotEmpty(suite.server.objects["charts/big-1.0.0.tgz"].header.Get("X-Amz-Meta-" + expiresMetadataKey))
+
+	object, err = backend.GetObject("charts/big-1.0.0.tgz")
+	suite.Nil(err)
+	suite.True(bytes.Equal(data, object.Data))
+
+	aborted, err := backend.AbortStaleUploads(context.Background(), 0)
+	suite.Nil(err)
+	suite.Equal([]string{"charts/big-1.0.0.tgz"}, aborted)
+	for key := range suite.server.objects {
+		suite.False(strings.HasPrefix(key, lockDir+"/"), "upload markers are deleted")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	suite.NotNil(backend.UploadObject(ctx, "charts/big-1.0.0.tgz", changed, Metadata{}), "upload is canceled")
+
+	suite.Nil(backend.PutObject("index.yaml", []byte("apiVersion: v1")))
+	suite.Equal(11, suite.server.partUploads, "small objects are put at once")
+}
+
+func (suite *AWSFakeTestSuite) TestConcurrentResumableUploads() {
+	backend := suite.newStorage(AWSOptions{PartSize: s3manager.MinUploadPartSize, ResumeUploads: true})
+	contents := [][]byte{
+		bytes.Repeat([]byte("0123456789"), 1100*1024),
+		bytes.Repeat([]byte("9876543210"), 1100*1024),
+	}
+
+	for i := 0; i < 3; i++ {
+		errs := make(chan error, len(contents))
+		for _, data := range contents {
+			go func(data []byte) {
+				errs <- backend.PutObject("charts/big-1.0.0.tgz", data)
+			}(data)
+		}
+		for range contents {
+			suite.Nil(<-errs, "concurrent upload of the key is not aborted")
+		}
+		suite.Empty(suite.server.uploads)
+
+		object, err := backend.GetObject("charts/big-1.0.0.tgz")
+		suite.Nil(err)
+		suite.True(bytes.Equal(contents[0], object.Data) || bytes.Equal(contents[1], object.Data))
+	}
+}
+
+func (suite *AWSFakeTestSuite) TestAbortStaleUploads() {
+	backend := suite.newStorage(AWSOptions{Prefix: "repo"})
+	for _, key := range []string{"repo/a.tgz", "repo/b.tgz", "other/c.tgz"} {
+		_, err := backend.Client.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+			Bucket: aws.String(fakeAWSBucket),
+			Key:    aws.String(key),
+		})
+		suite.Nil(err)
+	}
+	for _, upload := range suite.server.uploads {
+		if upload.key != "repo/b.tgz" {
+			upload.initiated = upload.initiated.Add(-2 * time.Hour)
+		}
+	}
+
+	aborted, err := backend.AbortStaleUploads(context.Background(), time.Hour)
+	suite.Nil(err)
+	suite.Equal([]string{"a.tgz"}, aborted, "only stale uploads under prefix are aborted")
+	suite.Len(suite.server.uploads, 2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go backend.RunUploadJanitor(ctx, 10*time.Millisecond, 0)
+	suite.Eventually(func() bool {
+		suite.server.mu.Lock()
+		defer suite.server.mu.Unlock()
+		return len(suite.server.uploads) == 1
+	}, 2*time.Second, 10*time.Millisecond, "janitor aborts uploads under prefix")
+}
+
+func TestAWSFakeStorageTestSuite(t *testing.T) {
+	suite.Run(t, new(AWSFakeTestSuite))
+}
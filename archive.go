@@ -0,0 +1,412 @@
+package storage
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ArchiveFormat string
+
+const (
+	ArchiveTar   ArchiveFormat = "tar"
+	ArchiveTarGz ArchiveFormat = "tar.gz"
+	ArchiveZip   ArchiveFormat = "zip"
+)
+
+// ErrArchiveWriting is returned by reads and deletes of an archive being created
+var ErrArchiveWriting = errors.New("archive is being written")
+
+// DetectArchiveFormat returns the format of an archive by its file name extension
+func DetectArchiveFormat(name string) (ArchiveFormat, error) {
+	name = strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(name, ".tar"):
+		return ArchiveTar, nil
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return ArchiveTarGz, nil
+	case strings.HasSuffix(name, ".zip"):
+		return ArchiveZip, nil
+	}
+	return "", fmt.Errorf("unknown archive format of %s", name)
+}
+
+type ArchiveOptions struct {
+	Logger *zap.SugaredLogger
+	// Path of a local archive file
+	Path string
+	// Backend and Key of an archive object, used instead of Path
+	Backend Backend
+	Key     string
+	// Format defaults to the one detected from the Path or Key extension
+	Format ArchiveFormat
+	// Create builds a new archive from PutObject calls, it is written to Path or Key on Close
+	Create bool
+}
+
+// archiveEntry is an object of an archive opened for reading
+type archiveEntry struct {
+	modified time.Time
+	// data of tar entries
+	data []byte
+	// file of zip entries
+	file *zip.File
+}
+
+// ArchiveStorage exposes a tar, gzipped tar or zip archive as a read-only backend,
+// the whole archive is loaded into memory. Created archives are append-only:
+// objects can be put once and are only listed until the archive is closed
+type ArchiveStorage struct {
+	logger  *zap.SugaredLogger
+	opts    ArchiveOptions
+	mu      sync.Mutex
+	entries map[string]*archiveEntry
+	closed  bool
+
+	// writers of a created archive
+	tmp     *os.File
+	buf     *bytes.Buffer
+	gzip    *gzip.Writer
+	tar     *tar.Writer
+	zip     *zip.Writer
+	written map[string]time.Time
+}
+
+func NewArchiveStorage(opts ArchiveOptions) (*ArchiveStorage, error) {
+	if opts.Logger == nil {
+		opts.Logger = zap.S()
+	}
+
+	name := opts.Path
+	switch {
+	case opts.Path != "" && opts.Backend != nil:
+		return nil, fmt.Errorf("archive path and backend are mutually exclusive")
+	case opts.Backend != nil:
+		key, err := defaultKeyRules.validate(opts.Key)
+		if err != nil {
+			return nil, err
+		}
+		opts.Key, name = key, key
+	case opts.Path == "":
+		return nil, fmt.Errorf("archive path or backend must be specified")
+	}
+	if opts.Format == "" {
+		format, err := DetectArchiveFormat(name)
+		if err != nil {
+			return nil, err
+		}
+		opts.Format = format
+	}
+
+	s := &ArchiveStorage{
+		logger:  opts.Logger,
+		opts:    opts,
+		entries: make(map[string]*archiveEntry),
+	}
+	if opts.Create {
+		return s, s.create()
+	}
+	return s, s.load()
+}
+
+// load indexes objects of the archive, directories and entries with invalid names are skipped
+func (s *ArchiveStorage) load() error {
+	var content []byte
+	var err error
+	if s.opts.Backend != nil {
+		var object Object
+		object, err = s.opts.Backend.GetObject(s.opts.Key)
+		content = object.Data
+	} else {
+		content, err = ioutil.ReadFile(s.opts.Path)
+	}
+	if err != nil {
+		return err
+	}
+
+	switch s.opts.Format {
+	case ArchiveZip:
+		reader, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+		if err != nil {
+			return fmt.Errorf("unable to read zip archive: %w", err)
+		}
+		for _, f := range reader.File {
+			if !f.Mode().IsRegular() {
+				continue
+			}
+			s.addEntry(f.Name, &archiveEntry{modified: f.Modified, file: f})
+		}
+		return nil
+	case ArchiveTar, ArchiveTarGz:
+		var r io.Reader = bytes.NewReader(content)
+		if s.opts.Format == ArchiveTarGz {
+			gz, err := gzip.NewReader(r)
+			if err != nil {
+				return fmt.Errorf("unable to read gzip archive: %w", err)
+			}
+			defer gz.Close()
+			r = gz
+		}
+		reader := tar.NewReader(r)
+		for {
+			header, err := reader.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("unable to read tar archive: %w", err)
+			}
+			if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA {
+				continue
+			}
+			data, err := ioutil.ReadAll(reader)
+			if err != nil {
+				return fmt.Errorf("unable to read tar archive: %w", err)
+			}
+			s.addEntry(header.Name, &archiveEntry{modified: header.ModTime, data: data})
+		}
+	}
+	return fmt.Errorf("unsupported archive format: %s", s.opts.Format)
+}
+
+func (s *ArchiveStorage) addEntry(name string, entry *archiveEntry) {
+	key, err := defaultKeyRules.validate(name)
+	if err != nil {
+		s.logger.Warnf("skipping archive entry: %v", err)
+		return
+	}
+	s.entries[key] = entry
+}
+
+// create opens the archive writers, local archives are written to a temporary file renamed on Close
+func (s *ArchiveStorage) create() error {
+	var w io.Writer
+	if s.opts.Backend != nil {
+		s.buf = &bytes.Buffer{}
+		w = s.buf
+	} else {
+		dir := filepath.Dir(s.opts.Path)
+		if err := os.MkdirAll(dir, DefaultDirMode); err != nil {
+			return err
+		}
+		tmp, err := ioutil.TempFile(dir, dirTempPrefix+filepath.Base(s.opts.Path)+"-")
+		if err != nil {
+			return err
+		}
+		s.tmp = tmp
+		w = tmp
+	}
+
+	switch s.opts.Format {
+	case ArchiveZip:
+		s.zip = zip.NewWriter(w)
+	case ArchiveTarGz:
+		s.gzip = gzip.NewWriter(w)
+		s.tar = tar.NewWriter(s.gzip)
+	case ArchiveTar:
+		s.tar = tar.NewWriter(w)
+	default:
+		s.abort()
+		return fmt.Errorf("unsupported archive format: %s", s.opts.Format)
+	}
+	s.written = make(map[string]time.Time)
+	return nil
+}
+
+func (s *ArchiveStorage) ListObjects(prefix string) ([]Object, error) {
+	var objects []Object
+	prefix, err := defaultKeyRules.validatePrefix(prefix)
+	if err != nil {
+		return objects, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	add := func(key string, modified time.Time) {
+		if objectPathInPrefix(prefix, key) {
+			objects = append(objects, Object{
+				Path:         removePrefixFromObjectPath(prefix, key),
+				Data:         []byte{},
+				LastModified: modified,
+			})
+		}
+	}
+	for key, entry := range s.entries {
+		add(key, entry.modified)
+	}
+	for key, modified := range s.written {
+		add(key, modified)
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Path < objects[j].Path
+	})
+	return objects, nil
+}
+
+func (s *ArchiveStorage) GetObject(key string) (Object, error) {
+	object := Object{Path: key}
+	normalized, err := defaultKeyRules.validate(key)
+	if err != nil {
+		return object, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.opts.Create {
+		return object, ErrArchiveWriting
+	}
+	entry, ok := s.entries[normalized]
+	if !ok {
+		return object, &os.PathError{Op: "open", Path: normalized, Err: os.ErrNotExist}
+	}
+
+	data := entry.data
+	if entry.file != nil {
+		r, err := entry.file.Open()
+		if err != nil {
+			return object, err
+		}
+		data, err = ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return object, fmt.Errorf("unable to read %s from zip archive: %w", normalized, err)
+		}
+	}
+
+	object.Meta.Name = path.Base(normalized)
+	object.Data = append([]byte{}, data...)
+	object.LastModified = entry.modified
+	return object, nil
+}
+
+// PutObject appends an object to a created archive, every key can be put once
+func (s *ArchiveStorage) PutObject(key string, data []byte) error {
+	if !s.opts.Create {
+		return &ReadOnlyError{Op: "put", Key: key}
+	}
+	key, err := defaultKeyRules.validate(key)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return fmt.Errorf("put %s: %w", key, os.ErrClosed)
+	}
+	if _, ok := s.written[key]; ok {
+		return &os.PathError{Op: "put", Path: key, Err: os.ErrExist}
+	}
+
+	modified := time.Now().UTC()
+	if s.zip != nil {
+		w, err := s.zip.CreateHeader(&zip.FileHeader{Name: key, Method: zip.Deflate, Modified: modified})
+		if err == nil {
+			_, err = w.Write(data)
+		}
+		if err != nil {
+			return err
+		}
+	} else {
+		header := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     key,
+			Mode:     int64(DefaultDirFileMode),
+			Size:     int64(len(data)),
+			ModTime:  modified,
+		}
+		if err := s.tar.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := s.tar.Write(data); err != nil {
+			return err
+		}
+	}
+	s.written[key] = modified
+	return nil
+}
+
+func (s *ArchiveStorage) DeleteObject(key string) error {
+	if s.opts.Create {
+		return ErrArchiveWriting
+	}
+	return &ReadOnlyError{Op: "delete", Key: key}
+}
+
+// Watch polls objects at prefix every DefaultPollInterval
+func (s *ArchiveStorage) Watch(ctx context.Context, prefix string) <-chan Event {
+	return PollObjects(ctx, s, prefix, DefaultPollInterval)
+}
+
+// Close finalizes a created archive and writes it to its path or backend key
+func (s *ArchiveStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if !s.opts.Create {
+		s.entries = nil
+		return nil
+	}
+
+	if err := s.finish(); err != nil {
+		s.abort()
+		return err
+	}
+	if s.opts.Backend != nil {
+		return s.opts.Backend.PutObject(s.opts.Key, s.buf.Bytes())
+	}
+
+	if err := s.tmp.Sync(); err != nil {
+		s.abort()
+		return err
+	}
+	if err := s.tmp.Close(); err != nil {
+		os.Remove(s.tmp.Name())
+		return err
+	}
+	if err := os.Rename(s.tmp.Name(), s.opts.Path); err != nil {
+		os.Remove(s.tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// finish writes the archive trailers
+func (s *ArchiveStorage) finish() error {
+	if s.zip != nil {
+		return s.zip.Close()
+	}
+	if err := s.tar.Close(); err != nil {
+		return err
+	}
+	if s.gzip != nil {
+		return s.gzip.Close()
+	}
+	return nil
+}
+
+// abort removes the temporary file of a local archive
+func (s *ArchiveStorage) abort() {
+	if s.tmp != nil {
+		s.tmp.Close()
+		os.Remove(s.tmp.Name())
+	}
+}
@@ -0,0 +1,180 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ArchiveTestSuite struct {
+	suite.Suite
+	Fixture *testFixture
+}
+
+func (suite *ArchiveTestSuite) SetupTest() {
+	suite.Fixture = newTestFixture("archive")
+}
+
+func (suite *ArchiveTestSuite) TearDownTest() {
+	suite.Fixture.Close()
+}
+
+// createArchive writes objects to a new archive at p
+func (suite *ArchiveTestSuite) createArchive(p string, objects map[string]string) {
+	archive, err := NewArchiveStorage(ArchiveOptions{Path: p, Create: true})
+	suite.Nil(err)
+	for key, data := range objects {
+		suite.Nil(archive.PutObject(key, []byte(data)))
+	}
+	suite.Nil(archive.Close())
+}
+
+func (suite *ArchiveTestSuite) TestNewArchiveStorage() {
+	_, err := NewArchiveStorage(ArchiveOptions{})
+	suite.NotNil(err, "path or backend is required")
+
+	_, err = NewArchiveStorage(ArchiveOptions{Path: "bundle.rar", Create: true})
+	suite.NotNil(err, "unknown format")
+
+	_, err = NewArchiveStorage(ArchiveOptions{Path: path.Join(suite.Fixture.Dir, "missing.tar")})
+	suite.True(os.IsNotExist(err))
+
+	format, err := DetectArchiveFormat("bundle.TGZ")
+	suite.Nil(err)
+	suite.Equal(ArchiveTarGz, format)
+}
+
+func (suite *ArchiveTestSuite) TestRoundTrip() {
+	objects := map[string]string{
+		"index.yaml":               "apiVersion: v1",
+		"charts/nginx-1.0.0.tgz":   "nginx",
+		"charts/redis-1.0.0.tgz":   "redis",
+		"charts/nested/empty.yaml": "",
+	}
+
+	for _, name := range []string{"bundle.tar", "bundle.tar.gz", "bundle.zip"} {
+		p := path.Join(suite.Fixture.Dir, name)
+		suite.createArchive(p, objects)
+
+		archive, err := NewArchiveStorage(ArchiveOptions{Path: p})
+		suite.Nil(err, name)
+
+		listed, err := archive.ListObjects("charts")
+		suite.Nil(err)
+		suite.Len(listed, 2, "%s: nested objects are not listed", name)
+		suite.Equal("nginx-1.0.0.tgz", listed[0].Path)
+		suite.Equal("redis-1.0.0.tgz", listed[1].Path)
+		suite.WithinDuration(time.Now(), listed[0].LastModified, 2*time.Second, name)
+
+		for key, data := range objects {
+			object, err := archive.GetObject(key)
+			suite.Nil(err, "%s: %s", name, key)
+			suite.Equal(data, string(object.Data), "%s: %s", name, key)
+			suite.Equal(path.Base(key), object.Meta.Name)
+		}
+
+		_, err = archive.GetObject("charts/missing.tgz")
+		suite.True(os.IsNotExist(err), name)
+		suite.Nil(archive.Close())
+	}
+}
+
+func (suite *ArchiveTestSuite) TestReadOnly() {
+	p := path.Join(suite.Fixture.Dir, "bundle.zip")
+	suite.createArchive(p, map[string]string{"index.yaml": "apiVersion: v1"})
+
+	archive, err := NewArchiveStorage(ArchiveOptions{Path: p})
+	suite.Nil(err)
+	suite.True(errors.Is(archive.PutObject("index.yaml", []byte{}), ErrReadOnly))
+	suite.True(errors.Is(archive.DeleteObject("index.yaml"), ErrReadOnly))
+}
+
+func (suite *ArchiveTestSuite) TestCreate() {
+	p := path.Join(suite.Fixture.Dir, "bundle.tgz")
+	archive, err := NewArchiveStorage(ArchiveOptions{Path: p, Create: true})
+	suite.Nil(err)
+
+	suite.Nil(archive.PutObject("charts/nginx-1.0.0.tgz", []byte("nginx")))
+	err = archive.PutObject("/charts/nginx-1.0.0.tgz", []byte("again"))
+	suite.True(errors.Is(err, os.ErrExist), "objects are put once")
+
+	objects, err := archive.ListObjects("charts")
+	suite.Nil(err)
+	suite.Len(objects, 1, "written objects are listed")
+	_, err = archive.GetObject("charts/nginx-1.0.0.tgz")
+	suite.True(errors.Is(err, ErrArchiveWriting))
+
+	_, err = os.Stat(p)
+	suite.True(os.IsNotExist(err), "archive is written on close")
+
+	suite.Nil(archive.Close())
+	suite.Nil(archive.Close(), "close is idempotent")
+	suite.True(errors.Is(archive.PutObject("index.yaml", []byte{}), os.ErrClosed))
+
+	entries, err := ioutil.ReadDir(suite.Fixture.Dir)
+	suite.Nil(err)
+	suite.Len(entries, 1, "temporary file renamed")
+	suite.Equal("bundle.tgz", entries[0].Name())
+}
+
+func (suite *ArchiveTestSuite) TestBackendArchive() {
+	backend, err := NewDirStorage(suite.Fixture.Dir)
+	suite.Nil(err)
+
+	archive, err := NewArchiveStorage(ArchiveOptions{Backend: backend, Key: "backups/bundle.zip", Create: true})
+	suite.Nil(err)
+	suite.Nil(archive.PutObject("index.yaml", []byte("apiVersion: v1")))
+	suite.Nil(archive.Close())
+
+	archive, err = NewArchiveStorage(ArchiveOptions{Backend: backend, Key: "backups/bundle.zip"})
+	suite.Nil(err)
+	object, err := archive.GetObject("index.yaml")
+	suite.Nil(err, "archive fetched from backend")
+	suite.Equal([]byte("apiVersion: v1"), object.Data)
+
+	_, err = NewArchiveStorage(ArchiveOptions{Path: "bundle.zip", Backend: backend, Key: "bundle.zip"})
+	suite.NotNil(err, "path and backend are mutually exclusive")
+}
+
+func (suite *ArchiveTestSuite) TestSkippedEntries() {
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	for _, header := range []*tar.Header{
+		{Typeflag: tar.TypeDir, Name: "./charts/", Mode: 0755},
+		{Typeflag: tar.TypeReg, Name: "./charts/nginx-1.0.0.tgz", Mode: 0644, Size: 5},
+		{Typeflag: tar.TypeReg, Name: "../escape.tgz", Mode: 0644, Size: 5},
+		{Typeflag: tar.TypeSymlink, Name: "link.tgz", Linkname: "charts/nginx-1.0.0.tgz"},
+	} {
+		suite.Nil(w.WriteHeader(header))
+		if header.Size > 0 {
+			_, err := w.Write([]byte("nginx"))
+			suite.Nil(err)
+		}
+	}
+	suite.Nil(w.Close())
+
+	p := path.Join(suite.Fixture.Dir, "bundle.tar")
+	suite.Nil(os.MkdirAll(suite.Fixture.Dir, 0777))
+	suite.Nil(ioutil.WriteFile(p, buf.Bytes(), 0644))
+
+	archive, err := NewArchiveStorage(ArchiveOptions{Path: p})
+	suite.Nil(err)
+	objects, err := archive.ListObjects("")
+	suite.Nil(err)
+	suite.Empty(objects, "directories, links and invalid names are skipped")
+
+	object, err := archive.GetObject("charts/nginx-1.0.0.tgz")
+	suite.Nil(err, "leading ./ is normalized")
+	suite.Equal([]byte("nginx"), object.Data)
+}
+
+func TestArchiveStorageTestSuite(t *testing.T) {
+	suite.Run(t, new(ArchiveTestSuite))
+}
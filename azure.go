@@ -0,0 +1,537 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultAzureBlockSize is the size of blocks staged by uploads of larger objects,
+// smaller objects are uploaded with a single Put Blob request
+const DefaultAzureBlockSize = 4 * 1024 * 1024
+
+const (
+	// azureAPIVersion is the Blob service REST API version requests are made with
+	azureAPIVersion = "2020-10-02"
+	// azureMetaHeaderPrefix starts headers holding blob user metadata
+	azureMetaHeaderPrefix = "X-Ms-Meta-"
+	// azureChecksumMetadataKey holds the SHA-256 digest of blobs,
+	// metadata names must be C# identifiers, so checksumMetadataKey can not be used
+	azureChecksumMetadataKey = "storage_sha256"
+)
+
+type AzureOptions struct {
+	Logger *zap.SugaredLogger
+	// Account is the storage account name
+	Account string
+	// Key is the base64 encoded account key used for Shared Key authorization
+	Key string
+	// SASToken is a shared access signature query string used instead of Key
+	SASToken  string
+	Container string
+	Prefix    string
+	// Endpoint is the blob service URL, https://<account>.blob.core.windows.net by default.
+	// Azurite serves accounts under the URL path: http://127.0.0.1:10000/<account>
+	Endpoint string
+	// BlockSize of staged block uploads, defaults to DefaultAzureBlockSize
+	BlockSize int
+	// HTTPClient defaults to http.DefaultClient
+	HTTPClient *http.Client
+}
+
+// AzureStorage stores objects as block blobs of an Azure Storage container
+type AzureStorage struct {
+	logger    *zap.SugaredLogger
+	Container string
+	Prefix    string
+	account   string
+	key       []byte
+	sas       url.Values
+	endpoint  *url.URL
+	blockSize int
+	client    *http.Client
+}
+
+// AzureError is returned for failed Blob service requests
+type AzureError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *AzureError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("azure: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("azure: %d %s: %s", e.StatusCode, e.Code, strings.TrimSpace(e.Message))
+}
+
+// Is matches os.ErrNotExist for missing blobs and containers
+func (e *AzureError) Is(target error) bool {
+	return target == os.ErrNotExist && e.StatusCode == http.StatusNotFound
+}
+
+func NewAzureStorage(opts AzureOptions) (*AzureStorage, error) {
+	if opts.Logger == nil {
+		opts.Logger = zap.S()
+	}
+
+	if opts.Account == "" {
+		return nil, fmt.Errorf("azure storage account must be specified")
+	}
+	if opts.Container == "" {
+		return nil, fmt.Errorf("azure storage container must be specified")
+	}
+	if opts.Key == "" && opts.SASToken == "" {
+		return nil, fmt.Errorf("azure storage account key or SAS token must be specified")
+	}
+
+	s := &AzureStorage{
+		logger:    opts.Logger,
+		Container: opts.Container,
+		Prefix:    cleanPrefix(opts.Prefix),
+		account:   opts.Account,
+		blockSize: opts.BlockSize,
+		client:    opts.HTTPClient,
+	}
+
+	if opts.Key != "" {
+		key, err := base64.StdEncoding.DecodeString(opts.Key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid azure storage account key: %w", err)
+		}
+		s.key = key
+	} else {
+		sas, err := url.ParseQuery(strings.TrimPrefix(opts.SASToken, "?"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid azure SAS token: %w", err)
+		}
+		s.sas = sas
+	}
+
+	if opts.Endpoint == "" {
+		opts.Endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", opts.Account)
+	}
+	endpoint, err := url.Parse(strings.TrimSuffix(opts.Endpoint, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid azure endpoint: %w", err)
+	}
+	s.endpoint = endpoint
+
+	if s.blockSize <= 0 {
+		s.blockSize = DefaultAzureBlockSize
+	}
+	if s.client == nil {
+		s.client = http.DefaultClient
+	}
+
+	return s, nil
+}
+
+// azureBlobList is the List Blobs response body
+type azureBlobList struct {
+	Blobs []struct {
+		Name       string `xml:"Name"`
+		Properties struct {
+			LastModified string `xml:"Last-Modified"`
+		} `xml:"Properties"`
+	} `xml:"Blobs>Blob"`
+	NextMarker string `xml:"NextMarker"`
+}
+
+// ListObjects lists blobs right under prefix, blobs of nested prefixes are skipped
+func (s *AzureStorage) ListObjects(prefix string) ([]Object, error) {
+	var objects []Object
+
+	prefix, err := defaultKeyRules.validatePrefix(prefix)
+	if err != nil {
+		return objects, err
+	}
+
+	prefix = path.Join(s.Prefix, prefix)
+	err = s.listBlobs(prefix, "/", func(name string, modified time.Time) error {
+		path := removePrefixFromObjectPath(prefix, name)
+		if objectPathIsInvalid(path) {
+			return nil
+		}
+		objects = append(objects, Object{
+			Path:         path,
+			Data:         []byte{},
+			LastModified: modified,
+		})
+		return nil
+	})
+	return objects, err
+}
+
+// listBlobs calls fn for every blob under prefix page by page,
+// with a delimiter blobs of nested prefixes are not listed
+func (s *AzureStorage) listBlobs(prefix string, delimiter string, fn func(name string, modified time.Time) error) error {
+	query := url.Values{
+		"restype": {"container"},
+		"comp":    {"list"},
+	}
+	if prefix != "" {
+		query.Set("prefix", prefix+"/")
+	}
+	if delimiter != "" {
+		query.Set("delimiter", delimiter)
+	}
+
+	for {
+		res, err := s.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return err
+		}
+
+		var list azureBlobList
+		err = xml.NewDecoder(res.Body).Decode(&list)
+		res.Body.Close()
+		if err != nil {
+			return fmt.Errorf("unable to decode azure blob list: %w", err)
+		}
+
+		for _, blob := range list.Blobs {
+			modified, _ := http.ParseTime(blob.Properties.LastModified)
+			if err := fn(blob.Name, modified); err != nil {
+				return err
+			}
+		}
+
+		if list.NextMarker == "" {
+			return nil
+		}
+		query.Set("marker", list.NextMarker)
+	}
+}
+
+func (s *AzureStorage) GetObject(key string) (Object, error) {
+	object := Object{Path: key}
+	blob, err := s.blobName(key)
+	if err != nil {
+		return object, err
+	}
+
+	res, err := s.do(http.MethodGet, blob, nil, nil, nil)
+	if err != nil {
+		return object, err
+	}
+	content, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return object, err
+	}
+
+	object.Meta = azureObjectMeta(key, res.Header)
+	object.Meta.Checksum, err = objectChecksum(key, content, object.Meta.Checksum)
+	if err != nil {
+		return object, err
+	}
+	object.Data = content
+	object.LastModified, _ = http.ParseTime(res.Header.Get("Last-Modified"))
+	return object, nil
+}
+
+// StatObject returns blob properties and metadata with a HEAD request
+func (s *AzureStorage) StatObject(key string) (Object, error) {
+	object := Object{Path: key, Data: []byte{}}
+	blob, err := s.blobName(key)
+	if err != nil {
+		return object, err
+	}
+
+	res, err := s.do(http.MethodHead, blob, nil, nil, nil)
+	if err != nil {
+		return object, err
+	}
+	res.Body.Close()
+
+	object.Meta = azureObjectMeta(key, res.Header)
+	object.LastModified, _ = http.ParseTime(res.Header.Get("Last-Modified"))
+	return object, nil
+}
+
+func (s *AzureStorage) PutObject(key string, data []byte) error {
+	return s.putObject(key, data, Metadata{})
+}
+
+// PutObjectWithMetadata uploads a blob with content type and user metadata,
+// SHA-256 checksum of data is stored in blob metadata as well
+func (s *AzureStorage) PutObjectWithMetadata(key string, data []byte, meta Metadata) error {
+	checksum, err := objectChecksum(key, data, meta.Checksum)
+	if err != nil {
+		return err
+	}
+	meta.Checksum = checksum
+	return s.putObject(key, data, meta)
+}
+
+// putObject uploads data with a single Put Blob request if it fits in a block,
+// larger data is staged in blocks committed at once with Put Block List
+func (s *AzureStorage) putObject(key string, data []byte, meta Metadata) error {
+	blob, err := s.blobName(key)
+	if err != nil {
+		return err
+	}
+
+	header := http.Header{}
+	for k, v := range meta.UserMetadata {
+		header.Set(azureMetaHeaderPrefix+k, v)
+	}
+	if meta.Checksum != "" {
+		header.Set(azureMetaHeaderPrefix+azureChecksumMetadataKey, meta.Checksum)
+	}
+
+	if len(data) <= s.blockSize {
+		header.Set("x-ms-blob-type", "BlockBlob")
+		if meta.ContentType != "" {
+			header.Set("Content-Type", meta.ContentType)
+		}
+		res, err := s.do(http.MethodPut, blob, nil, header, data)
+		if err != nil {
+			return err
+		}
+		return res.Body.Close()
+	}
+
+	// block ids of a blob must have the same length, a random part keeps
+	// blocks of concurrent uploads apart until one of them is committed
+	upload, err := randomID()
+	if err != nil {
+		return err
+	}
+
+	var list bytes.Buffer
+	list.WriteString(`<?xml version="1.0" encoding="utf-8"?><BlockList>`)
+	for i, offset := 0, 0; offset < len(data); i, offset = i+1, offset+s.blockSize {
+		end := offset + s.blockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s-%08d", upload, i)))
+		query := url.Values{"comp": {"block"}, "blockid": {id}}
+		res, err := s.do(http.MethodPut, blob, query, nil, data[offset:end])
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		fmt.Fprintf(&list, "<Latest>%s</Latest>", id)
+	}
+	list.WriteString("</BlockList>")
+
+	if meta.ContentType != "" {
+		header.Set("x-ms-blob-content-type", meta.ContentType)
+	}
+	res, err := s.do(http.MethodPut, blob, url.Values{"comp": {"blocklist"}}, header, list.Bytes())
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+func (s *AzureStorage) DeleteObject(key string) error {
+	blob, err := s.blobName(key)
+	if err != nil {
+		return err
+	}
+
+	res, err := s.do(http.MethodDelete, blob, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// DeletePrefix removes blobs under prefix one by one, Blob service batches require multipart requests
+func (s *AzureStorage) DeletePrefix(prefix string) error {
+	prefix, err := defaultKeyRules.validate(prefix)
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	err = s.listBlobs(path.Join(s.Prefix, prefix), "", func(name string, _ time.Time) error {
+		names = append(names, name)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		res, err := s.do(http.MethodDelete, name, nil, nil, nil)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err == nil {
+			res.Body.Close()
+		}
+	}
+	return nil
+}
+
+// Watch polls objects at prefix every DefaultPollInterval
+func (s *AzureStorage) Watch(ctx context.Context, prefix string) <-chan Event {
+	return PollObjects(ctx, s, prefix, DefaultPollInterval)
+}
+
+// blobName validates key and returns the name of its blob in the container
+func (s *AzureStorage) blobName(key string) (string, error) {
+	normalized, err := defaultKeyRules.validate(key)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(s.Prefix, normalized), nil
+}
+
+// do sends an authorized request for a blob, or for the container if blob is empty.
+// Responses with error status are returned as AzureError
+func (s *AzureStorage) do(method string, blob string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = u.Path + "/" + s.Container
+	u.RawPath = ""
+	if blob != "" {
+		u.Path += "/" + blob
+		u.RawPath = escapeAzurePath(u.Path)
+	}
+
+	q := url.Values{}
+	for k, v := range query {
+		q[k] = v
+	}
+	for k, v := range s.sas {
+		q[k] = v
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.ContentLength = int64(len(body))
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("x-ms-version", azureAPIVersion)
+	if s.key != nil {
+		req.Header.Set("Authorization", "SharedKey "+s.account+":"+azureSignature(s.key, s.account, req))
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 300 {
+		return res, nil
+	}
+	defer res.Body.Close()
+
+	azErr := &AzureError{StatusCode: res.StatusCode, Code: res.Header.Get("x-ms-error-code")}
+	var details struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(res.Body, 64*1024)).Decode(&details); err == nil {
+		azErr.Code, azErr.Message = details.Code, details.Message
+	}
+	return nil, azErr
+}
+
+// escapeAzurePath escapes every segment of a URL path
+func escapeAzurePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// azureSignature signs a request with Shared Key authorization scheme
+// https://docs.microsoft.com/en-us/rest/api/storageservices/authorize-with-shared-key
+func azureSignature(key []byte, account string, req *http.Request) string {
+	contentLength := ""
+	if req.ContentLength > 0 {
+		contentLength = strconv.FormatInt(req.ContentLength, 10)
+	}
+
+	var b strings.Builder
+	b.WriteString(req.Method + "\n")
+	for _, h := range []string{"Content-Encoding", "Content-Language"} {
+		b.WriteString(req.Header.Get(h) + "\n")
+	}
+	b.WriteString(contentLength + "\n")
+	for _, h := range []string{
+		"Content-MD5", "Content-Type", "Date", "If-Modified-Since", "If-Match",
+		"If-None-Match", "If-Unmodified-Since", "Range",
+	} {
+		b.WriteString(req.Header.Get(h) + "\n")
+	}
+
+	var headers []string
+	for k := range req.Header {
+		if name := strings.ToLower(k); strings.HasPrefix(name, "x-ms-") {
+			headers = append(headers, name)
+		}
+	}
+	sort.Strings(headers)
+	for _, name := range headers {
+		b.WriteString(name + ":" + strings.TrimSpace(req.Header.Get(name)) + "\n")
+	}
+
+	b.WriteString("/" + account + req.URL.EscapedPath())
+	query := req.URL.Query()
+	var params []string
+	for k := range query {
+		params = append(params, k)
+	}
+	sort.Strings(params)
+	for _, k := range params {
+		values := query[k]
+		sort.Strings(values)
+		b.WriteString("\n" + strings.ToLower(k) + ":" + strings.Join(values, ","))
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(b.String()))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func azureObjectMeta(key string, header http.Header) Metadata {
+	metadata := make(map[string]string)
+	for k, v := range header {
+		if strings.HasPrefix(k, azureMetaHeaderPrefix) && len(v) > 0 {
+			metadata[strings.TrimPrefix(k, azureMetaHeaderPrefix)] = v[0]
+		}
+	}
+	checksum := reservedMetadata(metadata, azureChecksumMetadataKey)
+	for k := range metadata {
+		if strings.EqualFold(k, azureChecksumMetadataKey) {
+			delete(metadata, k)
+		}
+	}
+
+	return Metadata{
+		Name:         path.Base(key),
+		Version:      header.Get("ETag"),
+		ContentType:  header.Get("Content-Type"),
+		UserMetadata: userMetadata(metadata),
+		Checksum:     checksum,
+	}
+}
@@ -0,0 +1,397 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+const (
+	fakeAzureAccount   = "devstoreaccount1"
+	fakeAzureContainer = "charts"
+	fakeAzureSASToken  = "sv=2020-10-02&ss=b&srt=sco&sp=rwdlac&sig=fake%2Bsignature"
+)
+
+var fakeAzureKey = base64.StdEncoding.EncodeToString([]byte("fake azure account key"))
+
+type fakeAzureBlob struct {
+	data     []byte
+	header   http.Header
+	modified time.Time
+}
+
+// fakeAzureBlobServer implements the subset of Blob service REST API used by AzureStorage,
+// serving a single account under the URL path like Azurite does
+type fakeAzureBlobServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	blobs    map[string]*fakeAzureBlob
+	blocks   map[string][]byte
+	pageSize int
+	requests int
+	// beforeDelete is called ahead of blob deletes, e.g. to emulate a concurrent delete
+	beforeDelete func(name string)
+}
+
+func newFakeAzureBlobServer() *fakeAzureBlobServer {
+	f := &fakeAzureBlobServer{
+		blobs:    make(map[string]*fakeAzureBlob),
+		blocks:   make(map[string][]byte),
+		pageSize: 2,
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	return f
+}
+
+func (f *fakeAzureBlobServer) endpoint() string {
+	return f.URL + "/" + fakeAzureAccount
+}
+
+func (f *fakeAzureBlobServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests++
+
+	if !f.authorized(r) {
+		fakeAzureError(w, http.StatusForbidden, "AuthenticationFailed", "Server failed to authenticate the request.")
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/"+fakeAzureAccount+"/"+fakeAzureContainer)
+	if name == r.URL.Path {
+		fakeAzureError(w, http.StatusNotFound, "ContainerNotFound", "The specified container does not exist.")
+		return
+	}
+	name = strings.TrimPrefix(name, "/")
+	query := r.URL.Query()
+
+	switch {
+	case name == "" && r.Method == http.MethodGet && query.Get("comp") == "list":
+		f.list(w, query)
+	case r.Method == http.MethodPut && query.Get("comp") == "block":
+		data, _ := ioutil.ReadAll(r.Body)
+		f.blocks[name+"/"+query.Get("blockid")] = data
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut && query.Get("comp") == "blocklist":
+		var list struct {
+			Latest []string `xml:"Latest"`
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&list); err != nil {
+			fakeAzureError(w, http.StatusBadRequest, "InvalidXmlDocument", err.Error())
+			return
+		}
+		var data []byte
+		for _, id := range list.Latest {
+			block, ok := f.blocks[name+"/"+id]
+			if !ok {
+				fakeAzureError(w, http.StatusBadRequest, "InvalidBlockList", "The specified block list is invalid.")
+				return
+			}
+			data = append(data, block...)
+		}
+		header := fakeAzureBlobHeader(r.Header)
+		if contentType := r.Header.Get("x-ms-blob-content-type"); contentType != "" {
+			header.Set("Content-Type", contentType)
+		}
+		f.put(name, data, header)
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut:
+		if r.Header.Get("x-ms-blob-type") != "BlockBlob" {
+			fakeAzureError(w, http.StatusBadRequest, "MissingRequiredHeader", "x-ms-blob-type is required.")
+			return
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		header := fakeAzureBlobHeader(r.Header)
+		if contentType := r.Header.Get("Content-Type"); contentType != "" {
+			header.Set("Content-Type", contentType)
+		}
+		f.put(name, data, header)
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		blob, ok := f.blobs[name]
+		if !ok {
+			fakeAzureError(w, http.StatusNotFound, "BlobNotFound", "The specified blob does not exist.")
+			return
+		}
+		for k, v := range blob.header {
+			w.Header()[k] = v
+		}
+		w.Header().Set("Last-Modified", blob.modified.Format(http.TimeFormat))
+		w.Header().Set("Content-Length", fmt.Sprint(len(blob.data)))
+		if r.Method == http.MethodGet {
+			w.Write(blob.data)
+		}
+	case r.Method == http.MethodDelete:
+		if f.beforeDelete != nil {
+			f.beforeDelete(name)
+		}
+		if _, ok := f.blobs[name]; !ok {
+			fakeAzureError(w, http.StatusNotFound, "BlobNotFound", "The specified blob does not exist.")
+			return
+		}
+		delete(f.blobs, name)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		fakeAzureError(w, http.StatusBadRequest, "UnsupportedHttpVerb", r.Method)
+	}
+}
+
+// authorized checks Shared Key signature of a request as received, or presence of a SAS signature
+func (f *fakeAzureBlobServer) authorized(r *http.Request) bool {
+	if r.Header.Get("x-ms-version") == "" || r.Header.Get("x-ms-date") == "" {
+		return false
+	}
+	if r.URL.Query().Get("sig") == "fake+signature" {
+		return true
+	}
+
+	key, _ := base64.StdEncoding.DecodeString(fakeAzureKey)
+	return r.Header.Get("Authorization") == "SharedKey "+fakeAzureAccount+":"+azureSignature(key, fakeAzureAccount, r)
+}
+
+func (f *fakeAzureBlobServer) put(name string, data []byte, header http.Header) {
+	header.Set("ETag", fmt.Sprintf(`"0x%X"`, time.Now().UnixNano()))
+	f.blobs[name] = &fakeAzureBlob{data: data, header: header, modified: time.Now()}
+	for id := range f.blocks {
+		if strings.HasPrefix(id, name+"/") {
+			delete(f.blocks, id)
+		}
+	}
+}
+
+func (f *fakeAzureBlobServer) list(w http.ResponseWriter, query map[string][]string) {
+	get := func(k string) string {
+		if v := query[k]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	prefix, delimiter, marker := get("prefix"), get("delimiter"), get("marker")
+
+	var names []string
+	for name := range f.blobs {
+		if !strings.HasPrefix(name, prefix) || name <= marker {
+			continue
+		}
+		if delimiter != "" && strings.Contains(strings.TrimPrefix(name, prefix), delimiter) {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b bytes.Buffer
+	b.WriteString(`<?xml version="1.0" encoding="utf-8"?><EnumerationResults><Blobs>`)
+	for i, name := range names {
+		if i == f.pageSize {
+			fmt.Fprintf(&b, "</Blobs><NextMarker>%s</NextMarker></EnumerationResults>", names[i-1])
+			w.Write(b.Bytes())
+			return
+		}
+		fmt.Fprintf(&b, "<Blob><Name>%s</Name><Properties><Last-Modified>%s</Last-Modified></Properties></Blob>",
+			name, f.blobs[name].modified.Format(http.TimeFormat))
+	}
+	b.WriteString("</Blobs><NextMarker /></EnumerationResults>")
+	w.Write(b.Bytes())
+}
+
+func fakeAzureBlobHeader(request http.Header) http.Header {
+	header := http.Header{}
+	for k, v := range request {
+		if strings.HasPrefix(k, azureMetaHeaderPrefix) {
+			header[k] = v
+		}
+	}
+	return header
+}
+
+func fakeAzureError(w http.ResponseWriter, status int, code string, message string) {
+	w.Header().Set("x-ms-error-code", code)
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?><Error><Code>%s</Code><Message>%s</Message></Error>`, code, message)
+}
+
+type AzureTestSuite struct {
+	suite.Suite
+	server     *fakeAzureBlobServer
+	KeyStorage *AzureStorage
+	SASStorage *AzureStorage
+}
+
+func (suite *AzureTestSuite) SetupTest() {
+	suite.server = newFakeAzureBlobServer()
+
+	backend, err := NewAzureStorage(AzureOptions{
+		Account:   fakeAzureAccount,
+		Key:       fakeAzureKey,
+		Container: fakeAzureContainer,
+		Prefix:    "/unittest/",
+		Endpoint:  suite.server.endpoint(),
+		BlockSize: 8,
+	})
+	suite.Nil(err)
+	suite.KeyStorage = backend
+
+	backend, err = NewAzureStorage(AzureOptions{
+		Account:   fakeAzureAccount,
+		SASToken:  "?" + fakeAzureSASToken,
+		Container: fakeAzureContainer,
+		Prefix:    "unittest",
+		Endpoint:  suite.server.endpoint(),
+	})
+	suite.Nil(err)
+	suite.SASStorage = backend
+}
+
+func (suite *AzureTestSuite) TearDownTest() {
+	suite.server.Close()
+}
+
+func (suite *AzureTestSuite) TestNewAzureStorage() {
+	_, err := NewAzureStorage(AzureOptions{Account: fakeAzureAccount, Container: fakeAzureContainer})
+	suite.NotNil(err, "credentials are required")
+
+	_, err = NewAzureStorage(AzureOptions{Account: fakeAzureAccount, Container: fakeAzureContainer, Key: "not base64!"})
+	suite.NotNil(err, "account key must be base64 encoded")
+
+	backend, err := NewAzureStorage(AzureOptions{Account: "account", Container: fakeAzureContainer, Key: fakeAzureKey})
+	suite.Nil(err)
+	suite.Equal("https://account.blob.core.windows.net", backend.endpoint.String(), "public endpoint by default")
+}
+
+func (suite *AzureTestSuite) TestPutGetObject() {
+	for name, backend := range map[string]*AzureStorage{"shared key": suite.KeyStorage, "SAS": suite.SASStorage} {
+		key := fmt.Sprintf("%s/index.yaml", strings.ReplaceAll(name, " ", "-"))
+		suite.Nil(backend.PutObject(key, []byte("apiVersion: v1")), "no error putting object with %s", name)
+
+		object, err := backend.GetObject(key)
+		suite.Nil(err, "no error getting object with %s", name)
+		suite.Equal([]byte("apiVersion: v1"), object.Data)
+		suite.Equal("index.yaml", object.Meta.Name)
+		suite.NotEmpty(object.Meta.Version, "etag is the object version")
+		suite.WithinDuration(time.Now(), object.LastModified, 2*time.Second)
+	}
+
+	_, ok := suite.server.blobs["unittest/shared-key/index.yaml"]
+	suite.True(ok, "blob stored under container prefix")
+}
+
+func (suite *AzureTestSuite) TestPutObjectInBlocks() {
+	data := []byte("a blob larger than a single block of eight bytes")
+	suite.Nil(suite.KeyStorage.PutObjectWithMetadata("large.txt", data, Metadata{ContentType: "text/plain"}))
+
+	object, err := suite.KeyStorage.GetObject("large.txt")
+	suite.Nil(err)
+	suite.Equal(data, object.Data, "blocks committed in order")
+	suite.Equal("text/plain", object.Meta.ContentType)
+	suite.Empty(suite.server.blocks, "uncommitted blocks are not left behind")
+}
+
+func (suite *AzureTestSuite) TestObjectMetadata() {
+	suite.Nil(suite.KeyStorage.PutObjectWithMetadata("chart.tgz", []byte("chart"), Metadata{
+		ContentType:  "application/gzip",
+		UserMetadata: map[string]string{"Owner": "ops"},
+	}))
+
+	object, err := suite.KeyStorage.StatObject("chart.tgz")
+	suite.Nil(err)
+	suite.Empty(object.Data)
+	suite.Equal("application/gzip", object.Meta.ContentType)
+	suite.Equal(map[string]string{"Owner": "ops"}, object.Meta.UserMetadata)
+	suite.Equal(sha256Digest([]byte("chart")), object.Meta.Checksum)
+
+	suite.server.blobs["unittest/chart.tgz"].data = []byte("tampered")
+	_, err = suite.KeyStorage.GetObject("chart.tgz")
+	var mismatch *DigestMismatchError
+	suite.True(errors.As(err, &mismatch), "stored checksum is verified")
+}
+
+func (suite *AzureTestSuite) TestListObjects() {
+	for i := 1; i <= 5; i++ {
+		suite.Nil(suite.KeyStorage.PutObject(fmt.Sprintf("test%d.txt", i), []byte("content")))
+	}
+	suite.Nil(suite.KeyStorage.PutObject("nested/object.txt", []byte("content")))
+	suite.Nil(suite.KeyStorage.PutObject("nested/deeper/object.txt", []byte("content")))
+
+	objects, err := suite.SASStorage.ListObjects("")
+	suite.Nil(err)
+	suite.Len(objects, 5, "listed across pages, nested objects skipped")
+	for i, object := range objects {
+		suite.Equal(fmt.Sprintf("test%d.txt", i+1), object.Path)
+		suite.False(object.LastModified.IsZero())
+	}
+
+	objects, err = suite.KeyStorage.ListObjects("nested")
+	suite.Nil(err)
+	suite.Len(objects, 1)
+	suite.Equal("object.txt", objects[0].Path)
+
+	objects, err = suite.KeyStorage.ListObjects("missing")
+	suite.Nil(err)
+	suite.Empty(objects)
+
+	_, err = suite.KeyStorage.ListObjects("../escape")
+	suite.True(errors.Is(err, ErrInvalidKey))
+}
+
+func (suite *AzureTestSuite) TestDeleteObject() {
+	suite.Nil(suite.KeyStorage.PutObject("deleteme.txt", []byte("content")))
+	suite.Nil(suite.KeyStorage.DeleteObject("deleteme.txt"))
+
+	_, err := suite.KeyStorage.GetObject("deleteme.txt")
+	suite.True(errors.Is(err, os.ErrNotExist), "missing blob matches os.ErrNotExist")
+
+	err = suite.KeyStorage.DeleteObject("deleteme.txt")
+	var azErr *AzureError
+	suite.True(errors.As(err, &azErr))
+	suite.Equal("BlobNotFound", azErr.Code)
+}
+
+func (suite *AzureTestSuite) TestDeletePrefix() {
+	suite.Nil(suite.KeyStorage.PutObject("charts/a.tgz", []byte("a")))
+	suite.Nil(suite.KeyStorage.PutObject("charts/nested/b.tgz", []byte("b")))
+	suite.Nil(suite.KeyStorage.PutObject("chartsmuseum.txt", []byte("c")))
+
+	// the other blob listed under the prefix is removed concurrently
+	suite.server.beforeDelete = func(name string) {
+		delete(suite.server.blobs, "unittest/charts/nested/b.tgz")
+	}
+	suite.Nil(suite.KeyStorage.DeletePrefix("charts"), "blobs removed meanwhile are skipped")
+
+	suite.Len(suite.server.blobs, 1)
+	_, err := suite.KeyStorage.GetObject("chartsmuseum.txt")
+	suite.Nil(err, "objects sharing the prefix as a substring are kept")
+}
+
+func (suite *AzureTestSuite) TestAuthenticationFailure() {
+	backend, err := NewAzureStorage(AzureOptions{
+		Account:   fakeAzureAccount,
+		Key:       base64.StdEncoding.EncodeToString([]byte("wrong key")),
+		Container: fakeAzureContainer,
+		Endpoint:  suite.server.endpoint(),
+	})
+	suite.Nil(err)
+
+	err = backend.PutObject("index.yaml", []byte{})
+	var azErr *AzureError
+	suite.True(errors.As(err, &azErr))
+	suite.Equal(http.StatusForbidden, azErr.StatusCode)
+	suite.Equal("AuthenticationFailed", azErr.Code)
+}
+
+func TestAzureStorageTestSuite(t *testing.T) {
+	suite.Run(t, new(AzureTestSuite))
+}
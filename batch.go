@@ -0,0 +1,536 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	committedHeadKey         = "HEAD"
+	committedManifestsPrefix = "manifests"
+	committedObjectsPrefix   = "objects"
+	// committedLockName is the name of the lock serializing commits of processes sharing a backend
+	committedLockName = "commit"
+)
+
+// BatchOp is a staged put or delete of a batch
+type BatchOp struct {
+	Key    string
+	Data   []byte
+	Delete bool
+}
+
+// Batch stages puts and deletes to be committed together,
+// a later operation on a key replaces the earlier one
+type Batch struct {
+	ops   []BatchOp
+	index map[string]int
+}
+
+func NewBatch() *Batch {
+	return &Batch{index: make(map[string]int)}
+}
+
+func (b *Batch) Put(key string, data []byte) {
+	b.add(BatchOp{Key: key, Data: data})
+}
+
+func (b *Batch) Delete(key string) {
+	b.add(BatchOp{Key: key, Delete: true})
+}
+
+// Ops returns staged operations in the order their keys were first staged
+func (b *Batch) Ops() []BatchOp {
+	return b.ops
+}
+
+func (b *Batch) add(op BatchOp) {
+	if i, ok := b.index[op.Key]; ok {
+		b.ops[i] = op
+		return
+	}
+	b.index[op.Key] = len(b.ops)
+	b.ops = append(b.ops, op)
+}
+
+// Batcher is implemented by backends committing batches atomically,
+// readers observe either none or all of the batch operations
+type Batcher interface {
+	CommitBatch(ctx context.Context, batch *Batch) error
+}
+
+type CommittedOptions struct {
+	Logger  *zap.SugaredLogger
+	Backend Backend
+	// LockTTL is the ttl of the commit lock taken when the backend is a Locker. Defaults to one minute
+	LockTTL time.Duration
+}
+
+// committedManifest maps keys of a committed set to the commits that have written them
+type committedManifest struct {
+	Objects map[string]committedEntry `json:"objects"`
+	// Token is the fencing token of the commit lock held while the manifest was committed
+	Token int64 `json:"token,omitempty"`
+}
+
+type committedEntry struct {
+	Commit   string    `json:"commit"`
+	Modified time.Time `json:"modified"`
+}
+
+// CommittedBackend commits batches atomically on backends without transactions, e.g. S3, GCS or disk.
+// Layout of the underlying backend:
+//
+//	HEAD                  id of the current manifest, the commit pointer
+//	manifests/<id>        keys of the committed set and commits holding their data
+//	objects/<id>/<key>    data written by commit id
+//
+// A commit writes its objects and manifest first and switches HEAD last, so readers
+// resolving keys through HEAD only observe committed sets. Objects and manifests
+// superseded by a commit are removed after it, a crashed commit leaves unreferenced ones behind.
+// The backend must be a Locker or a ConditionalBackend, otherwise concurrent commits could overwrite each other
+type CommittedBackend struct {
+	logger  *zap.SugaredLogger
+	backend Backend
+	lockTTL time.Duration
+	// fence rejects commits of lock holders older than the one of the current manifest
+	fence *Fence
+
+	// mu serializes commits within the process, commits of other processes are serialized with
+	// a lock if the backend is a Locker and by a conditional write of HEAD if it is a ConditionalBackend
+	mu sync.Mutex
+
+	cacheMu  sync.Mutex
+	cachedID string
+	cached   *committedManifest
+}
+
+func NewCommittedBackend(opts CommittedOptions) (*CommittedBackend, error) {
+	if opts.Backend == nil {
+		return nil, fmt.Errorf("backend must be specified")
+	}
+
+	_, locker := opts.Backend.(Locker)
+	_, conditional := opts.Backend.(ConditionalBackend)
+	if !locker && !conditional {
+		return nil, fmt.Errorf("%T supports neither locks nor conditional writes, concurrent commits could be lost", opts.Backend)
+	}
+
+	if opts.Logger == nil {
+		opts.Logger = zap.S()
+	}
+
+	if opts.LockTTL <= 0 {
+		opts.LockTTL = time.Minute
+	}
+
+	return &CommittedBackend{
+		logger:  opts.Logger,
+		backend: opts.Backend,
+		lockTTL: opts.LockTTL,
+		fence:   NewFence(),
+	}, nil
+}
+
+// GetObject reads key from the commit that has written it, retrying if HEAD moves meanwhile
+func (s *CommittedBackend) GetObject(key string) (Object, error) {
+	normalized, err := defaultKeyRules.validate(key)
+	if err != nil {
+		return Object{Path: key}, err
+	}
+	key = normalized
+
+	for attempt := 0; ; attempt++ {
+		id, _, manifest, err := s.head()
+		if err != nil {
+			return Object{Path: key}, err
+		}
+
+		entry, ok := manifest.Objects[key]
+		if !ok {
+			return Object{Path: key}, &os.PathError{Op: "open", Path: key, Err: os.ErrNotExist}
+		}
+
+		object, err := s.backend.GetObject(path.Join(committedObjectsPrefix, entry.Commit, key))
+		if err != nil {
+			// the object may have been superseded and removed by a newer commit
+			if current, _, _, headErr := s.head(); headErr == nil && current != id && attempt < 3 {
+				continue
+			}
+			return Object{Path: key}, err
+		}
+
+		return Object{
+			Meta: Metadata{
+				Name:    path.Base(key),
+				Version: entry.Commit,
+			},
+			Path:         key,
+			Data:         object.Data,
+			LastModified: entry.Modified,
+		}, nil
+	}
+}
+
+// ListObjects returns committed objects right under prefix
+func (s *CommittedBackend) ListObjects(prefix string) ([]Object, error) {
+	prefix, err := defaultKeyRules.validatePrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	_, _, manifest, err := s.head()
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []Object
+	for key, entry := range manifest.Objects {
+		if prefix != "" && !strings.HasPrefix(key, prefix+"/") {
+			continue
+		}
+		objectPath := removePrefixFromObjectPath(prefix, key)
+		if objectPathIsInvalid(objectPath) {
+			continue
+		}
+
+		objects = append(objects, Object{
+			Meta: Metadata{
+				Name:    objectPath,
+				Version: entry.Commit,
+			},
+			Path:         objectPath,
+			Data:         []byte{},
+			LastModified: entry.Modified,
+		})
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Path < objects[j].Path
+	})
+	return objects, nil
+}
+
+func (s *CommittedBackend) PutObject(key string, data []byte) error {
+	batch := NewBatch()
+	batch.Put(key, data)
+	return s.CommitBatch(context.Background(), batch)
+}
+
+func (s *CommittedBackend) DeleteObject(key string) error {
+	batch := NewBatch()
+	batch.Delete(key)
+	return s.CommitBatch(context.Background(), batch)
+}
+
+// DeletePrefix removes committed objects under prefix in a single commit
+func (s *CommittedBackend) DeletePrefix(prefix string) error {
+	prefix, err := defaultKeyRules.validate(prefix)
+	if err != nil {
+		return err
+	}
+
+	_, _, manifest, err := s.head()
+	if err != nil {
+		return err
+	}
+
+	batch := NewBatch()
+	for key := range manifest.Objects {
+		if strings.HasPrefix(key, prefix+"/") {
+			batch.Delete(key)
+		}
+	}
+	if len(batch.Ops()) == 0 {
+		return nil
+	}
+
+	return s.CommitBatch(context.Background(), batch)
+}
+
+// CommitBatch stages objects of the batch under a new commit, writes its manifest and switches HEAD to it.
+// Staged objects and the manifest are removed if the commit fails before HEAD is switched.
+// The commit lock is refreshed while staging, a commit that has lost it fails with ErrLockLost
+func (s *CommittedBackend) CommitBatch(ctx context.Context, batch *Batch) error {
+	batch, err := defaultKeyRules.validateBatch(batch)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var lock Lock
+	lockErr := func() error { return nil }
+	if locker, ok := s.backend.(Locker); ok {
+		lock, err = locker.Lock(ctx, committedLockName, s.lockTTL)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := lock.Unlock(context.Background()); err != nil && !errors.Is(err, ErrLockLost) {
+				s.logger.Warnf("Unable to release commit lock: %s", err)
+			}
+		}()
+
+		var stop func()
+		ctx, stop, lockErr = s.keepLock(ctx, lock)
+		defer stop()
+	}
+
+	previousID, _, previous, err := s.head()
+	if err != nil {
+		return err
+	}
+
+	id, err := newCommitID()
+	if err != nil {
+		return err
+	}
+
+	manifest := &committedManifest{Objects: make(map[string]committedEntry, len(previous.Objects))}
+	if lock != nil {
+		manifest.Token = lock.Token()
+	}
+	for key, entry := range previous.Objects {
+		manifest.Objects[key] = entry
+	}
+
+	var staged []string
+	rollback := func() {
+		for _, key := range staged {
+			if err := s.backend.DeleteObject(key); err != nil {
+				s.logger.Warnf("Unable to remove staged object %s of commit %s: %s", key, id, err)
+			}
+		}
+	}
+	// fail rolls the commit back, a commit canceled by a lost lock fails with the refresh error
+	fail := func(err error) error {
+		rollback()
+		if lost := lockErr(); lost != nil {
+			return lost
+		}
+		return err
+	}
+
+	modified := time.Now().UTC()
+	for _, op := range batch.Ops() {
+		if err := ctx.Err(); err != nil {
+			return fail(err)
+		}
+
+		if op.Delete {
+			delete(manifest.Objects, op.Key)
+			continue
+		}
+
+		key := path.Join(committedObjectsPrefix, id, op.Key)
+		if err := s.backend.PutObject(key, op.Data); err != nil {
+			return fail(err)
+		}
+		staged = append(staged, key)
+		manifest.Objects[op.Key] = committedEntry{Commit: id, Modified: modified}
+	}
+
+	content, err := json.Marshal(manifest)
+	if err != nil {
+		return fail(err)
+	}
+
+	manifestKey := path.Join(committedManifestsPrefix, id)
+	if err := s.backend.PutObject(manifestKey, content); err != nil {
+		return fail(err)
+	}
+	staged = append(staged, manifestKey)
+
+	headVersion, err := s.checkHead(ctx, lock, previousID)
+	if err != nil {
+		return fail(err)
+	}
+
+	if err := s.switchHead(previousID, id, headVersion); err != nil {
+		return fail(err)
+	}
+
+	s.cacheMu.Lock()
+	s.cachedID, s.cached = id, manifest
+	s.cacheMu.Unlock()
+
+	s.cleanup(previousID, previous, manifest)
+	return nil
+}
+
+// keepLock refreshes lock every third of the lock ttl until stop is called. If a refresh fails
+// the returned context is canceled and lockErr reports the failure
+func (s *CommittedBackend) keepLock(ctx context.Context, lock Lock) (refreshCtx context.Context, stop func(), lockErr func() error) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+
+	var mu sync.Mutex
+	var refreshErr error
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(s.lockTTL / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			if err := lock.Refresh(ctx, s.lockTTL); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				mu.Lock()
+				refreshErr = err
+				mu.Unlock()
+				cancel()
+				return
+			}
+		}
+	}()
+
+	stop = func() {
+		cancel()
+		<-done
+	}
+	lockErr = func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		return refreshErr
+	}
+	return ctx, stop, lockErr
+}
+
+// checkHead verifies right before HEAD is switched that HEAD still points to the commit the batch
+// is based on and that the commit lock is held with a token not older than the one of that commit.
+// It returns the version of the HEAD object read, empty if HEAD does not exist
+func (s *CommittedBackend) checkHead(ctx context.Context, lock Lock, previousID string) (string, error) {
+	if lock != nil {
+		// extend the lock so it outlives the switch of HEAD
+		if err := lock.Refresh(ctx, s.lockTTL); err != nil {
+			return "", err
+		}
+	}
+
+	id, version, current, err := s.head()
+	if err != nil {
+		return "", err
+	}
+	if id != previousID {
+		return "", fmt.Errorf("HEAD has moved from commit %s to %s: %w", previousID, id, ErrLockLost)
+	}
+
+	if lock == nil {
+		return version, nil
+	}
+	if err := s.fence.Check(committedLockName, current.Token); err != nil {
+		return "", err
+	}
+	return version, s.fence.Check(committedLockName, lock.Token())
+}
+
+// switchHead points HEAD to commit id. On a ConditionalBackend HEAD is only written if it is still
+// at version, so a commit of another process switching HEAD after checkHead is not overwritten
+func (s *CommittedBackend) switchHead(previousID string, id string, version string) error {
+	conditional, ok := s.backend.(ConditionalBackend)
+	if !ok {
+		return s.backend.PutObject(committedHeadKey, []byte(id))
+	}
+
+	err := conditional.PutObjectIfVersion(committedHeadKey, []byte(id), version)
+	if errors.Is(err, ErrVersionMismatch) {
+		return fmt.Errorf("HEAD has moved from commit %s: %w", previousID, ErrLockLost)
+	}
+	return err
+}
+
+// cleanup removes objects superseded by the current manifest and the previous manifest
+func (s *CommittedBackend) cleanup(previousID string, previous *committedManifest, current *committedManifest) {
+	for key, entry := range previous.Objects {
+		if e, ok := current.Objects[key]; ok && e.Commit == entry.Commit {
+			continue
+		}
+		if err := s.backend.DeleteObject(path.Join(committedObjectsPrefix, entry.Commit, key)); err != nil {
+			s.logger.Warnf("Unable to remove superseded object %s of commit %s: %s", key, entry.Commit, err)
+		}
+	}
+
+	if previousID == "" {
+		return
+	}
+	if err := s.backend.DeleteObject(path.Join(committedManifestsPrefix, previousID)); err != nil {
+		s.logger.Warnf("Unable to remove superseded manifest %s: %s", previousID, err)
+	}
+}
+
+// head returns the current commit id, the version of the HEAD object and the manifest of the commit,
+// empty before the first commit. The manifest read is retried if a newer commit has removed it after HEAD was read
+func (s *CommittedBackend) head() (string, string, *committedManifest, error) {
+	for attempt := 0; ; attempt++ {
+		id, version, manifest, err := s.readHead()
+		if err != nil && errors.Is(err, os.ErrNotExist) && attempt < 3 {
+			continue
+		}
+		return id, version, manifest, err
+	}
+}
+
+func (s *CommittedBackend) readHead() (string, string, *committedManifest, error) {
+	var id, version string
+	if object, err := s.backend.GetObject(committedHeadKey); err == nil {
+		id, version = strings.TrimSpace(string(object.Data)), object.Meta.Version
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", "", nil, err
+	}
+
+	if id == "" {
+		return "", version, &committedManifest{Objects: map[string]committedEntry{}}, nil
+	}
+
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+
+	if id == s.cachedID {
+		return id, version, s.cached, nil
+	}
+
+	object, err := s.backend.GetObject(path.Join(committedManifestsPrefix, id))
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	manifest := &committedManifest{}
+	if err := json.Unmarshal(object.Data, manifest); err != nil {
+		return "", "", nil, err
+	}
+	if manifest.Objects == nil {
+		manifest.Objects = map[string]committedEntry{}
+	}
+
+	s.cachedID, s.cached = id, manifest
+	return id, version, manifest, nil
+}
+
+// newCommitID returns a random id prefixed with the current time, so commits sort by their creation
+func newCommitID() (string, error) {
+	suffix, err := randomID()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%016x-%s", time.Now().UnixNano(), suffix[:8]), nil
+}
@@ -0,0 +1,381 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// failingKeyBackend rejects writes of keys ending with suffix
+type failingKeyBackend struct {
+	*DirStorage
+	suffix string
+}
+
+func (b *failingKeyBackend) PutObject(key string, data []byte) error {
+	if strings.HasSuffix(key, b.suffix) {
+		return fmt.Errorf("failing key %s", key)
+	}
+	return b.DirStorage.PutObject(key, data)
+}
+
+// hookBackend runs hook once before the first read or write of a key with prefix
+type hookBackend struct {
+	*DirStorage
+	prefix string
+	hook   func()
+	once   sync.Once
+}
+
+func (b *hookBackend) GetObject(key string) (Object, error) {
+	b.before(key)
+	return b.DirStorage.GetObject(key)
+}
+
+func (b *hookBackend) PutObject(key string, data []byte) error {
+	b.before(key)
+	return b.DirStorage.PutObject(key, data)
+}
+
+func (b *hookBackend) before(key string) {
+	if strings.HasPrefix(key, b.prefix) {
+		b.once.Do(b.hook)
+	}
+}
+
+// conditionalHookBackend runs hook once before the first conditional write of key
+type conditionalHookBackend struct {
+	ConditionalBackend
+	key  string
+	hook func()
+	once sync.Once
+}
+
+func (b *conditionalHookBackend) PutObjectIfVersion(key string, data []byte, version string) error {
+	if key == b.key {
+		b.once.Do(b.hook)
+	}
+	return b.ConditionalBackend.PutObjectIfVersion(key, data, version)
+}
+
+// lostLockBackend is a Locker whose locks can not be refreshed
+type lostLockBackend struct {
+	*DirStorage
+}
+
+type lostLock struct {
+	Lock
+}
+
+func (b *lostLockBackend) Lock(ctx context.Context, name string, ttl time.Duration) (Lock, error) {
+	lock, err := b.DirStorage.Lock(ctx, name, ttl)
+	if err != nil {
+		return nil, err
+	}
+	return &lostLock{Lock: lock}, nil
+}
+
+func (l *lostLock) Refresh(ctx context.Context, ttl time.Duration) error {
+	return ErrLockLost
+}
+
+// staleLockBackend releases its locks right after acquiring them, modelling
+// a holder that has lost its lock without noticing
+type staleLockBackend struct {
+	*hookBackend
+}
+
+type staleLock struct {
+	token int64
+}
+
+func (b *staleLockBackend) Lock(ctx context.Context, name string, ttl time.Duration) (Lock, error) {
+	lock, err := b.DirStorage.Lock(ctx, name, ttl)
+	if err != nil {
+		return nil, err
+	}
+	if err := lock.Unlock(ctx); err != nil {
+		return nil, err
+	}
+	return &staleLock{token: lock.Token()}, nil
+}
+
+func (l *staleLock) Token() int64 {
+	return l.token
+}
+
+func (l *staleLock) Refresh(ctx context.Context, ttl time.Duration) error {
+	return nil
+}
+
+func (l *staleLock) Unlock(ctx context.Context) error {
+	return nil
+}
+
+type BatchTestSuite struct {
+	BackendsTestSuite
+	Dir       *DirStorage
+	Committed *CommittedBackend
+}
+
+func (suite *BatchTestSuite) SetupTest() {
+	dir, err := suite.Fixture.DirStorage(fmt.Sprintf("committed-%s", suite.T().Name()))
+	suite.Nil(err)
+	suite.Dir = dir
+
+	committed, err := NewCommittedBackend(CommittedOptions{Backend: dir})
+	suite.Nil(err)
+	suite.Committed = committed
+}
+
+func (suite *BatchTestSuite) TestBatch() {
+	batch := NewBatch()
+	batch.Put("index.yaml", []byte("v1"))
+	batch.Put("charts/app.tgz", []byte("app"))
+	batch.Delete("index.yaml")
+	batch.Put("index.yaml", []byte("v2"))
+
+	ops := batch.Ops()
+	suite.Len(ops, 2, "later operation on a key replaces the earlier one")
+	suite.Equal(BatchOp{Key: "index.yaml", Data: []byte("v2")}, ops[0])
+}
+
+// commitBatch commits a release and its upgrade with batcher and checks them with reader
+func (suite *BatchTestSuite) commitBatch(batcher Batcher, reader Backend) {
+	ctx := context.Background()
+
+	_, err := reader.GetObject("batch/index.yaml")
+	suite.True(errors.Is(err, os.ErrNotExist), "nothing committed yet")
+
+	release := NewBatch()
+	release.Put("batch/index.yaml", []byte("v1"))
+	release.Put("batch/charts/app-1.0.0.tgz", []byte("app 1"))
+	release.Put("batch/charts/db-1.0.0.tgz", []byte("db 1"))
+	suite.Nil(batcher.CommitBatch(ctx, release))
+
+	index, err := reader.GetObject("batch/index.yaml")
+	suite.Nil(err)
+	suite.Equal([]byte("v1"), index.Data)
+
+	charts, err := reader.ListObjects("batch/charts")
+	suite.Nil(err)
+	suite.Len(charts, 2)
+
+	upgrade := NewBatch()
+	upgrade.Put("batch/index.yaml", []byte("v2"))
+	upgrade.Put("batch/charts/app-2.0.0.tgz", []byte("app 2"))
+	upgrade.Delete("batch/charts/app-1.0.0.tgz")
+	suite.Nil(batcher.CommitBatch(ctx, upgrade))
+
+	charts, err = reader.ListObjects("batch/charts")
+	suite.Nil(err)
+	var paths []string
+	for _, c := range charts {
+		paths = append(paths, c.Path)
+	}
+	suite.ElementsMatch([]string{"app-2.0.0.tgz", "db-1.0.0.tgz"}, paths)
+
+	db, err := reader.GetObject("batch/charts/db-1.0.0.tgz")
+	suite.Nil(err, "objects of earlier commits stay visible")
+	suite.Equal([]byte("db 1"), db.Data)
+}
+
+func (suite *BatchTestSuite) TestCommitBatch() {
+	suite.EachBackend(func(b Backend) bool {
+		_, ok := b.(Batcher)
+		return ok
+	}, func(backend Backend) {
+		suite.commitBatch(backend.(Batcher), backend)
+	})
+}
+
+func (suite *BatchTestSuite) TestCommittedBackend() {
+	suite.EachBackend(nil, func(backend Backend) {
+		committed, err := NewCommittedBackend(CommittedOptions{Backend: backend})
+		_, locker := backend.(Locker)
+		_, conditional := backend.(ConditionalBackend)
+		if !locker && !conditional {
+			suite.NotNil(err, "backend unable to serialize commits rejected")
+			return
+		}
+		suite.Nil(err)
+		suite.commitBatch(committed, committed)
+	})
+}
+
+func (suite *BatchTestSuite) TestCommittedBackendRequiresSerialization() {
+	_, err := NewCommittedBackend(CommittedOptions{Backend: struct{ Backend }{suite.Dir}})
+	suite.NotNil(err, "backend neither Locker nor ConditionalBackend rejected")
+}
+
+func (suite *BatchTestSuite) TestCommittedCleanup() {
+	var batcher Batcher = suite.Committed
+	ctx := context.Background()
+
+	release := NewBatch()
+	release.Put("index.yaml", []byte("v1"))
+	release.Put("charts/app-1.0.0.tgz", []byte("app 1"))
+	release.Put("charts/db-1.0.0.tgz", []byte("db 1"))
+	suite.Nil(batcher.CommitBatch(ctx, release))
+
+	upgrade := NewBatch()
+	upgrade.Put("index.yaml", []byte("v2"))
+	upgrade.Put("charts/app-2.0.0.tgz", []byte("app 2"))
+	upgrade.Delete("charts/app-1.0.0.tgz")
+	suite.Nil(batcher.CommitBatch(ctx, upgrade))
+
+	charts, err := suite.Committed.ListObjects("charts")
+	suite.Nil(err)
+	suite.Len(charts, 2)
+	suite.Equal("app-2.0.0.tgz", charts[0].Path)
+	suite.Equal("db-1.0.0.tgz", charts[1].Path)
+
+	db, err := suite.Committed.GetObject("charts/db-1.0.0.tgz")
+	suite.Nil(err)
+
+	manifests, err := suite.Dir.ListObjects(committedManifestsPrefix)
+	suite.Nil(err)
+	suite.Len(manifests, 1, "superseded manifest removed")
+
+	first := db.Meta.Version
+	superseded, err := suite.Dir.ListObjects(path.Join(committedObjectsPrefix, first, "charts"))
+	suite.Nil(err)
+	suite.Len(superseded, 1, "superseded objects removed")
+	suite.Equal("db-1.0.0.tgz", superseded[0].Path)
+}
+
+func (suite *BatchTestSuite) TestCommitBatchRollback() {
+	ctx := context.Background()
+	suite.Nil(suite.Committed.PutObject("index.yaml", []byte("v1")))
+
+	failing, err := NewCommittedBackend(CommittedOptions{
+		Backend: &failingKeyBackend{DirStorage: suite.Dir, suffix: "broken.tgz"},
+	})
+	suite.Nil(err)
+
+	batch := NewBatch()
+	batch.Put("index.yaml", []byte("v2"))
+	batch.Put("charts/app.tgz", []byte("app"))
+	batch.Put("charts/broken.tgz", []byte("broken"))
+	suite.NotNil(failing.CommitBatch(ctx, batch))
+
+	index, err := failing.GetObject("index.yaml")
+	suite.Nil(err)
+	suite.Equal([]byte("v1"), index.Data, "failed commit is not visible")
+
+	charts, err := failing.ListObjects("charts")
+	suite.Nil(err)
+	suite.Empty(charts)
+
+	for _, dir := range []string{committedObjectsPrefix, committedManifestsPrefix} {
+		entries, err := os.ReadDir(path.Join(suite.Dir.rootDir, dir))
+		suite.Nil(err)
+		for _, e := range entries {
+			if !e.IsDir() {
+				continue
+			}
+			staged, err := suite.Dir.ListObjects(path.Join(dir, e.Name(), "charts"))
+			suite.Nil(err)
+			suite.Empty(staged, "staged objects of failed commit removed")
+		}
+	}
+
+	manifests, err := suite.Dir.ListObjects(committedManifestsPrefix)
+	suite.Nil(err)
+	suite.Len(manifests, 1, "manifest of failed commit not written")
+}
+
+func (suite *BatchTestSuite) TestCommitBatchLockLost() {
+	suite.Nil(suite.Committed.PutObject("index.yaml", []byte("v1")))
+
+	lost, err := NewCommittedBackend(CommittedOptions{
+		Backend: &lostLockBackend{DirStorage: suite.Dir},
+		LockTTL: 30 * time.Millisecond,
+	})
+	suite.Nil(err)
+
+	err = lost.PutObject("index.yaml", []byte("v2"))
+	suite.True(errors.Is(err, ErrLockLost), "commit without the lock fails")
+
+	index, err := suite.Committed.GetObject("index.yaml")
+	suite.Nil(err)
+	suite.Equal([]byte("v1"), index.Data, "HEAD not switched by commit without the lock")
+}
+
+func (suite *BatchTestSuite) TestCommitBatchHeadMoved() {
+	suite.Nil(suite.Committed.PutObject("index.yaml", []byte("v1")))
+
+	// another process takes the lock and commits while the batch is staged
+	concurrent, err := NewCommittedBackend(CommittedOptions{
+		Backend: &staleLockBackend{hookBackend: &hookBackend{DirStorage: suite.Dir, prefix: committedObjectsPrefix + "/", hook: func() {
+			suite.Nil(suite.Committed.PutObject("index.yaml", []byte("v2")))
+		}}},
+	})
+	suite.Nil(err)
+
+	err = concurrent.PutObject("charts/app.tgz", []byte("app"))
+	suite.True(errors.Is(err, ErrLockLost), "commit on a superseded HEAD fails")
+
+	index, err := suite.Committed.GetObject("index.yaml")
+	suite.Nil(err)
+	suite.Equal([]byte("v2"), index.Data, "concurrent commit not lost")
+	_, err = suite.Committed.GetObject("charts/app.tgz")
+	suite.True(errors.Is(err, os.ErrNotExist))
+}
+
+func (suite *BatchTestSuite) TestCommitBatchConditionalHead() {
+	db, err := openSQLiteDB(suite.Fixture.Path(fmt.Sprintf("committed-%s.db", strings.ReplaceAll(suite.T().Name(), "/", "-"))))
+	suite.Nil(err)
+	defer db.Close()
+	backend, err := NewSQLStorage(SQLOptions{DB: db, Dialect: "sqlite"})
+	suite.Nil(err)
+
+	committed, err := NewCommittedBackend(CommittedOptions{Backend: backend})
+	suite.Nil(err)
+	suite.Nil(committed.PutObject("index.yaml", []byte("v1")))
+
+	// another process switches HEAD after the batch has checked it
+	concurrent, err := NewCommittedBackend(CommittedOptions{
+		Backend: &conditionalHookBackend{ConditionalBackend: backend, key: committedHeadKey, hook: func() {
+			suite.Nil(committed.PutObject("index.yaml", []byte("v2")))
+		}},
+	})
+	suite.Nil(err)
+
+	err = concurrent.PutObject("charts/app.tgz", []byte("app"))
+	suite.True(errors.Is(err, ErrLockLost), "conditional switch of a moved HEAD fails")
+
+	index, err := committed.GetObject("index.yaml")
+	suite.Nil(err)
+	suite.Equal([]byte("v2"), index.Data, "concurrent commit not lost")
+	_, err = committed.GetObject("charts/app.tgz")
+	suite.True(errors.Is(err, os.ErrNotExist))
+}
+
+func (suite *BatchTestSuite) TestCommittedManifestRemoved() {
+	suite.Nil(suite.Committed.PutObject("index.yaml", []byte("v1")))
+
+	// a commit removes the manifest between the reads of HEAD and the manifest
+	reader, err := NewCommittedBackend(CommittedOptions{
+		Backend: &hookBackend{DirStorage: suite.Dir, prefix: committedManifestsPrefix + "/", hook: func() {
+			suite.Nil(suite.Committed.PutObject("index.yaml", []byte("v2")))
+		}},
+	})
+	suite.Nil(err)
+
+	index, err := reader.GetObject("index.yaml")
+	suite.Nil(err, "manifest read retried on the new HEAD")
+	suite.Equal([]byte("v2"), index.Data)
+}
+
+func TestBatchTestSuite(t *testing.T) {
+	suite.Run(t, &BatchTestSuite{BackendsTestSuite: BackendsTestSuite{Name: "batch"}})
+}
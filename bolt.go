@@ -0,0 +1,388 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// DefaultBoltTimeout is how long opening a database waits for the file lock held by another process
+const DefaultBoltTimeout = 5 * time.Second
+
+var (
+	// boltRootBucket holds buckets of the top level prefix
+	boltRootBucket = []byte("objects")
+	// boltMetaBucket is nested in every prefix bucket and holds metadata of its objects,
+	// keys can not contain NUL bytes, so it never clashes with a prefix bucket
+	boltMetaBucket = []byte("\x00meta")
+)
+
+// boltObjectMeta is stored in the metadata bucket under the object name
+type boltObjectMeta struct {
+	Modified    time.Time         `json:"modified"`
+	ContentType string            `json:"content_type,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	Checksum    string            `json:"sha256,omitempty"`
+}
+
+type BoltOptions struct {
+	Logger *zap.SugaredLogger
+	// Path of the database file, created if it does not exist
+	Path string
+	// FileMode of a created database file. Defaults to DefaultDirFileMode
+	FileMode os.FileMode
+	// Timeout of waiting for the database file lock. Defaults to DefaultBoltTimeout
+	Timeout time.Duration
+}
+
+// BoltStorage stores objects in a bbolt database file with a nested bucket per prefix,
+// so listing a prefix scans its objects only. A database file can be opened by a single process at a time
+type BoltStorage struct {
+	logger *zap.SugaredLogger
+	DB     *bolt.DB
+}
+
+func NewBoltStorage(opts BoltOptions) (*BoltStorage, error) {
+	if opts.Logger == nil {
+		opts.Logger = zap.S()
+	}
+
+	if opts.Path == "" {
+		return nil, fmt.Errorf("bolt database path must be specified")
+	}
+	if opts.FileMode == 0 {
+		opts.FileMode = DefaultDirFileMode
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = DefaultBoltTimeout
+	}
+
+	if err := os.MkdirAll(path.Dir(opts.Path), DefaultDirMode); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(opts.Path, opts.FileMode, &bolt.Options{Timeout: opts.Timeout})
+	if err != nil {
+		return nil, fmt.Errorf("unable to open bolt database %s: %w", opts.Path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltRootBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltStorage{
+		logger: opts.Logger,
+		DB:     db,
+	}, nil
+}
+
+// Close releases the database file
+func (s *BoltStorage) Close() error {
+	return s.DB.Close()
+}
+
+func (s *BoltStorage) ListObjects(prefix string) ([]Object, error) {
+	var objects []Object
+	prefix, err := defaultKeyRules.validatePrefix(prefix)
+	if err != nil {
+		return objects, err
+	}
+
+	err = s.DB.View(func(tx *bolt.Tx) error {
+		bucket := boltPrefixBucket(tx, prefix)
+		if bucket == nil {
+			return nil
+		}
+
+		meta := bucket.Bucket(boltMetaBucket)
+		return bucket.ForEach(func(name, value []byte) error {
+			// nested prefix buckets have nil values
+			if value == nil {
+				return nil
+			}
+			objects = append(objects, Object{
+				Path:         string(name),
+				Data:         []byte{},
+				LastModified: boltReadMeta(meta, name).Modified,
+			})
+			return nil
+		})
+	})
+	return objects, err
+}
+
+func (s *BoltStorage) GetObject(key string) (Object, error) {
+	object, err := s.getObject(key, true)
+	if err != nil {
+		return object, err
+	}
+
+	checksum, err := objectChecksum(object.Path, object.Data, object.Meta.Checksum)
+	if err != nil {
+		return Object{Path: key}, err
+	}
+	object.Meta.Checksum = checksum
+	return object, nil
+}
+
+// StatObject returns object metadata without reading the data
+func (s *BoltStorage) StatObject(key string) (Object, error) {
+	return s.getObject(key, false)
+}
+
+func (s *BoltStorage) getObject(key string, withData bool) (Object, error) {
+	object := Object{Path: key, Data: []byte{}}
+	normalized, err := defaultKeyRules.validate(key)
+	if err != nil {
+		return object, err
+	}
+
+	dir, name := boltSplitKey(normalized)
+	err = s.DB.View(func(tx *bolt.Tx) error {
+		bucket := boltPrefixBucket(tx, dir)
+		var value []byte
+		if bucket != nil {
+			value = bucket.Get(name)
+		}
+		if value == nil {
+			return &os.PathError{Op: "open", Path: normalized, Err: os.ErrNotExist}
+		}
+
+		meta := boltReadMeta(bucket.Bucket(boltMetaBucket), name)
+		if withData {
+			// values are only valid for the life of the transaction
+			object.Data = append([]byte{}, value...)
+		}
+		object.Meta = Metadata{
+			Name:         path.Base(normalized),
+			ContentType:  meta.ContentType,
+			UserMetadata: meta.Metadata,
+			Checksum:     meta.Checksum,
+		}
+		object.LastModified = meta.Modified
+		return nil
+	})
+	return object, err
+}
+
+func (s *BoltStorage) PutObject(key string, data []byte) error {
+	return s.putObject(key, data, boltObjectMeta{})
+}
+
+// PutObjectWithMetadata writes an object with content type, user metadata and SHA-256 checksum
+// stored in the metadata bucket in the same transaction
+func (s *BoltStorage) PutObjectWithMetadata(key string, data []byte, meta Metadata) error {
+	checksum, err := objectChecksum(key, data, meta.Checksum)
+	if err != nil {
+		return err
+	}
+	return s.putObject(key, data, boltObjectMeta{
+		ContentType: meta.ContentType,
+		Metadata:    meta.UserMetadata,
+		Checksum:    checksum,
+	})
+}
+
+func (s *BoltStorage) putObject(key string, data []byte, meta boltObjectMeta) error {
+	key, err := defaultKeyRules.validate(key)
+	if err != nil {
+		return err
+	}
+
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		return boltPut(tx, key, data, meta)
+	})
+}
+
+func (s *BoltStorage) DeleteObject(key string) error {
+	key, err := defaultKeyRules.validate(key)
+	if err != nil {
+		return err
+	}
+
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		deleted, err := boltDelete(tx, key)
+		if err == nil && !deleted {
+			err = &os.PathError{Op: "remove", Path: key, Err: os.ErrNotExist}
+		}
+		return err
+	})
+}
+
+// DeletePrefix removes the prefix bucket with all the nested ones
+func (s *BoltStorage) DeletePrefix(prefix string) error {
+	prefix, err := defaultKeyRules.validate(prefix)
+	if err != nil {
+		return err
+	}
+
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		dir, name := boltSplitKey(prefix)
+		parent := boltPrefixBucket(tx, dir)
+		if parent == nil || parent.Bucket(name) == nil {
+			return nil
+		}
+		if err := parent.DeleteBucket(name); err != nil {
+			return err
+		}
+		boltPrune(tx, dir)
+		return nil
+	})
+}
+
+// CommitBatch applies the batch in a single transaction,
+// deletes of missing objects are ignored
+func (s *BoltStorage) CommitBatch(ctx context.Context, batch *Batch) error {
+	batch, err := defaultKeyRules.validateBatch(batch)
+	if err != nil {
+		return err
+	}
+
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		for _, op := range batch.Ops() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			if op.Delete {
+				if _, err := boltDelete(tx, op.Key); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := boltPut(tx, op.Key, op.Data, boltObjectMeta{}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Watch polls objects at prefix every DefaultPollInterval
+func (s *BoltStorage) Watch(ctx context.Context, prefix string) <-chan Event {
+	return PollObjects(ctx, s, prefix, DefaultPollInterval)
+}
+
+// boltPut writes object data and metadata creating missing prefix buckets,
+// a prefix bucket can not be created where an object of the same name exists and vice versa
+func boltPut(tx *bolt.Tx, key string, data []byte, meta boltObjectMeta) error {
+	dir, name := boltSplitKey(key)
+	bucket := tx.Bucket(boltRootBucket)
+	if dir != "" {
+		for _, segment := range strings.Split(dir, "/") {
+			var err error
+			bucket, err = bucket.CreateBucketIfNotExists([]byte(segment))
+			if err != nil {
+				return fmt.Errorf("unable to create bucket of %s: %w", key, err)
+			}
+		}
+	}
+
+	metaBucket, err := bucket.CreateBucketIfNotExists(boltMetaBucket)
+	if err != nil {
+		return err
+	}
+
+	meta.Modified = time.Now().UTC()
+	encoded, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	// bbolt does not accept nil values, they mark buckets
+	if data == nil {
+		data = []byte{}
+	}
+	if err := bucket.Put(name, data); err != nil {
+		return fmt.Errorf("unable to put %s: %w", key, err)
+	}
+	return metaBucket.Put(name, encoded)
+}
+
+// boltDelete removes an object with its metadata and prunes prefix buckets left empty
+func boltDelete(tx *bolt.Tx, key string) (bool, error) {
+	dir, name := boltSplitKey(key)
+	bucket := boltPrefixBucket(tx, dir)
+	if bucket == nil || bucket.Get(name) == nil {
+		return false, nil
+	}
+
+	if err := bucket.Delete(name); err != nil {
+		return false, err
+	}
+	if meta := bucket.Bucket(boltMetaBucket); meta != nil {
+		if err := meta.Delete(name); err != nil {
+			return false, err
+		}
+	}
+	boltPrune(tx, dir)
+	return true, nil
+}
+
+// boltPrune removes empty prefix buckets from dir up to the root bucket
+func boltPrune(tx *bolt.Tx, dir string) {
+	for dir != "" {
+		bucket := boltPrefixBucket(tx, dir)
+		if bucket == nil || !boltBucketEmpty(bucket) {
+			return
+		}
+
+		parent, name := boltSplitKey(dir)
+		if err := boltPrefixBucket(tx, parent).DeleteBucket(name); err != nil {
+			return
+		}
+		dir = parent
+	}
+}
+
+// boltBucketEmpty reports whether a prefix bucket holds nothing but its metadata bucket
+func boltBucketEmpty(bucket *bolt.Bucket) bool {
+	c := bucket.Cursor()
+	for name, _ := c.First(); name != nil; name, _ = c.Next() {
+		if !bytes.Equal(name, boltMetaBucket) {
+			return false
+		}
+	}
+	return true
+}
+
+// boltPrefixBucket returns the bucket of a normalized prefix, nil if it does not exist
+func boltPrefixBucket(tx *bolt.Tx, prefix string) *bolt.Bucket {
+	bucket := tx.Bucket(boltRootBucket)
+	if prefix == "" {
+		return bucket
+	}
+	for _, segment := range strings.Split(prefix, "/") {
+		if bucket = bucket.Bucket([]byte(segment)); bucket == nil {
+			return nil
+		}
+	}
+	return bucket
+}
+
+func boltReadMeta(bucket *bolt.Bucket, name []byte) boltObjectMeta {
+	var meta boltObjectMeta
+	if bucket != nil {
+		if encoded := bucket.Get(name); encoded != nil {
+			json.Unmarshal(encoded, &meta)
+		}
+	}
+	return meta
+}
+
+// boltSplitKey splits a normalized key into its prefix and name
+func boltSplitKey(key string) (string, []byte) {
+	dir, name := path.Split(key)
+	return strings.TrimSuffix(dir, "/"), []byte(name)
+}
@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	bolt "go.etcd.io/bbolt"
+)
+
+type BoltTestSuite struct {
+	suite.Suite
+	Fixture *testFixture
+	Backend *BoltStorage
+}
+
+func (suite *BoltTestSuite) SetupTest() {
+	suite.Fixture = newTestFixture("bolt")
+	backend, err := NewBoltStorage(BoltOptions{Path: path.Join(suite.Fixture.Dir, "storage.db")})
+	suite.Nil(err)
+	suite.Backend = backend
+}
+
+func (suite *BoltTestSuite) TearDownTest() {
+	suite.Backend.Close()
+	suite.Fixture.Close()
+}
+
+func (suite *BoltTestSuite) TestPutGetObject() {
+	suite.Nil(suite.Backend.PutObject("charts/index.yaml", []byte("apiVersion: v1")))
+
+	object, err := suite.Backend.GetObject("charts/index.yaml")
+	suite.Nil(err)
+	suite.Equal([]byte("apiVersion: v1"), object.Data)
+	suite.Equal("index.yaml", object.Meta.Name)
+	suite.WithinDuration(time.Now(), object.LastModified, time.Second)
+
+	suite.Nil(suite.Backend.PutObject("charts/empty.txt", nil))
+	object, err = suite.Backend.GetObject("charts/empty.txt")
+	suite.Nil(err, "empty objects are stored")
+	suite.Empty(object.Data)
+
+	_, err = suite.Backend.GetObject("charts")
+	suite.True(os.IsNotExist(err), "prefix is not an object")
+
+	err = suite.Backend.PutObject("charts/index.yaml/nested", []byte{})
+	suite.NotNil(err, "object can not be a prefix")
+}
+
+func (suite *BoltTestSuite) TestPersistence() {
+	suite.Nil(suite.Backend.PutObject("index.yaml", []byte("apiVersion: v1")))
+	suite.Nil(suite.Backend.Close())
+
+	backend, err := NewBoltStorage(BoltOptions{Path: path.Join(suite.Fixture.Dir, "storage.db")})
+	suite.Nil(err)
+	suite.Backend = backend
+
+	object, err := suite.Backend.GetObject("index.yaml")
+	suite.Nil(err, "object persisted after reopening the database")
+	suite.Equal([]byte("apiVersion: v1"), object.Data)
+}
+
+func (suite *BoltTestSuite) TestListObjects() {
+	objects, err := suite.Backend.ListObjects("missing")
+	suite.Nil(err)
+	suite.Empty(objects)
+
+	for _, key := range []string{"b.txt", "a.txt", "nested/c.txt", "nested/deeper/d.txt"} {
+		suite.Nil(suite.Backend.PutObject(key, []byte(key)))
+	}
+
+	objects, err = suite.Backend.ListObjects("")
+	suite.Nil(err)
+	suite.Len(objects, 2, "nested prefixes are not listed")
+	suite.Equal("a.txt", objects[0].Path)
+	suite.Equal("b.txt", objects[1].Path)
+	suite.False(objects[0].LastModified.IsZero())
+
+	objects, err = suite.Backend.ListObjects("nested")
+	suite.Nil(err)
+	suite.Len(objects, 1)
+	suite.Equal("c.txt", objects[0].Path)
+}
+
+func (suite *BoltTestSuite) TestObjectMetadata() {
+	suite.Nil(suite.Backend.PutObjectWithMetadata("chart.tgz", []byte("chart"), Metadata{
+		ContentType:  "application/gzip",
+		UserMetadata: map[string]string{"owner": "ops"},
+	}))
+
+	object, err := suite.Backend.StatObject("chart.tgz")
+	suite.Nil(err)
+	suite.Empty(object.Data)
+	suite.Equal("application/gzip", object.Meta.ContentType)
+	suite.Equal(map[string]string{"owner": "ops"}, object.Meta.UserMetadata)
+	suite.Equal(sha256Digest([]byte("chart")), object.Meta.Checksum)
+
+	suite.Nil(suite.Backend.DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltRootBucket).Put([]byte("chart.tgz"), []byte("tampered"))
+	}))
+	_, err = suite.Backend.GetObject("chart.tgz")
+	var mismatch *DigestMismatchError
+	suite.True(errors.As(err, &mismatch), "stored checksum is verified")
+}
+
+func (suite *BoltTestSuite) TestDeleteObject() {
+	suite.Nil(suite.Backend.PutObject("nested/deeper/deleteme.txt", []byte("content")))
+	suite.Nil(suite.Backend.DeleteObject("nested/deeper/deleteme.txt"))
+
+	_, err := suite.Backend.GetObject("nested/deeper/deleteme.txt")
+	suite.True(os.IsNotExist(err))
+
+	suite.Nil(suite.Backend.DB.View(func(tx *bolt.Tx) error {
+		suite.Nil(tx.Bucket(boltRootBucket).Bucket([]byte("nested")), "empty prefix buckets removed")
+		return nil
+	}))
+
+	err = suite.Backend.DeleteObject("nested/deeper/deleteme.txt")
+	suite.True(os.IsNotExist(err))
+}
+
+func (suite *BoltTestSuite) TestDeletePrefix() {
+	suite.Nil(suite.Backend.PutObject("charts/a.tgz", []byte("a")))
+	suite.Nil(suite.Backend.PutObject("charts/nested/b.tgz", []byte("b")))
+	suite.Nil(suite.Backend.PutObject("chartsmuseum.txt", []byte("c")))
+
+	suite.Nil(suite.Backend.DeletePrefix("charts"))
+
+	_, err := suite.Backend.GetObject("charts/nested/b.tgz")
+	suite.True(os.IsNotExist(err))
+	_, err = suite.Backend.GetObject("chartsmuseum.txt")
+	suite.Nil(err)
+
+	suite.True(errors.Is(suite.Backend.DeletePrefix(""), ErrInvalidKey))
+}
+
+func (suite *BoltTestSuite) TestCommitBatch() {
+	suite.Nil(suite.Backend.PutObject("old.txt", []byte("old")))
+
+	batch := NewBatch()
+	batch.Put("charts/a.tgz", []byte("a"))
+	batch.Put("charts/b.tgz", []byte("b"))
+	batch.Delete("old.txt")
+	batch.Delete("missing.txt")
+	suite.Nil(suite.Backend.CommitBatch(context.Background(), batch))
+
+	objects, err := suite.Backend.ListObjects("charts")
+	suite.Nil(err)
+	suite.Len(objects, 2)
+	_, err = suite.Backend.GetObject("old.txt")
+	suite.True(os.IsNotExist(err))
+
+	batch = NewBatch()
+	batch.Put("charts/c.tgz", []byte("c"))
+	batch.Put("charts/a.tgz/nested", []byte("conflicts with an object"))
+	suite.NotNil(suite.Backend.CommitBatch(context.Background(), batch))
+
+	_, err = suite.Backend.GetObject("charts/c.tgz")
+	suite.True(os.IsNotExist(err), "failed batch is rolled back")
+}
+
+func TestBoltStorageTestSuite(t *testing.T) {
+	suite.Run(t, new(BoltTestSuite))
+}
@@ -0,0 +1,259 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+const (
+	casBlobsPrefix    = "blobs"
+	casRefsPrefix     = "refs"
+	casBackrefsPrefix = "backrefs"
+)
+
+// DigestMismatchError is returned when a blob content does not match the digest it is referenced by
+type DigestMismatchError struct {
+	Key      string
+	Expected string
+	Actual   string
+}
+
+func (e *DigestMismatchError) Error() string {
+	return fmt.Sprintf("digest mismatch for %s: expected sha256:%s, got sha256:%s", e.Key, e.Expected, e.Actual)
+}
+
+type CASOptions struct {
+	Logger  *zap.SugaredLogger
+	Backend Backend
+}
+
+// CASBackend stores object contents once per SHA-256 digest.
+// Layout of the underlying backend:
+//
+//	blobs/<digest>                  object contents
+//	refs/<key>                      digest of the object stored under key
+//	backrefs/<digest>/<sha256(key)> marker of a key referencing the blob
+//
+// Blobs are written before references, so an interrupted write may leave an unreferenced blob
+// for GarbageCollect, but never a reference to a missing blob
+type CASBackend struct {
+	logger  *zap.SugaredLogger
+	backend Backend
+
+	// mu serializes writes with garbage collection within the process,
+	// GarbageCollect must not run concurrently with writers from other processes
+	mu sync.Mutex
+}
+
+func NewCASBackend(opts CASOptions) (*CASBackend, error) {
+	if opts.Backend == nil {
+		return nil, fmt.Errorf("backend must be specified")
+	}
+
+	if opts.Logger == nil {
+		opts.Logger = zap.S()
+	}
+
+	return &CASBackend{
+		logger:  opts.Logger,
+		backend: opts.Backend,
+	}, nil
+}
+
+// GetObject reads the blob referenced by key and verifies its digest
+func (s *CASBackend) GetObject(key string) (Object, error) {
+	normalized, err := defaultKeyRules.validate(key)
+	if err != nil {
+		return Object{Path: key}, err
+	}
+	key = normalized
+
+	ref, err := s.backend.GetObject(path.Join(casRefsPrefix, key))
+	if err != nil {
+		return Object{Path: key}, err
+	}
+	digest := strings.TrimSpace(string(ref.Data))
+
+	blob, err := s.backend.GetObject(path.Join(casBlobsPrefix, digest))
+	if err != nil {
+		return Object{Path: key}, err
+	}
+
+	if actual := sha256Digest(blob.Data); actual != digest {
+		return Object{Path: key}, &DigestMismatchError{
+			Key:      key,
+			Expected: digest,
+			Actual:   actual,
+		}
+	}
+
+	return Object{
+		Meta: Metadata{
+			Name:    path.Base(key),
+			Version: "sha256:" + digest,
+		},
+		Path:         key,
+		Data:         blob.Data,
+		LastModified: ref.LastModified,
+	}, nil
+}
+
+func (s *CASBackend) ListObjects(prefix string) ([]Object, error) {
+	prefix, err := defaultKeyRules.validatePrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	refs, err := s.backend.ListObjects(path.Join(casRefsPrefix, prefix))
+	if err != nil {
+		return nil, err
+	}
+
+	objects := make([]Object, 0, len(refs))
+	for _, ref := range refs {
+		objects = append(objects, Object{
+			Path:         ref.Path,
+			LastModified: ref.LastModified,
+		})
+	}
+	return objects, nil
+}
+
+// PutObject stores data as a blob unless a blob with the same digest already exists,
+// and points key at it
+func (s *CASBackend) PutObject(key string, data []byte) error {
+	key, err := defaultKeyRules.validate(key)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	digest := sha256Digest(data)
+	previous, _ := s.backend.GetObject(path.Join(casRefsPrefix, key))
+	previousDigest := strings.TrimSpace(string(previous.Data))
+
+	exists, err := s.blobExists(digest)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if err := s.backend.PutObject(path.Join(casBlobsPrefix, digest), data); err != nil {
+			return err
+		}
+	}
+
+	if err := s.backend.PutObject(s.backrefKey(digest, key), []byte(key)); err != nil {
+		return err
+	}
+	if err := s.backend.PutObject(path.Join(casRefsPrefix, key), []byte(digest)); err != nil {
+		return err
+	}
+
+	if previousDigest != "" && previousDigest != digest {
+		if err := s.backend.DeleteObject(s.backrefKey(previousDigest, key)); err != nil {
+			s.logger.Warnf("Unable to remove %s reference to blob %s: %s", key, previousDigest, err)
+		}
+	}
+
+	return nil
+}
+
+// DeleteObject removes the key reference, the blob is left for GarbageCollect
+func (s *CASBackend) DeleteObject(key string) error {
+	key, err := defaultKeyRules.validate(key)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ref, err := s.backend.GetObject(path.Join(casRefsPrefix, key))
+	if err != nil {
+		return err
+	}
+	digest := strings.TrimSpace(string(ref.Data))
+
+	if err := s.backend.DeleteObject(path.Join(casRefsPrefix, key)); err != nil {
+		return err
+	}
+
+	return s.backend.DeleteObject(s.backrefKey(digest, key))
+}
+
+// References returns the number of keys referencing a blob
+func (s *CASBackend) References(digest string) (int, error) {
+	refs, err := s.backend.ListObjects(path.Join(casBackrefsPrefix, digest))
+	if err != nil {
+		return 0, err
+	}
+	return len(refs), nil
+}
+
+// GarbageCollect removes blobs that are not referenced by any key
+// and returns their digests
+func (s *CASBackend) GarbageCollect() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	blobs, err := s.backend.ListObjects(casBlobsPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	for _, blob := range blobs {
+		refs, err := s.References(blob.Path)
+		if err != nil {
+			return removed, err
+		}
+		if refs > 0 {
+			continue
+		}
+
+		if err := s.backend.DeleteObject(path.Join(casBlobsPrefix, blob.Path)); err != nil {
+			return removed, err
+		}
+		s.logger.Debugf("Removed unreferenced blob %s", blob.Path)
+		removed = append(removed, blob.Path)
+	}
+
+	return removed, nil
+}
+
+// blobExists checks the blob itself rather than its backrefs,
+// which may outlive the blob after an interrupted garbage collection
+func (s *CASBackend) blobExists(digest string) (bool, error) {
+	var err error
+	if backend, ok := s.backend.(MetadataBackend); ok {
+		_, err = backend.StatObject(path.Join(casBlobsPrefix, digest))
+	} else {
+		_, err = s.backend.GetObject(path.Join(casBlobsPrefix, digest))
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *CASBackend) backrefKey(digest string, key string) string {
+	return path.Join(casBackrefsPrefix, digest, sha256Digest([]byte(key)))
+}
+
+func sha256Digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type CASTestSuite struct {
+	BackendsTestSuite
+	Dir *DirStorage
+	CAS *CASBackend
+}
+
+func (suite *CASTestSuite) SetupTest() {
+	dir, err := suite.Fixture.DirStorage(suite.T().Name())
+	suite.Nil(err)
+	suite.Dir = dir
+
+	cas, err := NewCASBackend(CASOptions{Backend: dir})
+	suite.Nil(err)
+	suite.CAS = cas
+}
+
+func (suite *CASTestSuite) TestDeduplication() {
+	data := []byte("dependency tarball")
+	digest := sha256Digest(data)
+	suite.Nil(suite.CAS.PutObject("app1/dep.tgz", data))
+	suite.Nil(suite.CAS.PutObject("app2/dep.tgz", data))
+
+	blobs, err := suite.Dir.ListObjects(casBlobsPrefix)
+	suite.Nil(err)
+	suite.Len(blobs, 1, "same content stored once")
+
+	refs, err := suite.CAS.References(digest)
+	suite.Nil(err)
+	suite.Equal(2, refs, "blob referenced by both keys")
+
+	object, err := suite.CAS.GetObject("app2/dep.tgz")
+	suite.Nil(err)
+	suite.Equal(data, object.Data)
+	suite.Equal("sha256:"+digest, object.Meta.Version)
+
+	objects, err := suite.CAS.ListObjects("app1")
+	suite.Nil(err)
+	suite.Len(objects, 1)
+	suite.Equal("dep.tgz", objects[0].Path)
+	suite.Empty(objects[0].Data, "listing does not expose digests")
+}
+
+func (suite *CASTestSuite) TestMissingBlobRewritten() {
+	data := []byte("dependency tarball")
+	suite.Nil(suite.CAS.PutObject("app1/dep.tgz", data))
+	// emulate a blob removed by an interrupted garbage collection
+	suite.Nil(suite.Dir.DeleteObject(casBlobsPrefix + "/" + sha256Digest(data)))
+
+	suite.Nil(suite.CAS.PutObject("app2/dep.tgz", data))
+	object, err := suite.CAS.GetObject("app2/dep.tgz")
+	suite.Nil(err, "missing blob written despite existing backrefs")
+	suite.Equal(data, object.Data)
+}
+
+func (suite *CASTestSuite) TestGarbageCollect() {
+	data := []byte("dependency tarball")
+	digest := sha256Digest(data)
+	suite.Nil(suite.CAS.PutObject("app1/dep.tgz", data))
+	suite.Nil(suite.CAS.PutObject("app2/dep.tgz", data))
+
+	suite.Nil(suite.CAS.DeleteObject("app1/dep.tgz"))
+	removed, err := suite.CAS.GarbageCollect()
+	suite.Nil(err)
+	suite.Empty(removed, "referenced blob kept")
+
+	suite.Nil(suite.CAS.PutObject("app2/dep.tgz", []byte("updated tarball")))
+	removed, err = suite.CAS.GarbageCollect()
+	suite.Nil(err)
+	suite.Equal([]string{digest}, removed, "blob unreferenced by overwrite removed")
+
+	object, err := suite.CAS.GetObject("app2/dep.tgz")
+	suite.Nil(err)
+	suite.Equal([]byte("updated tarball"), object.Data)
+
+	_, err = suite.CAS.GetObject("app1/dep.tgz")
+	suite.NotNil(err, "deleted key not found")
+}
+
+func (suite *CASTestSuite) TestDigestMismatch() {
+	data := []byte("dependency tarball")
+	suite.Nil(suite.CAS.PutObject("dep.tgz", data))
+	suite.Nil(suite.Dir.PutObject(casBlobsPrefix+"/"+sha256Digest(data), []byte("tampered")))
+
+	_, err := suite.CAS.GetObject("dep.tgz")
+	var mismatch *DigestMismatchError
+	suite.True(errors.As(err, &mismatch), "digest verified on read")
+	suite.Equal(sha256Digest(data), mismatch.Expected)
+}
+
+func (suite *CASTestSuite) TestBackends() {
+	suite.EachBackend(nil, func(backend Backend) {
+		cas, err := NewCASBackend(CASOptions{Backend: backend})
+		suite.Nil(err)
+
+		data := []byte("shared layer")
+		suite.Nil(cas.PutObject("cas/app1/layer.tgz", data))
+		suite.Nil(cas.PutObject("cas/app2/layer.tgz", data))
+
+		refs, err := cas.References(sha256Digest(data))
+		suite.Nil(err)
+		suite.Equal(2, refs)
+
+		object, err := cas.GetObject("cas/app2/layer.tgz")
+		suite.Nil(err)
+		suite.Equal(data, object.Data)
+
+		objects, err := cas.ListObjects("cas/app1")
+		suite.Nil(err)
+		suite.Len(objects, 1)
+
+		suite.Nil(cas.DeleteObject("cas/app1/layer.tgz"))
+		_, err = cas.GetObject("cas/app1/layer.tgz")
+		suite.True(errors.Is(err, os.ErrNotExist))
+	})
+}
+
+// TestGCS stores blobs on GCS, whose client reports missing objects with its own error
+func (suite *CASTestSuite) TestGCS() {
+	server := newFakeGCSServer()
+	defer server.Close()
+	gcs, err := newFakeGCSStorage(server, "")
+	suite.Require().Nil(err)
+	cas, err := NewCASBackend(CASOptions{Backend: gcs})
+	suite.Nil(err)
+
+	data := []byte("dependency tarball")
+	suite.Nil(cas.PutObject("app1/dep.tgz", data), "new blob written")
+	suite.Nil(cas.PutObject("app2/dep.tgz", data), "existing blob referenced")
+	blobs, err := gcs.ListObjects(casBlobsPrefix)
+	suite.Nil(err)
+	suite.Len(blobs, 1, "same content stored once")
+
+	suite.Nil(gcs.DeleteObject(casBlobsPrefix + "/" + sha256Digest(data)))
+	suite.Nil(cas.PutObject("app3/dep.tgz", data), "missing blob written")
+	object, err := cas.GetObject("app1/dep.tgz")
+	suite.Nil(err)
+	suite.Equal(data, object.Data)
+
+	_, err = cas.GetObject("missing.tgz")
+	suite.True(errors.Is(err, os.ErrNotExist))
+}
+
+func TestCASTestSuite(t *testing.T) {
+	suite.Run(t, &CASTestSuite{BackendsTestSuite: BackendsTestSuite{Name: "cas"}})
+}
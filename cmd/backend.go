@@ -0,0 +1,262 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	_ "github.com/lib/pq"
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/rovergulf/storage"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	_ "modernc.org/sqlite"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// newBackend initializes storage backend by its spec.
+// Spec format is `<type>[:<location>]`, where location is a directory path for `dir` and `sftp` types,
+// a database file path for `bolt` type, a data source name for `sql` type,
+// a read-only .tar, .tar.gz or .zip file for `archive` type, a key prefix for `consul` type,
+// `<bucket>[/<prefix>]` for `aws`, `gcp` and `azure` types, a collection URL for `webdav` type
+// and a base URL for read-only `http` type;
+// config values are used otherwise
+func newBackend(spec string) (storage.Backend, error) {
+	kind, location := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		kind, location = spec[:i], spec[i+1:]
+	}
+
+	switch kind {
+	case "dir":
+		if location == "" {
+			location = viper.GetString("path")
+		}
+		fileMode, err := strconv.ParseUint(viper.GetString("dir.file_mode"), 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dir.file_mode: %w", err)
+		}
+		dirMode, err := strconv.ParseUint(viper.GetString("dir.dir_mode"), 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dir.dir_mode: %w", err)
+		}
+		return storage.NewDirStorageWithOptions(storage.DirOptions{
+			Logger:   logger,
+			RootDir:  location,
+			FileMode: os.FileMode(fileMode),
+			DirMode:  os.FileMode(dirMode),
+		})
+	case "aws":
+		bucket, prefix := splitBucketLocation(location, viper.GetString("aws.bucket"), viper.GetString("aws.prefix"))
+		return storage.NewAWSStorageWithOptions(storage.AWSOptions{
+			Logger:                logger,
+			Bucket:                bucket,
+			Prefix:                prefix,
+			Region:                viper.GetString("aws.region"),
+			Endpoint:              viper.GetString("aws.endpoint"),
+			SSE:                   viper.GetString("aws.sse"),
+			AccessKey:             viper.GetString("aws.access_key"),
+			SecretKey:             viper.GetString("aws.secret_key"),
+			SessionToken:          viper.GetString("aws.session_token"),
+			Profile:               viper.GetString("aws.profile"),
+			RoleARN:               viper.GetString("aws.role_arn"),
+			ExternalID:            viper.GetString("aws.external_id"),
+			RoleSessionName:       viper.GetString("aws.role_session_name"),
+			STSEndpoint:           viper.GetString("aws.sts_endpoint"),
+			TLSCertFile:           viper.GetString("aws.ssl.cert"),
+			TLSKeyFile:            viper.GetString("aws.ssl.key"),
+			TLSCAFile:             viper.GetString("aws.ssl.ca"),
+			TLSInsecureSkipVerify: viper.GetBool("aws.ssl.insecure"),
+			VirtualHostedStyle:    viper.GetBool("aws.virtual_hosted_style"),
+			DisableContentMD5:     viper.GetBool("aws.disable_content_md5"),
+			Disable100Continue:    viper.GetBool("aws.disable_100_continue"),
+			PartSize:              viper.GetInt64("aws.part_size"),
+			Concurrency:           viper.GetInt("aws.concurrency"),
+			ResumeUploads:         viper.GetBool("aws.resume_uploads"),
+			HideExpiredOnList:     viper.GetBool("aws.hide_expired_on_list"),
+		})
+	case "gcp":
+		bucket, prefix := splitBucketLocation(location, viper.GetString("gcp.bucket"), viper.GetString("gcp.prefix"))
+		return storage.NewGCPStorage(bucket, prefix)
+	case "azure":
+		container, prefix := splitBucketLocation(location, viper.GetString("azure.container"), viper.GetString("azure.prefix"))
+		return storage.NewAzureStorage(storage.AzureOptions{
+			Logger:    logger,
+			Account:   viper.GetString("azure.account"),
+			Key:       viper.GetString("azure.key"),
+			SASToken:  viper.GetString("azure.sas_token"),
+			Container: container,
+			Prefix:    prefix,
+			Endpoint:  viper.GetString("azure.endpoint"),
+		})
+	case "sftp":
+		if location == "" {
+			location = viper.GetString("sftp.root_dir")
+		}
+		var privateKey []byte
+		if keyFile := viper.GetString("sftp.private_key_file"); keyFile != "" {
+			var err error
+			if privateKey, err = ioutil.ReadFile(keyFile); err != nil {
+				return nil, fmt.Errorf("unable to read sftp private key: %w", err)
+			}
+		}
+		knownHosts, err := homedir.Expand(viper.GetString("sftp.known_hosts"))
+		if err != nil {
+			return nil, err
+		}
+		return storage.NewSFTPStorage(storage.SFTPOptions{
+			Logger:               logger,
+			Host:                 viper.GetString("sftp.host"),
+			Port:                 viper.GetInt("sftp.port"),
+			User:                 viper.GetString("sftp.user"),
+			Password:             viper.GetString("sftp.password"),
+			PrivateKey:           privateKey,
+			PrivateKeyPassphrase: viper.GetString("sftp.private_key_passphrase"),
+			KnownHostsFile:       knownHosts,
+			RootDir:              location,
+		})
+	case "webdav":
+		if location == "" {
+			location = viper.GetString("webdav.url")
+		}
+		return storage.NewWebDAVStorage(storage.WebDAVOptions{
+			Logger:   logger,
+			URL:      location,
+			User:     viper.GetString("webdav.user"),
+			Password: viper.GetString("webdav.password"),
+		})
+	case "http":
+		if location == "" {
+			location = viper.GetString("http.url")
+		}
+		return storage.NewHTTPStorage(storage.HTTPOptions{
+			Logger:   logger,
+			URL:      location,
+			Manifest: viper.GetString("http.manifest"),
+			User:     viper.GetString("http.user"),
+			Password: viper.GetString("http.password"),
+		})
+	case "archive":
+		if location == "" {
+			location = viper.GetString("archive.path")
+		}
+		return storage.NewArchiveStorage(storage.ArchiveOptions{
+			Logger: logger,
+			Path:   location,
+		})
+	case "bolt":
+		if location == "" {
+			location = viper.GetString("bolt.path")
+		}
+		return storage.NewBoltStorage(storage.BoltOptions{
+			Logger:  logger,
+			Path:    location,
+			Timeout: viper.GetDuration("bolt.timeout"),
+		})
+	case "sql":
+		if location == "" {
+			location = viper.GetString("sql.dsn")
+		}
+		driver := viper.GetString("sql.driver")
+		db, err := sql.Open(driver, location)
+		if err != nil {
+			return nil, err
+		}
+		return storage.NewSQLStorage(storage.SQLOptions{
+			Logger:  logger,
+			DB:      db,
+			Dialect: driver,
+			Table:   viper.GetString("sql.table"),
+		})
+	case "consul":
+		if location == "" {
+			location = viper.GetString("consul.namespace")
+		}
+		return storage.NewConsulStorage(storage.ConsulOptions{
+			Logger:                logger,
+			Address:               viper.GetString("consul.address"),
+			Token:                 viper.GetString("consul.token"),
+			Datacenter:            viper.GetString("consul.datacenter"),
+			Namespace:             location,
+			TLSCertFile:           viper.GetString("consul.ssl.cert"),
+			TLSKeyFile:            viper.GetString("consul.ssl.key"),
+			TLSCAFile:             viper.GetString("consul.ssl.ca"),
+			TLSInsecureSkipVerify: viper.GetBool("consul.ssl.insecure"),
+			MaxValueSize:          viper.GetInt("consul.max_value_size"),
+		})
+	case "etcd":
+		return storage.NewEtcdStorage(storage.EtcdOptions{
+			Logger: logger,
+		})
+	default:
+		return nil, fmt.Errorf("unsupported storage type: %s", kind)
+	}
+}
+
+func newReplicatedBackend() (*storage.ReplicatedBackend, error) {
+	var replicas []storage.Replica
+	for _, spec := range viper.GetStringSlice("replication.replicas") {
+		b, err := newBackend(spec)
+		if err != nil {
+			return nil, fmt.Errorf("unable to init %s replica: %w", spec, err)
+		}
+		replicas = append(replicas, storage.Replica{
+			Name:    spec,
+			Backend: b,
+		})
+	}
+
+	return storage.NewReplicatedBackend(storage.ReplicatedOptions{
+		Logger:             logger,
+		Replicas:           replicas,
+		WriteQuorum:        viper.GetInt("replication.write_quorum"),
+		Preferred:          viper.GetString("replication.preferred"),
+		TimestampTolerance: viper.GetDuration("replication.timestamp_tolerance"),
+	})
+}
+
+func newShardedBackend(extra ...string) (*storage.ShardedBackend, error) {
+	var shards []storage.Shard
+	for _, spec := range append(viper.GetStringSlice("sharding.shards"), extra...) {
+		b, err := newBackend(spec)
+		if err != nil {
+			return nil, fmt.Errorf("unable to init %s shard: %w", spec, err)
+		}
+		shards = append(shards, storage.Shard{
+			Name:    spec,
+			Backend: b,
+		})
+	}
+
+	return storage.NewShardedBackend(storage.ShardedOptions{
+		Logger:       logger,
+		Shards:       shards,
+		VirtualNodes: viper.GetInt("sharding.virtual_nodes"),
+		Prefixes:     viper.GetStringSlice("sharding.prefixes"),
+	})
+}
+
+func newCASBackend() (*storage.CASBackend, error) {
+	b, err := newBackend(viper.GetString("cas.backend"))
+	if err != nil {
+		return nil, err
+	}
+
+	return storage.NewCASBackend(storage.CASOptions{
+		Logger:  logger,
+		Backend: b,
+	})
+}
+
+func splitBucketLocation(location, defaultBucket, defaultPrefix string) (string, string) {
+	if location == "" {
+		return defaultBucket, defaultPrefix
+	}
+
+	parts := strings.SplitN(location, "/", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+
+	return parts[0], parts[1]
+}
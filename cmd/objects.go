@@ -24,6 +24,9 @@ func init() {
 	objectsCmd.AddCommand(putObjectsCmd())
 	objectsCmd.AddCommand(deleteObjectsCmd())
 	objectsCmd.AddCommand(syncObjectsCmd())
+	objectsCmd.AddCommand(repairObjectsCmd())
+	objectsCmd.AddCommand(rebalanceObjectsCmd())
+	objectsCmd.AddCommand(gcObjectsCmd())
 
 	// Cobra supports Persistent Flags which will work for this command
 	// and all subcommands, e.g.:
@@ -185,3 +188,117 @@ func syncObjectsCmd() *cobra.Command {
 
 	return syncObjectsCmd
 }
+
+func repairObjectsCmd() *cobra.Command {
+	var repairObjectsCmd = &cobra.Command{
+		Use:   "repair [prefix]",
+		Short: "Reconcile divergent replicas",
+		Long: `Replays writes and deletes recorded in the replication log on the replicas that missed them,
+then compares every replica listed in 'replication.replicas' with the preferred one and copies missing
+or outdated objects. Objects absent from the preferred replica are copied back to it, as only recorded
+deletes are propagated`,
+		Example: `storage objects repair charts`,
+		Args:    cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var prefix string
+			if len(args) > 0 {
+				prefix = args[0]
+			}
+
+			replicated, err := newReplicatedBackend()
+			if err != nil {
+				return err
+			}
+
+			results, err := replicated.Repair(prefix)
+			if err != nil {
+				return err
+			}
+
+			return writeOutput(cmd, results)
+		},
+		TraverseChildren: true,
+	}
+
+	addOutputFormatFlag(repairObjectsCmd)
+
+	return repairObjectsCmd
+}
+
+func rebalanceObjectsCmd() *cobra.Command {
+	var rebalanceObjectsCmd = &cobra.Command{
+		Use:   "rebalance [prefix]",
+		Short: "Move objects to their owner shards",
+		Long: `Moves objects stored on shards listed in 'sharding.shards' to the shards owning them on the hash ring.
+Shards passed with --drain are taken off the ring and all their objects are moved out`,
+		Example: `storage objects rebalance charts --drain dir:/mnt/old`,
+		Args:    cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var prefix string
+			if len(args) > 0 {
+				prefix = args[0]
+			}
+
+			drain, _ := cmd.Flags().GetStringArray("drain")
+			sharded, err := newShardedBackend(drain...)
+			if err != nil {
+				return err
+			}
+
+			var moved []string
+			for _, spec := range drain {
+				keys, err := sharded.RemoveShard(spec)
+				moved = append(moved, keys...)
+				if err != nil {
+					return err
+				}
+			}
+
+			keys, err := sharded.Rebalance(prefix)
+			moved = append(moved, keys...)
+			if err != nil {
+				return err
+			}
+
+			return writeOutput(cmd, map[string]interface{}{
+				"moved": moved,
+			})
+		},
+		TraverseChildren: true,
+	}
+
+	rebalanceObjectsCmd.Flags().StringArray("drain", []string{}, "Shards to remove objects from")
+	addOutputFormatFlag(rebalanceObjectsCmd)
+
+	return rebalanceObjectsCmd
+}
+
+func gcObjectsCmd() *cobra.Command {
+	var gcObjectsCmd = &cobra.Command{
+		Use:   "gc",
+		Short: "Remove unreferenced content-addressed blobs",
+		Long: `Removes blobs of the content-addressable storage configured by 'cas.backend'
+that are not referenced by any key. Must not run concurrently with writers`,
+		Example: `storage objects gc`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cas, err := newCASBackend()
+			if err != nil {
+				return err
+			}
+
+			removed, err := cas.GarbageCollect()
+			if err != nil {
+				return err
+			}
+
+			return writeOutput(cmd, map[string]interface{}{
+				"removed": removed,
+			})
+		},
+		TraverseChildren: true,
+	}
+
+	addOutputFormatFlag(gcObjectsCmd)
+
+	return gcObjectsCmd
+}
@@ -113,6 +113,8 @@ func setDefaultFlags() {
 	// storage
 	viper.SetDefault("type", "dir")
 	viper.SetDefault("path", "tmp")
+	viper.SetDefault("dir.file_mode", "0644")
+	viper.SetDefault("dir.dir_mode", "0755")
 
 	// etcd
 	viper.SetDefault("etcd.endpoints", []string{os.Getenv("ETCD_ADDR")})
@@ -126,12 +128,87 @@ func setDefaultFlags() {
 	// google cloud
 	viper.SetDefault("gcp.credentials_file", os.Getenv("GOOGLE_APP_CREDENTIALS"))
 	viper.SetDefault("gcp.bucket", os.Getenv("GCS_BUCKET"))
+	viper.SetDefault("gcp.prefix", os.Getenv("GCS_PREFIX"))
 	// amazon services
 	viper.SetDefault("aws.access_key", os.Getenv("AWS_ACCESS_KEY_ID"))
 	viper.SetDefault("aws.secret_key", os.Getenv("AWS_SECRET_ACCESS_KEY"))
 	viper.SetDefault("aws.region", os.Getenv("AWS_REGION"))
 	viper.SetDefault("aws.bucket", os.Getenv("AWS_S3_BUCKET"))
-
+	viper.SetDefault("aws.prefix", os.Getenv("AWS_S3_PREFIX"))
+	viper.SetDefault("aws.endpoint", os.Getenv("AWS_S3_ENDPOINT"))
+	viper.SetDefault("aws.sse", os.Getenv("AWS_S3_SSE"))
+	viper.SetDefault("aws.session_token", os.Getenv("AWS_SESSION_TOKEN"))
+	viper.SetDefault("aws.profile", os.Getenv("AWS_PROFILE"))
+	viper.SetDefault("aws.role_arn", os.Getenv("AWS_ROLE_ARN"))
+	viper.SetDefault("aws.external_id", "")
+	viper.SetDefault("aws.role_session_name", os.Getenv("AWS_ROLE_SESSION_NAME"))
+	viper.SetDefault("aws.sts_endpoint", "")
+	viper.SetDefault("aws.ssl.ca", os.Getenv("AWS_CA_BUNDLE"))
+	viper.SetDefault("aws.ssl.cert", "")
+	viper.SetDefault("aws.ssl.key", "")
+	viper.SetDefault("aws.ssl.insecure", false)
+	viper.SetDefault("aws.virtual_hosted_style", false)
+	viper.SetDefault("aws.disable_content_md5", false)
+	viper.SetDefault("aws.disable_100_continue", false)
+	viper.SetDefault("aws.part_size", 0)
+	viper.SetDefault("aws.concurrency", 0)
+	viper.SetDefault("aws.resume_uploads", false)
+	viper.SetDefault("aws.hide_expired_on_list", false)
+	// azure blob storage
+	viper.SetDefault("azure.account", os.Getenv("AZURE_STORAGE_ACCOUNT"))
+	viper.SetDefault("azure.key", os.Getenv("AZURE_STORAGE_KEY"))
+	viper.SetDefault("azure.sas_token", os.Getenv("AZURE_STORAGE_SAS_TOKEN"))
+	viper.SetDefault("azure.container", os.Getenv("AZURE_STORAGE_CONTAINER"))
+	viper.SetDefault("azure.prefix", os.Getenv("AZURE_STORAGE_PREFIX"))
+	viper.SetDefault("azure.endpoint", os.Getenv("AZURE_STORAGE_ENDPOINT"))
+	// sftp
+	viper.SetDefault("sftp.host", os.Getenv("SFTP_HOST"))
+	viper.SetDefault("sftp.port", storage.DefaultSFTPPort)
+	viper.SetDefault("sftp.user", os.Getenv("SFTP_USER"))
+	viper.SetDefault("sftp.password", os.Getenv("SFTP_PASSWORD"))
+	viper.SetDefault("sftp.private_key_file", os.Getenv("SFTP_PRIVATE_KEY_FILE"))
+	viper.SetDefault("sftp.private_key_passphrase", os.Getenv("SFTP_PRIVATE_KEY_PASSPHRASE"))
+	viper.SetDefault("sftp.known_hosts", "~/.ssh/known_hosts")
+	viper.SetDefault("sftp.root_dir", os.Getenv("SFTP_ROOT_DIR"))
+	// webdav
+	viper.SetDefault("webdav.url", os.Getenv("WEBDAV_URL"))
+	viper.SetDefault("webdav.user", os.Getenv("WEBDAV_USER"))
+	viper.SetDefault("webdav.password", os.Getenv("WEBDAV_PASSWORD"))
+	// http, manifest path is relative to the url, autoindex pages are parsed without it
+	viper.SetDefault("http.url", "")
+	viper.SetDefault("http.manifest", "")
+	viper.SetDefault("http.user", "")
+	viper.SetDefault("http.password", "")
+	// consul
+	viper.SetDefault("consul.address", os.Getenv("CONSUL_HTTP_ADDR"))
+	viper.SetDefault("consul.token", os.Getenv("CONSUL_HTTP_TOKEN"))
+	viper.SetDefault("consul.datacenter", "")
+	viper.SetDefault("consul.namespace", "storage")
+	viper.SetDefault("consul.ssl.ca", os.Getenv("CONSUL_CACERT"))
+	viper.SetDefault("consul.ssl.cert", os.Getenv("CONSUL_CLIENT_CERT"))
+	viper.SetDefault("consul.ssl.key", os.Getenv("CONSUL_CLIENT_KEY"))
+	viper.SetDefault("consul.ssl.insecure", false)
+	viper.SetDefault("consul.max_value_size", storage.DefaultConsulMaxValueSize)
+	// archive
+	viper.SetDefault("archive.path", "")
+	// bolt
+	viper.SetDefault("bolt.path", "storage.db")
+	viper.SetDefault("bolt.timeout", storage.DefaultBoltTimeout)
+	// sql, the driver name is the dialect: postgres or sqlite
+	viper.SetDefault("sql.driver", "postgres")
+	viper.SetDefault("sql.dsn", os.Getenv("DATABASE_URL"))
+	viper.SetDefault("sql.table", storage.DefaultSQLTable)
+	// replication
+	viper.SetDefault("replication.replicas", []string{})
+	viper.SetDefault("replication.write_quorum", 0)
+	viper.SetDefault("replication.preferred", "")
+	viper.SetDefault("replication.timestamp_tolerance", "0s")
+	// sharding
+	viper.SetDefault("sharding.shards", []string{})
+	viper.SetDefault("sharding.virtual_nodes", 128)
+	viper.SetDefault("sharding.prefixes", []string{""})
+	// content-addressable storage
+	viper.SetDefault("cas.backend", "dir")
 }
 
 func addOutputFormatFlag(cmd *cobra.Command) {
@@ -0,0 +1,42 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrVersionMismatch matches every VersionMismatchError with errors.Is
+var ErrVersionMismatch = errors.New("version mismatch")
+
+// VersionMismatchError is returned by conditional writes of objects changed since the expected version was read
+type VersionMismatchError struct {
+	Key      string
+	Expected string
+	// Actual is empty if the object does not exist
+	Actual string
+}
+
+func (e *VersionMismatchError) Error() string {
+	if e.Actual == "" {
+		return fmt.Sprintf("object %s does not exist, expected version %s", e.Key, e.Expected)
+	}
+	if e.Expected == "" {
+		return fmt.Sprintf("object %s exists with version %s", e.Key, e.Actual)
+	}
+	return fmt.Sprintf("object %s has version %s, expected version %s", e.Key, e.Actual, e.Expected)
+}
+
+func (e *VersionMismatchError) Is(target error) bool {
+	return target == ErrVersionMismatch
+}
+
+// ConditionalBackend is implemented by backends supporting optimistic concurrency,
+// versions are the Meta.Version of objects returned by GetObject
+type ConditionalBackend interface {
+	Backend
+	// PutObjectIfVersion writes the object if its current version is version,
+	// empty version requires the object not to exist
+	PutObjectIfVersion(key string, data []byte, version string) error
+	// DeleteObjectIfVersion deletes the object if its current version is version
+	DeleteObjectIfVersion(key string, version string) error
+}
@@ -0,0 +1,635 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultConsulAddress is the HTTP API address of a local Consul agent
+	DefaultConsulAddress = "http://127.0.0.1:8500"
+	// DefaultConsulWaitTime is how long blocking queries of Watch wait for changes
+	DefaultConsulWaitTime = 5 * time.Minute
+	// DefaultConsulMaxValueSize is the default kv_max_value_size of Consul servers
+	DefaultConsulMaxValueSize = 512 * 1024
+	// consulMaxTxnOps is the limit of operations of a Consul transaction
+	consulMaxTxnOps = 64
+	// consulWatchRetryInterval is how long Watch waits after a failed blocking query
+	consulWatchRetryInterval = time.Second
+)
+
+type ConsulOptions struct {
+	Logger *zap.SugaredLogger
+	// Address of the Consul HTTP API. Defaults to DefaultConsulAddress
+	Address string
+	// Token is the ACL token sent with every request
+	Token string
+	// Datacenter defaults to the datacenter of the agent
+	Datacenter string
+	// Namespace is the key prefix objects are stored under
+	Namespace string
+	// TLS client certificate, CA certificate to verify the server with and whether to skip the verification,
+	// used for https addresses if HTTPClient is not set
+	TLSCertFile           string
+	TLSKeyFile            string
+	TLSCAFile             string
+	TLSInsecureSkipVerify bool
+	// WaitTime of blocking queries of Watch. Defaults to DefaultConsulWaitTime
+	WaitTime time.Duration
+	// MaxValueSize is the kv_max_value_size of the servers, larger objects are rejected
+	// with ObjectTooLargeError before they are sent. Defaults to DefaultConsulMaxValueSize
+	MaxValueSize int
+	// HTTPClient defaults to http.DefaultClient
+	HTTPClient *http.Client
+}
+
+// consulKVPair is an entry of the KV API, Flags hold the modification time in Unix nanoseconds
+type consulKVPair struct {
+	Key         string
+	Value       []byte
+	Flags       uint64
+	ModifyIndex uint64
+}
+
+// consulTxnOp is an operation of the transaction API
+type consulTxnOp struct {
+	KV consulTxnKVOp
+}
+
+type consulTxnKVOp struct {
+	Verb  string
+	Key   string
+	Value []byte `json:",omitempty"`
+	Flags uint64 `json:",omitempty"`
+	Index uint64 `json:",omitempty"`
+}
+
+// ObjectTooLargeError is returned for objects exceeding the value size limit of a backend
+type ObjectTooLargeError struct {
+	Key   string
+	Size  int
+	Limit int
+}
+
+func (e *ObjectTooLargeError) Error() string {
+	return fmt.Sprintf("object %s of %d bytes exceeds the limit of %d bytes", e.Key, e.Size, e.Limit)
+}
+
+// ConsulStorage stores objects in the Consul KV store under a namespace prefix.
+// ModifyIndex of a key is the object version, values are limited to 512 KiB by default
+type ConsulStorage struct {
+	logger       *zap.SugaredLogger
+	address      *url.URL
+	token        string
+	datacenter   string
+	namespace    string
+	waitTime     time.Duration
+	maxValueSize int
+	client       *http.Client
+}
+
+func NewConsulStorage(opts ConsulOptions) (*ConsulStorage, error) {
+	if opts.Logger == nil {
+		opts.Logger = zap.S()
+	}
+
+	if opts.Address == "" {
+		opts.Address = DefaultConsulAddress
+	}
+	if !strings.Contains(opts.Address, "://") {
+		opts.Address = "http://" + opts.Address
+	}
+	address, err := url.Parse(opts.Address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid consul address: %w", err)
+	}
+	if address.Scheme != "http" && address.Scheme != "https" {
+		return nil, fmt.Errorf("invalid consul address scheme: %s", address.Scheme)
+	}
+
+	namespace, err := defaultKeyRules.validatePrefix(opts.Namespace)
+	if err != nil {
+		return nil, fmt.Errorf("invalid consul namespace: %w", err)
+	}
+	if namespace != "" {
+		namespace += "/"
+	}
+
+	if opts.WaitTime <= 0 {
+		opts.WaitTime = DefaultConsulWaitTime
+	}
+	if opts.MaxValueSize <= 0 {
+		opts.MaxValueSize = DefaultConsulMaxValueSize
+	}
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = http.DefaultClient
+		if address.Scheme == "https" {
+			tlsConfig, err := consulTLSConfig(opts)
+			if err != nil {
+				return nil, err
+			}
+			opts.HTTPClient = &http.Client{Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: tlsConfig,
+			}}
+		}
+	}
+
+	return &ConsulStorage{
+		logger:       opts.Logger,
+		address:      address,
+		token:        opts.Token,
+		datacenter:   opts.Datacenter,
+		namespace:    namespace,
+		waitTime:     opts.WaitTime,
+		maxValueSize: opts.MaxValueSize,
+		client:       opts.HTTPClient,
+	}, nil
+}
+
+func consulTLSConfig(opts ConsulOptions) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: opts.TLSInsecureSkipVerify}
+
+	if opts.TLSCertFile != "" && opts.TLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.TLSCertFile, opts.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if opts.TLSCAFile != "" {
+		caCert, err := ioutil.ReadFile(opts.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no certificates found in %s", opts.TLSCAFile)
+		}
+	}
+	return config, nil
+}
+
+func (s *ConsulStorage) GetObject(key string) (Object, error) {
+	normalized, err := defaultKeyRules.validate(key)
+	if err != nil {
+		return Object{Path: key}, err
+	}
+
+	res, err := s.do(http.MethodGet, normalized, nil, nil)
+	if err != nil {
+		return Object{Path: key}, err
+	}
+	defer res.Body.Close()
+
+	var pairs []consulKVPair
+	if err := json.NewDecoder(res.Body).Decode(&pairs); err != nil {
+		return Object{Path: key}, fmt.Errorf("unable to decode consul kv response: %w", err)
+	}
+	if len(pairs) == 0 {
+		return Object{Path: key}, &os.PathError{Op: "open", Path: normalized, Err: os.ErrNotExist}
+	}
+
+	object := newConsulObject(normalized, pairs[0])
+	if pairs[0].Value != nil {
+		object.Data = pairs[0].Value
+	}
+	return object, nil
+}
+
+func (s *ConsulStorage) PutObject(key string, data []byte) error {
+	key, err := defaultKeyRules.validate(key)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.put(key, data, nil)
+	return err
+}
+
+// PutObjectIfVersion writes the object if its ModifyIndex is version using check-and-set,
+// empty version requires the object not to exist
+func (s *ConsulStorage) PutObjectIfVersion(key string, data []byte, version string) error {
+	key, err := defaultKeyRules.validate(key)
+	if err != nil {
+		return err
+	}
+	cas := version
+	if cas == "" {
+		cas = "0"
+	} else if _, err := strconv.ParseUint(version, 10, 64); err != nil {
+		return s.versionMismatch(key, version)
+	}
+
+	ok, err := s.put(key, data, url.Values{"cas": {cas}})
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return s.versionMismatch(key, version)
+	}
+	return nil
+}
+
+func (s *ConsulStorage) put(key string, data []byte, query url.Values) (bool, error) {
+	if err := s.checkSize(key, data); err != nil {
+		return false, err
+	}
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("flags", strconv.FormatInt(time.Now().UnixNano(), 10))
+	if data == nil {
+		data = []byte{}
+	}
+
+	res, err := s.do(http.MethodPut, key, query, data)
+	if err != nil {
+		return false, err
+	}
+	return consulResult(res)
+}
+
+// DeleteObject removes the key, deleting a missing key is not an error as with etcd
+func (s *ConsulStorage) DeleteObject(key string) error {
+	key, err := defaultKeyRules.validate(key)
+	if err != nil {
+		return err
+	}
+
+	res, err := s.do(http.MethodDelete, key, nil, nil)
+	if err != nil {
+		return err
+	}
+	_, err = consulResult(res)
+	return err
+}
+
+// DeleteObjectIfVersion deletes the object if its ModifyIndex is version using check-and-set
+func (s *ConsulStorage) DeleteObjectIfVersion(key string, version string) error {
+	key, err := defaultKeyRules.validate(key)
+	if err != nil {
+		return err
+	}
+	index, err := strconv.ParseUint(version, 10, 64)
+	if err != nil {
+		return s.versionMismatch(key, version)
+	}
+
+	// check-and-set delete of a missing key succeeds, check-index fails the transaction unless the key exists
+	err = s.txn(context.Background(), []consulTxnOp{
+		{KV: consulTxnKVOp{Verb: "check-index", Key: s.namespace + key, Index: index}},
+		{KV: consulTxnKVOp{Verb: "delete-cas", Key: s.namespace + key, Index: index}},
+	})
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusConflict {
+		return s.versionMismatch(key, version)
+	}
+	return err
+}
+
+// DeletePrefix removes keys under prefix recursively
+func (s *ConsulStorage) DeletePrefix(prefix string) error {
+	prefix, err := defaultKeyRules.validate(prefix)
+	if err != nil {
+		return err
+	}
+
+	res, err := s.do(http.MethodDelete, prefix+"/", url.Values{"recurse": {"true"}}, nil)
+	if err != nil {
+		return err
+	}
+	_, err = consulResult(res)
+	return err
+}
+
+// ListObjects returns objects right under prefix, with paths relative to it.
+// The KV API lists values with keys, so nested objects are read too
+func (s *ConsulStorage) ListObjects(prefix string) ([]Object, error) {
+	prefix, err := defaultKeyRules.validatePrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	pairs, _, err := s.list(context.Background(), prefix, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []Object
+	for _, pair := range pairs {
+		if object, ok := s.listedObject(prefix, pair); ok {
+			result = append(result, object)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Path < result[j].Path
+	})
+	return result, nil
+}
+
+// list returns pairs under prefix and the index of the result, a non-zero index makes it a blocking query
+func (s *ConsulStorage) list(ctx context.Context, prefix string, index uint64) ([]consulKVPair, uint64, error) {
+	query := url.Values{"recurse": {"true"}}
+	if index > 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", fmt.Sprintf("%ds", int(s.waitTime/time.Second)))
+	}
+	dir := prefix
+	if dir != "" {
+		dir += "/"
+	}
+
+	req, err := s.request(ctx, http.MethodGet, dir, query, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	res, err := s.send(req)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, 0, err
+	}
+
+	var pairs []consulKVPair
+	if err == nil {
+		defer res.Body.Close()
+		if err := json.NewDecoder(res.Body).Decode(&pairs); err != nil {
+			return nil, 0, fmt.Errorf("unable to decode consul kv response: %w", err)
+		}
+		index, _ = strconv.ParseUint(res.Header.Get("X-Consul-Index"), 10, 64)
+	} else if httpErr, ok := err.(*consulHTTPError); ok {
+		// missing prefix still reports the index to block on
+		index = httpErr.index
+	}
+	return pairs, index, nil
+}
+
+// listedObject returns the object of a pair right under prefix
+func (s *ConsulStorage) listedObject(prefix string, pair consulKVPair) (Object, bool) {
+	key := strings.TrimPrefix(pair.Key, s.namespace)
+	path := removePrefixFromObjectPath(prefix, key)
+	if objectPathIsInvalid(path) || !strings.HasPrefix(pair.Key, s.namespace) {
+		return Object{}, false
+	}
+	object := newConsulObject(key, pair)
+	object.Path = path
+	return object, true
+}
+
+// Watch notifies about changes of objects right under prefix using blocking queries,
+// event revisions are ModifyIndex of the changed keys
+func (s *ConsulStorage) Watch(ctx context.Context, prefix string) <-chan Event {
+	events := make(chan Event)
+
+	normalized, err := defaultKeyRules.validatePrefix(prefix)
+	if err != nil {
+		s.logger.Errorf("Unable to watch '%s' prefix: %s", prefix, err)
+		close(events)
+		return events
+	}
+	prefix = normalized
+
+	go func() {
+		defer close(events)
+
+		var index uint64
+		var prev map[string]Object
+		for {
+			pairs, next, err := s.list(ctx, prefix, index)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				s.logger.Errorf("Unable to watch '%s': %s", prefix, err)
+				select {
+				case <-time.After(consulWatchRetryInterval):
+					continue
+				case <-ctx.Done():
+					return
+				}
+			}
+			// index going backwards means the state was reset, start over.
+			// Zero index would not block, so the lowest valid one is used instead
+			if next < index || next == 0 {
+				next = 1
+			}
+			index = next
+
+			curr := make(map[string]Object)
+			for _, pair := range pairs {
+				if object, ok := s.listedObject(prefix, pair); ok {
+					curr[object.Path] = object
+				}
+			}
+			if prev != nil {
+				for _, event := range consulEvents(prev, curr, int64(index)) {
+					select {
+					case events <- event:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+			prev = curr
+		}
+	}()
+
+	return events
+}
+
+// consulEvents compares two listings of a prefix, deletions get the index of the listing
+func consulEvents(prev map[string]Object, curr map[string]Object, index int64) []Event {
+	var events []Event
+	for p, object := range curr {
+		revision, _ := strconv.ParseInt(object.Meta.Version, 10, 64)
+		if old, ok := prev[p]; !ok {
+			events = append(events, Event{Type: EventCreated, Object: object, Revision: revision})
+		} else if old.Meta.Version != object.Meta.Version {
+			events = append(events, Event{Type: EventUpdated, Object: object, Revision: revision})
+		}
+	}
+	for p, object := range prev {
+		if _, ok := curr[p]; !ok {
+			events = append(events, Event{Type: EventDeleted, Object: object, Revision: index})
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Revision < events[j].Revision
+	})
+	return events
+}
+
+// CommitBatch applies the batch in a single transaction, Consul limits transactions to 64 operations
+func (s *ConsulStorage) CommitBatch(ctx context.Context, batch *Batch) error {
+	batch, err := defaultKeyRules.validateBatch(batch)
+	if err != nil {
+		return err
+	}
+	if len(batch.Ops()) > consulMaxTxnOps {
+		return fmt.Errorf("consul transactions are limited to %d operations, batch has %d", consulMaxTxnOps, len(batch.Ops()))
+	}
+
+	modified := uint64(time.Now().UnixNano())
+	var ops []consulTxnOp
+	for _, op := range batch.Ops() {
+		if op.Delete {
+			ops = append(ops, consulTxnOp{KV: consulTxnKVOp{Verb: "delete", Key: s.namespace + op.Key}})
+			continue
+		}
+		data := op.Data
+		if data == nil {
+			data = []byte{}
+		}
+		if err := s.checkSize(op.Key, data); err != nil {
+			return err
+		}
+		ops = append(ops, consulTxnOp{KV: consulTxnKVOp{Verb: "set", Key: s.namespace + op.Key, Value: data, Flags: modified}})
+	}
+	return s.txn(ctx, ops)
+}
+
+// txn applies operations atomically, a failed check fails the transaction with 409 Conflict
+func (s *ConsulStorage) txn(ctx context.Context, ops []consulTxnOp) error {
+	body, err := json.Marshal(ops)
+	if err != nil {
+		return err
+	}
+
+	u := s.endpoint("/v1/txn", nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	res, err := s.send(req)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// checkSize rejects values the servers would refuse
+func (s *ConsulStorage) checkSize(key string, data []byte) error {
+	if len(data) > s.maxValueSize {
+		return &ObjectTooLargeError{Key: key, Size: len(data), Limit: s.maxValueSize}
+	}
+	return nil
+}
+
+// versionMismatch reads the current version of a key for the error of a failed check-and-set
+func (s *ConsulStorage) versionMismatch(key string, expected string) error {
+	object, err := s.GetObject(key)
+	if errors.Is(err, os.ErrNotExist) {
+		return &VersionMismatchError{Key: key, Expected: expected}
+	}
+	if err != nil {
+		return err
+	}
+	return &VersionMismatchError{Key: key, Expected: expected, Actual: object.Meta.Version}
+}
+
+func newConsulObject(key string, pair consulKVPair) Object {
+	object := Object{
+		Meta: Metadata{
+			Name:    path.Base(key),
+			Version: strconv.FormatUint(pair.ModifyIndex, 10),
+		},
+		Path: key,
+		Data: []byte{},
+	}
+	if pair.Flags > 0 {
+		object.LastModified = time.Unix(0, int64(pair.Flags))
+	}
+	return object
+}
+
+// consulHTTPError keeps the index of error responses of blocking queries
+type consulHTTPError struct {
+	*HTTPError
+	index uint64
+}
+
+func (e *consulHTTPError) Unwrap() error {
+	return e.HTTPError
+}
+
+// endpoint returns the URL of an API path with the datacenter set
+func (s *ConsulStorage) endpoint(apiPath string, query url.Values) *url.URL {
+	u := *s.address
+	u.Path = strings.TrimSuffix(u.Path, "/") + apiPath
+	u.RawPath = ""
+	if query == nil {
+		query = url.Values{}
+	}
+	if s.datacenter != "" {
+		query.Set("dc", s.datacenter)
+	}
+	u.RawQuery = query.Encode()
+	return &u
+}
+
+// request builds a KV API request of a key relative to the namespace
+func (s *ConsulStorage) request(ctx context.Context, method string, key string, query url.Values, body []byte) (*http.Request, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	u := s.endpoint("/v1/kv/"+s.namespace+key, query)
+	return http.NewRequestWithContext(ctx, method, u.String(), reader)
+}
+
+func (s *ConsulStorage) do(method string, key string, query url.Values, body []byte) (*http.Response, error) {
+	req, err := s.request(context.Background(), method, key, query, body)
+	if err != nil {
+		return nil, err
+	}
+	return s.send(req)
+}
+
+// send adds the ACL token, responses with error status are returned as HTTPError
+func (s *ConsulStorage) send(req *http.Request) (*http.Response, error) {
+	if s.token != "" {
+		req.Header.Set("X-Consul-Token", s.token)
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 300 {
+		return res, nil
+	}
+
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 64*1024))
+	res.Body.Close()
+	index, _ := strconv.ParseUint(res.Header.Get("X-Consul-Index"), 10, 64)
+	return nil, &consulHTTPError{
+		HTTPError: &HTTPError{Method: req.Method, URL: req.URL.String(), StatusCode: res.StatusCode},
+		index:     index,
+	}
+}
+
+// consulResult decodes the boolean result of a KV write
+func consulResult(res *http.Response) (bool, error) {
+	defer res.Body.Close()
+	var ok bool
+	if err := json.NewDecoder(res.Body).Decode(&ok); err != nil {
+		return false, fmt.Errorf("unable to decode consul kv response: %w", err)
+	}
+	return ok, nil
+}
@@ -0,0 +1,428 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+const fakeConsulToken = "secret-token"
+
+// fakeConsulServer implements the KV and transaction API of Consul in memory,
+// including check-and-set and blocking queries
+type fakeConsulServer struct {
+	*httptest.Server
+	mu      sync.Mutex
+	index   uint64
+	kv      map[string]consulKVPair
+	changed chan struct{}
+	dc      string
+}
+
+func newFakeConsulServer() *fakeConsulServer {
+	s := &fakeConsulServer{
+		index:   1,
+		kv:      make(map[string]consulKVPair),
+		changed: make(chan struct{}),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+func (s *fakeConsulServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Consul-Token") != fakeConsulToken {
+		http.Error(w, "ACL not found", http.StatusForbidden)
+		return
+	}
+	s.mu.Lock()
+	s.dc = r.URL.Query().Get("dc")
+	s.mu.Unlock()
+
+	switch {
+	case r.URL.Path == "/v1/txn" && r.Method == http.MethodPut:
+		s.txn(w, r)
+	case strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+		key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		switch r.Method {
+		case http.MethodGet:
+			s.get(w, r, key)
+		case http.MethodPut:
+			s.put(w, r, key)
+		case http.MethodDelete:
+			s.delete(w, r, key)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *fakeConsulServer) get(w http.ResponseWriter, r *http.Request, key string) {
+	query := r.URL.Query()
+	if index, _ := strconv.ParseUint(query.Get("index"), 10, 64); index > 0 {
+		wait, _ := time.ParseDuration(query.Get("wait"))
+		timeout := time.After(wait)
+		for {
+			s.mu.Lock()
+			current, changed := s.index, s.changed
+			s.mu.Unlock()
+			if current > index {
+				break
+			}
+			select {
+			case <-changed:
+				continue
+			case <-timeout:
+			case <-r.Context().Done():
+			}
+			break
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var pairs []consulKVPair
+	for k, pair := range s.kv {
+		if k == key || (query.Has("recurse") && strings.HasPrefix(k, key)) {
+			pairs = append(pairs, pair)
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		return pairs[i].Key < pairs[j].Key
+	})
+
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(s.index, 10))
+	if len(pairs) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(pairs)
+}
+
+func (s *fakeConsulServer) put(w http.ResponseWriter, r *http.Request, key string) {
+	value, _ := ioutil.ReadAll(r.Body)
+	flags, _ := strconv.ParseUint(r.URL.Query().Get("flags"), 10, 64)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cas := r.URL.Query().Get("cas"); cas != "" {
+		expected, _ := strconv.ParseUint(cas, 10, 64)
+		if pair, ok := s.kv[key]; (expected == 0 && ok) || (expected > 0 && (!ok || pair.ModifyIndex != expected)) {
+			w.Write([]byte("false"))
+			return
+		}
+	}
+	s.set(key, value, flags)
+	s.notify()
+	w.Write([]byte("true"))
+}
+
+func (s *fakeConsulServer) delete(w http.ResponseWriter, r *http.Request, key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cas := r.URL.Query().Get("cas"); cas != "" {
+		expected, _ := strconv.ParseUint(cas, 10, 64)
+		if pair, ok := s.kv[key]; ok && pair.ModifyIndex != expected {
+			w.Write([]byte("false"))
+			return
+		}
+	}
+	for k := range s.kv {
+		if k == key || (r.URL.Query().Has("recurse") && strings.HasPrefix(k, key)) {
+			delete(s.kv, k)
+		}
+	}
+	s.notify()
+	w.Write([]byte("true"))
+}
+
+func (s *fakeConsulServer) txn(w http.ResponseWriter, r *http.Request) {
+	var ops []consulTxnOp
+	if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// checks fail the whole transaction before any operation is applied
+	for _, op := range ops {
+		switch op.KV.Verb {
+		case "set", "delete":
+		case "check-index", "delete-cas":
+			pair, ok := s.kv[op.KV.Key]
+			if op.KV.Verb == "check-index" && (!ok || pair.ModifyIndex != op.KV.Index) ||
+				op.KV.Verb == "delete-cas" && ok && pair.ModifyIndex != op.KV.Index {
+				w.WriteHeader(http.StatusConflict)
+				w.Write([]byte(`{"Results": null, "Errors": [{"OpIndex": 0, "What": "index check failed"}]}`))
+				return
+			}
+		default:
+			http.Error(w, "unsupported verb "+op.KV.Verb, http.StatusBadRequest)
+			return
+		}
+	}
+	for _, op := range ops {
+		switch op.KV.Verb {
+		case "set":
+			s.set(op.KV.Key, op.KV.Value, op.KV.Flags)
+		case "delete", "delete-cas":
+			delete(s.kv, op.KV.Key)
+		}
+	}
+	s.notify()
+	w.Write([]byte(`{"Results": [], "Errors": null}`))
+}
+
+func (s *fakeConsulServer) set(key string, value []byte, flags uint64) {
+	s.index++
+	if len(value) == 0 {
+		value = nil
+	}
+	s.kv[key] = consulKVPair{Key: key, Value: value, Flags: flags, ModifyIndex: s.index}
+}
+
+// notify wakes up blocking queries
+func (s *fakeConsulServer) notify() {
+	s.index++
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+type ConsulTestSuite struct {
+	suite.Suite
+	server  *fakeConsulServer
+	Backend *ConsulStorage
+}
+
+func (suite *ConsulTestSuite) SetupTest() {
+	suite.server = newFakeConsulServer()
+
+	backend, err := NewConsulStorage(ConsulOptions{
+		Address:    suite.server.URL,
+		Token:      fakeConsulToken,
+		Datacenter: "dc1",
+		Namespace:  "/storage/test/",
+		WaitTime:   time.Second,
+	})
+	suite.Nil(err)
+	suite.Backend = backend
+}
+
+func (suite *ConsulTestSuite) TearDownTest() {
+	suite.server.Close()
+}
+
+func (suite *ConsulTestSuite) TestNewConsulStorage() {
+	_, err := NewConsulStorage(ConsulOptions{Address: "ftp://127.0.0.1:8500"})
+	suite.NotNil(err, "only http and https addresses are supported")
+
+	_, err = NewConsulStorage(ConsulOptions{Namespace: "../escape"})
+	suite.True(errors.Is(err, ErrInvalidKey), "namespace is validated")
+
+	_, err = NewConsulStorage(ConsulOptions{Address: "https://127.0.0.1:8501", TLSCAFile: "missing-ca.pem"})
+	suite.True(os.IsNotExist(err), "ca file is read for https addresses")
+
+	backend, err := NewConsulStorage(ConsulOptions{Address: "127.0.0.1:8500"})
+	suite.Nil(err)
+	suite.Equal("http", backend.address.Scheme, "http scheme is the default")
+}
+
+func (suite *ConsulTestSuite) TestPutGetObject() {
+	suite.Nil(suite.Backend.PutObject("charts/index.yaml", []byte("apiVersion: v1")))
+
+	object, err := suite.Backend.GetObject("charts/index.yaml")
+	suite.Nil(err)
+	suite.Equal([]byte("apiVersion: v1"), object.Data)
+	suite.Equal("index.yaml", object.Meta.Name)
+	suite.Equal(strconv.FormatUint(suite.server.kv["storage/test/charts/index.yaml"].ModifyIndex, 10), object.Meta.Version,
+		"modify index is the version")
+	suite.WithinDuration(time.Now(), object.LastModified, time.Second, "modification time stored in flags")
+	suite.Equal("dc1", suite.server.dc)
+
+	suite.Nil(suite.Backend.PutObject("empty.txt", nil))
+	object, err = suite.Backend.GetObject("empty.txt")
+	suite.Nil(err)
+	suite.Empty(object.Data)
+
+	_, err = suite.Backend.GetObject("missing.txt")
+	suite.True(errors.Is(err, os.ErrNotExist))
+}
+
+func (suite *ConsulTestSuite) TestACLToken() {
+	backend, err := NewConsulStorage(ConsulOptions{Address: suite.server.URL, Token: "wrong"})
+	suite.Nil(err)
+
+	err = backend.PutObject("index.yaml", []byte{})
+	suite.True(errors.Is(err, os.ErrPermission), "rejected token matches os.ErrPermission")
+}
+
+func (suite *ConsulTestSuite) TestListObjects() {
+	objects, err := suite.Backend.ListObjects("missing")
+	suite.Nil(err)
+	suite.Empty(objects)
+
+	for _, key := range []string{"b.txt", "a.txt", "charts/c.tgz", "charts/nested/d.tgz"} {
+		suite.Nil(suite.Backend.PutObject(key, []byte(key)))
+	}
+	suite.server.kv["storage/other.txt"] = consulKVPair{Key: "storage/other.txt", ModifyIndex: 1}
+
+	objects, err = suite.Backend.ListObjects("")
+	suite.Nil(err)
+	suite.Len(objects, 2, "nested objects and keys out of the namespace are not listed")
+	suite.Equal("a.txt", objects[0].Path)
+	suite.Equal("b.txt", objects[1].Path)
+	suite.False(objects[0].LastModified.IsZero())
+
+	objects, err = suite.Backend.ListObjects("charts")
+	suite.Nil(err)
+	suite.Len(objects, 1)
+	suite.Equal("c.tgz", objects[0].Path)
+}
+
+func (suite *ConsulTestSuite) TestConditionalWrites() {
+	var backend ConditionalBackend = suite.Backend
+
+	suite.Nil(backend.PutObjectIfVersion("index.yaml", []byte("v1"), ""))
+	err := backend.PutObjectIfVersion("index.yaml", []byte("v1"), "")
+	suite.True(errors.Is(err, ErrVersionMismatch), "object exists")
+
+	object, err := backend.GetObject("index.yaml")
+	suite.Nil(err)
+	suite.Nil(backend.PutObjectIfVersion("index.yaml", []byte("v2"), object.Meta.Version))
+
+	err = backend.PutObjectIfVersion("index.yaml", []byte("stale"), object.Meta.Version)
+	var mismatch *VersionMismatchError
+	suite.True(errors.As(err, &mismatch), "stale version rejected")
+	current, err := backend.GetObject("index.yaml")
+	suite.Nil(err)
+	suite.Equal(current.Meta.Version, mismatch.Actual)
+	suite.Equal([]byte("v2"), current.Data)
+
+	suite.True(errors.Is(backend.DeleteObjectIfVersion("index.yaml", object.Meta.Version), ErrVersionMismatch))
+	suite.Nil(backend.DeleteObjectIfVersion("index.yaml", current.Meta.Version))
+	suite.True(errors.Is(backend.DeleteObjectIfVersion("index.yaml", current.Meta.Version), ErrVersionMismatch),
+		"missing object")
+}
+
+func (suite *ConsulTestSuite) TestValueSizeLimit() {
+	large := make([]byte, DefaultConsulMaxValueSize+1)
+	var tooLarge *ObjectTooLargeError
+	suite.True(errors.As(suite.Backend.PutObject("large.bin", large), &tooLarge), "oversize value rejected")
+	suite.Equal(DefaultConsulMaxValueSize, tooLarge.Limit)
+	suite.True(errors.As(suite.Backend.PutObjectIfVersion("large.bin", large, ""), &tooLarge))
+
+	batch := NewBatch()
+	batch.Put("small.bin", []byte("small"))
+	batch.Put("large.bin", large)
+	suite.True(errors.As(suite.Backend.CommitBatch(context.Background(), batch), &tooLarge))
+	_, err := suite.Backend.GetObject("small.bin")
+	suite.True(errors.Is(err, os.ErrNotExist), "batch with an oversize value not sent")
+
+	suite.Nil(suite.Backend.PutObject("max.bin", large[1:]))
+}
+
+func (suite *ConsulTestSuite) TestDeleteObject() {
+	suite.Nil(suite.Backend.PutObject("deleteme.txt", []byte("content")))
+	suite.Nil(suite.Backend.DeleteObject("deleteme.txt"))
+
+	_, err := suite.Backend.GetObject("deleteme.txt")
+	suite.True(errors.Is(err, os.ErrNotExist))
+	suite.Nil(suite.Backend.DeleteObject("deleteme.txt"), "missing object is not an error")
+}
+
+func (suite *ConsulTestSuite) TestDeletePrefix() {
+	for _, key := range []string{"charts/a.tgz", "charts/nested/b.tgz", "chartsmuseum.txt"} {
+		suite.Nil(suite.Backend.PutObject(key, []byte(key)))
+	}
+
+	suite.Nil(suite.Backend.DeletePrefix("charts"))
+
+	_, err := suite.Backend.GetObject("charts/nested/b.tgz")
+	suite.True(errors.Is(err, os.ErrNotExist))
+	_, err = suite.Backend.GetObject("chartsmuseum.txt")
+	suite.Nil(err)
+
+	suite.True(errors.Is(suite.Backend.DeletePrefix(""), ErrInvalidKey))
+}
+
+func (suite *ConsulTestSuite) TestCommitBatch() {
+	suite.Nil(suite.Backend.PutObject("old.txt", []byte("old")))
+
+	batch := NewBatch()
+	batch.Put("charts/a.tgz", []byte("a"))
+	batch.Put("charts/b.tgz", nil)
+	batch.Delete("old.txt")
+	batch.Delete("missing.txt")
+	suite.Nil(suite.Backend.CommitBatch(context.Background(), batch))
+
+	objects, err := suite.Backend.ListObjects("charts")
+	suite.Nil(err)
+	suite.Len(objects, 2)
+	_, err = suite.Backend.GetObject("old.txt")
+	suite.True(errors.Is(err, os.ErrNotExist))
+
+	batch = NewBatch()
+	for i := 0; i <= consulMaxTxnOps; i++ {
+		batch.Put(fmt.Sprintf("large/%d.txt", i), []byte{})
+	}
+	suite.NotNil(suite.Backend.CommitBatch(context.Background(), batch), "transaction size is limited")
+}
+
+func (suite *ConsulTestSuite) TestWatch() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	suite.Nil(suite.Backend.PutObject("charts/existing.tgz", []byte("v1")))
+	events := suite.Backend.Watch(ctx, "charts")
+	// let the initial query establish the index
+	time.Sleep(100 * time.Millisecond)
+
+	next := func() Event {
+		select {
+		case event := <-events:
+			return event
+		case <-time.After(3 * time.Second):
+			suite.FailNow("no event received")
+		}
+		return Event{}
+	}
+
+	suite.Nil(suite.Backend.PutObject("charts/nginx-1.0.0.tgz", []byte("v1")))
+	event := next()
+	suite.Equal(EventCreated, event.Type)
+	suite.Equal("nginx-1.0.0.tgz", event.Object.Path)
+	suite.Equal(event.Object.Meta.Version, strconv.FormatInt(event.Revision, 10), "revision is the modify index")
+
+	suite.Nil(suite.Backend.PutObject("charts/nested/ignored.tgz", []byte("v1")))
+	suite.Nil(suite.Backend.PutObject("charts/nginx-1.0.0.tgz", []byte("v2")))
+	event = next()
+	suite.Equal(EventUpdated, event.Type, "nested objects are not watched")
+
+	suite.Nil(suite.Backend.DeleteObject("charts/existing.tgz"))
+	event = next()
+	suite.Equal(EventDeleted, event.Type)
+	suite.Equal("existing.tgz", event.Object.Path)
+
+	cancel()
+	for range events {
+	}
+}
+
+func TestConsulStorageTestSuite(t *testing.T) {
+	suite.Run(t, new(ConsulTestSuite))
+}
@@ -0,0 +1,19 @@
+package storage
+
+import "fmt"
+
+// PrefixDeleter is implemented by backends able to remove all objects under a prefix recursively
+type PrefixDeleter interface {
+	// DeletePrefix removes objects with keys starting with prefix followed by a slash,
+	// empty prefix is rejected with InvalidKeyError to never wipe a whole backend by mistake
+	DeletePrefix(prefix string) error
+}
+
+// deletePrefix removes prefix from a backend wrapped by another one, which must support prefix deletes
+func deletePrefix(backend Backend, prefix string) error {
+	deleter, ok := backend.(PrefixDeleter)
+	if !ok {
+		return fmt.Errorf("%T does not support prefix deletes", backend)
+	}
+	return deleter.DeletePrefix(prefix)
+}
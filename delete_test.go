@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type DeleteTestSuite struct {
+	BackendsTestSuite
+}
+
+func (suite *DeleteTestSuite) exists(relPath string) bool {
+	_, err := os.Stat(suite.Dir().rootDir + "/" + relPath)
+	return err == nil
+}
+
+func (suite *DeleteTestSuite) TestDeleteObjectPrunesEmptyDirs() {
+	dir := suite.Dir()
+	suite.Nil(dir.PutObjectWithTTL("a/b/c/expiring.tgz", []byte("data"), time.Hour))
+	suite.Nil(dir.PutObject("a/kept.tgz", []byte("data")))
+
+	suite.Nil(dir.DeleteObject("a/b/c/expiring.tgz"))
+	suite.False(suite.exists("a/b"), "empty parents pruned")
+	suite.True(suite.exists("a/kept.tgz"), "parent with objects kept")
+	suite.True(suite.exists(""), "root kept")
+
+	suite.Nil(dir.DeleteObject("a/kept.tgz"))
+	suite.False(suite.exists("a"))
+	suite.True(suite.exists(""), "root kept when empty")
+}
+
+func (suite *DeleteTestSuite) TestDeletePrefix() {
+	suite.EachBackend(func(b Backend) bool {
+		_, ok := b.(PrefixDeleter)
+		return ok
+	}, suite.assertDeletePrefix)
+}
+
+func (suite *DeleteTestSuite) TestWrappersDeletePrefix() {
+	dir := func(name string) *DirStorage {
+		backend, err := suite.Fixture.DirStorage(suite.T().Name() + "/" + name)
+		suite.Require().Nil(err)
+		return backend
+	}
+
+	replicated, err := NewReplicatedBackend(ReplicatedOptions{Replicas: []Replica{
+		{Name: "primary", Backend: dir("primary")},
+		{Name: "secondary", Backend: dir("secondary")},
+	}})
+	suite.Nil(err)
+	tiered, err := NewTieredBackend(TieredOptions{Hot: dir("hot"), Cold: dir("cold"), MaxAge: time.Hour})
+	suite.Nil(err)
+	sharded, err := NewShardedBackend(ShardedOptions{Shards: []Shard{
+		{Name: "a", Backend: dir("a")},
+		{Name: "b", Backend: dir("b")},
+	}})
+	suite.Nil(err)
+
+	for name, backend := range map[string]Backend{"Replicated": replicated, "Tiered": tiered, "Sharded": sharded} {
+		suite.Run(name, func() {
+			suite.assertDeletePrefix(backend)
+		})
+	}
+
+	suite.True(errors.Is(replicated.DeletePrefix(replicationLogPrefix), ErrInvalidKey), "replication log is never deleted")
+
+	partial, err := NewTieredBackend(TieredOptions{Hot: dir("partial"), Cold: brokenBackend{}, MaxAge: time.Hour})
+	suite.Nil(err)
+	suite.NotNil(partial.DeletePrefix("releases"), "children without prefix deletes are not skipped")
+}
+
+func (suite *DeleteTestSuite) assertDeletePrefix(backend Backend) {
+	deleter := backend.(PrefixDeleter)
+	suite.Nil(backend.PutObject("releases/1.0/app.tgz", []byte("app")))
+	suite.Nil(backend.PutObject("releases/1.0/db/db.tgz", []byte("db")))
+	suite.Nil(backend.PutObject("releases/2.0/app.tgz", []byte("app")))
+	suite.Nil(backend.PutObject("releases/1.0.tgz", []byte("archive")))
+
+	suite.Nil(deleter.DeletePrefix("releases/1.0"))
+	for _, key := range []string{"releases/1.0/app.tgz", "releases/1.0/db/db.tgz"} {
+		_, err := backend.GetObject(key)
+		suite.True(errors.Is(err, os.ErrNotExist), "%s removed recursively", key)
+	}
+	_, err := backend.GetObject("releases/2.0/app.tgz")
+	suite.Nil(err)
+	_, err = backend.GetObject("releases/1.0.tgz")
+	suite.Nil(err, "sibling keys sharing the prefix string kept")
+
+	suite.Nil(deleter.DeletePrefix("releases/2.0"))
+	suite.Nil(backend.DeleteObject("releases/1.0.tgz"))
+	objects, err := backend.ListObjects("releases")
+	suite.Nil(err)
+	suite.Empty(objects)
+
+	suite.True(errors.Is(deleter.DeletePrefix(""), ErrInvalidKey), "root is never deleted")
+	suite.True(errors.Is(deleter.DeletePrefix(".."), ErrInvalidKey))
+}
+
+func (suite *DeleteTestSuite) TestDirDeletePrefixPrunesEmptyDirs() {
+	dir := suite.Dir()
+	suite.Nil(dir.PutObject("prune/1.0/app.tgz", []byte("app")))
+	suite.Nil(dir.DeletePrefix("prune/1.0"))
+	suite.False(suite.exists("prune"), "empty parents pruned")
+}
+
+func (suite *DeleteTestSuite) TestCommittedDeletePrefix() {
+	committed, err := NewCommittedBackend(CommittedOptions{Backend: suite.Dir()})
+	suite.Nil(err)
+
+	suite.Nil(committed.PutObject("committed/1.0/app.tgz", []byte("app")))
+	suite.Nil(committed.PutObject("committed/2.0/app.tgz", []byte("app")))
+
+	suite.Nil(committed.DeletePrefix("committed/1.0"))
+	_, err = committed.GetObject("committed/1.0/app.tgz")
+	suite.True(os.IsNotExist(err))
+	_, err = committed.GetObject("committed/2.0/app.tgz")
+	suite.Nil(err)
+}
+
+func TestDeleteTestSuite(t *testing.T) {
+	suite.Run(t, &DeleteTestSuite{BackendsTestSuite: BackendsTestSuite{Name: "delete"}})
+}
@@ -1,85 +1,376 @@
 package storage
 
 import (
+	"context"
+	"encoding/json"
+	"github.com/fsnotify/fsnotify"
 	"go.uber.org/zap"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dirMetaDir holds metadata sidecars of the files in its parent directory,
+// it is hidden from ListObjects as all the directories
+const dirMetaDir = ".meta"
+
+// dirLockRetryInterval is shorter than DefaultLockRetryInterval as a local flock is cheap to retry
+const dirLockRetryInterval = 50 * time.Millisecond
+
+// dirObjectMeta is stored in a sidecar file next to the object
+type dirObjectMeta struct {
+	Expires     time.Time         `json:"expires"`
+	ContentType string            `json:"content_type,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	Checksum    string            `json:"sha256,omitempty"`
+	// Data names the version file in the metadata directory holding the data the sidecar describes,
+	// the object file is a hard link to it. Empty if the object file itself holds the data
+	Data string `json:"data,omitempty"`
+}
+
+// dirTempPrefix marks files being written, they are renamed to the object name once complete
+// and hidden from ListObjects and Watch until then
+const dirTempPrefix = ".storage-tmp-"
+
+const (
+	DefaultDirFileMode os.FileMode = 0644
+	DefaultDirMode     os.FileMode = 0755
 )
 
 type DirStorage struct {
-	logger  *zap.SugaredLogger
-	rootDir string
+	logger   *zap.SugaredLogger
+	rootDir  string
+	fileMode os.FileMode
+	dirMode  os.FileMode
+}
+
+type DirOptions struct {
+	Logger  *zap.SugaredLogger
+	RootDir string
+	// FileMode is the permission of written files. Defaults to DefaultDirFileMode
+	FileMode os.FileMode
+	// DirMode is the permission of created directories. Defaults to DefaultDirMode
+	DirMode os.FileMode
 }
 
 func NewDirStorage(rootDir string) (*DirStorage, error) {
-	absPath, err := filepath.Abs(rootDir)
+	return NewDirStorageWithOptions(DirOptions{
+		RootDir: rootDir,
+	})
+}
+
+func NewDirStorageWithOptions(opts DirOptions) (*DirStorage, error) {
+	absPath, err := filepath.Abs(opts.RootDir)
 	if err != nil {
 		return nil, err
 	}
 
+	if opts.Logger == nil {
+		opts.Logger = zap.S()
+	}
+
+	if opts.FileMode == 0 {
+		opts.FileMode = DefaultDirFileMode
+	}
+
+	if opts.DirMode == 0 {
+		opts.DirMode = DefaultDirMode
+	}
+
 	return &DirStorage{
-		rootDir: absPath,
+		logger:   opts.Logger,
+		rootDir:  absPath,
+		fileMode: opts.FileMode,
+		dirMode:  opts.DirMode,
 	}, nil
 }
 
 func (s *DirStorage) GetObject(key string) (Object, error) {
 	var object Object
 	object.Path = key
-	fullPath := path.Join(s.rootDir, key)
+	fullPath, err := s.fullPath(key)
+	if err != nil {
+		return object, err
+	}
 
-	content, err := ioutil.ReadFile(fullPath)
+	meta, content, info, err := s.readObject(fullPath, true)
+	if err != nil {
+		return object, err
+	}
+	if isExpired(meta.Expires) {
+		return object, &os.PathError{Op: "open", Path: fullPath, Err: os.ErrNotExist}
+	}
+
+	checksum, err := objectChecksum(key, content, meta.Checksum)
 	if err != nil {
 		return object, err
 	}
 
 	object.Data = content
-	info, err := os.Stat(fullPath)
+	object.Meta = meta.objectMeta(key)
+	object.Meta.Checksum = checksum
+	object.LastModified = info.ModTime()
+	return object, nil
+}
+
+// StatObject returns object metadata from its sidecar, without reading the data
+func (s *DirStorage) StatObject(key string) (Object, error) {
+	object := Object{Path: key, Data: []byte{}}
+	fullPath, err := s.fullPath(key)
+	if err != nil {
+		return object, err
+	}
+
+	meta, _, info, err := s.readObject(fullPath, false)
+	if err == nil && isExpired(meta.Expires) {
+		err = &os.PathError{Op: "stat", Path: fullPath, Err: os.ErrNotExist}
+	}
 	if err != nil {
 		return object, err
 	}
+
+	object.Meta = meta.objectMeta(key)
 	object.LastModified = info.ModTime()
-	return object, err
+	return object, nil
+}
+
+// readObject reads the sidecar and the data file it describes. The version file named by the sidecar
+// is removed once a newer write is committed, so the sidecar is read again if the version is gone
+func (s *DirStorage) readObject(fullPath string, withData bool) (dirObjectMeta, []byte, os.FileInfo, error) {
+	for attempt := 0; ; attempt++ {
+		meta, err := s.readMeta(fullPath)
+		if err != nil {
+			return meta, nil, nil, err
+		}
+
+		content, info, err := readDataFile(meta.dataPath(fullPath), withData)
+		if err != nil && os.IsNotExist(err) && meta.Data != "" && attempt < 3 {
+			continue
+		}
+		return meta, content, info, err
+	}
+}
+
+func readDataFile(dataPath string, withData bool) ([]byte, os.FileInfo, error) {
+	file, err := os.Open(dataPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err == nil && info.IsDir() {
+		// a key naming a prefix is not an object
+		return nil, nil, &os.PathError{Op: "open", Path: dataPath, Err: os.ErrNotExist}
+	}
+	if err != nil || !withData {
+		return nil, info, err
+	}
+
+	content, err := ioutil.ReadAll(file)
+	return content, info, err
+}
+
+// PutObjectWithMetadata writes an object along with a metadata sidecar
+// holding its content type, user metadata and checksum
+func (s *DirStorage) PutObjectWithMetadata(key string, data []byte, meta Metadata) error {
+	fullPath, err := s.fullPath(key)
+	if err != nil {
+		return err
+	}
+
+	checksum, err := objectChecksum(key, data, meta.Checksum)
+	if err != nil {
+		return err
+	}
+
+	return s.writeObject(fullPath, data, dirObjectMeta{
+		ContentType: meta.ContentType,
+		Metadata:    meta.UserMetadata,
+		Checksum:    checksum,
+	})
 }
 
 func (s *DirStorage) PutObject(key string, data []byte) error {
-	fullPath := path.Join(s.rootDir, key)
-	folderPath := path.Dir(fullPath)
+	fullPath, err := s.fullPath(key)
+	if err != nil {
+		return err
+	}
 
-	if _, err := os.Stat(folderPath); err != nil {
-		if os.IsNotExist(err) {
-			if err := os.MkdirAll(folderPath, 0777); err != nil {
-				return err
-			}
-		} else {
+	// object overwritten without ttl must not expire, a sidecar without it is committed along with the data
+	if _, err := os.Stat(metaPath(fullPath)); err == nil {
+		return s.writeObject(fullPath, data, dirObjectMeta{})
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	return s.writeFile(fullPath, data)
+}
+
+// PutObjectWithTTL writes an object that expires after ttl,
+// expiration time is kept in a metadata sidecar until SweepExpired removes the object
+func (s *DirStorage) PutObjectWithTTL(key string, data []byte, ttl time.Duration) error {
+	fullPath, err := s.fullPath(key)
+	if err != nil {
+		return err
+	}
+
+	expires, err := expiresAt(ttl)
+	if err != nil {
+		return err
+	}
+
+	return s.writeObject(fullPath, data, dirObjectMeta{Expires: expires})
+}
+
+// writeObject commits data along with its sidecar. Data is written to a new version file in the metadata
+// directory and linked to the object file first, the rename of the sidecar naming the version then switches
+// readers to the new data and metadata at once. A crash before it leaves the previous version readable,
+// a version file of a write that has not been committed is left behind
+func (s *DirStorage) writeObject(fullPath string, data []byte, meta dirObjectMeta) error {
+	previous, err := s.readMeta(fullPath)
+	if err != nil {
+		return err
+	}
+
+	id, err := randomID()
+	if err != nil {
+		return err
+	}
+	meta.Data = path.Base(fullPath) + "." + id[:16] + ".data"
+	versionPath := meta.dataPath(fullPath)
+
+	if err := s.writeFile(versionPath, data); err != nil {
+		return err
+	}
+
+	if err := s.linkFile(versionPath, fullPath); err != nil {
+		os.Remove(versionPath)
+		return err
+	}
+
+	if err := s.writeMeta(fullPath, meta); err != nil {
+		os.Remove(versionPath)
+		return err
+	}
+
+	s.removeVersion(fullPath, previous)
+	return nil
+}
+
+// linkFile replaces fullPath with a hard link to versionPath.
+// Data is copied if the filesystem does not support hard links
+func (s *DirStorage) linkFile(versionPath string, fullPath string) error {
+	tmp := path.Join(path.Dir(fullPath), dirTempPrefix+path.Base(versionPath))
+	if err := os.Link(versionPath, tmp); err != nil {
+		data, readErr := ioutil.ReadFile(versionPath)
+		if readErr != nil {
 			return err
 		}
+		return s.writeFile(fullPath, data)
 	}
 
-	if err := ioutil.WriteFile(fullPath, data, 0644); err != nil {
+	if err := os.Rename(tmp, fullPath); err != nil {
+		os.Remove(tmp)
 		return err
 	}
+	return syncDir(path.Dir(fullPath))
+}
 
-	return nil
+// removeVersion removes the version file of a superseded or deleted sidecar
+func (s *DirStorage) removeVersion(fullPath string, meta dirObjectMeta) {
+	if meta.Data == "" {
+		return
+	}
+	if err := os.Remove(meta.dataPath(fullPath)); err != nil && !os.IsNotExist(err) {
+		s.logger.Warnf("Unable to remove superseded version %s: %s", meta.Data, err)
+	}
 }
 
 func (s *DirStorage) DeleteObject(key string) error {
-	fullPath := path.Join(s.rootDir, key)
-	return os.Remove(fullPath)
+	fullPath, err := s.fullPath(key)
+	if err != nil {
+		return err
+	}
+
+	meta, err := s.readMeta(fullPath)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(fullPath); err != nil {
+		return err
+	}
+
+	if err := os.Remove(metaPath(fullPath)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	s.removeVersion(fullPath, meta)
+	s.pruneDirs(path.Dir(fullPath))
+	return nil
+}
+
+// DeletePrefix removes the prefix directory with all objects under it and prunes its empty parents
+func (s *DirStorage) DeletePrefix(prefix string) error {
+	normalized, err := dirKeyRules.validate(prefix)
+	if err != nil {
+		return err
+	}
+
+	dir, err := s.prefixPath(normalized)
+	if err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+
+	s.pruneDirs(path.Dir(dir))
+	return nil
+}
+
+// pruneDirs removes empty directories from dir up to the root, along with their empty metadata directories.
+// Removal of a directory that is not empty fails, so objects written concurrently are kept
+func (s *DirStorage) pruneDirs(dir string) {
+	for strings.HasPrefix(dir, s.rootDir+"/") {
+		os.Remove(path.Join(dir, dirMetaDir))
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+		dir = path.Dir(dir)
+	}
 }
 
 func (s *DirStorage) ListObjects(prefix string) ([]Object, error) {
 	var objects []Object
-	files, err := ioutil.ReadDir(path.Join(s.rootDir, prefix))
+	dir, err := s.prefixPath(prefix)
+	if err != nil {
+		return objects, err
+	}
+
+	files, err := ioutil.ReadDir(dir)
 	if err != nil {
 		if os.IsNotExist(err) { // OK if the directory doesnt exist yet
 			err = nil
 		}
 		return objects, err
 	}
+
+	expired, err := s.expiredFiles(dir)
+	if err != nil {
+		return objects, err
+	}
+
 	for _, f := range files {
-		if f.IsDir() {
+		if f.IsDir() || expired[f.Name()] || strings.HasPrefix(f.Name(), dirTempPrefix) {
 			continue
 		}
 
@@ -89,3 +380,417 @@ func (s *DirStorage) ListObjects(prefix string) ([]Object, error) {
 
 	return objects, nil
 }
+
+// SweepExpired removes expired objects right under prefix directory
+func (s *DirStorage) SweepExpired(prefix string) ([]string, error) {
+	dir, err := s.prefixPath(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	expired, err := s.expiredFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var swept []string
+	for name := range expired {
+		key := joinObjectPath(prefix, name)
+		if err := s.DeleteObject(key); err != nil && !os.IsNotExist(err) {
+			return swept, err
+		}
+		if err := os.Remove(metaPath(path.Join(dir, name))); err != nil && !os.IsNotExist(err) {
+			return swept, err
+		}
+		swept = append(swept, key)
+	}
+
+	sort.Strings(swept)
+	return swept, nil
+}
+
+// writeFile writes data to a temporary file in the same directory, syncs it and renames it over fullPath,
+// so a crash never leaves a partially written file and readers see either old or new content
+func (s *DirStorage) writeFile(fullPath string, data []byte) error {
+	folderPath := path.Dir(fullPath)
+
+	var tmp *os.File
+	for attempt := 0; ; attempt++ {
+		if err := os.MkdirAll(folderPath, s.dirMode); err != nil {
+			return err
+		}
+
+		var err error
+		tmp, err = ioutil.TempFile(folderPath, dirTempPrefix+path.Base(fullPath)+"-")
+		if err == nil {
+			break
+		}
+		// the directory may be pruned by a concurrent delete before the file is created in it
+		if !os.IsNotExist(err) || attempt == 2 {
+			return err
+		}
+	}
+
+	err := writeTempFile(tmp, data, s.fileMode)
+	if err == nil {
+		err = os.Rename(tmp.Name(), fullPath)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	// persist the rename itself
+	return syncDir(folderPath)
+}
+
+func writeTempFile(tmp *os.File, data []byte, mode os.FileMode) error {
+	_, err := tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(mode)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// fullPath validates key and returns the path of its file, which never escapes the root directory
+func (s *DirStorage) fullPath(key string) (string, error) {
+	normalized, err := dirKeyRules.validate(key)
+	if err != nil {
+		return "", err
+	}
+	return s.rootPath(key, normalized)
+}
+
+// prefixPath validates prefix and returns the path of its directory
+func (s *DirStorage) prefixPath(prefix string) (string, error) {
+	normalized, err := dirKeyRules.validatePrefix(prefix)
+	if err != nil {
+		return "", err
+	}
+	return s.rootPath(prefix, normalized)
+}
+
+func (s *DirStorage) rootPath(key string, normalized string) (string, error) {
+	fullPath := path.Join(s.rootDir, normalized)
+	if fullPath != s.rootDir && !strings.HasPrefix(fullPath, s.rootDir+"/") {
+		return "", &InvalidKeyError{Key: key, Reason: "key escapes the root directory"}
+	}
+	return fullPath, nil
+}
+
+func (m dirObjectMeta) objectMeta(key string) Metadata {
+	return Metadata{
+		Name:         path.Base(key),
+		ContentType:  m.ContentType,
+		UserMetadata: m.Metadata,
+		Checksum:     m.Checksum,
+	}
+}
+
+func metaPath(fullPath string) string {
+	return path.Join(path.Dir(fullPath), dirMetaDir, path.Base(fullPath)+".json")
+}
+
+// dataPath returns the path of the file holding the data described by the sidecar
+func (m dirObjectMeta) dataPath(fullPath string) string {
+	if m.Data == "" {
+		return fullPath
+	}
+	return path.Join(path.Dir(fullPath), dirMetaDir, path.Base(m.Data))
+}
+
+func (s *DirStorage) readMeta(fullPath string) (dirObjectMeta, error) {
+	var meta dirObjectMeta
+	content, err := ioutil.ReadFile(metaPath(fullPath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return meta, err
+	}
+
+	err = json.Unmarshal(content, &meta)
+	return meta, err
+}
+
+func (s *DirStorage) writeMeta(fullPath string, meta dirObjectMeta) error {
+	content, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	return s.writeFile(metaPath(fullPath), content)
+}
+
+// expiredFiles returns names of expired files in dir
+func (s *DirStorage) expiredFiles(dir string) (map[string]bool, error) {
+	expired := make(map[string]bool)
+	files, err := ioutil.ReadDir(path.Join(dir, dirMetaDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return expired, err
+	}
+
+	for _, f := range files {
+		name := strings.TrimSuffix(f.Name(), ".json")
+		if f.IsDir() || name == f.Name() {
+			continue
+		}
+
+		content, err := ioutil.ReadFile(path.Join(dir, dirMetaDir, f.Name()))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return expired, err
+		}
+
+		var meta dirObjectMeta
+		if err := json.Unmarshal(content, &meta); err != nil {
+			return expired, err
+		}
+		if isExpired(meta.Expires) {
+			expired[name] = true
+		}
+	}
+
+	return expired, nil
+}
+
+// Watch notifies about changes of files right under prefix directory using fsnotify
+func (s *DirStorage) Watch(ctx context.Context, prefix string) <-chan Event {
+	events := make(chan Event)
+	dir, err := s.prefixPath(prefix)
+	if err != nil {
+		s.logger.Errorf("Unable to watch '%s' prefix: %s", prefix, err)
+		close(events)
+		return events
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		if err = os.MkdirAll(dir, s.dirMode); err == nil {
+			err = watcher.Add(dir)
+		}
+		if err != nil {
+			watcher.Close()
+		}
+	}
+	if err != nil {
+		s.logger.Errorf("Unable to watch '%s' directory: %s", dir, err)
+		close(events)
+		return events
+	}
+
+	known := make(map[string]bool)
+	if files, err := ioutil.ReadDir(dir); err == nil {
+		for _, f := range files {
+			if !f.IsDir() {
+				known[f.Name()] = true
+			}
+		}
+	}
+
+	go func() {
+		defer close(events)
+		defer watcher.Close()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				s.logger.Errorf("Unable to watch '%s' directory: %s", dir, err)
+			case e, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+
+				if e.Name == dir && e.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+					// the directory has been pruned after its last object was deleted, keep watching it
+					if err := os.MkdirAll(dir, s.dirMode); err == nil {
+						err = watcher.Add(dir)
+					}
+					if err != nil {
+						s.logger.Errorf("Unable to watch '%s' directory: %s", dir, err)
+						return
+					}
+
+					// report files written before the directory has been watched again
+					files, _ := ioutil.ReadDir(dir)
+					for _, f := range files {
+						if f.IsDir() || known[f.Name()] {
+							continue
+						}
+						event, ok := newDirEvent(fsnotify.Event{Name: path.Join(dir, f.Name()), Op: fsnotify.Create}, known)
+						if !ok {
+							continue
+						}
+						select {
+						case events <- event:
+						case <-ctx.Done():
+							return
+						}
+					}
+					continue
+				}
+
+				event, ok := newDirEvent(e, known)
+				if !ok {
+					continue
+				}
+
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return events
+}
+
+// newDirEvent converts fsnotify event to an object event. Writes are atomic renames reported as creates,
+// so known holds names of existing files to tell updates apart
+func newDirEvent(e fsnotify.Event, known map[string]bool) (Event, bool) {
+	object := Object{Path: filepath.Base(e.Name), Data: []byte{}}
+	if strings.HasPrefix(object.Path, dirTempPrefix) {
+		return Event{}, false
+	}
+
+	var eventType EventType
+	switch {
+	case e.Op&fsnotify.Create != 0:
+		eventType = EventCreated
+		if known[object.Path] {
+			eventType = EventUpdated
+		}
+	case e.Op&fsnotify.Write != 0:
+		eventType = EventUpdated
+	case e.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+		delete(known, object.Path)
+		return Event{Type: EventDeleted, Object: object}, true
+	default:
+		return Event{}, false
+	}
+
+	info, err := os.Stat(e.Name)
+	if err != nil || info.IsDir() {
+		return Event{}, false
+	}
+	object.LastModified = info.ModTime()
+	known[object.Path] = true
+
+	return Event{Type: eventType, Object: object}, true
+}
+
+// dirLock is an exclusive flock on a file under lockDir, holding the last fencing token
+type dirLock struct {
+	mu    sync.Mutex
+	file  *os.File
+	token int64
+}
+
+// Lock acquires an exclusive flock of a file named after the lock.
+// The kernel releases the lock when the holding process exits, so ttl is not used
+func (s *DirStorage) Lock(ctx context.Context, name string, ttl time.Duration) (Lock, error) {
+	normalized, err := dirKeyRules.validate(name)
+	if err != nil {
+		return nil, err
+	}
+
+	fullPath := path.Join(s.rootDir, lockDir, normalized)
+	if err := os.MkdirAll(path.Dir(fullPath), s.dirMode); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(fullPath, os.O_RDWR|os.O_CREATE, s.fileMode)
+	if err != nil {
+		return nil, err
+	}
+
+	err = retryLock(ctx, dirLockRetryInterval, func() (bool, error) {
+		return tryLockFile(file)
+	})
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	token, err := nextDirLockToken(file)
+	if err != nil {
+		unlockFile(file)
+		file.Close()
+		return nil, err
+	}
+
+	return &dirLock{file: file, token: token}, nil
+}
+
+// nextDirLockToken increments the fencing token stored in the locked file
+func nextDirLockToken(file *os.File) (int64, error) {
+	content, err := ioutil.ReadAll(file)
+	if err != nil {
+		return 0, err
+	}
+
+	var token int64
+	if len(content) > 0 {
+		if token, err = strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64); err != nil {
+			return 0, err
+		}
+	}
+	token++
+
+	if err := file.Truncate(0); err != nil {
+		return 0, err
+	}
+	if _, err := file.WriteAt([]byte(strconv.FormatInt(token, 10)), 0); err != nil {
+		return 0, err
+	}
+	return token, file.Sync()
+}
+
+func (l *dirLock) Token() int64 {
+	return l.token
+}
+
+// Refresh only checks the lock is still held, flock does not expire
+func (l *dirLock) Refresh(ctx context.Context, ttl time.Duration) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return ErrLockLost
+	}
+	return nil
+}
+
+func (l *dirLock) Unlock(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return ErrLockLost
+	}
+
+	err := unlockFile(l.file)
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+	l.file = nil
+	return err
+}
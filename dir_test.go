@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"testing"
@@ -41,6 +42,68 @@ func (suite *LocalTestSuite) TestPutObjectWithNonExistentPath() {
 	suite.Nil(err)
 }
 
+func (suite *LocalTestSuite) TestPutObjectPermissions() {
+	fixture := newTestFixture("local")
+	defer fixture.Close()
+
+	backend, err := NewDirStorageWithOptions(DirOptions{
+		RootDir:  fixture.Path("modes"),
+		FileMode: 0600,
+		DirMode:  0700,
+	})
+	suite.Nil(err)
+	suite.Nil(backend.PutObject("private/key.pem", []byte("secret")))
+
+	info, err := os.Stat(backend.rootDir + "/private")
+	suite.Nil(err)
+	suite.Equal(os.FileMode(0700), info.Mode().Perm(), "directory created with configured mode")
+
+	info, err = os.Stat(backend.rootDir + "/private/key.pem")
+	suite.Nil(err)
+	suite.Equal(os.FileMode(0600), info.Mode().Perm(), "file written with configured mode")
+}
+
+func (suite *LocalTestSuite) TestPutObjectAtomic() {
+	fixture := newTestFixture("local")
+	defer fixture.Close()
+
+	backend, err := fixture.DirStorage("atomic")
+	suite.Nil(err)
+
+	original := bytes.Repeat([]byte("a"), 1024*1024)
+	updated := bytes.Repeat([]byte("b"), 1024*1024)
+	suite.Nil(backend.PutObject("index.yaml", original))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			data := updated
+			if i%2 == 1 {
+				data = original
+			}
+			suite.Nil(backend.PutObject("index.yaml", data))
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			objects, err := backend.ListObjects("")
+			suite.Nil(err)
+			suite.Len(objects, 1, "temporary files are not listed")
+			return
+		default:
+		}
+
+		object, err := backend.GetObject("index.yaml")
+		suite.Nil(err)
+		if !bytes.Equal(object.Data, original) && !bytes.Equal(object.Data, updated) {
+			suite.FailNow("reader observed partially written object")
+		}
+	}
+}
+
 func TestLocalStorageTestSuite(t *testing.T) {
 	suite.Run(t, new(LocalTestSuite))
 }
@@ -0,0 +1,33 @@
+//go:build !windows
+// +build !windows
+
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+// tryLockFile takes an exclusive flock of the file without blocking
+func tryLockFile(file *os.File) (bool, error) {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func unlockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
+
+// syncDir flushes directory entries, e.g. a file renamed into it
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return f.Sync()
+}
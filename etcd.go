@@ -2,26 +2,70 @@ package storage
 
 import (
 	"context"
+	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"github.com/spf13/viper"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
 	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
 	"go.etcd.io/etcd/client/v3/namespace"
 	"go.uber.org/zap"
 	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
+// DefaultEtcdChunkSize keeps every put request below the default etcd request size limit of 1.5 MiB
+const DefaultEtcdChunkSize = 1024 * 1024
+
+const (
+	// etcdChunkPrefix holds chunks of large objects, NUL byte keeps them apart from user keys
+	etcdChunkPrefix = "\x00chunks/"
+	// etcdMetaPrefix holds object metadata, etcd does not track modification time of keys
+	etcdMetaPrefix = "\x00meta/"
+	// etcdLockPrefix holds keys of concurrency mutexes
+	etcdLockPrefix = "\x00locks/"
+	// etcdManifestMagic marks values holding a manifest of a chunked object
+	etcdManifestMagic = "\x00storage/chunked\x00"
+)
+
 type etcdStorage struct {
-	logger *zap.SugaredLogger
-	Client *clientv3.Client
-	ctx    context.Context
+	logger    *zap.SugaredLogger
+	Client    *clientv3.Client
+	ctx       context.Context
+	chunkSize int
 }
 
 type EtcdOptions struct {
 	Logger *zap.SugaredLogger
 	Config *clientv3.Config
+	// ChunkSize is the maximum size of a value written at once,
+	// larger objects are split into chunks. Defaults to DefaultEtcdChunkSize
+	ChunkSize int
+}
+
+// etcdObjectMeta is stored under etcdMetaPrefix in the same transaction as the object value
+type etcdObjectMeta struct {
+	Modified time.Time `json:"modified"`
+}
+
+// etcdManifest is stored under the object key in place of a chunked object data.
+// Chunks of every write get a new generation, so the manifest is a commit marker:
+// readers never see a partially written object
+type etcdManifest struct {
+	Generation string `json:"generation"`
+	Chunks     int    `json:"chunks"`
+	Size       int    `json:"size"`
+	Digest     string `json:"sha256"`
 }
 
 func NewEtcdStorage(opts EtcdOptions) (*etcdStorage, error) {
@@ -90,75 +134,611 @@ func NewEtcdStorage(opts EtcdOptions) (*etcdStorage, error) {
 	cli.Watcher = namespace.NewWatcher(cli.Watcher, etcdNamespace)
 	cli.Lease = namespace.NewLease(cli.Lease, etcdNamespace)
 
+	chunkSize := opts.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DefaultEtcdChunkSize
+	}
+
 	return &etcdStorage{
-		logger: opts.Logger,
-		Client: cli,
-		ctx:    ctx,
+		logger:    opts.Logger,
+		Client:    cli,
+		ctx:       ctx,
+		chunkSize: chunkSize,
 	}, nil
 }
 
 func (s *etcdStorage) GetObject(key string) (Object, error) {
-	//
-	res, err := s.Client.Get(s.ctx, key)
+	normalized, err := defaultKeyRules.validate(key)
 	if err != nil {
-		return Object{}, err
+		return Object{Path: key}, err
 	}
+	key = normalized
 
-	if len(res.Kvs) == 0 {
-		return Object{}, fmt.Errorf("no results")
+	// read value and metadata at the same revision
+	res, err := s.Client.Txn(s.ctx).
+		Then(clientv3.OpGet(key), clientv3.OpGet(etcdMetaKey(key))).
+		Commit()
+	if err != nil {
+		return Object{Path: key}, err
 	}
 
-	val := res.Kvs[0]
-	return Object{
-		Meta: Metadata{
-			Name:    "",
-			Version: "",
-		},
-		Path: key,
-		Data: val.Key,
-		//LastModified: time.Time{},
-	}, nil
+	values := res.Responses[0].GetResponseRange().Kvs
+	if len(values) == 0 {
+		return Object{Path: key}, &os.PathError{Op: "open", Path: key, Err: os.ErrNotExist}
+	}
+
+	val := values[0]
+	data := val.Value
+	if manifest := decodeEtcdManifest(val.Value); manifest != nil {
+		// read chunks at the manifest revision, so a concurrent write can't replace them
+		data, err = s.getChunks(key, manifest, res.Header.Revision)
+		if err != nil {
+			return Object{Path: key}, err
+		}
+	}
+
+	object := newEtcdObject(key, val, res.Responses[1].GetResponseRange().Kvs)
+	object.Data = data
+	return object, nil
 }
 
+// PutObject writes data as a single value, or as chunks followed by a manifest
+// if data exceeds the chunk size
 func (s *etcdStorage) PutObject(key string, data []byte) error {
-	//
-	_, err := s.Client.Put(s.ctx, key, string(data))
+	key, err := defaultKeyRules.validate(key)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return s.putObject(key, data)
+}
+
+// PutObjectWithTTL writes an object attached to a new lease,
+// etcd removes the object with its chunks and metadata when the lease expires
+func (s *etcdStorage) PutObjectWithTTL(key string, data []byte, ttl time.Duration) error {
+	key, err := defaultKeyRules.validate(key)
+	if err != nil {
+		return err
+	}
+
+	if _, err := expiresAt(ttl); err != nil {
+		return err
+	}
+
+	// lease ttl is set in seconds, round up so an object never expires earlier
+	seconds := int64((ttl + time.Second - 1) / time.Second)
+	lease, err := s.Client.Grant(s.ctx, seconds)
+	if err != nil {
+		return err
+	}
+
+	return s.putObject(key, data, clientv3.WithLease(lease.ID))
+}
+
+func (s *etcdStorage) putObject(key string, data []byte, opts ...clientv3.OpOption) error {
+	value := string(data)
+	var manifest *etcdManifest
+	if len(data) > s.chunkSize || strings.HasPrefix(value, etcdManifestMagic) {
+		var err error
+		manifest, err = s.putChunks(key, data, opts...)
+		if err != nil {
+			return err
+		}
+		value = manifest.encode()
+	}
+
+	meta, err := json.Marshal(etcdObjectMeta{Modified: time.Now().UTC()})
+	if err != nil {
+		s.cleanupChunks(key, manifest)
+		return err
+	}
+
+	for {
+		res, err := s.Client.Get(s.ctx, key)
+		if err != nil {
+			s.cleanupChunks(key, manifest)
+			return err
+		}
+
+		var rev int64
+		var previous *etcdManifest
+		if len(res.Kvs) > 0 {
+			rev = res.Kvs[0].ModRevision
+			previous = decodeEtcdManifest(res.Kvs[0].Value)
+		}
+
+		txn, err := s.Client.Txn(s.ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", rev)).
+			Then(clientv3.OpPut(key, value, opts...), clientv3.OpPut(etcdMetaKey(key), string(meta), opts...)).
+			Commit()
+		if err != nil {
+			s.cleanupChunks(key, manifest)
+			return err
+		}
+		if !txn.Succeeded {
+			// object has been replaced concurrently, retry to clean up its chunks
+			continue
+		}
+
+		s.cleanupChunks(key, previous)
+		return nil
+	}
 }
 
 func (s *etcdStorage) DeleteObject(key string) error {
-	//
-	_, err := s.Client.Delete(s.ctx, key)
+	key, err := defaultKeyRules.validate(key)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	for {
+		res, err := s.Client.Get(s.ctx, key)
+		if err != nil {
+			return err
+		}
+		if len(res.Kvs) == 0 {
+			return nil
+		}
+
+		val := res.Kvs[0]
+		ops := []clientv3.Op{clientv3.OpDelete(key), clientv3.OpDelete(etcdMetaKey(key))}
+		if manifest := decodeEtcdManifest(val.Value); manifest != nil {
+			ops = append(ops, clientv3.OpDelete(etcdChunkGenerationPrefix(key, manifest.Generation), clientv3.WithPrefix()))
+		}
+
+		txn, err := s.Client.Txn(s.ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", val.ModRevision)).
+			Then(ops...).
+			Commit()
+		if err != nil {
+			return err
+		}
+		if txn.Succeeded {
+			return nil
+		}
+	}
+}
+
+// DeletePrefix removes objects under prefix with their metadata and chunks in a single transaction
+func (s *etcdStorage) DeletePrefix(prefix string) error {
+	prefix, err := defaultKeyRules.validate(prefix)
+	if err != nil {
+		return err
+	}
+
+	prefix += "/"
+	_, err = s.Client.Txn(s.ctx).
+		Then(
+			clientv3.OpDelete(prefix, clientv3.WithPrefix()),
+			clientv3.OpDelete(etcdMetaKey(prefix), clientv3.WithPrefix()),
+			clientv3.OpDelete(etcdChunkPrefix+prefix, clientv3.WithPrefix()),
+		).
+		Commit()
+	return err
 }
 
+// ListObjects returns objects right under prefix, with paths relative to it
 func (s *etcdStorage) ListObjects(prefix string) ([]Object, error) {
-	//
-	res, err := s.Client.Get(s.ctx, prefix, clientv3.WithPrefix())
+	prefix, err := defaultKeyRules.validatePrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	keysOp := clientv3.OpGet(prefix+"/", clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if prefix == "" {
+		// skip chunks and other reserved keys, they all start with NUL byte
+		keysOp = clientv3.OpGet("\x01", clientv3.WithFromKey(), clientv3.WithKeysOnly())
+	}
+
+	res, err := s.Client.Txn(s.ctx).
+		Then(keysOp, clientv3.OpGet(etcdMetaKey(prefix), clientv3.WithPrefix())).
+		Commit()
 	if err != nil {
 		return nil, err
 	}
 
+	metas := make(map[string][]*mvccpb.KeyValue)
+	for _, kv := range res.Responses[1].GetResponseRange().Kvs {
+		key := strings.TrimPrefix(string(kv.Key), etcdMetaPrefix)
+		metas[key] = []*mvccpb.KeyValue{kv}
+	}
+
 	var result []Object
-	for i := range res.Kvs {
-		val := res.Kvs[i]
-		result = append(result, Object{
-			Meta: Metadata{
-				Name:    "",
-				Version: "",
-			},
-			Path: string(val.Key),
-			Data: val.Value,
-		})
+	for _, kv := range res.Responses[0].GetResponseRange().Kvs {
+		key := string(kv.Key)
+		path := removePrefixFromObjectPath(prefix, key)
+		if objectPathIsInvalid(path) {
+			continue
+		}
+
+		object := newEtcdObject(key, kv, metas[key])
+		object.Path = path
+		result = append(result, object)
 	}
 
 	return result, nil
 }
+
+// Watch notifies about changes of objects right under prefix using etcd watch API
+func (s *etcdStorage) Watch(ctx context.Context, prefix string) <-chan Event {
+	return s.WatchFromRevision(ctx, prefix, 0)
+}
+
+// WatchFromRevision resumes watching from a revision, e.g. the one following the last received event.
+// Zero revision starts from the current one
+func (s *etcdStorage) WatchFromRevision(ctx context.Context, prefix string, rev int64) <-chan Event {
+	events := make(chan Event)
+
+	normalized, err := defaultKeyRules.validatePrefix(prefix)
+	if err != nil {
+		s.logger.Errorf("Unable to watch '%s' prefix: %s", prefix, err)
+		close(events)
+		return events
+	}
+	prefix = normalized
+
+	key := prefix + "/"
+	opts := []clientv3.OpOption{clientv3.WithPrefix()}
+	if prefix == "" {
+		// skip chunks and other reserved keys, they all start with NUL byte
+		key = "\x01"
+		opts = []clientv3.OpOption{clientv3.WithFromKey()}
+	}
+	if rev > 0 {
+		opts = append(opts, clientv3.WithRev(rev))
+	}
+
+	watchCtx, cancel := context.WithCancel(clientv3.WithRequireLeader(ctx))
+	watchChan := s.Client.Watch(watchCtx, key, opts...)
+
+	go func() {
+		defer close(events)
+		defer cancel()
+
+		for res := range watchChan {
+			if err := res.Err(); err != nil {
+				if res.CompactRevision > 0 {
+					s.logger.Errorf("Unable to watch '%s' from revision %d, compacted at %d", prefix, rev, res.CompactRevision)
+				} else {
+					s.logger.Errorf("Unable to watch '%s': %s", prefix, err)
+				}
+				return
+			}
+
+			for _, e := range res.Events {
+				path := removePrefixFromObjectPath(prefix, string(e.Kv.Key))
+				if objectPathIsInvalid(path) {
+					continue
+				}
+
+				object := newEtcdObject(string(e.Kv.Key), e.Kv, nil)
+				object.Path = path
+
+				event := Event{Object: object, Revision: e.Kv.ModRevision}
+				switch {
+				case e.Type == mvccpb.DELETE:
+					event.Type = EventDeleted
+				case e.IsCreate():
+					event.Type = EventCreated
+				default:
+					event.Type = EventUpdated
+				}
+
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return events
+}
+
+func newEtcdObject(key string, kv *mvccpb.KeyValue, metas []*mvccpb.KeyValue) Object {
+	object := Object{
+		Meta: Metadata{
+			Name:    path.Base(key),
+			Version: strconv.FormatInt(kv.ModRevision, 10),
+		},
+		Path: key,
+		Data: []byte{},
+	}
+
+	if len(metas) > 0 {
+		var meta etcdObjectMeta
+		if err := json.Unmarshal(metas[0].Value, &meta); err == nil {
+			object.LastModified = meta.Modified
+		}
+	}
+
+	return object
+}
+
+func (s *etcdStorage) putChunks(key string, data []byte, opts ...clientv3.OpOption) (*etcdManifest, error) {
+	generation := make([]byte, 8)
+	if _, err := rand.Read(generation); err != nil {
+		return nil, err
+	}
+
+	manifest := &etcdManifest{
+		Generation: hex.EncodeToString(generation),
+		Size:       len(data),
+		Digest:     sha256Digest(data),
+	}
+
+	for offset := 0; offset < len(data); offset += s.chunkSize {
+		end := offset + s.chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+
+		chunkKey := etcdChunkKey(key, manifest.Generation, manifest.Chunks)
+		if _, err := s.Client.Put(s.ctx, chunkKey, string(data[offset:end]), opts...); err != nil {
+			s.cleanupChunks(key, manifest)
+			return nil, err
+		}
+		manifest.Chunks++
+	}
+
+	return manifest, nil
+}
+
+func (s *etcdStorage) getChunks(key string, manifest *etcdManifest, rev int64) ([]byte, error) {
+	data := make([]byte, 0, manifest.Size)
+	for i := 0; i < manifest.Chunks; i++ {
+		res, err := s.Client.Get(s.ctx, etcdChunkKey(key, manifest.Generation, i), clientv3.WithRev(rev))
+		if err != nil {
+			return nil, err
+		}
+		if len(res.Kvs) == 0 {
+			return nil, fmt.Errorf("chunk %d of %s not found", i, key)
+		}
+		data = append(data, res.Kvs[0].Value...)
+	}
+
+	if len(data) != manifest.Size || sha256Digest(data) != manifest.Digest {
+		return nil, fmt.Errorf("chunks of %s do not match the manifest", key)
+	}
+
+	return data, nil
+}
+
+// cleanupChunks removes chunks of a manifest generation, failures leave orphaned chunks behind
+// that are invisible to readers
+func (s *etcdStorage) cleanupChunks(key string, manifest *etcdManifest) {
+	if manifest == nil {
+		return
+	}
+
+	prefix := etcdChunkGenerationPrefix(key, manifest.Generation)
+	if _, err := s.Client.Delete(s.ctx, prefix, clientv3.WithPrefix()); err != nil {
+		s.logger.Warnf("Unable to remove chunks of %s: %s", key, err)
+	}
+}
+
+func (m *etcdManifest) encode() string {
+	payload, _ := json.Marshal(m)
+	return etcdManifestMagic + string(payload)
+}
+
+func decodeEtcdManifest(value []byte) *etcdManifest {
+	if !strings.HasPrefix(string(value), etcdManifestMagic) {
+		return nil
+	}
+
+	var manifest etcdManifest
+	if err := json.Unmarshal(value[len(etcdManifestMagic):], &manifest); err != nil {
+		return nil
+	}
+
+	return &manifest
+}
+
+func etcdMetaKey(key string) string {
+	return etcdMetaPrefix + key
+}
+
+func etcdChunkGenerationPrefix(key string, generation string) string {
+	return etcdChunkPrefix + key + "\x00" + generation + "/"
+}
+
+func etcdChunkKey(key string, generation string, n int) string {
+	return fmt.Sprintf("%s%08d", etcdChunkGenerationPrefix(key, generation), n)
+}
+
+// etcdLock is a concurrency mutex held by a session,
+// the session keeps its lease alive until the lock is released or the process exits
+type etcdLock struct {
+	mu       sync.Mutex
+	released bool
+	client   *clientv3.Client
+	session  *concurrency.Session
+	mutex    *concurrency.Mutex
+	token    int64
+}
+
+// Lock acquires a mutex of clientv3/concurrency attached to a lease of ttl.
+// Fencing token is the create revision of the holder's key, it grows with every acquisition
+func (s *etcdStorage) Lock(ctx context.Context, name string, ttl time.Duration) (Lock, error) {
+	name, err := defaultKeyRules.validate(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := expiresAt(ttl); err != nil {
+		return nil, err
+	}
+
+	// lease ttl is set in seconds, round up so a lock never expires earlier
+	seconds := int((ttl + time.Second - 1) / time.Second)
+	session, err := concurrency.NewSession(s.Client, concurrency.WithTTL(seconds), concurrency.WithContext(s.ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	mutex := concurrency.NewMutex(session, etcdLockPrefix+name)
+	if err := mutex.Lock(ctx); err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	res, err := s.Client.Get(ctx, mutex.Key())
+	if err == nil && len(res.Kvs) == 0 {
+		err = ErrLockLost
+	}
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	return &etcdLock{
+		client:  s.Client,
+		session: session,
+		mutex:   mutex,
+		token:   res.Kvs[0].CreateRevision,
+	}, nil
+}
+
+func (l *etcdLock) Token() int64 {
+	return l.token
+}
+
+// Refresh renews the session lease, its ttl is set once on Lock
+func (l *etcdLock) Refresh(ctx context.Context, ttl time.Duration) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.released {
+		return ErrLockLost
+	}
+	select {
+	case <-l.session.Done():
+		return ErrLockLost
+	default:
+	}
+
+	if _, err := l.client.KeepAliveOnce(ctx, l.session.Lease()); err != nil {
+		if err == rpctypes.ErrLeaseNotFound {
+			return ErrLockLost
+		}
+		return err
+	}
+	return nil
+}
+
+func (l *etcdLock) Unlock(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.released {
+		return ErrLockLost
+	}
+	l.released = true
+
+	select {
+	case <-l.session.Done():
+		l.session.Close()
+		return ErrLockLost
+	default:
+	}
+
+	err := l.mutex.Unlock(ctx)
+	if closeErr := l.session.Close(); err == nil && closeErr != nil && closeErr != rpctypes.ErrLeaseNotFound {
+		err = closeErr
+	}
+	return err
+}
+
+// CommitBatch applies the batch in a single transaction, so readers observe either none or all of its operations.
+// Chunks of large objects are written before the transaction and removed if it fails.
+// The number of operations is limited by the --max-txn-ops setting of etcd server
+func (s *etcdStorage) CommitBatch(ctx context.Context, batch *Batch) error {
+	batch, err := defaultKeyRules.validateBatch(batch)
+	if err != nil {
+		return err
+	}
+
+	ops := batch.Ops()
+	manifests := make(map[string]*etcdManifest)
+	rollback := func() {
+		for key, manifest := range manifests {
+			s.cleanupChunks(key, manifest)
+		}
+	}
+
+	for _, op := range ops {
+		if op.Delete || (len(op.Data) <= s.chunkSize && !strings.HasPrefix(string(op.Data), etcdManifestMagic)) {
+			continue
+		}
+		manifest, err := s.putChunks(op.Key, op.Data)
+		if err != nil {
+			rollback()
+			return err
+		}
+		manifests[op.Key] = manifest
+	}
+
+	meta, err := json.Marshal(etcdObjectMeta{Modified: time.Now().UTC()})
+	if err != nil {
+		rollback()
+		return err
+	}
+
+	gets := make([]clientv3.Op, len(ops))
+	for i, op := range ops {
+		gets[i] = clientv3.OpGet(op.Key)
+	}
+
+	for {
+		res, err := s.Client.Txn(ctx).Then(gets...).Commit()
+		if err != nil {
+			rollback()
+			return err
+		}
+
+		var cmps []clientv3.Cmp
+		var thenOps []clientv3.Op
+		previous := make(map[string]*etcdManifest)
+		for i, op := range ops {
+			var rev int64
+			if kvs := res.Responses[i].GetResponseRange().Kvs; len(kvs) > 0 {
+				rev = kvs[0].ModRevision
+				previous[op.Key] = decodeEtcdManifest(kvs[0].Value)
+			}
+			cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(op.Key), "=", rev))
+
+			if op.Delete {
+				thenOps = append(thenOps, clientv3.OpDelete(op.Key), clientv3.OpDelete(etcdMetaKey(op.Key)))
+				if manifest := previous[op.Key]; manifest != nil {
+					thenOps = append(thenOps, clientv3.OpDelete(etcdChunkGenerationPrefix(op.Key, manifest.Generation), clientv3.WithPrefix()))
+				}
+				continue
+			}
+
+			value := string(op.Data)
+			if manifest, ok := manifests[op.Key]; ok {
+				value = manifest.encode()
+			}
+			thenOps = append(thenOps, clientv3.OpPut(op.Key, value), clientv3.OpPut(etcdMetaKey(op.Key), string(meta)))
+		}
+
+		txn, err := s.Client.Txn(ctx).If(cmps...).Then(thenOps...).Commit()
+		if err != nil {
+			rollback()
+			return err
+		}
+		if !txn.Succeeded {
+			// some objects have been replaced concurrently, retry to clean up their chunks
+			continue
+		}
+
+		for _, op := range ops {
+			if !op.Delete {
+				s.cleanupChunks(op.Key, previous[op.Key])
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,216 @@
+package storage
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.etcd.io/etcd/client/pkg/v3/transport"
+	"go.etcd.io/etcd/server/v3/embed"
+	"go.uber.org/zap"
+)
+
+// startEmbeddedEtcd runs a single node etcd server on random local ports and connects etcd backend to it.
+// With secure set, the server requires TLS client certificates signed by a generated CA
+func startEmbeddedEtcd(secure bool) (*etcdStorage, func(), error) {
+	dir, err := ioutil.TempDir("", "storage-etcd")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	scheme := "http"
+	if secure {
+		scheme = "https"
+	}
+
+	clientURL, err := freeLocalURL(scheme)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, nil, err
+	}
+	peerURL, err := freeLocalURL("http")
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, nil, err
+	}
+
+	cfg := embed.NewConfig()
+	cfg.Dir = filepath.Join(dir, "data")
+	cfg.LogLevel = "error"
+	cfg.LCUrls = []url.URL{*clientURL}
+	cfg.ACUrls = []url.URL{*clientURL}
+	cfg.LPUrls = []url.URL{*peerURL}
+	cfg.APUrls = []url.URL{*peerURL}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	var certs *etcdTestCerts
+	if secure {
+		certs, err = generateEtcdTestCerts(filepath.Join(dir, "certs"))
+		if err != nil {
+			os.RemoveAll(dir)
+			return nil, nil, err
+		}
+		cfg.ClientTLSInfo = transport.TLSInfo{
+			CertFile:       certs.ServerCert,
+			KeyFile:        certs.ServerKey,
+			TrustedCAFile:  certs.CA,
+			ClientCertAuth: true,
+		}
+	}
+
+	server, err := embed.StartEtcd(cfg)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, nil, err
+	}
+
+	stop := func() {
+		server.Close()
+		os.RemoveAll(dir)
+	}
+
+	select {
+	case <-server.Server.ReadyNotify():
+	case <-time.After(30 * time.Second):
+		stop()
+		return nil, nil, fmt.Errorf("embedded etcd server did not start in time")
+	}
+
+	viper.Set("etcd.endpoints", []string{clientURL.String()})
+	viper.Set("etcd.namespace", "/storage-test/")
+	viper.Set("etcd.ssl.enabled", secure)
+	viper.Set("etcd.ssl.verify", false)
+	viper.Set("etcd.ssl.ca", "")
+	viper.Set("etcd.ssl.cert", "")
+	viper.Set("etcd.ssl.key", "")
+	if certs != nil {
+		viper.Set("etcd.ssl.ca", certs.CA)
+		viper.Set("etcd.ssl.cert", certs.ClientCert)
+		viper.Set("etcd.ssl.key", certs.ClientKey)
+	}
+
+	backend, err := NewEtcdStorage(EtcdOptions{
+		Logger: zap.S(),
+	})
+	if err != nil {
+		stop()
+		return nil, nil, err
+	}
+
+	return backend, func() {
+		backend.Client.Close()
+		stop()
+	}, nil
+}
+
+func freeLocalURL(scheme string) (*url.URL, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+
+	return url.Parse(fmt.Sprintf("%s://%s", scheme, l.Addr().String()))
+}
+
+type etcdTestCerts struct {
+	CA         string
+	ServerCert string
+	ServerKey  string
+	ClientCert string
+	ClientKey  string
+}
+
+// generateEtcdTestCerts writes a self-signed CA with server and client certificates issued by it
+func generateEtcdTestCerts(dir string) (*etcdTestCerts, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "storage-test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return nil, err
+	}
+
+	certs := &etcdTestCerts{
+		CA:         filepath.Join(dir, "ca.pem"),
+		ServerCert: filepath.Join(dir, "server.pem"),
+		ServerKey:  filepath.Join(dir, "server-key.pem"),
+		ClientCert: filepath.Join(dir, "client.pem"),
+		ClientKey:  filepath.Join(dir, "client-key.pem"),
+	}
+	if err := writePEM(certs.CA, "CERTIFICATE", caDER); err != nil {
+		return nil, err
+	}
+
+	issue := func(serial int64, name string, usage x509.ExtKeyUsage, certFile, keyFile string) error {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(24 * time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+			DNSNames:     []string{"localhost"},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+		if err != nil {
+			return err
+		}
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return err
+		}
+		if err := writePEM(certFile, "CERTIFICATE", der); err != nil {
+			return err
+		}
+		return writePEM(keyFile, "EC PRIVATE KEY", keyDER)
+	}
+
+	if err := issue(2, "storage-test-server", x509.ExtKeyUsageServerAuth, certs.ServerCert, certs.ServerKey); err != nil {
+		return nil, err
+	}
+	if err := issue(3, "storage-test-client", x509.ExtKeyUsageClientAuth, certs.ClientCert, certs.ClientKey); err != nil {
+		return nil, err
+	}
+
+	return certs, nil
+}
+
+func writePEM(file string, blockType string, der []byte) error {
+	return ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600)
+}
@@ -1,79 +1,264 @@
 package storage
 
 import (
-	"fmt"
-	"github.com/stretchr/testify/suite"
-	clientv3 "go.etcd.io/etcd/client/v3"
-	"go.uber.org/zap"
+	"bytes"
+	"context"
+	"errors"
 	"os"
 	"testing"
-)
+	"time"
 
-var (
-	//cafile   = "./_test/ca.pem"
-	//certfile = "./_test/cert.pem"
-	//keyfile  = "./_test/key.pem"
-	endpoints = os.Getenv("ETCD_ADDR")
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/suite"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
 )
 
 type CsEtcdSuite struct {
 	suite.Suite
 	etcd Backend
+	stop func()
 }
 
 func (c *CsEtcdSuite) SetupSuite() {
-	// TODO: renable, see https://github.com/chartmuseum/storage/issues/6
-	c.T().Skip()
-	etcd, err := NewEtcdStorage(EtcdOptions{
-		Logger: zap.S(),
-		Config: &clientv3.Config{
-			Endpoints: []string{endpoints},
-		},
-	})
+	etcd, stop, err := startEmbeddedEtcd(true)
 	if err != nil {
-		c.Fail(err.Error())
+		c.FailNow(err.Error())
 	}
 
 	c.etcd = etcd
-	fmt.Println("init success")
+	c.stop = stop
+}
+
+func (c *CsEtcdSuite) TearDownSuite() {
+	if c.stop != nil {
+		c.stop()
+	}
 }
 
 func (c *CsEtcdSuite) TestListObjecs() {
-	c.etcd.PutObject("listtest1", []byte("puttestetcd"))
+	c.Nil(c.etcd.PutObject("listtest/1", []byte("puttestetcd")))
+	c.Nil(c.etcd.PutObject("listtest/2", []byte("puttestetcd")))
+	c.Nil(c.etcd.PutObject("listtest/nested/3", []byte("puttestetcd")))
+	c.Nil(c.etcd.PutObject("listtest1", []byte("puttestetcd")))
+
+	objs, err := c.etcd.ListObjects("listtest")
+	c.Nil(err, "etcd list objects")
+	c.Len(objs, 2, "nested keys and keys sharing prefix skipped")
+	for i, obj := range objs {
+		c.Equal([]string{"1", "2"}[i], obj.Path, "paths relative to prefix")
+		c.False(obj.LastModified.IsZero(), "modification time set")
+		c.NotEmpty(obj.Meta.Version, "version set")
+	}
+}
+
+func (c *CsEtcdSuite) TestGetObject() {
+	c.Nil(c.etcd.PutObject("gettest", []byte("testdate")))
+
+	obj, err := c.etcd.GetObject("gettest")
+	c.Nil(err, "etcd get object")
+	c.Equal([]byte("testdate"), obj.Data, "value returned as data")
+	c.False(obj.LastModified.IsZero(), "modification time set")
 
-	c.etcd.PutObject("listtest2", []byte("puttestetcd"))
+	c.Nil(c.etcd.PutObject("gettest", []byte("testdate2")))
+	updated, err := c.etcd.GetObject("gettest")
+	c.Nil(err)
+	c.NotEqual(obj.Meta.Version, updated.Meta.Version, "version changed by write")
 
-	if objs, err := c.etcd.ListObjects("listtest"); err != nil {
-		c.Fail("etcd list objects err:%s", err)
-	} else {
-		fmt.Println(objs)
+	_, err = c.etcd.GetObject("missingtest")
+	c.True(errors.Is(err, os.ErrNotExist), "missing object not found")
+}
+
+func (c *CsEtcdSuite) TestDeleteObject() {
+	c.Nil(c.etcd.PutObject("deletetest", []byte("testdate")))
+	c.Nil(c.etcd.DeleteObject("deletetest"), "etcd delete object")
+
+	_, err := c.etcd.GetObject("deletetest")
+	c.NotNil(err, "deleted object not found")
+}
+
+func (c *CsEtcdSuite) TestPutLargeObject() {
+	data := bytes.Repeat([]byte("0123456789abcdef"), DefaultEtcdChunkSize/4)
+	c.Nil(c.etcd.PutObject("largetest", data), "etcd put large object")
+
+	obj, err := c.etcd.GetObject("largetest")
+	c.Nil(err)
+	c.Equal(data, obj.Data, "chunked object reassembled")
+
+	objs, err := c.etcd.ListObjects("")
+	c.Nil(err)
+	for _, o := range objs {
+		c.NotContains(o.Path, etcdChunkPrefix, "chunk keys hidden from list")
 	}
 
+	c.Nil(c.etcd.PutObject("largetest", []byte("small")), "chunked object replaced")
+	obj, err = c.etcd.GetObject("largetest")
+	c.Nil(err)
+	c.Equal([]byte("small"), obj.Data)
+
+	c.Nil(c.etcd.DeleteObject("largetest"))
 }
 
-func (c *CsEtcdSuite) TestGetObject() {
+func (c *CsEtcdSuite) TestWatch() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	c.etcd.PutObject("gettest", []byte("testdate"))
+	watcher := c.etcd.(Watcher)
+	events := watcher.Watch(ctx, "watchtest")
+	c.Nil(c.etcd.PutObject("watchtest/1", []byte("created")))
+	c.Nil(c.etcd.PutObject("watchtest/1", []byte("updated")))
+	c.Nil(c.etcd.PutObject("watchtest/nested/2", []byte("skipped")))
+	c.Nil(c.etcd.DeleteObject("watchtest/1"))
 
-	if obj, err := c.etcd.GetObject("gettest"); err != nil {
-		c.Fail("etcd get objects err:%s", err)
-	} else {
-		fmt.Println(obj)
+	var received []Event
+	for _, expected := range []EventType{EventCreated, EventUpdated, EventDeleted} {
+		select {
+		case e := <-events:
+			c.Equal(expected, e.Type)
+			c.Equal("1", e.Object.Path)
+			received = append(received, e)
+		case <-time.After(5 * time.Second):
+			c.FailNow("watch event not received")
+		}
 	}
 
+	// resume right after the created event
+	resumed := c.etcd.(*etcdStorage).WatchFromRevision(ctx, "watchtest", received[0].Revision+1)
+	select {
+	case e := <-resumed:
+		c.Equal(EventUpdated, e.Type, "watch resumed from revision")
+		c.Equal(received[1].Revision, e.Revision)
+	case <-time.After(5 * time.Second):
+		c.FailNow("resumed watch event not received")
+	}
 }
 
-func (c *CsEtcdSuite) TestDeleteObject() {
+func (c *CsEtcdSuite) TestCommitBatch() {
+	batcher := c.etcd.(Batcher)
+	c.Nil(c.etcd.PutObject("batchtest/old.tgz", []byte("old")))
 
-	c.etcd.PutObject("deletetest", []byte("testdate"))
+	batch := NewBatch()
+	batch.Put("batchtest/index.yaml", []byte("v1"))
+	batch.Put("batchtest/large.tgz", bytes.Repeat([]byte("large"), 512*1024))
+	batch.Delete("batchtest/old.tgz")
+	c.Nil(batcher.CommitBatch(context.Background(), batch))
 
-	if err := c.etcd.DeleteObject("deletetest"); err != nil {
-		c.Fail("etcd delete objects err:%s", err)
+	objs, err := c.etcd.ListObjects("batchtest")
+	c.Nil(err)
+	c.Len(objs, 2)
+	c.Equal("index.yaml", objs[0].Path)
+	c.Equal("large.tgz", objs[1].Path)
+
+	large, err := c.etcd.GetObject("batchtest/large.tgz")
+	c.Nil(err, "chunked object committed with the batch")
+	c.Len(large.Data, 5*512*1024)
+
+	_, err = c.etcd.GetObject("batchtest/old.tgz")
+	c.NotNil(err, "deleted object removed with the batch")
+}
+
+func (c *CsEtcdSuite) TestDeletePrefix() {
+	c.Nil(c.etcd.PutObject("prefixtest/1.0/app.tgz", []byte("app")))
+	c.Nil(c.etcd.PutObject("prefixtest/1.0/large.tgz", bytes.Repeat([]byte("large"), 512*1024)))
+	c.Nil(c.etcd.PutObject("prefixtest/1.0.tgz", []byte("archive")))
+
+	c.Nil(c.etcd.(PrefixDeleter).DeletePrefix("prefixtest/1.0"))
+
+	objs, err := c.etcd.ListObjects("prefixtest/1.0")
+	c.Nil(err)
+	c.Empty(objs, "objects removed")
+
+	res, err := c.etcd.(*etcdStorage).Client.Get(context.Background(), etcdChunkPrefix+"prefixtest/", clientv3.WithPrefix(), clientv3.WithCountOnly())
+	c.Nil(err)
+	c.Zero(res.Count, "chunks removed")
+
+	_, err = c.etcd.GetObject("prefixtest/1.0.tgz")
+	c.Nil(err, "sibling keys sharing the prefix string kept")
+}
+
+func (c *CsEtcdSuite) TestLock() {
+	locker := c.etcd.(Locker)
+	ctx := context.Background()
+
+	lock, err := locker.Lock(ctx, "deploy", 5*time.Second)
+	c.Nil(err)
+
+	timeout, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer cancel()
+	_, err = locker.Lock(timeout, "deploy", 5*time.Second)
+	c.NotNil(err, "held lock is not acquired twice")
+
+	c.Nil(lock.Refresh(ctx, 5*time.Second))
+	c.Nil(lock.Unlock(ctx))
+	c.Equal(ErrLockLost, lock.Unlock(ctx), "released lock is not unlocked twice")
+
+	next, err := locker.Lock(ctx, "deploy", 5*time.Second)
+	c.Nil(err)
+	c.Greater(next.Token(), lock.Token(), "fencing token grows with every acquisition")
+	c.Nil(next.Unlock(ctx))
+
+	objs, err := c.etcd.ListObjects("")
+	c.Nil(err)
+	for _, o := range objs {
+		c.NotContains(o.Path, "deploy", "lock keys are hidden from list")
+	}
+}
+
+func (c *CsEtcdSuite) TestPutObjectWithTTL() {
+	backend := c.etcd.(ExpiringBackend)
+	c.Nil(backend.PutObjectWithTTL("ttltest/token", []byte("secret"), time.Second))
+
+	obj, err := backend.GetObject("ttltest/token")
+	c.Nil(err, "object visible before lease expiration")
+	c.Equal([]byte("secret"), obj.Data)
+
+	c.Eventually(func() bool {
+		_, err := backend.GetObject("ttltest/token")
+		return err != nil
+	}, 10*time.Second, 100*time.Millisecond, "object removed with lease")
+
+	objs, err := backend.ListObjects("ttltest")
+	c.Nil(err)
+	c.Empty(objs, "expired object invisible to list")
+}
+
+func TestEtcdManifest(t *testing.T) {
+	manifest := &etcdManifest{
+		Generation: "0011223344556677",
+		Chunks:     3,
+		Size:       3 * DefaultEtcdChunkSize,
+		Digest:     sha256Digest([]byte("test")),
+	}
+
+	decoded := decodeEtcdManifest([]byte(manifest.encode()))
+	if decoded == nil || *decoded != *manifest {
+		t.Errorf("manifest not decoded: %v", decoded)
 	}
 
+	if decodeEtcdManifest([]byte("plain value")) != nil {
+		t.Error("plain value decoded as manifest")
+	}
 }
 
-func TestEtcdCSBackend(t *testing.T) {
+func TestEtcdTLSConfigErrors(t *testing.T) {
+	defer viper.Reset()
+	viper.Set("etcd.endpoints", []string{"https://127.0.0.1:2379"})
+	viper.Set("etcd.ssl.enabled", true)
+
+	viper.Set("etcd.ssl.cert", "./_test/missing-cert.pem")
+	viper.Set("etcd.ssl.key", "./_test/missing-key.pem")
+	if _, err := NewEtcdStorage(EtcdOptions{Logger: zap.S()}); err == nil {
+		t.Error("cannot connect with missing client certificate")
+	}
 
+	viper.Set("etcd.ssl.cert", "")
+	viper.Set("etcd.ssl.key", "")
+	viper.Set("etcd.ssl.ca", "./_test/missing-ca.pem")
+	if _, err := NewEtcdStorage(EtcdOptions{Logger: zap.S()}); err == nil {
+		t.Error("cannot connect with missing CA certificate")
+	}
+}
+
+func TestEtcdCSBackend(t *testing.T) {
 	suite.Run(t, new(CsEtcdSuite))
 }
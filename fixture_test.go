@@ -0,0 +1,216 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/ssh"
+)
+
+// testFixture owns the temporary directory and in-process servers of a test,
+// Close releases all of them
+type testFixture struct {
+	// Dir is ../../.test/storage-<name>/<timestamp>
+	Dir string
+	// Backends are started by StartBackends, keyed by backend name
+	Backends map[string]Backend
+
+	timestamp string
+	closers   []func()
+}
+
+func newTestFixture(name string) *testFixture {
+	timestamp := time.Now().Format("20060102150405.000000000")
+	return &testFixture{
+		Dir:       fmt.Sprintf("../../.test/storage-%s/%s", name, timestamp),
+		Backends:  make(map[string]Backend),
+		timestamp: timestamp,
+	}
+}
+
+// Path joins elem to the fixture directory
+func (f *testFixture) Path(elem ...string) string {
+	return filepath.Join(append([]string{f.Dir}, elem...)...)
+}
+
+// DirStorage creates a local filesystem backend in a subdirectory of the fixture
+func (f *testFixture) DirStorage(name string) (*DirStorage, error) {
+	return NewDirStorage(f.Path(name))
+}
+
+// OnClose registers fn to run on Close, in reverse order of registration
+func (f *testFixture) OnClose(fn func()) {
+	f.closers = append(f.closers, fn)
+}
+
+func (f *testFixture) Close() {
+	for i := len(f.closers) - 1; i >= 0; i-- {
+		f.closers[i]()
+	}
+	f.closers = nil
+	os.RemoveAll(f.Dir)
+}
+
+// Names returns names of the started backends in a stable order
+func (f *testFixture) Names() []string {
+	names := make([]string, 0, len(f.Backends))
+	for name := range f.Backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// StartBackends starts every backend that runs without external services:
+// local filesystem, Bolt, SQL, embedded etcd and fakes of Azure, SFTP, WebDAV, Consul and S3
+func (f *testFixture) StartBackends() error {
+	local, err := f.DirStorage("local")
+	if err != nil {
+		return err
+	}
+	f.Backends["LocalFilesystem"] = local
+
+	if err := os.MkdirAll(f.Path("bolt"), 0777); err != nil {
+		return err
+	}
+	bolt, err := NewBoltStorage(BoltOptions{Path: f.Path("bolt", "storage.db")})
+	if err != nil {
+		return err
+	}
+	f.OnClose(func() { bolt.Close() })
+	f.Backends["Bolt"] = bolt
+
+	if err := os.MkdirAll(f.Path("sql"), 0777); err != nil {
+		return err
+	}
+	db, err := openSQLiteDB(f.Path("sql", "storage.db"))
+	if err != nil {
+		return err
+	}
+	f.OnClose(func() { db.Close() })
+	sqlStorage, err := NewSQLStorage(SQLOptions{DB: db, Dialect: "sqlite"})
+	if err != nil {
+		return err
+	}
+	f.Backends["SQL"] = sqlStorage
+
+	etcd, stop, err := startEmbeddedEtcd(false)
+	if err != nil {
+		return err
+	}
+	f.OnClose(stop)
+	f.Backends["Etcd"] = etcd
+
+	azureServer := newFakeAzureBlobServer()
+	f.OnClose(azureServer.Close)
+	azure, err := NewAzureStorage(AzureOptions{
+		Account:   fakeAzureAccount,
+		Key:       fakeAzureKey,
+		Container: fakeAzureContainer,
+		Prefix:    fmt.Sprintf("unittest/%s", f.timestamp),
+		Endpoint:  azureServer.endpoint(),
+	})
+	if err != nil {
+		return err
+	}
+	f.Backends["Azure"] = azure
+
+	sftpServer, err := newFakeSFTPServer(f.Dir)
+	if err != nil {
+		return err
+	}
+	f.OnClose(func() { sftpServer.Close() })
+	host, port := sftpServer.hostPort()
+	sftp, err := NewSFTPStorage(SFTPOptions{
+		Host:            host,
+		Port:            port,
+		User:            fakeSFTPUser,
+		Password:        fakeSFTPPassword,
+		HostKeyCallback: ssh.FixedHostKey(sftpServer.hostKey.PublicKey()),
+		RootDir:         "sftp",
+	})
+	if err != nil {
+		return err
+	}
+	f.Backends["SFTP"] = sftp
+
+	webdavServer := newFakeWebDAVServer()
+	f.OnClose(webdavServer.Close)
+	webdav, err := NewWebDAVStorage(WebDAVOptions{
+		URL:      webdavServer.URL + "/dav",
+		User:     fakeWebDAVUser,
+		Password: fakeWebDAVPassword,
+	})
+	if err != nil {
+		return err
+	}
+	f.Backends["WebDAV"] = webdav
+
+	consulServer := newFakeConsulServer()
+	f.OnClose(consulServer.Close)
+	consul, err := NewConsulStorage(ConsulOptions{
+		Address:   consulServer.URL,
+		Token:     fakeConsulToken,
+		Namespace: "storage",
+	})
+	if err != nil {
+		return err
+	}
+	f.Backends["Consul"] = consul
+
+	s3Server := newFakeS3Server()
+	f.OnClose(s3Server.Close)
+	s3, err := NewAWSStorageWithOptions(AWSOptions{
+		Bucket:    fakeAWSBucket,
+		Prefix:    fmt.Sprintf("unittest/%s", f.timestamp),
+		Region:    fakeAWSRegion,
+		Endpoint:  s3Server.URL,
+		AccessKey: fakeAWSAccessKey,
+		SecretKey: fakeAWSSecretKey,
+	})
+	if err != nil {
+		return err
+	}
+	f.Backends["S3"] = s3
+
+	return nil
+}
+
+// BackendsTestSuite starts fixture backends once per suite, feature suites embed it
+// and run their tests against every backend implementing the feature with EachBackend
+type BackendsTestSuite struct {
+	suite.Suite
+	Name    string
+	Fixture *testFixture
+}
+
+func (suite *BackendsTestSuite) SetupSuite() {
+	suite.Fixture = newTestFixture(suite.Name)
+	suite.Require().Nil(suite.Fixture.StartBackends(), "No error starting test backends")
+}
+
+func (suite *BackendsTestSuite) TearDownSuite() {
+	suite.Fixture.Close()
+}
+
+// Dir returns the local filesystem backend of the fixture
+func (suite *BackendsTestSuite) Dir() *DirStorage {
+	return suite.Fixture.Backends["LocalFilesystem"].(*DirStorage)
+}
+
+// EachBackend runs test as a subtest for every fixture backend accepted by filter
+func (suite *BackendsTestSuite) EachBackend(filter func(Backend) bool, test func(backend Backend)) {
+	for _, name := range suite.Fixture.Names() {
+		backend := suite.Fixture.Backends[name]
+		if filter != nil && !filter(backend) {
+			continue
+		}
+		suite.Run(name, func() {
+			test(backend)
+		})
+	}
+}
@@ -3,9 +3,17 @@ package storage
 import (
 	"cloud.google.com/go/storage"
 	"context"
+	"errors"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
 	"io/ioutil"
+	"net/http"
+	"os"
 	"path"
+	"strconv"
+	"sync"
+	"time"
 )
 
 type GCPStorage struct {
@@ -16,9 +24,13 @@ type GCPStorage struct {
 }
 
 func NewGCPStorage(bucket string, prefix string) (*GCPStorage, error) {
+	return newGCPStorage(bucket, prefix)
+}
+
+func newGCPStorage(bucket string, prefix string, opts ...option.ClientOption) (*GCPStorage, error) {
 	ctx := context.Background()
 
-	client, err := storage.NewClient(ctx)
+	client, err := storage.NewClient(ctx, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -37,29 +49,92 @@ func NewGCPStorage(bucket string, prefix string) (*GCPStorage, error) {
 func (s *GCPStorage) GetObject(key string) (Object, error) {
 	var object Object
 	object.Path = key
-	objectHandle := s.client.Object(path.Join(s.prefix, key))
-	attrs, err := objectHandle.Attrs(s.ctx)
+	objectHandle, err := s.object(key)
 	if err != nil {
 		return object, err
 	}
+	attrs, err := objectHandle.Attrs(s.ctx)
+	if err != nil {
+		return object, gcsNotExist(key, err)
+	}
+	if isExpired(gcsExpiresAt(attrs)) {
+		return object, &os.PathError{Op: "open", Path: key, Err: os.ErrNotExist}
+	}
 	object.LastModified = attrs.Updated
-	rc, err := objectHandle.NewReader(s.ctx)
+	// read the generation metadata belongs to
+	rc, err := objectHandle.Generation(attrs.Generation).NewReader(s.ctx)
 	if err != nil {
-		return object, err
+		return object, gcsNotExist(key, err)
 	}
 	content, err := ioutil.ReadAll(rc)
 	rc.Close()
 	if err != nil {
 		return object, err
 	}
+	object.Meta = gcsObjectMeta(key, attrs)
+	object.Meta.Checksum, err = objectChecksum(key, content, object.Meta.Checksum)
+	if err != nil {
+		return object, err
+	}
 	object.Data = content
 	return object, nil
 }
 
+// StatObject returns object attributes without reading its data
+func (s *GCPStorage) StatObject(key string) (Object, error) {
+	object := Object{Path: key, Data: []byte{}}
+	objectHandle, err := s.object(key)
+	if err != nil {
+		return object, err
+	}
+	attrs, err := objectHandle.Attrs(s.ctx)
+	if err != nil {
+		return object, gcsNotExist(key, err)
+	}
+	if isExpired(gcsExpiresAt(attrs)) {
+		return object, &os.PathError{Op: "open", Path: key, Err: os.ErrNotExist}
+	}
+	object.Meta = gcsObjectMeta(key, attrs)
+	object.LastModified = attrs.Updated
+	return object, nil
+}
+
+// PutObjectWithMetadata uploads an object with content type and user metadata,
+// SHA-256 checksum of data is stored in user metadata as well
+func (s *GCPStorage) PutObjectWithMetadata(key string, content []byte, meta Metadata) error {
+	objectHandle, err := s.object(key)
+	if err != nil {
+		return err
+	}
+
+	checksum, err := objectChecksum(key, content, meta.Checksum)
+	if err != nil {
+		return err
+	}
+
+	wc := objectHandle.NewWriter(s.ctx)
+	wc.ContentType = meta.ContentType
+	wc.Metadata = map[string]string{
+		checksumMetadataKey: checksum,
+	}
+	for k, v := range meta.UserMetadata {
+		wc.Metadata[k] = v
+	}
+	if _, err := wc.Write(content); err != nil {
+		wc.Close()
+		return err
+	}
+	return wc.Close()
+}
+
 // PutObject uploads an object to Google Cloud Storage bucket, at prefix
 func (s *GCPStorage) PutObject(key string, content []byte) error {
-	wc := s.client.Object(path.Join(s.prefix, key)).NewWriter(s.ctx)
-	_, err := wc.Write(content)
+	objectHandle, err := s.object(key)
+	if err != nil {
+		return err
+	}
+	wc := objectHandle.NewWriter(s.ctx)
+	_, err = wc.Write(content)
 	if err != nil {
 		return err
 	}
@@ -67,14 +142,112 @@ func (s *GCPStorage) PutObject(key string, content []byte) error {
 	return err
 }
 
+// PutObjectWithTTL uploads an object with expiration time stored in its metadata and custom time,
+// so a bucket lifecycle rule on days since custom time can remove it along with SweepExpired
+func (s *GCPStorage) PutObjectWithTTL(key string, content []byte, ttl time.Duration) error {
+	objectHandle, err := s.object(key)
+	if err != nil {
+		return err
+	}
+
+	expires, err := expiresAt(ttl)
+	if err != nil {
+		return err
+	}
+
+	wc := objectHandle.NewWriter(s.ctx)
+	wc.CustomTime = expires
+	wc.Metadata = map[string]string{
+		expiresMetadataKey: expires.Format(time.RFC3339Nano),
+	}
+	if _, err := wc.Write(content); err != nil {
+		wc.Close()
+		return err
+	}
+	return wc.Close()
+}
+
 // DeleteObject removes an object from Google Cloud Storage bucket, at prefix
 func (s *GCPStorage) DeleteObject(key string) error {
-	err := s.client.Object(path.Join(s.prefix, key)).Delete(s.ctx)
-	return err
+	objectHandle, err := s.object(key)
+	if err != nil {
+		return err
+	}
+	return gcsNotExist(key, objectHandle.Delete(s.ctx))
+}
+
+// DeletePrefix removes objects under prefix one by one, as GCS has no batch delete in the JSON API client
+func (s *GCPStorage) DeletePrefix(prefix string) error {
+	prefix, err := gcsKeyRules.validate(prefix)
+	if err != nil {
+		return err
+	}
+
+	it := s.client.Objects(s.ctx, &storage.Query{
+		Prefix: path.Join(s.prefix, prefix) + "/",
+	})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := s.client.Object(attrs.Name).Delete(s.ctx); err != nil && err != storage.ErrObjectNotExist {
+			return err
+		}
+	}
+}
+
+// object validates key and returns a handle of its object in the bucket
+func (s *GCPStorage) object(key string) (*storage.ObjectHandle, error) {
+	normalized, err := gcsKeyRules.validate(key)
+	if err != nil {
+		return nil, err
+	}
+	return s.client.Object(path.Join(s.prefix, normalized)), nil
 }
 
 func (s *GCPStorage) ListObjects(prefix string) ([]Object, error) {
 	var objects []Object
+	err := s.eachObject(prefix, func(key string, attrs *storage.ObjectAttrs) error {
+		if isExpired(gcsExpiresAt(attrs)) {
+			return nil
+		}
+		objects = append(objects, Object{
+			Path:         key,
+			Data:         []byte{},
+			LastModified: attrs.Updated,
+		})
+		return nil
+	})
+	return objects, err
+}
+
+// SweepExpired removes expired objects right under prefix
+func (s *GCPStorage) SweepExpired(prefix string) ([]string, error) {
+	var swept []string
+	err := s.eachObject(prefix, func(key string, attrs *storage.ObjectAttrs) error {
+		if !isExpired(gcsExpiresAt(attrs)) {
+			return nil
+		}
+		if err := s.client.Object(attrs.Name).Delete(s.ctx); err != nil && err != storage.ErrObjectNotExist {
+			return err
+		}
+		swept = append(swept, joinObjectPath(prefix, key))
+		return nil
+	})
+	return swept, err
+}
+
+// eachObject calls fn for objects right under prefix with their paths relative to it
+func (s *GCPStorage) eachObject(prefix string, fn func(key string, attrs *storage.ObjectAttrs) error) error {
+	prefix, err := gcsKeyRules.validatePrefix(prefix)
+	if err != nil {
+		return err
+	}
+
 	prefix = path.Join(s.prefix, prefix)
 	listQuery := &storage.Query{
 		Prefix: prefix,
@@ -86,18 +259,165 @@ func (s *GCPStorage) ListObjects(prefix string) ([]Object, error) {
 			break
 		}
 		if err != nil {
-			return objects, err
+			return err
 		}
 		key := removePrefixFromObjectPath(prefix, attrs.Name)
 		if objectPathIsInvalid(key) {
 			continue
 		}
-		object := Object{
-			Path:         key,
-			Data:         []byte{},
-			LastModified: attrs.Updated,
+		if err := fn(key, attrs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func gcsObjectMeta(key string, attrs *storage.ObjectAttrs) Metadata {
+	return Metadata{
+		Name:         path.Base(key),
+		Version:      strconv.FormatInt(attrs.Generation, 10),
+		ContentType:  attrs.ContentType,
+		UserMetadata: userMetadata(attrs.Metadata),
+		Checksum:     reservedMetadata(attrs.Metadata, checksumMetadataKey),
+	}
+}
+
+func gcsExpiresAt(attrs *storage.ObjectAttrs) time.Time {
+	if value, ok := attrs.Metadata[expiresMetadataKey]; ok {
+		expires, _ := time.Parse(time.RFC3339, value)
+		return expires
+	}
+	return time.Time{}
+}
+
+// Watch polls objects at prefix every DefaultPollInterval
+func (s *GCPStorage) Watch(ctx context.Context, prefix string) <-chan Event {
+	return PollObjects(ctx, s, prefix, DefaultPollInterval)
+}
+
+// gcsLock is a lock object created only if it does not exist,
+// its generation grows with every creation and serves as the fencing token
+type gcsLock struct {
+	mu         sync.Mutex
+	object     *storage.ObjectHandle
+	generation int64
+	released   bool
+}
+
+// Lock creates a lock object under lockDir with expiration time in its metadata,
+// an expired lock object of a holder that stopped refreshing it is removed and created again
+func (s *GCPStorage) Lock(ctx context.Context, name string, ttl time.Duration) (Lock, error) {
+	name, err := gcsKeyRules.validate(name)
+	if err != nil {
+		return nil, err
+	}
+
+	// lock objects are kept under the prefix reserved for them, which object() rejects
+	object := s.client.Object(path.Join(s.prefix, lockDir, name))
+
+	if _, err := expiresAt(ttl); err != nil {
+		return nil, err
+	}
+
+	lock := &gcsLock{object: object}
+	err = retryLock(ctx, DefaultLockRetryInterval, func() (bool, error) {
+		expires, _ := expiresAt(ttl)
+		wc := object.If(storage.Conditions{DoesNotExist: true}).NewWriter(ctx)
+		wc.Metadata = map[string]string{
+			expiresMetadataKey: expires.Format(time.RFC3339Nano),
 		}
-		objects = append(objects, object)
+		err := wc.Close()
+		if err == nil {
+			lock.generation = wc.Attrs().Generation
+			return true, nil
+		}
+		if !isGCSPreconditionFailed(err) {
+			return false, err
+		}
+
+		attrs, err := object.Attrs(ctx)
+		if err == storage.ErrObjectNotExist {
+			return false, nil
+		}
+		if err != nil || !isExpired(gcsExpiresAt(attrs)) {
+			return false, err
+		}
+
+		// take over the expired lock, unless its holder has refreshed it meanwhile
+		err = object.If(storage.Conditions{GenerationMatch: attrs.Generation, MetagenerationMatch: attrs.Metageneration}).Delete(ctx)
+		if err != nil && err != storage.ErrObjectNotExist && !isGCSPreconditionFailed(err) {
+			return false, err
+		}
+		return false, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return lock, nil
+}
+
+func (l *gcsLock) Token() int64 {
+	return l.generation
+}
+
+func (l *gcsLock) Refresh(ctx context.Context, ttl time.Duration) error {
+	expires, err := expiresAt(ttl)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.released {
+		return ErrLockLost
+	}
+
+	attrs, err := l.object.If(storage.Conditions{GenerationMatch: l.generation}).Attrs(ctx)
+	if err == nil && isExpired(gcsExpiresAt(attrs)) {
+		err = ErrLockLost
+	}
+	if err == nil {
+		_, err = l.object.If(storage.Conditions{GenerationMatch: l.generation, MetagenerationMatch: attrs.Metageneration}).
+			Update(ctx, storage.ObjectAttrsToUpdate{
+				Metadata: map[string]string{
+					expiresMetadataKey: expires.Format(time.RFC3339Nano),
+				},
+			})
+	}
+	return gcsLockError(err)
+}
+
+func (l *gcsLock) Unlock(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.released {
+		return ErrLockLost
 	}
-	return objects, nil
+	l.released = true
+
+	return gcsLockError(l.object.If(storage.Conditions{GenerationMatch: l.generation}).Delete(ctx))
+}
+
+// gcsLockError reports a lock object removed or replaced by another holder as ErrLockLost
+func gcsLockError(err error) error {
+	if err == storage.ErrObjectNotExist || isGCSPreconditionFailed(err) {
+		return ErrLockLost
+	}
+	return err
+}
+
+// gcsNotExist reports missing objects as os.ErrNotExist like other backends
+func gcsNotExist(key string, err error) error {
+	if err == storage.ErrObjectNotExist {
+		return &os.PathError{Op: "open", Path: key, Err: os.ErrNotExist}
+	}
+	return err
+}
+
+func isGCSPreconditionFailed(err error) bool {
+	var gerr *googleapi.Error
+	return errors.As(err, &gerr) && gerr.Code == http.StatusPreconditionFailed
 }
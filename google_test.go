@@ -1,12 +1,222 @@
 package storage
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/suite"
+	"google.golang.org/api/option"
 )
 
+const fakeGCSBucket = "charts"
+
+// fakeGCSServer implements the subset of GCS JSON and XML APIs used by GCPStorage in memory,
+// with generation and metageneration preconditions
+type fakeGCSServer struct {
+	*httptest.Server
+	mu         sync.Mutex
+	objects    map[string]*fakeGCSObject
+	generation int64
+}
+
+type fakeGCSObject struct {
+	data           []byte
+	generation     int64
+	metageneration int64
+	contentType    string
+	metadata       map[string]string
+	updated        time.Time
+}
+
+func newFakeGCSServer() *fakeGCSServer {
+	f := &fakeGCSServer{objects: make(map[string]*fakeGCSObject)}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	return f
+}
+
+func (f *fakeGCSServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	objectsPath := "/storage/v1/b/" + fakeGCSBucket + "/o"
+	switch {
+	case r.URL.Path == "/upload"+objectsPath && r.Method == http.MethodPost:
+		f.upload(w, r)
+	case r.URL.Path == objectsPath && r.Method == http.MethodGet:
+		f.list(w, r)
+	case strings.HasPrefix(r.URL.Path, objectsPath+"/"):
+		name := strings.TrimPrefix(r.URL.Path, objectsPath+"/")
+		object, ok := f.objects[name]
+		if !ok {
+			fakeGCSError(w, http.StatusNotFound, "No such object: "+name)
+			return
+		}
+		if !fakeGCSConditions(w, r, object) {
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			fakeGCSJSON(w, object.resource(name))
+		case http.MethodPatch:
+			var attrs struct {
+				Metadata map[string]string
+			}
+			if err := json.NewDecoder(r.Body).Decode(&attrs); err != nil {
+				fakeGCSError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			object.metadata = attrs.Metadata
+			object.metageneration++
+			fakeGCSJSON(w, object.resource(name))
+		case http.MethodDelete:
+			delete(f.objects, name)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	case strings.HasPrefix(r.URL.Path, "/"+fakeGCSBucket+"/") && r.Method == http.MethodGet:
+		name := strings.TrimPrefix(r.URL.Path, "/"+fakeGCSBucket+"/")
+		object, ok := f.objects[name]
+		if !ok || r.URL.Query().Has("generation") && r.URL.Query().Get("generation") != strconv.FormatInt(object.generation, 10) {
+			fakeGCSError(w, http.StatusNotFound, "No such object: "+name)
+			return
+		}
+		w.Header().Set("Content-Type", object.contentType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(object.data)))
+		w.Header().Set("X-Goog-Generation", strconv.FormatInt(object.generation, 10))
+		w.Header().Set("X-Goog-Metageneration", strconv.FormatInt(object.metageneration, 10))
+		w.Write(object.data)
+	default:
+		fakeGCSError(w, http.StatusNotImplemented, "not implemented")
+	}
+}
+
+// upload serves multipart uploads of the JSON API, the only kind used for small objects
+func (f *fakeGCSServer) upload(w http.ResponseWriter, r *http.Request) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		fakeGCSError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	reader := multipart.NewReader(r.Body, params["boundary"])
+	var attrs struct {
+		Name        string
+		ContentType string
+		Metadata    map[string]string
+	}
+	part, err := reader.NextPart()
+	if err == nil {
+		err = json.NewDecoder(part).Decode(&attrs)
+	}
+	if err == nil {
+		part, err = reader.NextPart()
+	}
+	var data []byte
+	if err == nil {
+		data, err = ioutil.ReadAll(part)
+	}
+	if err != nil {
+		fakeGCSError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if !fakeGCSConditions(w, r, f.objects[attrs.Name]) {
+		return
+	}
+	f.generation++
+	object := &fakeGCSObject{
+		data:           data,
+		generation:     f.generation,
+		metageneration: 1,
+		contentType:    attrs.ContentType,
+		metadata:       attrs.Metadata,
+		updated:        time.Now().UTC(),
+	}
+	f.objects[attrs.Name] = object
+	fakeGCSJSON(w, object.resource(attrs.Name))
+}
+
+func (f *fakeGCSServer) list(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	var names []string
+	for name := range f.objects {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	items := []map[string]interface{}{}
+	for _, name := range names {
+		items = append(items, f.objects[name].resource(name))
+	}
+	fakeGCSJSON(w, map[string]interface{}{"kind": "storage#objects", "items": items})
+}
+
+func (o *fakeGCSObject) resource(name string) map[string]interface{} {
+	return map[string]interface{}{
+		"kind":           "storage#object",
+		"bucket":         fakeGCSBucket,
+		"name":           name,
+		"generation":     strconv.FormatInt(o.generation, 10),
+		"metageneration": strconv.FormatInt(o.metageneration, 10),
+		"contentType":    o.contentType,
+		"size":           strconv.Itoa(len(o.data)),
+		"metadata":       o.metadata,
+		"updated":        o.updated.Format(time.RFC3339Nano),
+	}
+}
+
+// fakeGCSConditions checks generation and metageneration preconditions of a request,
+// generation 0 matches only missing objects
+func fakeGCSConditions(w http.ResponseWriter, r *http.Request, object *fakeGCSObject) bool {
+	query := r.URL.Query()
+	if query.Has("ifGenerationMatch") {
+		var generation int64
+		if object != nil {
+			generation = object.generation
+		}
+		if query.Get("ifGenerationMatch") != strconv.FormatInt(generation, 10) {
+			fakeGCSError(w, http.StatusPreconditionFailed, "conditionNotMet")
+			return false
+		}
+	}
+	if query.Has("ifMetagenerationMatch") && (object == nil ||
+		query.Get("ifMetagenerationMatch") != strconv.FormatInt(object.metageneration, 10)) {
+		fakeGCSError(w, http.StatusPreconditionFailed, "conditionNotMet")
+		return false
+	}
+	return true
+}
+
+func fakeGCSJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func fakeGCSError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"error":{"code":%d,"message":%q}}`, status, message)
+}
+
+// newFakeGCSStorage creates a backend of the fake server bucket
+func newFakeGCSStorage(server *fakeGCSServer, prefix string) (*GCPStorage, error) {
+	return newGCPStorage(fakeGCSBucket, prefix,
+		option.WithEndpoint(server.URL+"/storage/v1/"), option.WithoutAuthentication())
+}
+
 type GoogleTestSuite struct {
 	suite.Suite
 	BrokenGoogleCSBackend   *GCPStorage
@@ -58,6 +268,68 @@ func (suite *GoogleTestSuite) TestPutObject() {
 	suite.NotNil(err, "cannot put objects with bad bucket")
 }
 
+type GCSFakeTestSuite struct {
+	suite.Suite
+	server  *fakeGCSServer
+	Backend *GCPStorage
+}
+
+func (suite *GCSFakeTestSuite) SetupTest() {
+	suite.server = newFakeGCSServer()
+	backend, err := newFakeGCSStorage(suite.server, "repo")
+	suite.Require().Nil(err)
+	suite.Backend = backend
+}
+
+func (suite *GCSFakeTestSuite) TearDownTest() {
+	suite.server.Close()
+}
+
+func (suite *GCSFakeTestSuite) TestNotExist() {
+	_, err := suite.Backend.GetObject("missing.tgz")
+	suite.True(errors.Is(err, os.ErrNotExist), "missing object not found")
+	_, err = suite.Backend.StatObject("missing.tgz")
+	suite.True(errors.Is(err, os.ErrNotExist), "missing object not found")
+	suite.True(errors.Is(suite.Backend.DeleteObject("missing.tgz"), os.ErrNotExist), "missing object not found")
+
+	suite.Nil(suite.Backend.PutObjectWithTTL("expired.tgz", []byte("data"), time.Nanosecond))
+	time.Sleep(time.Millisecond)
+	_, err = suite.Backend.GetObject("expired.tgz")
+	suite.True(errors.Is(err, os.ErrNotExist), "expired object not found")
+
+	suite.Nil(suite.Backend.PutObject("charts/a.tgz", []byte("data")))
+	object, err := suite.Backend.GetObject("charts/a.tgz")
+	suite.Nil(err)
+	suite.Equal([]byte("data"), object.Data)
+}
+
+func (suite *GCSFakeTestSuite) TestTTLPrecision() {
+	suite.Nil(suite.Backend.PutObjectWithTTL("token", []byte("secret"), 1500*time.Millisecond))
+	expires, err := time.Parse(time.RFC3339Nano, suite.server.objects["repo/token"].metadata[expiresMetadataKey])
+	suite.Nil(err)
+	suite.NotZero(expires.Nanosecond(), "sub-second expiry kept")
+}
+
+func (suite *GCSFakeTestSuite) TestCommitEmptyBucket() {
+	committed, err := NewCommittedBackend(CommittedOptions{Backend: suite.Backend})
+	suite.Require().Nil(err)
+
+	batch := NewBatch()
+	batch.Put("index.yaml", []byte("apiVersion: v1"))
+	suite.Nil(committed.CommitBatch(context.Background(), batch), "first commit to an empty bucket")
+
+	object, err := committed.GetObject("index.yaml")
+	suite.Nil(err)
+	suite.Equal([]byte("apiVersion: v1"), object.Data)
+
+	_, err = committed.GetObject("missing.tgz")
+	suite.True(errors.Is(err, os.ErrNotExist), "missing object not found")
+}
+
+func TestGCSFakeStorageTestSuite(t *testing.T) {
+	suite.Run(t, new(GCSFakeTestSuite))
+}
+
 func TestGoogleStorageTestSuite(t *testing.T) {
 	if os.Getenv("TEST_CLOUD_STORAGE") == "1" &&
 		os.Getenv("TEST_STORAGE_GOOGLE_BUCKET") != "" {
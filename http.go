@@ -0,0 +1,311 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"golang.org/x/net/html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTPManifest lists objects published on a web server, for example
+// {"objects": [{"path": "charts/nginx-1.0.0.tgz", "last_modified": "2022-07-01T12:00:00Z"}]}
+type HTTPManifest struct {
+	Objects []HTTPManifestObject `json:"objects"`
+}
+
+type HTTPManifestObject struct {
+	// Path of the object relative to the storage URL
+	Path         string    `json:"path"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+type HTTPOptions struct {
+	Logger *zap.SugaredLogger
+	// URL objects are published under
+	URL string
+	// Manifest is the path of an HTTPManifest JSON file relative to URL,
+	// without it directories are listed by parsing their autoindex pages
+	Manifest string
+	// User and Password are sent with basic authentication if User is set
+	User     string
+	Password string
+	// HTTPClient defaults to http.DefaultClient
+	HTTPClient *http.Client
+}
+
+// HTTPStorage is a read-only backend of objects published on a web server or CDN,
+// writes return ReadOnlyError
+type HTTPStorage struct {
+	logger   *zap.SugaredLogger
+	base     *url.URL
+	manifest string
+	user     string
+	password string
+	client   *http.Client
+
+	// mu guards the manifest cached until the server reports it modified
+	mu         sync.Mutex
+	cached     *HTTPManifest
+	cachedETag string
+}
+
+func NewHTTPStorage(opts HTTPOptions) (*HTTPStorage, error) {
+	if opts.Logger == nil {
+		opts.Logger = zap.S()
+	}
+
+	if opts.URL == "" {
+		return nil, fmt.Errorf("http url must be specified")
+	}
+	base, err := url.Parse(opts.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid http url: %w", err)
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return nil, fmt.Errorf("invalid http url scheme: %s", base.Scheme)
+	}
+	base.Path = strings.TrimSuffix(base.Path, "/")
+	base.RawPath = ""
+
+	manifest := ""
+	if opts.Manifest != "" {
+		if manifest, err = defaultKeyRules.validate(opts.Manifest); err != nil {
+			return nil, fmt.Errorf("invalid http manifest path: %w", err)
+		}
+	}
+
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = http.DefaultClient
+	}
+
+	return &HTTPStorage{
+		logger:   opts.Logger,
+		base:     base,
+		manifest: manifest,
+		user:     opts.User,
+		password: opts.Password,
+		client:   opts.HTTPClient,
+	}, nil
+}
+
+// ListObjects lists objects of the manifest if configured, otherwise links of the prefix directory autoindex page.
+// Autoindex listings have no modification times
+func (s *HTTPStorage) ListObjects(prefix string) ([]Object, error) {
+	var objects []Object
+	prefix, err := defaultKeyRules.validatePrefix(prefix)
+	if err != nil {
+		return objects, err
+	}
+
+	if s.manifest != "" {
+		objects, err = s.listManifest(prefix)
+	} else {
+		objects, err = s.listAutoindex(prefix)
+	}
+	if err != nil {
+		return objects, err
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Path < objects[j].Path
+	})
+	return objects, nil
+}
+
+func (s *HTTPStorage) listManifest(prefix string) ([]Object, error) {
+	var objects []Object
+	manifest, err := s.fetchManifest()
+	if err != nil {
+		return objects, err
+	}
+
+	for _, entry := range manifest.Objects {
+		key, err := defaultKeyRules.validate(entry.Path)
+		if err != nil {
+			s.logger.Warnf("skipping invalid path of http manifest: %v", err)
+			continue
+		}
+		if !objectPathInPrefix(prefix, key) {
+			continue
+		}
+		objects = append(objects, Object{
+			Path:         removePrefixFromObjectPath(prefix, key),
+			Data:         []byte{},
+			LastModified: entry.LastModified,
+		})
+	}
+	return objects, nil
+}
+
+// fetchManifest returns the manifest, revalidating the cached one with its ETag
+func (s *HTTPStorage) fetchManifest() (*HTTPManifest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	header := http.Header{}
+	if s.cached != nil && s.cachedETag != "" {
+		header.Set("If-None-Match", s.cachedETag)
+	}
+	res, err := s.do(http.MethodGet, s.url(s.manifest), header)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotModified {
+		return s.cached, nil
+	}
+
+	var manifest HTTPManifest
+	if err := json.NewDecoder(res.Body).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("unable to decode http manifest %s: %w", s.manifest, err)
+	}
+	s.cached = &manifest
+	s.cachedETag = res.Header.Get("ETag")
+	return s.cached, nil
+}
+
+// listAutoindex lists links of the directory page pointing to its direct children,
+// links to subdirectories end with a slash and are skipped
+func (s *HTTPStorage) listAutoindex(prefix string) ([]Object, error) {
+	var objects []Object
+	res, err := s.do(http.MethodGet, s.url(prefix)+"/", nil)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) { // OK if the directory doesnt exist
+			err = nil
+		}
+		return objects, err
+	}
+	defer res.Body.Close()
+
+	// links are relative to the page URL after redirects
+	page := res.Request.URL
+	dir := path.Join("/", page.Path)
+	seen := make(map[string]bool)
+	tokenizer := html.NewTokenizer(res.Body)
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			if err := tokenizer.Err(); err != io.EOF {
+				return objects, fmt.Errorf("unable to parse autoindex of %s: %w", page, err)
+			}
+			return objects, nil
+		case html.StartTagToken:
+			name, hasAttr := tokenizer.TagName()
+			if string(name) != "a" || !hasAttr {
+				continue
+			}
+			href := autoindexHref(tokenizer)
+			ref, err := url.Parse(href)
+			if href == "" || err != nil {
+				continue
+			}
+			target := page.ResolveReference(ref)
+			if target.Host != page.Host || strings.HasSuffix(target.Path, "/") {
+				continue
+			}
+			if linked := path.Join("/", target.Path); path.Dir(linked) == dir && !seen[linked] {
+				seen[linked] = true
+				objects = append(objects, Object{Path: path.Base(linked), Data: []byte{}})
+			}
+		}
+	}
+}
+
+func (s *HTTPStorage) GetObject(key string) (Object, error) {
+	object := Object{Path: key}
+	normalized, err := defaultKeyRules.validate(key)
+	if err != nil {
+		return object, err
+	}
+
+	res, err := s.do(http.MethodGet, s.url(normalized), nil)
+	if err != nil {
+		return object, err
+	}
+	content, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return object, err
+	}
+
+	object.Meta = Metadata{
+		Name:        path.Base(normalized),
+		Version:     res.Header.Get("ETag"),
+		ContentType: res.Header.Get("Content-Type"),
+	}
+	object.Data = content
+	object.LastModified, _ = http.ParseTime(res.Header.Get("Last-Modified"))
+	return object, nil
+}
+
+func (s *HTTPStorage) PutObject(key string, data []byte) error {
+	return &ReadOnlyError{Op: "put", Key: key}
+}
+
+func (s *HTTPStorage) DeleteObject(key string) error {
+	return &ReadOnlyError{Op: "delete", Key: key}
+}
+
+// Watch polls objects at prefix every DefaultPollInterval
+func (s *HTTPStorage) Watch(ctx context.Context, prefix string) <-chan Event {
+	return PollObjects(ctx, s, prefix, DefaultPollInterval)
+}
+
+// url returns the escaped URL of a normalized key
+func (s *HTTPStorage) url(key string) string {
+	u := *s.base
+	u.Path = path.Join(u.Path, key)
+	return u.String()
+}
+
+// do sends a request, responses with error status are returned as HTTPError,
+// 304 Not Modified answers conditional requests
+func (s *HTTPStorage) do(method string, target string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if s.user != "" {
+		req.SetBasicAuth(s.user, s.password)
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 300 || res.StatusCode == http.StatusNotModified {
+		return res, nil
+	}
+
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 64*1024))
+	res.Body.Close()
+	return nil, &HTTPError{Method: method, URL: target, StatusCode: res.StatusCode}
+}
+
+// autoindexHref returns the href attribute of the current tag
+func autoindexHref(tokenizer *html.Tokenizer) string {
+	for {
+		name, value, more := tokenizer.TagAttr()
+		if string(name) == "href" {
+			return string(value)
+		}
+		if !more {
+			return ""
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package storage
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// nginxAutoindexPage mimics nginx autoindex output with parent, subdirectory and foreign links
+const nginxAutoindexPage = `<html>
+<head><title>Index of /charts/</title></head>
+<body>
+<h1>Index of /charts/</h1><hr><pre><a href="../">../</a>
+<a href="nested/">nested/</a>                                            01-Jul-2022 12:00       -
+<a href="nginx-1.0.0.tgz">nginx-1.0.0.tgz</a>                                    01-Jul-2022 12:00    1024
+<a href="redis%201.0.0.tgz">redis 1.0.0.tgz</a>                                    01-Jul-2022 12:00    1024
+<a href="/charts/nginx-1.0.0.tgz">nginx-1.0.0.tgz</a>
+<a href="?C=N;O=D">Name</a>
+<a href="https://example.com/other.tgz">other</a>
+<a>no href</a>
+</pre><hr></body>
+</html>`
+
+type HTTPTestSuite struct {
+	suite.Suite
+	Fixture *testFixture
+	server  *httptest.Server
+	Backend *HTTPStorage
+}
+
+func (suite *HTTPTestSuite) SetupTest() {
+	suite.Fixture = newTestFixture("http")
+	for _, key := range []string{"index.yaml", "charts/a.tgz", "charts/b.tgz", "charts/nested/c.tgz"} {
+		p := filepath.Join(suite.Fixture.Dir, key)
+		suite.Nil(os.MkdirAll(filepath.Dir(p), 0777))
+		suite.Nil(ioutil.WriteFile(p, []byte(key), 0644))
+	}
+
+	suite.server = httptest.NewServer(http.FileServer(http.Dir(suite.Fixture.Dir)))
+	backend, err := NewHTTPStorage(HTTPOptions{URL: suite.server.URL + "/"})
+	suite.Nil(err)
+	suite.Backend = backend
+}
+
+func (suite *HTTPTestSuite) TearDownTest() {
+	suite.server.Close()
+	suite.Fixture.Close()
+}
+
+func (suite *HTTPTestSuite) TestNewHTTPStorage() {
+	_, err := NewHTTPStorage(HTTPOptions{})
+	suite.NotNil(err, "url is required")
+
+	_, err = NewHTTPStorage(HTTPOptions{URL: "ftp://example.com/charts"})
+	suite.NotNil(err, "only http and https urls are supported")
+
+	_, err = NewHTTPStorage(HTTPOptions{URL: suite.server.URL, Manifest: "../manifest.json"})
+	suite.True(errors.Is(err, ErrInvalidKey), "manifest path is validated")
+}
+
+func (suite *HTTPTestSuite) TestGetObject() {
+	object, err := suite.Backend.GetObject("charts/a.tgz")
+	suite.Nil(err)
+	suite.Equal([]byte("charts/a.tgz"), object.Data)
+	suite.Equal("a.tgz", object.Meta.Name)
+	suite.WithinDuration(time.Now(), object.LastModified, 2*time.Second, "last-modified parsed")
+
+	_, err = suite.Backend.GetObject("charts/missing.tgz")
+	suite.True(errors.Is(err, os.ErrNotExist), "missing object matches os.ErrNotExist")
+}
+
+func (suite *HTTPTestSuite) TestGetObjectETag() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", "Fri, 01 Jul 2022 12:00:00 GMT")
+		w.Write([]byte("chart"))
+	}))
+	defer server.Close()
+
+	backend, err := NewHTTPStorage(HTTPOptions{URL: server.URL})
+	suite.Nil(err)
+	object, err := backend.GetObject("chart.tgz")
+	suite.Nil(err)
+	suite.Equal(`"v1"`, object.Meta.Version, "etag is the object version")
+	suite.Equal(time.Date(2022, 7, 1, 12, 0, 0, 0, time.UTC), object.LastModified)
+}
+
+func (suite *HTTPTestSuite) TestWritesAreReadOnly() {
+	err := suite.Backend.PutObject("index.yaml", []byte{})
+	suite.True(errors.Is(err, ErrReadOnly))
+
+	err = suite.Backend.DeleteObject("index.yaml")
+	var readOnly *ReadOnlyError
+	suite.True(errors.As(err, &readOnly))
+	suite.Equal("delete", readOnly.Op)
+
+	_, err = suite.Backend.GetObject("index.yaml")
+	suite.Nil(err, "object is kept")
+}
+
+func (suite *HTTPTestSuite) TestListObjectsAutoindex() {
+	objects, err := suite.Backend.ListObjects("")
+	suite.Nil(err)
+	suite.Len(objects, 1, "directories are not listed")
+	suite.Equal("index.yaml", objects[0].Path)
+
+	objects, err = suite.Backend.ListObjects("charts")
+	suite.Nil(err)
+	suite.Len(objects, 2)
+	suite.Equal("a.tgz", objects[0].Path)
+	suite.Equal("b.tgz", objects[1].Path)
+
+	objects, err = suite.Backend.ListObjects("missing")
+	suite.Nil(err, "list objects does not return error if directory does not exist")
+	suite.Empty(objects)
+
+	_, err = suite.Backend.ListObjects("../escape")
+	suite.True(errors.Is(err, ErrInvalidKey))
+}
+
+func (suite *HTTPTestSuite) TestListObjectsNginxAutoindex() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/charts/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(nginxAutoindexPage))
+	}))
+	defer server.Close()
+
+	backend, err := NewHTTPStorage(HTTPOptions{URL: server.URL})
+	suite.Nil(err)
+	objects, err := backend.ListObjects("charts")
+	suite.Nil(err)
+	suite.Len(objects, 2, "parent, subdirectory, sorting and foreign links skipped, duplicates listed once")
+	suite.Equal("nginx-1.0.0.tgz", objects[0].Path)
+	suite.Equal("redis 1.0.0.tgz", objects[1].Path, "hrefs are unescaped")
+}
+
+func (suite *HTTPTestSuite) TestListObjectsManifest() {
+	var fetches, notModified int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/dist/manifest.json" {
+			http.NotFound(w, r)
+			return
+		}
+		atomic.AddInt32(&fetches, 1)
+		w.Header().Set("ETag", `"manifest-1"`)
+		if r.Header.Get("If-None-Match") == `"manifest-1"` {
+			atomic.AddInt32(&notModified, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte(`{"objects": [
+			{"path": "charts/nginx-1.0.0.tgz", "last_modified": "2022-07-01T12:00:00Z"},
+			{"path": "/charts/nested/redis-1.0.0.tgz"},
+			{"path": "index.yaml"},
+			{"path": "../escape.tgz"}
+		]}`))
+	}))
+	defer server.Close()
+
+	backend, err := NewHTTPStorage(HTTPOptions{URL: server.URL + "/dist", Manifest: "manifest.json"})
+	suite.Nil(err)
+
+	objects, err := backend.ListObjects("charts")
+	suite.Nil(err)
+	suite.Len(objects, 1)
+	suite.Equal("nginx-1.0.0.tgz", objects[0].Path)
+	suite.Equal(time.Date(2022, 7, 1, 12, 0, 0, 0, time.UTC), objects[0].LastModified)
+
+	objects, err = backend.ListObjects("")
+	suite.Nil(err)
+	suite.Len(objects, 1, "invalid paths skipped")
+	suite.Equal("index.yaml", objects[0].Path)
+
+	suite.Equal(int32(2), atomic.LoadInt32(&fetches))
+	suite.Equal(int32(1), atomic.LoadInt32(&notModified), "cached manifest revalidated with its etag")
+
+	backend, err = NewHTTPStorage(HTTPOptions{URL: server.URL, Manifest: "manifest.json"})
+	suite.Nil(err)
+	_, err = backend.ListObjects("")
+	suite.True(errors.Is(err, os.ErrNotExist), "missing manifest is an error")
+}
+
+func TestHTTPStorageTestSuite(t *testing.T) {
+	suite.Run(t, new(HTTPTestSuite))
+}
@@ -0,0 +1,29 @@
+package storage
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// HTTPError is returned by HTTP based backends for responses with error status
+type HTTPError struct {
+	Method     string
+	URL        string
+	StatusCode int
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("%s %s: %d %s", e.Method, e.URL, e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// Is matches os.ErrNotExist for missing resources and os.ErrPermission for rejected credentials
+func (e *HTTPError) Is(target error) bool {
+	switch target {
+	case os.ErrNotExist:
+		return e.StatusCode == http.StatusNotFound || e.StatusCode == http.StatusGone
+	case os.ErrPermission:
+		return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+	}
+	return false
+}
@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"unicode/utf8"
+)
+
+// DefaultMaxKeyLength is the maximum key length in bytes, the limit of S3 and GCS object names
+const DefaultMaxKeyLength = 1024
+
+// ErrInvalidKey matches every InvalidKeyError with errors.Is
+var ErrInvalidKey = errors.New("invalid key")
+
+// InvalidKeyError is returned by backends for keys and prefixes rejected by validation
+type InvalidKeyError struct {
+	Key    string
+	Reason string
+}
+
+func (e *InvalidKeyError) Error() string {
+	return fmt.Sprintf("invalid key %q: %s", e.Key, e.Reason)
+}
+
+func (e *InvalidKeyError) Is(target error) bool {
+	return target == ErrInvalidKey
+}
+
+// keyRules are backend specific additions to the common key validation
+type keyRules struct {
+	// forbidden characters
+	forbidden string
+	// reserved names of path segments
+	reserved []string
+	// reservedPrefix of path segments
+	reservedPrefix string
+	// reservedKeyPrefixes of whole keys
+	reservedKeyPrefixes []string
+}
+
+var (
+	// lock objects of Locker implementations are kept under the lock prefix
+	defaultKeyRules = keyRules{
+		reservedKeyPrefixes: []string{lockDir + "/"},
+	}
+	dirKeyRules = keyRules{
+		forbidden:      `\`,
+		reserved:       []string{dirMetaDir, lockDir},
+		reservedPrefix: dirTempPrefix,
+	}
+	gcsKeyRules = keyRules{
+		forbidden:           "\r\n",
+		reservedKeyPrefixes: []string{".well-known/acme-challenge/", lockDir + "/"},
+	}
+	replicatedKeyRules = keyRules{
+		reservedKeyPrefixes: []string{lockDir + "/", replicationLogPrefix + "/"},
+	}
+)
+
+// ValidateKey checks key syntax common to all backends and returns the normalized key:
+// without leading and duplicate slashes and "." segments. Empty keys, ".." segments,
+// NUL bytes, invalid UTF-8 and keys longer than DefaultMaxKeyLength are rejected
+func ValidateKey(key string) (string, error) {
+	return defaultKeyRules.validate(key)
+}
+
+func (r keyRules) validate(key string) (string, error) {
+	normalized, err := r.validatePrefix(key)
+	if err == nil && normalized == "" {
+		err = &InvalidKeyError{Key: key, Reason: "key is empty"}
+	}
+	return normalized, err
+}
+
+// validatePrefix validates a listing prefix, empty prefix stands for the root
+func (r keyRules) validatePrefix(key string) (string, error) {
+	invalid := func(reason string, args ...interface{}) (string, error) {
+		return "", &InvalidKeyError{Key: key, Reason: fmt.Sprintf(reason, args...)}
+	}
+
+	switch {
+	case len(key) > DefaultMaxKeyLength:
+		return invalid("key is longer than %d bytes", DefaultMaxKeyLength)
+	case !utf8.ValidString(key):
+		return invalid("key is not valid UTF-8")
+	case strings.ContainsRune(key, 0):
+		return invalid("key contains NUL byte")
+	case r.forbidden != "" && strings.ContainsAny(key, r.forbidden):
+		return invalid("key contains one of forbidden characters %q", r.forbidden)
+	}
+
+	var segments []string
+	for _, segment := range strings.Split(key, "/") {
+		switch {
+		case segment == "" || segment == ".":
+			continue
+		case segment == "..":
+			return invalid("key contains '..' segment")
+		case r.reservedPrefix != "" && strings.HasPrefix(segment, r.reservedPrefix):
+			return invalid("segment %q starts with reserved %q", segment, r.reservedPrefix)
+		}
+		for _, reserved := range r.reserved {
+			if segment == reserved {
+				return invalid("segment %q is reserved", segment)
+			}
+		}
+		segments = append(segments, segment)
+	}
+
+	normalized := path.Join(segments...)
+	for _, prefix := range r.reservedKeyPrefixes {
+		if strings.HasPrefix(normalized+"/", prefix) {
+			return invalid("key starts with reserved %q", prefix)
+		}
+	}
+
+	return normalized, nil
+}
+
+// validateBatch returns a batch with normalized keys, operations on keys normalized to the same one are merged
+func (r keyRules) validateBatch(batch *Batch) (*Batch, error) {
+	normalized := NewBatch()
+	for _, op := range batch.Ops() {
+		key, err := r.validate(op.Key)
+		if err != nil {
+			return nil, err
+		}
+		op.Key = key
+		normalized.add(op)
+	}
+	return normalized, nil
+}
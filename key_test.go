@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type KeyTestSuite struct {
+	BackendsTestSuite
+}
+
+func (suite *KeyTestSuite) TestValidateKey() {
+	for key, expected := range map[string]string{
+		"charts/app.tgz":     "charts/app.tgz",
+		"/charts//./app.tgz": "charts/app.tgz",
+		"charts/":            "charts",
+		"..app.tgz":          "..app.tgz",
+	} {
+		normalized, err := ValidateKey(key)
+		suite.Nil(err, key)
+		suite.Equal(expected, normalized, key)
+	}
+
+	for _, key := range []string{
+		"",
+		"/",
+		"..",
+		"../../etc/passwd",
+		"charts/../../secret",
+		"charts/\x00app.tgz",
+		"charts/\xff.tgz",
+		strings.Repeat("a", DefaultMaxKeyLength+1),
+	} {
+		_, err := ValidateKey(key)
+		suite.True(errors.Is(err, ErrInvalidKey), "key %q rejected", key)
+
+		var invalid *InvalidKeyError
+		suite.True(errors.As(err, &invalid))
+		suite.Equal(key, invalid.Key)
+	}
+}
+
+func (suite *KeyTestSuite) TestBackendKeyRules() {
+	_, err := dirKeyRules.validate(`charts\app.tgz`)
+	suite.True(errors.Is(err, ErrInvalidKey), "backslash rejected on disk")
+
+	for _, key := range []string{".meta/app.tgz.json", "charts/.locks/commit", ".storage-tmp-app.tgz-123"} {
+		_, err := dirKeyRules.validate(key)
+		suite.True(errors.Is(err, ErrInvalidKey), "reserved name %q rejected on disk", key)
+	}
+
+	_, err = gcsKeyRules.validate("charts/app\n.tgz")
+	suite.True(errors.Is(err, ErrInvalidKey), "new line rejected on GCS")
+
+	_, err = gcsKeyRules.validate(".well-known/acme-challenge/token")
+	suite.True(errors.Is(err, ErrInvalidKey), "acme challenge prefix rejected on GCS")
+
+	for _, rules := range []keyRules{defaultKeyRules, gcsKeyRules, replicatedKeyRules} {
+		_, err = rules.validate(".locks/commit")
+		suite.True(errors.Is(err, ErrInvalidKey), "lock prefix reserved")
+		_, err = rules.validatePrefix("/.locks")
+		suite.True(errors.Is(err, ErrInvalidKey), "lock prefix can not be listed or deleted")
+		_, err = rules.validate("charts/.locks/commit")
+		suite.Nil(err, "nested lock segment allowed")
+	}
+
+	_, err = defaultKeyRules.validate(`charts\app.tgz`)
+	suite.Nil(err, "backslash allowed elsewhere")
+
+	normalized, err := defaultKeyRules.validatePrefix("/")
+	suite.Nil(err, "root prefix allowed")
+	suite.Equal("", normalized)
+}
+
+func (suite *KeyTestSuite) TestPathTraversal() {
+	suite.EachBackend(nil, func(backend Backend) {
+		_, err := backend.GetObject("../secret")
+		suite.True(errors.Is(err, ErrInvalidKey), "get can not escape the root")
+
+		suite.True(errors.Is(backend.PutObject("../secret", []byte("overwritten")), ErrInvalidKey), "put can not escape the root")
+		suite.True(errors.Is(backend.DeleteObject("../secret"), ErrInvalidKey), "delete can not escape the root")
+
+		_, err = backend.ListObjects("..")
+		suite.True(errors.Is(err, ErrInvalidKey), "list can not escape the root")
+
+		suite.Nil(backend.PutObject("/normalized//app.tgz", []byte("app")))
+		object, err := backend.GetObject("normalized/app.tgz")
+		suite.Nil(err, "keys are normalized")
+		suite.Equal([]byte("app"), object.Data)
+	})
+}
+
+func (suite *KeyTestSuite) TestDirPathTraversal() {
+	dir := suite.Dir()
+	secret := suite.Fixture.Path("secret")
+	suite.Nil(os.WriteFile(secret, []byte("secret"), 0600))
+
+	suite.True(errors.Is(dir.PutObject("../secret", []byte("overwritten")), ErrInvalidKey))
+	suite.True(errors.Is(dir.DeleteObject("../secret"), ErrInvalidKey))
+
+	content, err := os.ReadFile(secret)
+	suite.Nil(err)
+	suite.Equal([]byte("secret"), content, "file outside the root untouched")
+}
+
+func (suite *KeyTestSuite) TestBatchKeys() {
+	batch := NewBatch()
+	batch.Put("/index.yaml", []byte("v1"))
+	batch.Put("index.yaml", []byte("v2"))
+
+	normalized, err := defaultKeyRules.validateBatch(batch)
+	suite.Nil(err)
+	suite.Equal([]BatchOp{{Key: "index.yaml", Data: []byte("v2")}}, normalized.Ops(), "operations on the same normalized key merged")
+
+	batch.Delete("../index.yaml")
+	_, err = defaultKeyRules.validateBatch(batch)
+	suite.True(errors.Is(err, ErrInvalidKey))
+}
+
+func TestKeyTestSuite(t *testing.T) {
+	suite.Run(t, &KeyTestSuite{BackendsTestSuite: BackendsTestSuite{Name: "key"}})
+}
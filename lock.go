@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// lockDir holds lock objects of disk and cloud storage backends,
+// it is hidden from ListObjects as all the nested paths
+const lockDir = ".locks"
+
+// DefaultLockRetryInterval is how often backends without blocking lock primitives retry to acquire a held lock
+var DefaultLockRetryInterval = time.Second
+
+// ErrLockLost is returned when a lock has expired or has been taken over by another holder
+var ErrLockLost = errors.New("lock lost")
+
+// Lock is an acquired distributed lock
+type Lock interface {
+	// Token is a fencing token, it grows with every acquisition of the lock with the same name,
+	// so resources guarded by the lock can reject writes of stale holders with Fence
+	Token() int64
+	// Refresh extends the lock for ttl from now, it returns ErrLockLost if the lock is not held anymore
+	Refresh(ctx context.Context, ttl time.Duration) error
+	// Unlock releases the lock, it returns ErrLockLost if the lock is not held anymore
+	Unlock(ctx context.Context) error
+}
+
+// Locker is implemented by backends able to provide mutual exclusion between processes
+type Locker interface {
+	// Lock blocks until the lock is acquired or the context is canceled.
+	// Lock of a holder that stopped refreshing it is released after ttl
+	Lock(ctx context.Context, name string, ttl time.Duration) (Lock, error)
+}
+
+// StaleTokenError is returned by Fence for tokens older than the newest seen one
+type StaleTokenError struct {
+	Name    string
+	Token   int64
+	Current int64
+}
+
+func (e *StaleTokenError) Error() string {
+	return fmt.Sprintf("stale fencing token %d of lock '%s', current token is %d", e.Token, e.Name, e.Current)
+}
+
+// Fence rejects fencing tokens older than the newest one seen per lock name
+type Fence struct {
+	mu     sync.Mutex
+	tokens map[string]int64
+}
+
+func NewFence() *Fence {
+	return &Fence{tokens: make(map[string]int64)}
+}
+
+// Check accepts token if it is not older than any token of the lock seen before
+func (f *Fence) Check(name string, token int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if current := f.tokens[name]; token < current {
+		return &StaleTokenError{Name: name, Token: token, Current: current}
+	}
+	f.tokens[name] = token
+	return nil
+}
+
+// retryLock calls acquire every interval until it succeeds, fails or the context is canceled
+func retryLock(ctx context.Context, interval time.Duration, acquire func() (bool, error)) error {
+	for {
+		ok, err := acquire()
+		if err != nil || ok {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// randomID returns a random hex id
+func randomID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type LockTestSuite struct {
+	BackendsTestSuite
+}
+
+func (suite *LockTestSuite) TestLockExclusive() {
+	suite.EachBackend(func(b Backend) bool {
+		_, ok := b.(Locker)
+		return ok
+	}, func(backend Backend) {
+		locker := backend.(Locker)
+		ctx := context.Background()
+
+		lock, err := locker.Lock(ctx, "deploy/charts", time.Minute)
+		suite.Nil(err)
+		suite.Greater(lock.Token(), int64(0))
+
+		timeout, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+		defer cancel()
+		_, err = locker.Lock(timeout, "deploy/charts", time.Minute)
+		suite.True(errors.Is(err, context.DeadlineExceeded), "held lock is not acquired twice")
+
+		other, err := locker.Lock(ctx, "deploy/images", time.Minute)
+		suite.Nil(err, "locks with other names are independent")
+		suite.Nil(other.Unlock(ctx))
+
+		acquired := make(chan Lock)
+		go func() {
+			next, err := locker.Lock(ctx, "deploy/charts", time.Minute)
+			suite.Nil(err)
+			acquired <- next
+		}()
+
+		suite.Nil(lock.Refresh(ctx, time.Minute))
+		suite.Nil(lock.Unlock(ctx))
+
+		next := <-acquired
+		suite.Greater(next.Token(), lock.Token(), "fencing token grows with every acquisition")
+		suite.Nil(next.Unlock(ctx))
+
+		suite.Equal(ErrLockLost, lock.Unlock(ctx), "released lock is not unlocked twice")
+		suite.Equal(ErrLockLost, lock.Refresh(ctx, time.Minute), "released lock is not refreshed")
+
+		objects, err := backend.ListObjects("")
+		suite.Nil(err)
+		for _, o := range objects {
+			suite.NotEqual(lockDir, o.Path, "lock objects are hidden from list")
+		}
+
+		suite.True(errors.Is(backend.PutObject(".locks/deploy/charts", []byte("{}")), ErrInvalidKey), "lock objects can not be overwritten")
+		if deleter, ok := backend.(PrefixDeleter); ok {
+			suite.True(errors.Is(deleter.DeletePrefix(".locks"), ErrInvalidKey), "lock objects can not be deleted")
+		}
+	})
+}
+
+func (suite *LockTestSuite) TestDirLockToken() {
+	ctx := context.Background()
+	lock, err := suite.Dir().Lock(ctx, "token", time.Minute)
+	suite.Nil(err)
+	suite.Equal(int64(1), lock.Token(), "first acquisition gets token 1")
+	suite.Nil(lock.Unlock(ctx))
+
+	lock, err = suite.Dir().Lock(ctx, "token", time.Minute)
+	suite.Nil(err)
+	suite.Equal(int64(2), lock.Token())
+	suite.Nil(lock.Unlock(ctx))
+}
+
+func (suite *LockTestSuite) TestFence() {
+	fence := NewFence()
+	suite.Nil(fence.Check("deploy", 2))
+	suite.Nil(fence.Check("deploy", 2), "current token is accepted")
+	suite.Nil(fence.Check("other", 1), "tokens are tracked per lock name")
+	suite.Nil(fence.Check("deploy", 3))
+
+	err := fence.Check("deploy", 2)
+	suite.IsType(&StaleTokenError{}, err, "stale holder is rejected")
+	suite.Equal(int64(3), err.(*StaleTokenError).Current)
+}
+
+func TestLockTestSuite(t *testing.T) {
+	suite.Run(t, &LockTestSuite{BackendsTestSuite: BackendsTestSuite{Name: "lock"}})
+}
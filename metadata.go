@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"strings"
+)
+
+// checksumMetadataKey is the user metadata key holding SHA-256 digest of cloud storage objects
+const checksumMetadataKey = "Storage-Sha256"
+
+// MetadataBackend is implemented by backends storing content type, user metadata and checksums with objects.
+// GetObject returns them in object Meta and verifies data against the stored checksum
+type MetadataBackend interface {
+	Backend
+	// PutObjectWithMetadata writes an object with content type and user metadata of meta,
+	// checksum is computed from data, a non-empty meta checksum must match it
+	PutObjectWithMetadata(key string, data []byte, meta Metadata) error
+	// StatObject returns an object with its metadata and without data
+	StatObject(key string) (Object, error)
+}
+
+// objectChecksum computes the checksum of data, comparing it with the expected one if set
+func objectChecksum(key string, data []byte, expected string) (string, error) {
+	actual := sha256Digest(data)
+	if expected != "" && !strings.EqualFold(expected, actual) {
+		return "", &DigestMismatchError{Key: key, Expected: expected, Actual: actual}
+	}
+	return actual, nil
+}
+
+// userMetadata returns a copy of metadata without keys reserved by the package
+func userMetadata(metadata map[string]string) map[string]string {
+	var user map[string]string
+	for k, v := range metadata {
+		if strings.EqualFold(k, expiresMetadataKey) || strings.EqualFold(k, checksumMetadataKey) {
+			continue
+		}
+		if user == nil {
+			user = make(map[string]string)
+		}
+		user[k] = v
+	}
+	return user
+}
+
+// reservedMetadata returns metadata value of a reserved key, S3 may change the case of keys
+func reservedMetadata(metadata map[string]string, key string) string {
+	for k, v := range metadata {
+		if strings.EqualFold(k, key) {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type MetadataTestSuite struct {
+	BackendsTestSuite
+}
+
+func isMetadataBackend(b Backend) bool {
+	_, ok := b.(MetadataBackend)
+	return ok
+}
+
+func (suite *MetadataTestSuite) TestPutObjectWithMetadata() {
+	suite.EachBackend(isMetadataBackend, func(b Backend) {
+		backend := b.(MetadataBackend)
+		data := []byte("apiVersion: v1")
+
+		err := backend.PutObjectWithMetadata("charts/index.yaml", data, Metadata{
+			ContentType:  "application/x-yaml",
+			UserMetadata: map[string]string{"Release": "1.0.0"},
+		})
+		suite.Nil(err)
+
+		object, err := backend.GetObject("charts/index.yaml")
+		suite.Nil(err)
+		suite.Equal(data, object.Data)
+		suite.Equal("index.yaml", object.Meta.Name)
+		suite.Equal("application/x-yaml", object.Meta.ContentType)
+		suite.Equal(map[string]string{"Release": "1.0.0"}, object.Meta.UserMetadata)
+		suite.Equal(sha256Digest(data), object.Meta.Checksum)
+
+		stat, err := backend.StatObject("charts/index.yaml")
+		suite.Nil(err)
+		suite.Empty(stat.Data, "stat does not read data")
+		suite.Equal(object.Meta.ContentType, stat.Meta.ContentType)
+		suite.Equal(object.Meta.UserMetadata, stat.Meta.UserMetadata)
+		suite.Equal(object.Meta.Checksum, stat.Meta.Checksum)
+		suite.True(object.LastModified.Equal(stat.LastModified))
+
+		objects, err := backend.ListObjects("charts")
+		suite.Nil(err)
+		suite.Len(objects, 1, "metadata is hidden from list")
+		suite.Equal("index.yaml", objects[0].Path)
+
+		suite.Nil(backend.PutObject("charts/index.yaml", []byte("apiVersion: v2")))
+		stat, err = backend.StatObject("charts/index.yaml")
+		suite.Nil(err)
+		suite.NotEqual("application/x-yaml", stat.Meta.ContentType, "plain put clears metadata")
+		suite.Empty(stat.Meta.UserMetadata)
+
+		_, err = backend.StatObject("charts/missing.yaml")
+		suite.True(errors.Is(err, os.ErrNotExist))
+	})
+}
+
+func (suite *MetadataTestSuite) TestChecksum() {
+	suite.EachBackend(isMetadataBackend, func(b Backend) {
+		backend := b.(MetadataBackend)
+		data := []byte("chart")
+
+		err := backend.PutObjectWithMetadata("app.tgz", data, Metadata{Checksum: sha256Digest([]byte("other"))})
+		suite.IsType(&DigestMismatchError{}, err, "put rejects data not matching the checksum")
+
+		suite.Nil(backend.PutObjectWithMetadata("app.tgz", data, Metadata{Checksum: sha256Digest(data)}))
+	})
+}
+
+func (suite *MetadataTestSuite) TestDirCorruptedData() {
+	dir := suite.Dir()
+	data := []byte("chart")
+	suite.Nil(dir.PutObjectWithMetadata("corrupted.tgz", data, Metadata{Checksum: sha256Digest(data)}))
+	suite.Nil(os.WriteFile(dir.rootDir+"/corrupted.tgz", []byte("corrupted"), 0644))
+
+	_, err := dir.GetObject("corrupted.tgz")
+	suite.IsType(&DigestMismatchError{}, err, "get detects corrupted data")
+}
+
+func (suite *MetadataTestSuite) TestDirMetadataAtomic() {
+	dir := suite.Dir()
+	original := bytes.Repeat([]byte("a"), 1024*1024)
+	updated := bytes.Repeat([]byte("b"), 1024*1024)
+	suite.Nil(dir.PutObjectWithMetadata("atomic/index.tgz", original, Metadata{ContentType: "text/a"}))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			data, contentType := updated, "text/b"
+			if i%2 == 1 {
+				data, contentType = original, "text/a"
+			}
+			suite.Nil(dir.PutObjectWithMetadata("atomic/index.tgz", data, Metadata{ContentType: contentType}))
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			versions, err := os.ReadDir(path.Join(dir.rootDir, "atomic", dirMetaDir))
+			suite.Nil(err)
+			suite.Len(versions, 2, "superseded versions removed")
+			return
+		default:
+		}
+
+		object, err := dir.GetObject("atomic/index.tgz")
+		suite.Nil(err, "reader never observes data with metadata of another write")
+		if err != nil {
+			return
+		}
+		expected := "text/a"
+		if bytes.Equal(object.Data, updated) {
+			expected = "text/b"
+		}
+		suite.Equal(expected, object.Meta.ContentType)
+	}
+}
+
+func (suite *MetadataTestSuite) TestDirInterruptedPut() {
+	dir := suite.Dir()
+	data := []byte("chart 1")
+	suite.Nil(dir.PutObjectWithMetadata("interrupted.tgz", data, Metadata{ContentType: "application/gzip"}))
+
+	// a put crashed after linking its data, before the sidecar has been written
+	fullPath := path.Join(dir.rootDir, "interrupted.tgz")
+	versionPath := path.Join(dir.rootDir, dirMetaDir, "interrupted.tgz.crashed.data")
+	suite.Nil(dir.writeFile(versionPath, []byte("chart 2")))
+	suite.Nil(dir.linkFile(versionPath, fullPath))
+
+	object, err := dir.GetObject("interrupted.tgz")
+	suite.Nil(err, "object readable after interrupted put")
+	suite.Equal(data, object.Data, "committed version read")
+	suite.Equal("application/gzip", object.Meta.ContentType)
+
+	suite.Nil(dir.PutObject("interrupted.tgz", []byte("chart 3")))
+	object, err = dir.GetObject("interrupted.tgz")
+	suite.Nil(err)
+	suite.Equal([]byte("chart 3"), object.Data)
+
+	suite.Nil(dir.DeleteObject("interrupted.tgz"))
+	_, err = os.Stat(versionPath)
+	suite.Nil(err, "uncommitted version left behind")
+	suite.Nil(os.Remove(versionPath))
+}
+
+func (suite *MetadataTestSuite) TestDirPrefixKey() {
+	dir := suite.Dir()
+	suite.Nil(dir.PutObject("prefix/chart.tgz", []byte("chart")))
+
+	_, err := dir.GetObject("prefix")
+	suite.True(errors.Is(err, os.ErrNotExist), "prefix key read as not found")
+	_, err = dir.StatObject("prefix")
+	suite.True(errors.Is(err, os.ErrNotExist), "prefix key stated as not found")
+}
+
+func TestMetadataTestSuite(t *testing.T) {
+	suite.Run(t, &MetadataTestSuite{BackendsTestSuite: BackendsTestSuite{Name: "metadata"}})
+}
@@ -2,6 +2,7 @@ package storage
 
 import (
 	"fmt"
+	"path"
 	"path/filepath"
 	"strings"
 	"time"
@@ -20,6 +21,12 @@ type Object struct {
 type Metadata struct {
 	Name    string
 	Version string
+	// ContentType is the MIME type of the object data
+	ContentType string
+	// UserMetadata holds custom key-value pairs stored with the object
+	UserMetadata map[string]string
+	// Checksum is the hex SHA-256 digest of the object data
+	Checksum string
 }
 
 // ObjectSliceDiff provides information on what has changed since last calling ListObjects
@@ -83,3 +90,19 @@ func removePrefixFromObjectPath(prefix string, path string) string {
 func objectPathIsInvalid(path string) bool {
 	return strings.Contains(path, "/") || path == ""
 }
+
+func joinObjectPath(prefix string, name string) string {
+	return path.Join(cleanPrefix(prefix), name)
+}
+
+// objectPathInPrefix reports whether key is listed by ListObjects(prefix)
+func objectPathInPrefix(prefix string, key string) bool {
+	prefix = cleanPrefix(prefix)
+	if prefix != "" {
+		if !strings.HasPrefix(key, prefix+"/") {
+			return false
+		}
+		key = strings.TrimPrefix(key, prefix+"/")
+	}
+	return !objectPathIsInvalid(key)
+}
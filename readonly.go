@@ -0,0 +1,23 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrReadOnly matches every ReadOnlyError with errors.Is
+var ErrReadOnly = errors.New("backend is read-only")
+
+// ReadOnlyError is returned by writes to read-only backends
+type ReadOnlyError struct {
+	Op  string
+	Key string
+}
+
+func (e *ReadOnlyError) Error() string {
+	return fmt.Sprintf("%s %s: %v", e.Op, e.Key, ErrReadOnly)
+}
+
+func (e *ReadOnlyError) Is(target error) bool {
+	return target == ErrReadOnly
+}
@@ -0,0 +1,516 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// replicationLogPrefix holds records of writes and deletes that did not reach all replicas
+const replicationLogPrefix = ".replication"
+
+// Replica is a named backend participating in replication
+type Replica struct {
+	Name    string
+	Backend Backend
+}
+
+// ReplicaFailure records a write or delete that did not reach a replica
+type ReplicaFailure struct {
+	Replica string
+	Key     string
+	Op      string
+	Err     error
+	Time    time.Time
+}
+
+// RepairResult summarizes the changes applied to a replica by Repair
+type RepairResult struct {
+	Replica string
+	Copied  []string
+	Removed []string
+	Errors  []string
+}
+
+type ReplicatedOptions struct {
+	Logger *zap.SugaredLogger
+	// Replicas are written in parallel; the first one is used as a source of truth
+	// for reads and repairs unless Preferred is set
+	Replicas []Replica
+	// WriteQuorum is the number of replicas that must acknowledge a write,
+	// defaults to all of them
+	WriteQuorum int
+	// Preferred is the name of the replica to read from first
+	Preferred string
+	// TimestampTolerance is passed to GetObjectSliceDiff when repairing replicas
+	TimestampTolerance time.Duration
+}
+
+// ReplicatedBackend fans out writes and deletes to several backends
+// and reads from a preferred one, falling back to the others
+type ReplicatedBackend struct {
+	logger    *zap.SugaredLogger
+	replicas  []Replica
+	quorum    int
+	tolerance time.Duration
+}
+
+func NewReplicatedBackend(opts ReplicatedOptions) (*ReplicatedBackend, error) {
+	if len(opts.Replicas) == 0 {
+		return nil, fmt.Errorf("no replicas specified")
+	}
+
+	if opts.Logger == nil {
+		opts.Logger = zap.S()
+	}
+
+	quorum := opts.WriteQuorum
+	if quorum <= 0 {
+		quorum = len(opts.Replicas)
+	}
+	if quorum > len(opts.Replicas) {
+		return nil, fmt.Errorf("write quorum %d exceeds number of replicas %d", quorum, len(opts.Replicas))
+	}
+
+	// move preferred replica to the head of the list, so reads hit it first
+	replicas := make([]Replica, 0, len(opts.Replicas))
+	for _, r := range opts.Replicas {
+		if r.Backend == nil {
+			return nil, fmt.Errorf("replica %q has no backend", r.Name)
+		}
+		if r.Name == opts.Preferred {
+			replicas = append([]Replica{r}, replicas...)
+		} else {
+			replicas = append(replicas, r)
+		}
+	}
+	if opts.Preferred != "" && replicas[0].Name != opts.Preferred {
+		return nil, fmt.Errorf("preferred replica %q not found", opts.Preferred)
+	}
+
+	return &ReplicatedBackend{
+		logger:    opts.Logger,
+		replicas:  replicas,
+		quorum:    quorum,
+		tolerance: opts.TimestampTolerance,
+	}, nil
+}
+
+// Replicas returns the replicas in read preference order
+func (s *ReplicatedBackend) Replicas() []Replica {
+	return s.replicas
+}
+
+func (s *ReplicatedBackend) GetObject(key string) (Object, error) {
+	key, err := replicatedKeyRules.validate(key)
+	if err != nil {
+		return Object{Path: key}, err
+	}
+	return s.getFromReplicas(key, s.replicas)
+}
+
+func (s *ReplicatedBackend) ListObjects(prefix string) ([]Object, error) {
+	prefix, err := replicatedKeyRules.validatePrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for _, r := range s.replicas {
+		objects, err := r.Backend.ListObjects(prefix)
+		if err == nil {
+			return objects, nil
+		}
+		s.logger.Debugf("Unable to list objects from %s replica: %s", r.Name, err)
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func (s *ReplicatedBackend) PutObject(key string, data []byte) error {
+	key, err := replicatedKeyRules.validate(key)
+	if err != nil {
+		return err
+	}
+	return s.fanOut("put", key, func(b Backend) error {
+		return b.PutObject(key, data)
+	})
+}
+
+func (s *ReplicatedBackend) DeleteObject(key string) error {
+	key, err := replicatedKeyRules.validate(key)
+	if err != nil {
+		return err
+	}
+	return s.fanOut("delete", key, func(b Backend) error {
+		return b.DeleteObject(key)
+	})
+}
+
+// DeletePrefix removes prefix from every replica, all of them must support prefix deletes.
+// Prefix deletes are not recorded in the replication log, so a replica that misses one would
+// get the objects back from Repair; it fails unless every replica has removed the prefix
+func (s *ReplicatedBackend) DeletePrefix(prefix string) error {
+	prefix, err := replicatedKeyRules.validate(prefix)
+	if err != nil {
+		return err
+	}
+
+	var firstErr error
+	for _, r := range s.replicas {
+		if err := deletePrefix(r.Backend, prefix); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("unable to delete %s from %s replica: %w", prefix, r.Name, err)
+		}
+	}
+	return firstErr
+}
+
+// FailedReplicas returns the writes and deletes that did not reach all replicas
+// since the last successful Repair, as recorded in the replication log
+func (s *ReplicatedBackend) FailedReplicas() ([]ReplicaFailure, error) {
+	records, err := s.readLog("")
+	if err != nil {
+		return nil, err
+	}
+
+	var failed []ReplicaFailure
+	for _, record := range records {
+		for _, replica := range s.replicas {
+			if msg, ok := record.Failures[replica.Name]; ok {
+				failed = append(failed, ReplicaFailure{
+					Replica: replica.Name,
+					Key:     record.Key,
+					Op:      record.Op,
+					Err:     errors.New(msg),
+					Time:    record.Time,
+				})
+			}
+		}
+	}
+	return failed, nil
+}
+
+// Repair reconciles every replica with the preferred one at prefix.
+// Writes and deletes recorded in the replication log are replayed first on the replicas
+// that missed them. Then objects missing or outdated on other replicas are copied from
+// the preferred replica. Objects absent from the preferred replica are never removed,
+// as no delete was recorded for them; they are copied back to the preferred replica instead
+func (s *ReplicatedBackend) Repair(prefix string) ([]RepairResult, error) {
+	prefix, err := replicatedKeyRules.validatePrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]RepairResult, len(s.replicas))
+	for i, r := range s.replicas {
+		results[i].Replica = r.Name
+	}
+
+	pending, err := s.replayLog(prefix, results)
+	if err != nil {
+		return results, err
+	}
+
+	source := s.replicas[0]
+	sourceObjects, err := source.Backend.ListObjects(prefix)
+	if err != nil {
+		return results, err
+	}
+
+	listed := make(map[string][]Object)
+	// restored maps keys copied back to the preferred replica to the replica they came from
+	restored := make(map[string]string)
+	for i, r := range s.replicas[1:] {
+		objects, err := r.Backend.ListObjects(prefix)
+		if err != nil {
+			results[i+1].Errors = append(results[i+1].Errors, err.Error())
+			continue
+		}
+		listed[r.Name] = objects
+
+		for _, o := range GetObjectSliceDiff(objects, sourceObjects, s.tolerance).Removed {
+			key := joinObjectPath(prefix, o.Path)
+			if restored[key] != "" || pending[key] {
+				continue
+			}
+			if err := s.copyObject(key, r, source); err != nil {
+				results[0].Errors = append(results[0].Errors, fmt.Sprintf("%s: %s", key, err))
+				continue
+			}
+			restored[key] = r.Name
+			results[0].Copied = append(results[0].Copied, key)
+		}
+	}
+
+	if len(restored) > 0 {
+		if sourceObjects, err = source.Backend.ListObjects(prefix); err != nil {
+			return results, err
+		}
+	}
+
+	for i, r := range s.replicas[1:] {
+		result := &results[i+1]
+		objects, ok := listed[r.Name]
+		if !ok {
+			continue
+		}
+
+		diff := GetObjectSliceDiff(objects, sourceObjects, s.tolerance)
+		for _, o := range append(diff.Added, diff.Updated...) {
+			key := joinObjectPath(prefix, o.Path)
+			if restored[key] == r.Name {
+				continue
+			}
+			if err := s.copyObject(key, source, r); err != nil {
+				result.Errors = append(result.Errors, fmt.Sprintf("%s: %s", key, err))
+				continue
+			}
+			result.Copied = append(result.Copied, key)
+		}
+	}
+
+	return results, nil
+}
+
+// replayLog applies recorded writes and deletes under prefix to the replicas that missed them,
+// using the state of the replicas that acknowledged them, and forgets fully replayed records.
+// Keys of records that could not be replayed are returned as pending
+func (s *ReplicatedBackend) replayLog(prefix string, results []RepairResult) (map[string]bool, error) {
+	records, err := s.readLog(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	pending := make(map[string]bool)
+	for _, record := range records {
+		var failed, acked []Replica
+		for _, r := range s.replicas {
+			if _, ok := record.Failures[r.Name]; ok {
+				failed = append(failed, r)
+			} else {
+				acked = append(acked, r)
+			}
+		}
+
+		object, found, err := s.lookup(record.Key, acked)
+		replayed := true
+		for _, r := range failed {
+			result := s.result(results, r.Name)
+			switch {
+			case err != nil:
+			case found:
+				if err = r.Backend.PutObject(record.Key, object.Data); err == nil {
+					result.Copied = append(result.Copied, record.Key)
+				}
+			default:
+				if err = r.Backend.DeleteObject(record.Key); err == nil || errors.Is(err, os.ErrNotExist) {
+					err = nil
+					result.Removed = append(result.Removed, record.Key)
+				}
+			}
+			if err != nil {
+				result.Errors = append(result.Errors, fmt.Sprintf("%s: %s", record.Key, err))
+				replayed = false
+			}
+		}
+
+		if replayed {
+			s.forget(record.Key)
+		} else {
+			pending[record.Key] = true
+		}
+	}
+
+	return pending, nil
+}
+
+// lookup reads key from replicas, found is false only if none of them has the object
+// and all of them report it as missing
+func (s *ReplicatedBackend) lookup(key string, replicas []Replica) (Object, bool, error) {
+	var lastErr error
+	for _, r := range replicas {
+		object, err := r.Backend.GetObject(key)
+		if err == nil {
+			return object, true, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			lastErr = err
+		}
+	}
+	if lastErr == nil && len(replicas) == 0 {
+		lastErr = fmt.Errorf("no replicas acknowledged %s", key)
+	}
+	return Object{Path: key}, false, lastErr
+}
+
+func (s *ReplicatedBackend) copyObject(key string, from Replica, to Replica) error {
+	object, err := from.Backend.GetObject(key)
+	if err != nil {
+		return err
+	}
+	return to.Backend.PutObject(key, object.Data)
+}
+
+func (s *ReplicatedBackend) result(results []RepairResult, name string) *RepairResult {
+	for i := range results {
+		if results[i].Replica == name {
+			return &results[i]
+		}
+	}
+	return nil
+}
+
+func (s *ReplicatedBackend) getFromReplicas(key string, replicas []Replica) (Object, error) {
+	var lastErr = fmt.Errorf("no replicas to read %s from", key)
+	for _, r := range replicas {
+		object, err := r.Backend.GetObject(key)
+		if err == nil {
+			return object, nil
+		}
+		s.logger.Debugf("Unable to get object %s from %s replica: %s", key, r.Name, err)
+		lastErr = err
+	}
+	return Object{Path: key}, lastErr
+}
+
+func (s *ReplicatedBackend) fanOut(op string, key string, fn func(b Backend) error) error {
+	errs := make([]error, len(s.replicas))
+
+	var wg sync.WaitGroup
+	for i := range s.replicas {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = fn(s.replicas[i].Backend)
+		}(i)
+	}
+	wg.Wait()
+
+	record := replicationRecord{Key: key, Op: op, Time: time.Now(), Failures: make(map[string]string)}
+	var acked []Replica
+	var lastErr error
+	for i, err := range errs {
+		if err == nil {
+			acked = append(acked, s.replicas[i])
+			continue
+		}
+		lastErr = err
+		record.Failures[s.replicas[i].Name] = err.Error()
+		s.logger.Warnf("Unable to %s object %s on %s replica: %s", op, key, s.replicas[i].Name, err)
+	}
+
+	if lastErr != nil {
+		s.record(record, acked)
+	}
+
+	if len(acked) < s.quorum {
+		return fmt.Errorf("%s %s: %d of %d replicas acknowledged, quorum is %d: %w",
+			op, key, len(acked), len(s.replicas), s.quorum, lastErr)
+	}
+
+	return nil
+}
+
+// replicationRecord is an entry of the replication log. There is at most one record per key,
+// the latest write or delete that did not reach all replicas
+type replicationRecord struct {
+	Key  string    `json:"key"`
+	Op   string    `json:"op"`
+	Time time.Time `json:"time"`
+	// Failures maps names of replicas that missed the operation to the errors returned
+	Failures map[string]string `json:"failures"`
+}
+
+func replicationLogKey(key string) string {
+	digest := sha256.Sum256([]byte(key))
+	return path.Join(replicationLogPrefix, hex.EncodeToString(digest[:]))
+}
+
+// record stores the record in the replication log of every replica that acknowledged
+// the operation, so that a Repair in another process can replay it
+func (s *ReplicatedBackend) record(record replicationRecord, replicas []Replica) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		s.logger.Errorf("Unable to encode replication record of %s: %s", record.Key, err)
+		return
+	}
+
+	for _, r := range replicas {
+		if err := r.Backend.PutObject(replicationLogKey(record.Key), data); err != nil {
+			s.logger.Errorf("Unable to store replication record of %s on %s replica: %s", record.Key, r.Name, err)
+		}
+	}
+}
+
+// readLog merges replication logs of all available replicas, keeping the latest record for every key under prefix
+func (s *ReplicatedBackend) readLog(prefix string) ([]replicationRecord, error) {
+	latest := make(map[string]replicationRecord)
+	var available int
+	var lastErr error
+	for _, r := range s.replicas {
+		objects, err := r.Backend.ListObjects(replicationLogPrefix)
+		if err != nil {
+			s.logger.Debugf("Unable to list replication log of %s replica: %s", r.Name, err)
+			lastErr = err
+			continue
+		}
+		available++
+
+		for _, o := range objects {
+			object, err := r.Backend.GetObject(joinObjectPath(replicationLogPrefix, o.Path))
+			if err != nil {
+				s.logger.Debugf("Unable to read replication record %s of %s replica: %s", o.Path, r.Name, err)
+				continue
+			}
+			var record replicationRecord
+			if err := json.Unmarshal(object.Data, &record); err != nil {
+				s.logger.Warnf("Invalid replication record %s on %s replica: %s", o.Path, r.Name, err)
+				continue
+			}
+			if !keyInPrefix(prefix, record.Key) {
+				continue
+			}
+			if previous, ok := latest[record.Key]; !ok || record.Time.After(previous.Time) {
+				latest[record.Key] = record
+			}
+		}
+	}
+
+	if available == 0 {
+		return nil, fmt.Errorf("unable to read replication log: %w", lastErr)
+	}
+
+	records := make([]replicationRecord, 0, len(latest))
+	for _, record := range latest {
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Key < records[j].Key
+	})
+	return records, nil
+}
+
+// forget removes the record of key from the replication logs
+func (s *ReplicatedBackend) forget(key string) {
+	for _, r := range s.replicas {
+		if err := r.Backend.DeleteObject(replicationLogKey(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			s.logger.Warnf("Unable to remove replication record of %s from %s replica: %s", key, r.Name, err)
+		}
+	}
+}
+
+// keyInPrefix reports whether key is prefix itself or located anywhere below it
+func keyInPrefix(prefix string, key string) bool {
+	prefix = cleanPrefix(prefix)
+	return prefix == "" || key == prefix || strings.HasPrefix(key, prefix+"/")
+}
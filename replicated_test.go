@@ -0,0 +1,292 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// brokenBackend fails every operation, used to emulate an unavailable replica
+type brokenBackend struct{}
+
+func (brokenBackend) ListObjects(prefix string) ([]Object, error) {
+	return nil, fmt.Errorf("broken backend")
+}
+
+func (brokenBackend) GetObject(key string) (Object, error) {
+	return Object{}, fmt.Errorf("broken backend")
+}
+
+func (brokenBackend) PutObject(key string, data []byte) error {
+	return fmt.Errorf("broken backend")
+}
+
+func (brokenBackend) DeleteObject(key string) error {
+	return fmt.Errorf("broken backend")
+}
+
+// flakyBackend rejects writes while broken
+type flakyBackend struct {
+	Backend
+	broken bool
+}
+
+func (b *flakyBackend) PutObject(key string, data []byte) error {
+	if b.broken {
+		return fmt.Errorf("flaky backend")
+	}
+	return b.Backend.PutObject(key, data)
+}
+
+// flakyDeleteBackend rejects deletes while broken
+type flakyDeleteBackend struct {
+	Backend
+	broken bool
+}
+
+func (b *flakyDeleteBackend) DeleteObject(key string) error {
+	if b.broken {
+		return fmt.Errorf("flaky backend")
+	}
+	return b.Backend.DeleteObject(key)
+}
+
+type ReplicatedTestSuite struct {
+	suite.Suite
+	Fixture   *testFixture
+	Primary   *DirStorage
+	Secondary *DirStorage
+}
+
+func (suite *ReplicatedTestSuite) SetupTest() {
+	suite.Fixture = newTestFixture("replicated")
+
+	primary, err := suite.Fixture.DirStorage("primary")
+	suite.Nil(err)
+	suite.Primary = primary
+
+	secondary, err := suite.Fixture.DirStorage("secondary")
+	suite.Nil(err)
+	suite.Secondary = secondary
+}
+
+func (suite *ReplicatedTestSuite) TearDownTest() {
+	suite.Fixture.Close()
+}
+
+func (suite *ReplicatedTestSuite) TestNewReplicatedBackend() {
+	_, err := NewReplicatedBackend(ReplicatedOptions{})
+	suite.NotNil(err, "cannot create replicated backend without replicas")
+
+	_, err = NewReplicatedBackend(ReplicatedOptions{
+		Replicas:    []Replica{{Name: "primary", Backend: suite.Primary}},
+		WriteQuorum: 2,
+	})
+	suite.NotNil(err, "cannot create replicated backend with quorum exceeding replicas")
+
+	_, err = NewReplicatedBackend(ReplicatedOptions{
+		Replicas:  []Replica{{Name: "primary", Backend: suite.Primary}},
+		Preferred: "unknown",
+	})
+	suite.NotNil(err, "cannot create replicated backend with unknown preferred replica")
+
+	b, err := NewReplicatedBackend(ReplicatedOptions{
+		Replicas: []Replica{
+			{Name: "primary", Backend: suite.Primary},
+			{Name: "secondary", Backend: suite.Secondary},
+		},
+		Preferred: "secondary",
+	})
+	suite.Nil(err)
+	suite.Equal("secondary", b.Replicas()[0].Name, "preferred replica is read first")
+}
+
+func (suite *ReplicatedTestSuite) TestPutObjectQuorum() {
+	b, err := NewReplicatedBackend(ReplicatedOptions{
+		Replicas: []Replica{
+			{Name: "primary", Backend: suite.Primary},
+			{Name: "broken", Backend: brokenBackend{}},
+		},
+	})
+	suite.Nil(err)
+	suite.NotNil(b.PutObject("test.txt", []byte("test content")), "write fails without quorum")
+
+	b, err = NewReplicatedBackend(ReplicatedOptions{
+		Replicas: []Replica{
+			{Name: "primary", Backend: suite.Primary},
+			{Name: "broken", Backend: brokenBackend{}},
+		},
+		WriteQuorum: 1,
+	})
+	suite.Nil(err)
+	suite.Nil(b.PutObject("test.txt", []byte("test content")), "write succeeds with quorum")
+
+	failed, err := b.FailedReplicas()
+	suite.Nil(err)
+	suite.Len(failed, 1, "failed replica recorded")
+	suite.Equal("broken", failed[0].Replica)
+	suite.Equal("test.txt", failed[0].Key)
+	suite.Equal("put", failed[0].Op)
+}
+
+func (suite *ReplicatedTestSuite) TestGetObjectFallback() {
+	suite.Nil(suite.Secondary.PutObject("test.txt", []byte("test content")))
+
+	b, err := NewReplicatedBackend(ReplicatedOptions{
+		Replicas: []Replica{
+			{Name: "broken", Backend: brokenBackend{}},
+			{Name: "secondary", Backend: suite.Secondary},
+		},
+	})
+	suite.Nil(err)
+
+	object, err := b.GetObject("test.txt")
+	suite.Nil(err, "object read from fallback replica")
+	suite.Equal([]byte("test content"), object.Data)
+
+	objects, err := b.ListObjects("")
+	suite.Nil(err, "objects listed from fallback replica")
+	suite.Len(objects, 1)
+}
+
+func (suite *ReplicatedTestSuite) TestRepair() {
+	suite.Nil(suite.Primary.PutObject("added.txt", []byte("added")))
+	suite.Nil(suite.Primary.PutObject("updated.txt", []byte("new content")))
+	suite.Nil(suite.Secondary.PutObject("unrecorded.txt", []byte("unrecorded")))
+	suite.Nil(suite.Secondary.PutObject("updated.txt", []byte("old content")))
+	past := time.Now().Add(-time.Hour)
+	suite.Nil(os.Chtimes(suite.Secondary.rootDir+"/updated.txt", past, past))
+
+	b, err := NewReplicatedBackend(ReplicatedOptions{
+		Replicas: []Replica{
+			{Name: "primary", Backend: suite.Primary},
+			{Name: "secondary", Backend: suite.Secondary},
+		},
+	})
+	suite.Nil(err)
+
+	results, err := b.Repair("")
+	suite.Nil(err)
+	suite.Len(results, 2)
+	suite.Equal([]string{"unrecorded.txt"}, results[0].Copied, "object without recorded delete restored")
+	suite.ElementsMatch([]string{"added.txt", "updated.txt"}, results[1].Copied)
+	suite.Empty(results[1].Removed)
+	suite.Empty(results[1].Errors)
+
+	object, err := suite.Secondary.GetObject("updated.txt")
+	suite.Nil(err)
+	suite.Equal([]byte("new content"), object.Data, "outdated object copied")
+
+	object, err = suite.Primary.GetObject("unrecorded.txt")
+	suite.Nil(err)
+	suite.Equal([]byte("unrecorded"), object.Data)
+}
+
+func (suite *ReplicatedTestSuite) TestRepairPreferredReplica() {
+	flaky := &flakyBackend{Backend: suite.Primary, broken: true}
+	replicas := []Replica{
+		{Name: "primary", Backend: flaky},
+		{Name: "secondary", Backend: suite.Secondary},
+	}
+	b, err := NewReplicatedBackend(ReplicatedOptions{Replicas: replicas, WriteQuorum: 1})
+	suite.Nil(err)
+	suite.Nil(b.PutObject("test.txt", []byte("test content")))
+	failed, err := b.FailedReplicas()
+	suite.Nil(err)
+	suite.Len(failed, 1)
+
+	// repair runs in a fresh process and relies on the persisted replication log
+	flaky.broken = false
+	b, err = NewReplicatedBackend(ReplicatedOptions{Replicas: replicas})
+	suite.Nil(err)
+	results, err := b.Repair("")
+	suite.Nil(err)
+	suite.Equal([]string{"test.txt"}, results[0].Copied, "missed write replayed on preferred replica")
+	suite.Empty(results[1].Removed, "missed write not propagated as removal")
+	failed, err = b.FailedReplicas()
+	suite.Nil(err)
+	suite.Empty(failed, "failures cleared after repair")
+
+	object, err := suite.Primary.GetObject("test.txt")
+	suite.Nil(err)
+	suite.Equal([]byte("test content"), object.Data)
+}
+
+func (suite *ReplicatedTestSuite) TestRepairRecordedDelete() {
+	suite.Nil(suite.Primary.PutObject("test.txt", []byte("test content")))
+	suite.Nil(suite.Secondary.PutObject("test.txt", []byte("test content")))
+
+	flaky := &flakyDeleteBackend{Backend: suite.Secondary, broken: true}
+	replicas := []Replica{
+		{Name: "primary", Backend: suite.Primary},
+		{Name: "secondary", Backend: flaky},
+	}
+	b, err := NewReplicatedBackend(ReplicatedOptions{Replicas: replicas, WriteQuorum: 1})
+	suite.Nil(err)
+	suite.Nil(b.DeleteObject("test.txt"))
+
+	flaky.broken = false
+	b, err = NewReplicatedBackend(ReplicatedOptions{Replicas: replicas})
+	suite.Nil(err)
+	results, err := b.Repair("")
+	suite.Nil(err)
+	suite.Empty(results[0].Copied, "recorded delete not restored on preferred replica")
+	suite.Equal([]string{"test.txt"}, results[1].Removed, "recorded delete replayed")
+
+	_, err = suite.Secondary.GetObject("test.txt")
+	suite.True(errors.Is(err, os.ErrNotExist))
+}
+
+// TestRepairGCSReplica pairs a disk replica with GCS, whose client reports missing objects with its own error
+func (suite *ReplicatedTestSuite) TestRepairGCSReplica() {
+	server := newFakeGCSServer()
+	defer server.Close()
+	gcs, err := newFakeGCSStorage(server, "replica")
+	suite.Require().Nil(err)
+
+	suite.Nil(gcs.PutObject("test.txt", []byte("test content")))
+	suite.Nil(suite.Secondary.PutObject("test.txt", []byte("test content")))
+
+	flaky := &flakyDeleteBackend{Backend: suite.Secondary, broken: true}
+	replicas := []Replica{
+		{Name: "gcs", Backend: gcs},
+		{Name: "secondary", Backend: flaky},
+	}
+	b, err := NewReplicatedBackend(ReplicatedOptions{Replicas: replicas, WriteQuorum: 1})
+	suite.Nil(err)
+	suite.Nil(b.DeleteObject("test.txt"))
+	suite.Nil(b.PutObject("added.txt", []byte("added")))
+
+	flaky.broken = false
+	b, err = NewReplicatedBackend(ReplicatedOptions{Replicas: replicas})
+	suite.Nil(err)
+	results, err := b.Repair("")
+	suite.Nil(err)
+	suite.Empty(results[0].Errors)
+	suite.Empty(results[1].Errors)
+	suite.Empty(results[0].Copied, "recorded delete not restored on GCS")
+	suite.Equal([]string{"test.txt"}, results[1].Removed, "recorded delete replayed")
+
+	_, err = suite.Secondary.GetObject("test.txt")
+	suite.True(errors.Is(err, os.ErrNotExist))
+	failed, err := b.FailedReplicas()
+	suite.Nil(err)
+	suite.Empty(failed, "failures cleared after repair")
+}
+
+func (suite *ReplicatedTestSuite) TestReplicationLogReserved() {
+	b, err := NewReplicatedBackend(ReplicatedOptions{
+		Replicas: []Replica{{Name: "primary", Backend: suite.Primary}},
+	})
+	suite.Nil(err)
+	suite.True(errors.Is(b.PutObject(".replication/test.txt", []byte("test")), ErrInvalidKey))
+	suite.True(errors.Is(b.DeleteObject(".replication/test.txt"), ErrInvalidKey))
+}
+
+func TestReplicatedTestSuite(t *testing.T) {
+	suite.Run(t, new(ReplicatedTestSuite))
+}
@@ -0,0 +1,416 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/pkg/sftp"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultSFTPPort = 22
+
+// sftpPosixRenameExt is the OpenSSH extension replacing an existing file atomically
+const sftpPosixRenameExt = "posix-rename@openssh.com"
+
+type SFTPOptions struct {
+	Logger *zap.SugaredLogger
+	Host   string
+	// Port defaults to DefaultSFTPPort
+	Port int
+	User string
+	// Password authenticates the user if set
+	Password string
+	// PrivateKey is a PEM encoded private key authenticating the user if set
+	PrivateKey []byte
+	// PrivateKeyPassphrase decrypts PrivateKey
+	PrivateKeyPassphrase string
+	// HostKeyCallback verifies the server host key, KnownHostsFile is used if it is not set
+	HostKeyCallback ssh.HostKeyCallback
+	// KnownHostsFile is an OpenSSH known_hosts file the server host key is verified against
+	KnownHostsFile string
+	// RootDir objects are stored under, relative to the user home directory unless absolute
+	RootDir string
+	// FileMode is the permission of written files. Defaults to DefaultDirFileMode
+	FileMode os.FileMode
+	// DirMode is the permission of created directories. Defaults to DefaultDirMode
+	DirMode os.FileMode
+	// Timeout of the connection establishment, 30 seconds by default
+	Timeout time.Duration
+}
+
+// SFTPStorage stores objects as files under a root directory of an SFTP server,
+// keys are paths relative to the root directory as with DirStorage.
+// The connection is established on first use and re-established after it is lost
+type SFTPStorage struct {
+	logger   *zap.SugaredLogger
+	addr     string
+	config   *ssh.ClientConfig
+	rootDir  string
+	fileMode os.FileMode
+	dirMode  os.FileMode
+
+	mu     sync.Mutex
+	client *ssh.Client
+	conn   *sftp.Client
+}
+
+func NewSFTPStorage(opts SFTPOptions) (*SFTPStorage, error) {
+	if opts.Logger == nil {
+		opts.Logger = zap.S()
+	}
+
+	if opts.Host == "" {
+		return nil, fmt.Errorf("sftp host must be specified")
+	}
+	if opts.Port == 0 {
+		opts.Port = DefaultSFTPPort
+	}
+	if opts.FileMode == 0 {
+		opts.FileMode = DefaultDirFileMode
+	}
+	if opts.DirMode == 0 {
+		opts.DirMode = DefaultDirMode
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = 30 * time.Second
+	}
+
+	var auth []ssh.AuthMethod
+	if len(opts.PrivateKey) > 0 {
+		var signer ssh.Signer
+		var err error
+		if opts.PrivateKeyPassphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(opts.PrivateKey, []byte(opts.PrivateKeyPassphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(opts.PrivateKey)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid sftp private key: %w", err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if opts.Password != "" {
+		auth = append(auth, ssh.Password(opts.Password))
+	}
+	if len(auth) == 0 {
+		return nil, fmt.Errorf("sftp password or private key must be specified")
+	}
+
+	if opts.HostKeyCallback == nil {
+		if opts.KnownHostsFile == "" {
+			return nil, fmt.Errorf("sftp host key callback or known hosts file must be specified")
+		}
+		callback, err := knownhosts.New(opts.KnownHostsFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read known hosts: %w", err)
+		}
+		opts.HostKeyCallback = callback
+	}
+
+	rootDir := path.Clean(opts.RootDir)
+	return &SFTPStorage{
+		logger: opts.Logger,
+		addr:   net.JoinHostPort(opts.Host, strconv.Itoa(opts.Port)),
+		config: &ssh.ClientConfig{
+			User:            opts.User,
+			Auth:            auth,
+			HostKeyCallback: opts.HostKeyCallback,
+			Timeout:         opts.Timeout,
+		},
+		rootDir:  rootDir,
+		fileMode: opts.FileMode,
+		dirMode:  opts.DirMode,
+	}, nil
+}
+
+// sftp returns the open sftp session, connecting if there is none.
+// Reads and writes of a file are pipelined over the session
+func (s *SFTPStorage) sftp() (*sftp.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn != nil {
+		return s.conn, nil
+	}
+
+	client, err := ssh.Dial("tcp", s.addr, s.config)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := sftp.NewClient(client, sftp.UseConcurrentWrites(true))
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	s.logger.Debugf("Connected to sftp server %s", s.addr)
+	s.client, s.conn = client, conn
+	return conn, nil
+}
+
+// withConn runs fn with the sftp session, dropping the session if the connection is lost.
+// Statuses returned by the server are wrapped in os.PathError by sftpPathError, other errors drop the session
+func (s *SFTPStorage) withConn(fn func(conn *sftp.Client) error) error {
+	conn, err := s.sftp()
+	if err != nil {
+		return err
+	}
+
+	err = fn(conn)
+	if _, ok := err.(*os.PathError); err != nil && !ok {
+		s.logger.Warnf("Closing sftp connection to %s: %s", s.addr, err)
+		s.mu.Lock()
+		if s.conn == conn {
+			s.client.Close()
+			s.client, s.conn = nil, nil
+		}
+		s.mu.Unlock()
+	}
+	return err
+}
+
+// Close closes the connection to the server
+func (s *SFTPStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client == nil {
+		return nil
+	}
+	err := s.client.Close()
+	s.client, s.conn = nil, nil
+	return err
+}
+
+func (s *SFTPStorage) ListObjects(prefix string) ([]Object, error) {
+	var objects []Object
+	prefix, err := dirKeyRules.validatePrefix(prefix)
+	if err != nil {
+		return objects, err
+	}
+
+	dir := path.Join(s.rootDir, prefix)
+	err = s.withConn(func(conn *sftp.Client) error {
+		entries, err := conn.ReadDir(dir)
+		if errors.Is(err, os.ErrNotExist) { // OK if the directory doesnt exist yet
+			return nil
+		}
+		if err != nil {
+			return sftpPathError("readdir", dir, err)
+		}
+
+		for _, e := range entries {
+			if !e.Mode().IsRegular() || strings.HasPrefix(e.Name(), dirTempPrefix) {
+				continue
+			}
+			objects = append(objects, Object{Path: e.Name(), Data: []byte{}, LastModified: e.ModTime()})
+		}
+		return nil
+	})
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Path < objects[j].Path
+	})
+	return objects, err
+}
+
+func (s *SFTPStorage) GetObject(key string) (Object, error) {
+	object := Object{Path: key}
+	fullPath, err := s.fullPath(key)
+	if err != nil {
+		return object, err
+	}
+
+	err = s.withConn(func(conn *sftp.Client) error {
+		info, err := conn.Stat(fullPath)
+		if err != nil {
+			return sftpPathError("stat", fullPath, err)
+		}
+		if info.IsDir() {
+			return &os.PathError{Op: "open", Path: fullPath, Err: os.ErrNotExist}
+		}
+
+		file, err := conn.Open(fullPath)
+		if err != nil {
+			return sftpPathError("open", fullPath, err)
+		}
+		defer file.Close()
+
+		var data bytes.Buffer
+		if _, err := file.WriteTo(&data); err != nil {
+			return sftpPathError("read", fullPath, err)
+		}
+		object.Meta = Metadata{Name: path.Base(key)}
+		object.Data = data.Bytes()
+		object.LastModified = info.ModTime()
+		return nil
+	})
+	return object, err
+}
+
+// PutObject writes data to a temporary file and renames it to the object file,
+// the rename is atomic if the server supports posix-rename@openssh.com extension
+func (s *SFTPStorage) PutObject(key string, data []byte) error {
+	fullPath, err := s.fullPath(key)
+	if err != nil {
+		return err
+	}
+
+	suffix, err := randomID()
+	if err != nil {
+		return err
+	}
+	tmpPath := path.Join(path.Dir(fullPath), dirTempPrefix+suffix)
+
+	return s.withConn(func(conn *sftp.Client) error {
+		if err := s.mkdirAll(conn, path.Dir(fullPath)); err != nil {
+			return err
+		}
+		if err := s.writeFile(conn, tmpPath, data); err != nil {
+			conn.Remove(tmpPath)
+			return err
+		}
+		if err := rename(conn, tmpPath, fullPath); err != nil {
+			conn.Remove(tmpPath)
+			return err
+		}
+		return nil
+	})
+}
+
+// writeFile creates a new file at filePath with data, failing if it exists
+func (s *SFTPStorage) writeFile(conn *sftp.Client, filePath string, data []byte) error {
+	file, err := conn.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return sftpPathError("open", filePath, err)
+	}
+
+	_, err = file.ReadFrom(bytes.NewReader(data))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = conn.Chmod(filePath, s.fileMode)
+	}
+	return sftpPathError("write", filePath, err)
+}
+
+// rename replaces newPath atomically with the OpenSSH extension if the server supports it,
+// protocol version 3 rename fails if newPath exists, so it is removed first otherwise
+func rename(conn *sftp.Client, oldPath string, newPath string) error {
+	if _, ok := conn.HasExtension(sftpPosixRenameExt); ok {
+		return sftpPathError("rename", newPath, conn.PosixRename(oldPath, newPath))
+	}
+
+	if err := conn.Remove(newPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return sftpPathError("remove", newPath, err)
+	}
+	return sftpPathError("rename", newPath, conn.Rename(oldPath, newPath))
+}
+
+// DeleteObject removes the object file and its parent directories left empty up to the root
+func (s *SFTPStorage) DeleteObject(key string) error {
+	fullPath, err := s.fullPath(key)
+	if err != nil {
+		return err
+	}
+
+	return s.withConn(func(conn *sftp.Client) error {
+		if err := conn.Remove(fullPath); err != nil {
+			return sftpPathError("remove", fullPath, err)
+		}
+		// keys are validated, so walking up the path reaches the root
+		for dir := path.Dir(fullPath); dir != s.rootDir; dir = path.Dir(dir) {
+			if conn.RemoveDirectory(dir) != nil {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+// DeletePrefix removes the prefix directory with all objects under it and prunes its empty parents
+func (s *SFTPStorage) DeletePrefix(prefix string) error {
+	dir, err := s.fullPath(prefix)
+	if err != nil {
+		return err
+	}
+
+	return s.withConn(func(conn *sftp.Client) error {
+		info, err := conn.Stat(dir)
+		if errors.Is(err, os.ErrNotExist) || err == nil && !info.IsDir() {
+			return nil
+		}
+		if err != nil {
+			return sftpPathError("stat", dir, err)
+		}
+		if err := conn.RemoveAll(dir); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return sftpPathError("remove", dir, err)
+		}
+		for parent := path.Dir(dir); parent != s.rootDir; parent = path.Dir(parent) {
+			if conn.RemoveDirectory(parent) != nil {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+// mkdirAll creates dir with its missing parents
+func (s *SFTPStorage) mkdirAll(conn *sftp.Client, dir string) error {
+	info, err := conn.Stat(dir)
+	if err == nil {
+		if !info.IsDir() {
+			return &os.PathError{Op: "mkdir", Path: dir, Err: fmt.Errorf("not a directory")}
+		}
+		return nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return sftpPathError("stat", dir, err)
+	}
+
+	if parent := path.Dir(dir); parent != dir {
+		if err := s.mkdirAll(conn, parent); err != nil {
+			return err
+		}
+	}
+	if err := conn.Mkdir(dir); err != nil {
+		// created concurrently
+		if info, statErr := conn.Stat(dir); statErr == nil && info.IsDir() {
+			return nil
+		}
+		return sftpPathError("mkdir", dir, err)
+	}
+	return sftpPathError("chmod", dir, conn.Chmod(dir, s.dirMode))
+}
+
+// sftpPathError wraps a status returned by the server in os.PathError,
+// failures of the connection are returned as is
+func sftpPathError(op string, filePath string, err error) error {
+	var status *sftp.StatusError
+	if errors.Is(err, os.ErrNotExist) || errors.Is(err, os.ErrPermission) || errors.As(err, &status) {
+		return &os.PathError{Op: op, Path: filePath, Err: err}
+	}
+	return err
+}
+
+// fullPath validates key and returns its path on the server
+func (s *SFTPStorage) fullPath(key string) (string, error) {
+	normalized, err := dirKeyRules.validate(key)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(s.rootDir, normalized), nil
+}
@@ -0,0 +1,316 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	fakeSFTPUser     = "charts"
+	fakeSFTPPassword = "secret"
+)
+
+// fakeSFTPServer serves the sftp subsystem with github.com/pkg/sftp over an in-process SSH server,
+// relative client paths are resolved under root directory
+type fakeSFTPServer struct {
+	listener  net.Listener
+	root      string
+	hostKey   ssh.Signer
+	clientKey ed25519.PrivateKey
+}
+
+func newFakeSFTPServer(root string) (*fakeSFTPServer, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		return nil, err
+	}
+	_, clientKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	f := &fakeSFTPServer{
+		listener:  listener,
+		root:      root,
+		hostKey:   hostSigner,
+		clientKey: clientKey,
+	}
+	go f.serve()
+	return f, nil
+}
+
+func (f *fakeSFTPServer) Close() error {
+	return f.listener.Close()
+}
+
+func (f *fakeSFTPServer) hostPort() (string, int) {
+	addr := f.listener.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port
+}
+
+func (f *fakeSFTPServer) serve() {
+	clientPublicKey, _ := ssh.NewPublicKey(f.clientKey.Public())
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if meta.User() == fakeSFTPUser && string(password) == fakeSFTPPassword {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("password rejected for %s", meta.User())
+		},
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if meta.User() == fakeSFTPUser && bytes.Equal(key.Marshal(), clientPublicKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("public key rejected for %s", meta.User())
+		},
+	}
+	config.AddHostKey(f.hostKey)
+
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			_, channels, requests, err := ssh.NewServerConn(conn, config)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			go ssh.DiscardRequests(requests)
+			for newChannel := range channels {
+				if newChannel.ChannelType() != "session" {
+					newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+					continue
+				}
+				channel, requests, err := newChannel.Accept()
+				if err != nil {
+					continue
+				}
+				go f.session(channel, requests)
+			}
+		}()
+	}
+}
+
+func (f *fakeSFTPServer) session(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+	for req := range requests {
+		if req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp" {
+			req.Reply(true, nil)
+			server, err := sftp.NewServer(channel, sftp.WithServerWorkingDirectory(f.root))
+			if err != nil {
+				return
+			}
+			server.Serve()
+			return
+		}
+		req.Reply(false, nil)
+	}
+}
+
+type SFTPTestSuite struct {
+	suite.Suite
+	Fixture      *testFixture
+	server       *fakeSFTPServer
+	PasswordSFTP *SFTPStorage
+	KeySFTP      *SFTPStorage
+}
+
+func (suite *SFTPTestSuite) SetupTest() {
+	suite.Fixture = newTestFixture("sftp")
+	suite.Nil(os.MkdirAll(suite.Fixture.Dir, 0755))
+
+	server, err := newFakeSFTPServer(suite.Fixture.Dir)
+	suite.Nil(err)
+	suite.server = server
+	host, port := server.hostPort()
+
+	backend, err := NewSFTPStorage(SFTPOptions{
+		Host:            host,
+		Port:            port,
+		User:            fakeSFTPUser,
+		Password:        fakeSFTPPassword,
+		HostKeyCallback: ssh.FixedHostKey(server.hostKey.PublicKey()),
+		RootDir:         "charts",
+	})
+	suite.Nil(err)
+	suite.PasswordSFTP = backend
+
+	block, err := ssh.MarshalPrivateKey(server.clientKey, "")
+	suite.Nil(err)
+	knownHosts := path.Join(suite.Fixture.Dir, "known_hosts")
+	line := knownhosts.Line([]string{net.JoinHostPort(host, strconv.Itoa(port))}, server.hostKey.PublicKey())
+	suite.Nil(ioutil.WriteFile(knownHosts, []byte(line+"\n"), 0600))
+
+	backend, err = NewSFTPStorage(SFTPOptions{
+		Host:           host,
+		Port:           port,
+		User:           fakeSFTPUser,
+		PrivateKey:     pem.EncodeToMemory(block),
+		KnownHostsFile: knownHosts,
+		RootDir:        server.root + "/charts/",
+	})
+	suite.Nil(err)
+	suite.KeySFTP = backend
+}
+
+func (suite *SFTPTestSuite) TearDownTest() {
+	suite.PasswordSFTP.Close()
+	suite.KeySFTP.Close()
+	suite.server.Close()
+	suite.Fixture.Close()
+}
+
+func (suite *SFTPTestSuite) TestNewSFTPStorage() {
+	_, err := NewSFTPStorage(SFTPOptions{Host: "localhost", User: fakeSFTPUser, HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+	suite.NotNil(err, "password or private key is required")
+
+	_, err = NewSFTPStorage(SFTPOptions{Host: "localhost", User: fakeSFTPUser, Password: fakeSFTPPassword})
+	suite.NotNil(err, "host key verification is required")
+
+	_, err = NewSFTPStorage(SFTPOptions{Host: "localhost", User: fakeSFTPUser, PrivateKey: []byte("not a key"), HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+	suite.NotNil(err, "invalid private key")
+}
+
+func (suite *SFTPTestSuite) TestPutGetObject() {
+	for name, backend := range map[string]*SFTPStorage{"password": suite.PasswordSFTP, "key": suite.KeySFTP} {
+		key := name + "/index.yaml"
+		suite.Nil(backend.PutObject(key, []byte("apiVersion: v1")), "no error putting object with %s auth", name)
+
+		object, err := backend.GetObject(key)
+		suite.Nil(err, "no error getting object with %s auth", name)
+		suite.Equal([]byte("apiVersion: v1"), object.Data)
+		suite.Equal("index.yaml", object.Meta.Name)
+		suite.WithinDuration(time.Now(), object.LastModified, 2*time.Second)
+
+		content, err := ioutil.ReadFile(path.Join(suite.Fixture.Dir, "charts", key))
+		suite.Nil(err, "object stored relative to the root directory")
+		suite.Equal([]byte("apiVersion: v1"), content)
+	}
+}
+
+func (suite *SFTPTestSuite) TestPutObjectOverwrite() {
+	// larger than a single read or write request
+	large := bytes.Repeat([]byte("chart"), 100*1024)
+	suite.Nil(suite.KeySFTP.PutObject("chart.tgz", large))
+	suite.Nil(suite.KeySFTP.PutObject("chart.tgz", []byte("updated")))
+
+	object, err := suite.KeySFTP.GetObject("chart.tgz")
+	suite.Nil(err)
+	suite.Equal([]byte("updated"), object.Data, "object replaced and truncated")
+
+	suite.Nil(suite.KeySFTP.PutObject("large.tgz", large))
+	object, err = suite.KeySFTP.GetObject("large.tgz")
+	suite.Nil(err)
+	suite.Equal(large, object.Data, "object transferred in chunks")
+}
+
+func (suite *SFTPTestSuite) TestPutObjectWithoutPosixRename() {
+	// extensions are advertised when the session is opened
+	suite.Nil(sftp.SetSFTPExtensions("statvfs@openssh.com"))
+	defer sftp.SetSFTPExtensions("hardlink@openssh.com", sftpPosixRenameExt, "statvfs@openssh.com")
+	suite.PasswordSFTP.Close()
+
+	suite.Nil(suite.PasswordSFTP.PutObject("index.yaml", []byte("first")))
+	suite.Nil(suite.PasswordSFTP.PutObject("index.yaml", []byte("second")))
+
+	object, err := suite.PasswordSFTP.GetObject("index.yaml")
+	suite.Nil(err)
+	suite.Equal([]byte("second"), object.Data, "existing file replaced without the extension")
+}
+
+func (suite *SFTPTestSuite) TestListObjects() {
+	objects, err := suite.PasswordSFTP.ListObjects("")
+	suite.Nil(err, "list objects does not return error if dir does not exist")
+	suite.Empty(objects)
+
+	for _, key := range []string{"b.txt", "a.txt", "nested/c.txt"} {
+		suite.Nil(suite.PasswordSFTP.PutObject(key, []byte(key)))
+	}
+	suite.Nil(ioutil.WriteFile(path.Join(suite.Fixture.Dir, "charts", dirTempPrefix+"partial"), nil, 0644))
+
+	objects, err = suite.KeySFTP.ListObjects("")
+	suite.Nil(err)
+	suite.Len(objects, 2, "directories and temporary files are not listed")
+	suite.Equal("a.txt", objects[0].Path)
+	suite.Equal("b.txt", objects[1].Path)
+
+	objects, err = suite.KeySFTP.ListObjects("nested")
+	suite.Nil(err)
+	suite.Len(objects, 1)
+	suite.Equal("c.txt", objects[0].Path)
+
+	_, err = suite.KeySFTP.ListObjects("../escape")
+	suite.True(errors.Is(err, ErrInvalidKey))
+}
+
+func (suite *SFTPTestSuite) TestDeleteObject() {
+	suite.Nil(suite.PasswordSFTP.PutObject("nested/deeper/deleteme.txt", []byte("content")))
+	suite.Nil(suite.PasswordSFTP.PutObject("kept.txt", []byte("content")))
+	suite.Nil(suite.PasswordSFTP.DeleteObject("nested/deeper/deleteme.txt"))
+
+	_, err := suite.PasswordSFTP.GetObject("nested/deeper/deleteme.txt")
+	suite.True(os.IsNotExist(err), "deleted object does not exist")
+
+	_, err = os.Stat(path.Join(suite.Fixture.Dir, "charts", "nested"))
+	suite.True(os.IsNotExist(err), "empty parent directories removed")
+	_, err = os.Stat(path.Join(suite.Fixture.Dir, "charts"))
+	suite.Nil(err, "root directory kept")
+
+	err = suite.PasswordSFTP.DeleteObject("nested/deeper/deleteme.txt")
+	suite.True(os.IsNotExist(err))
+}
+
+func (suite *SFTPTestSuite) TestReconnect() {
+	suite.Nil(suite.PasswordSFTP.PutObject("index.yaml", []byte("content")))
+
+	// connection closed underneath the storage
+	suite.PasswordSFTP.mu.Lock()
+	suite.PasswordSFTP.client.Close()
+	suite.PasswordSFTP.mu.Unlock()
+
+	_, err := suite.PasswordSFTP.GetObject("index.yaml")
+	suite.NotNil(err, "request on a lost connection fails")
+
+	object, err := suite.PasswordSFTP.GetObject("index.yaml")
+	suite.Nil(err, "connection re-established")
+	suite.Equal([]byte("content"), object.Data)
+}
+
+func TestSFTPStorageTestSuite(t *testing.T) {
+	suite.Run(t, new(SFTPTestSuite))
+}
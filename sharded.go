@@ -0,0 +1,341 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// Shard is a named backend holding a part of the keyspace
+type Shard struct {
+	Name    string
+	Backend Backend
+}
+
+type ShardedOptions struct {
+	Logger *zap.SugaredLogger
+	Shards []Shard
+	// VirtualNodes is the number of points every shard takes on the hash ring, defaults to 128
+	VirtualNodes int
+	// Prefixes to look up objects at when a shard is removed, defaults to the root
+	Prefixes []string
+}
+
+// ShardedBackend spreads keys across several backends using a consistent hash ring
+type ShardedBackend struct {
+	logger       *zap.SugaredLogger
+	virtualNodes int
+	prefixes     []string
+
+	mu     sync.RWMutex
+	shards map[string]Backend
+	ring   []ringPoint
+}
+
+type ringPoint struct {
+	hash  uint32
+	shard string
+}
+
+func NewShardedBackend(opts ShardedOptions) (*ShardedBackend, error) {
+	if len(opts.Shards) == 0 {
+		return nil, fmt.Errorf("no shards specified")
+	}
+
+	if opts.Logger == nil {
+		opts.Logger = zap.S()
+	}
+
+	if opts.VirtualNodes <= 0 {
+		opts.VirtualNodes = 128
+	}
+
+	if len(opts.Prefixes) == 0 {
+		opts.Prefixes = []string{""}
+	}
+
+	s := &ShardedBackend{
+		logger:       opts.Logger,
+		virtualNodes: opts.VirtualNodes,
+		prefixes:     opts.Prefixes,
+		shards:       make(map[string]Backend),
+	}
+
+	for _, shard := range opts.Shards {
+		if err := s.addShard(shard); err != nil {
+			return nil, err
+		}
+	}
+	s.buildRing()
+
+	return s, nil
+}
+
+// ShardFor returns the name of the shard owning key
+func (s *ShardedBackend) ShardFor(key string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.owner(key)
+}
+
+func (s *ShardedBackend) GetObject(key string) (Object, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	owner := s.owner(key)
+	object, err := s.shards[owner].GetObject(key)
+	if !errors.Is(err, os.ErrNotExist) {
+		return object, err
+	}
+
+	// key may still reside on its previous shard until rebalance
+	for _, name := range s.shardNames() {
+		if name == owner {
+			continue
+		}
+		other, otherErr := s.shards[name].GetObject(key)
+		if otherErr == nil {
+			return other, nil
+		}
+		if !errors.Is(otherErr, os.ErrNotExist) {
+			err = otherErr
+		}
+	}
+
+	return object, err
+}
+
+func (s *ShardedBackend) PutObject(key string, data []byte) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.shards[s.owner(key)].PutObject(key, data)
+}
+
+// DeleteObject removes key from every shard, so copies not rebalanced yet do not show up again.
+// Not found is returned only if none of the shards has the key
+func (s *ShardedBackend) DeleteObject(key string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var notFound, failed error
+	deleted := false
+	for _, name := range s.shardNames() {
+		err := s.shards[name].DeleteObject(key)
+		switch {
+		case err == nil:
+			deleted = true
+		case errors.Is(err, os.ErrNotExist):
+			notFound = err
+		case failed == nil:
+			failed = fmt.Errorf("unable to delete %s from %s shard: %w", key, name, err)
+		}
+	}
+
+	if failed != nil {
+		return failed
+	}
+	if !deleted {
+		return notFound
+	}
+	return nil
+}
+
+// DeletePrefix removes prefix from every shard, all of them must support prefix deletes
+func (s *ShardedBackend) DeletePrefix(prefix string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, name := range s.shardNames() {
+		if err := deletePrefix(s.shards[name], prefix); err != nil {
+			return fmt.Errorf("unable to delete %s from %s shard: %w", prefix, name, err)
+		}
+	}
+	return nil
+}
+
+// ListObjects merges objects of all shards sorted by path
+func (s *ShardedBackend) ListObjects(prefix string) ([]Object, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	listed := make(map[string]Object)
+	for _, name := range s.shardNames() {
+		objects, err := s.shards[name].ListObjects(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("unable to list objects of %s shard: %w", name, err)
+		}
+		for _, o := range objects {
+			// a copy on the owner shard wins over one not rebalanced yet
+			if _, found := listed[o.Path]; found && s.owner(joinObjectPath(prefix, o.Path)) != name {
+				continue
+			}
+			listed[o.Path] = o
+		}
+	}
+
+	objects := make([]Object, 0, len(listed))
+	for _, o := range listed {
+		objects = append(objects, o)
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Path < objects[j].Path
+	})
+
+	return objects, nil
+}
+
+// AddShard places a new shard on the ring, call Rebalance afterwards to move the keys it now owns
+func (s *ShardedBackend) AddShard(shard Shard) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.addShard(shard); err != nil {
+		return err
+	}
+	s.buildRing()
+
+	return nil
+}
+
+// RemoveShard takes a shard off the ring and moves its keys to their new owners
+func (s *ShardedBackend) RemoveShard(name string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	backend, found := s.shards[name]
+	if !found {
+		return nil, fmt.Errorf("shard %q not found", name)
+	}
+	if len(s.shards) == 1 {
+		return nil, fmt.Errorf("cannot remove the last shard")
+	}
+
+	delete(s.shards, name)
+	s.buildRing()
+
+	var moved []string
+	for _, prefix := range s.prefixes {
+		keys, err := s.moveMisplaced(name, backend, prefix)
+		moved = append(moved, keys...)
+		if err != nil {
+			// keep the shard, so its remaining keys stay reachable
+			s.shards[name] = backend
+			s.buildRing()
+			return moved, err
+		}
+	}
+
+	return moved, nil
+}
+
+// Rebalance moves the keys at prefix that are not stored on their owner shard
+func (s *ShardedBackend) Rebalance(prefix string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var moved []string
+	for _, name := range s.shardNames() {
+		keys, err := s.moveMisplaced(name, s.shards[name], prefix)
+		moved = append(moved, keys...)
+		if err != nil {
+			return moved, err
+		}
+	}
+
+	return moved, nil
+}
+
+func (s *ShardedBackend) moveMisplaced(name string, backend Backend, prefix string) ([]string, error) {
+	objects, err := backend.ListObjects(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list objects of %s shard: %w", name, err)
+	}
+
+	var moved []string
+	for _, o := range objects {
+		key := joinObjectPath(prefix, o.Path)
+		owner := s.owner(key)
+		if owner == name {
+			continue
+		}
+
+		object, err := backend.GetObject(key)
+		if err != nil {
+			return moved, err
+		}
+		if err := s.shards[owner].PutObject(key, object.Data); err != nil {
+			return moved, fmt.Errorf("unable to move %s to %s shard: %w", key, owner, err)
+		}
+		if err := backend.DeleteObject(key); err != nil {
+			return moved, err
+		}
+
+		s.logger.Debugf("Moved %s from %s to %s shard", key, name, owner)
+		moved = append(moved, key)
+	}
+
+	return moved, nil
+}
+
+func (s *ShardedBackend) addShard(shard Shard) error {
+	if shard.Backend == nil {
+		return fmt.Errorf("shard %q has no backend", shard.Name)
+	}
+	if _, found := s.shards[shard.Name]; found {
+		return fmt.Errorf("shard %q already exists", shard.Name)
+	}
+
+	s.shards[shard.Name] = shard.Backend
+	return nil
+}
+
+func (s *ShardedBackend) buildRing() {
+	ring := make([]ringPoint, 0, len(s.shards)*s.virtualNodes)
+	for name := range s.shards {
+		for i := 0; i < s.virtualNodes; i++ {
+			ring = append(ring, ringPoint{
+				hash:  crc32.ChecksumIEEE([]byte(name + "#" + strconv.Itoa(i))),
+				shard: name,
+			})
+		}
+	}
+
+	sort.Slice(ring, func(i, j int) bool {
+		if ring[i].hash == ring[j].hash {
+			return ring[i].shard < ring[j].shard
+		}
+		return ring[i].hash < ring[j].hash
+	})
+
+	s.ring = ring
+}
+
+// owner hashes the normalized key, so spellings of one key like a//b and a/b share a shard
+func (s *ShardedBackend) owner(key string) string {
+	if normalized, err := defaultKeyRules.validate(key); err == nil {
+		key = normalized
+	}
+	hash := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(s.ring), func(i int) bool {
+		return s.ring[i].hash >= hash
+	})
+	if i == len(s.ring) {
+		i = 0
+	}
+	return s.ring[i].shard
+}
+
+func (s *ShardedBackend) shardNames() []string {
+	names := make([]string, 0, len(s.shards))
+	for name := range s.shards {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,193 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ShardedTestSuite struct {
+	suite.Suite
+	Fixture *testFixture
+	Shards  []Shard
+	Sharded *ShardedBackend
+}
+
+func (suite *ShardedTestSuite) newShard(name string) Shard {
+	backend, err := suite.Fixture.DirStorage(name)
+	suite.Nil(err)
+	return Shard{Name: name, Backend: backend}
+}
+
+func (suite *ShardedTestSuite) SetupTest() {
+	suite.Fixture = newTestFixture("sharded")
+	suite.Shards = []Shard{suite.newShard("a"), suite.newShard("b"), suite.newShard("c")}
+
+	sharded, err := NewShardedBackend(ShardedOptions{Shards: suite.Shards})
+	suite.Nil(err)
+	suite.Sharded = sharded
+
+	for i := 1; i <= 30; i++ {
+		key := fmt.Sprintf("test%02d.txt", i)
+		suite.Nil(suite.Sharded.PutObject(key, []byte(key)))
+	}
+}
+
+func (suite *ShardedTestSuite) TearDownTest() {
+	suite.Fixture.Close()
+}
+
+func (suite *ShardedTestSuite) owners() map[string]string {
+	owners := make(map[string]string)
+	for i := 1; i <= 30; i++ {
+		key := fmt.Sprintf("test%02d.txt", i)
+		owners[key] = suite.Sharded.ShardFor(key)
+	}
+	return owners
+}
+
+func (suite *ShardedTestSuite) assertPlacement() {
+	for key, owner := range suite.owners() {
+		for _, shard := range suite.Shards {
+			_, err := shard.Backend.GetObject(key)
+			if shard.Name == owner {
+				suite.Nil(err, "object %s stored on owner shard %s", key, owner)
+			} else {
+				suite.NotNil(err, "object %s not stored on shard %s", key, shard.Name)
+			}
+		}
+	}
+}
+
+func (suite *ShardedTestSuite) TestNewShardedBackend() {
+	_, err := NewShardedBackend(ShardedOptions{})
+	suite.NotNil(err, "cannot create sharded backend without shards")
+
+	_, err = NewShardedBackend(ShardedOptions{Shards: []Shard{suite.Shards[0], suite.Shards[0]}})
+	suite.NotNil(err, "cannot create sharded backend with duplicate shards")
+}
+
+func (suite *ShardedTestSuite) TestPlacement() {
+	suite.assertPlacement()
+
+	used := make(map[string]bool)
+	for _, owner := range suite.owners() {
+		used[owner] = true
+	}
+	suite.Len(used, 3, "keys spread across all shards")
+}
+
+func (suite *ShardedTestSuite) TestListObjects() {
+	objects, err := suite.Sharded.ListObjects("")
+	suite.Nil(err)
+	suite.Len(objects, 30)
+	suite.True(sort.SliceIsSorted(objects, func(i, j int) bool {
+		return objects[i].Path < objects[j].Path
+	}), "objects sorted by path")
+}
+
+func (suite *ShardedTestSuite) TestAddShard() {
+	before := suite.owners()
+	shard := suite.newShard("d")
+	suite.Shards = append(suite.Shards, shard)
+	suite.Nil(suite.Sharded.AddShard(shard))
+	suite.NotNil(suite.Sharded.AddShard(shard), "cannot add shard twice")
+	after := suite.owners()
+
+	object, err := suite.Sharded.GetObject("test01.txt")
+	suite.Nil(err, "object readable before rebalance")
+	suite.Equal([]byte("test01.txt"), object.Data)
+
+	moved, err := suite.Sharded.Rebalance("")
+	suite.Nil(err)
+	var expected []string
+	for key := range after {
+		if before[key] != after[key] {
+			suite.Equal("d", after[key], "keys move only to the new shard")
+			expected = append(expected, key)
+		}
+	}
+	suite.NotEmpty(expected)
+	suite.ElementsMatch(expected, moved, "only affected keys moved")
+	suite.assertPlacement()
+}
+
+func (suite *ShardedTestSuite) TestRemoveShard() {
+	moved, err := suite.Sharded.RemoveShard("b")
+	suite.Nil(err)
+	suite.NotEmpty(moved)
+	suite.Shards = []Shard{suite.Shards[0], suite.Shards[2]}
+	suite.assertPlacement()
+
+	objects, err := suite.Sharded.ListObjects("")
+	suite.Nil(err)
+	suite.Len(objects, 30, "no objects lost")
+
+	_, err = suite.Sharded.RemoveShard("b")
+	suite.NotNil(err, "cannot remove unknown shard")
+}
+
+func (suite *ShardedTestSuite) TestDeleteObject() {
+	shard := suite.newShard("d")
+	suite.Shards = append(suite.Shards, shard)
+	suite.Nil(suite.Sharded.AddShard(shard))
+
+	var key string
+	for k, owner := range suite.owners() {
+		if owner == "d" {
+			key = k
+			break
+		}
+	}
+	suite.Require().NotEmpty(key)
+	suite.Nil(suite.Sharded.PutObject(key, []byte("updated")), "new copy written before rebalance")
+
+	suite.Nil(suite.Sharded.DeleteObject(key))
+	_, err := suite.Sharded.GetObject(key)
+	suite.True(errors.Is(err, os.ErrNotExist), "stale copy removed along with the owner one")
+	objects, err := suite.Sharded.ListObjects("")
+	suite.Nil(err)
+	suite.Len(objects, 29)
+
+	suite.True(errors.Is(suite.Sharded.DeleteObject(key), os.ErrNotExist), "missing key not found")
+}
+
+func (suite *ShardedTestSuite) TestOwnerFailure() {
+	sharded, err := NewShardedBackend(ShardedOptions{Shards: []Shard{
+		{Name: "a", Backend: brokenBackend{}},
+		suite.Shards[1],
+	}})
+	suite.Nil(err)
+
+	for i := 1; i <= 30; i++ {
+		key := fmt.Sprintf("test%02d.txt", i)
+		if sharded.ShardFor(key) != "a" {
+			continue
+		}
+		suite.Nil(suite.Shards[1].Backend.PutObject(key, []byte("stale")))
+		_, err := sharded.GetObject(key)
+		suite.NotNil(err, "failure of the owner shard is returned")
+		suite.False(errors.Is(err, os.ErrNotExist))
+		suite.NotNil(sharded.DeleteObject(key), "failed delete is returned")
+	}
+}
+
+func (suite *ShardedTestSuite) TestNormalizedKeys() {
+	for i := 1; i <= 30; i++ {
+		key := fmt.Sprintf("charts/test%02d.txt", i)
+		suite.Equal(suite.Sharded.ShardFor(key), suite.Sharded.ShardFor("/charts//"+path.Base(key)))
+	}
+	suite.Nil(suite.Sharded.PutObject("charts//app.tgz", []byte("app")))
+	object, err := suite.Sharded.GetObject("charts/app.tgz")
+	suite.Nil(err)
+	suite.Equal([]byte("app"), object.Data)
+}
+
+func TestShardedTestSuite(t *testing.T) {
+	suite.Run(t, new(ShardedTestSuite))
+}
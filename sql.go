@@ -0,0 +1,516 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultSQLTable is the name of the table objects are stored in
+const DefaultSQLTable = "objects"
+
+// sqlTableName restricts table names, they are formatted into statements
+var sqlTableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// sqlDialect holds the statements differing between database engines.
+// Statements are written with "?" placeholders and double quoted identifiers, rewrite adapts them
+type sqlDialect struct {
+	// migrations of the objects table by version, pending ones are applied in a single transaction.
+	// Keys must compare byte-wise for prefix range scans
+	migrations [][]string
+	// migrationLock serializes migrations of concurrently starting processes until the transaction ends
+	migrationLock string
+	// upsert inserts an object with version 1 or replaces it incrementing its version
+	upsert string
+	// insert inserts an object with version 1 unless it exists
+	insert string
+	// numbered placeholders $1, $2...
+	numbered bool
+}
+
+var sqlDialects = map[string]sqlDialect{
+	"sqlite": {
+		migrations: [][]string{{
+			`CREATE TABLE "%[1]s" ("key" TEXT NOT NULL PRIMARY KEY, "dir" TEXT NOT NULL, "data" BLOB NOT NULL,
+				"metadata" TEXT NOT NULL, "modified" BIGINT NOT NULL, "version" BIGINT NOT NULL)`,
+			`CREATE INDEX "%[1]s_dir" ON "%[1]s" ("dir", "key")`,
+		}},
+		upsert: `INSERT INTO "%[1]s" ("key", "dir", "data", "metadata", "modified", "version") VALUES (?, ?, ?, ?, ?, 1)
+			ON CONFLICT ("key") DO UPDATE SET "data" = excluded."data", "metadata" = excluded."metadata",
+			"modified" = excluded."modified", "version" = "%[1]s"."version" + 1`,
+		insert: `INSERT INTO "%[1]s" ("key", "dir", "data", "metadata", "modified", "version") VALUES (?, ?, ?, ?, ?, 1)
+			ON CONFLICT ("key") DO NOTHING`,
+	},
+	"postgres": {
+		migrations: [][]string{{
+			`CREATE TABLE "%[1]s" ("key" TEXT COLLATE "C" NOT NULL PRIMARY KEY, "dir" TEXT COLLATE "C" NOT NULL,
+				"data" BYTEA NOT NULL, "metadata" TEXT NOT NULL, "modified" BIGINT NOT NULL, "version" BIGINT NOT NULL)`,
+			`CREATE INDEX "%[1]s_dir" ON "%[1]s" ("dir", "key")`,
+		}},
+		upsert: `INSERT INTO "%[1]s" ("key", "dir", "data", "metadata", "modified", "version") VALUES (?, ?, ?, ?, ?, 1)
+			ON CONFLICT ("key") DO UPDATE SET "data" = excluded."data", "metadata" = excluded."metadata",
+			"modified" = excluded."modified", "version" = "%[1]s"."version" + 1`,
+		insert: `INSERT INTO "%[1]s" ("key", "dir", "data", "metadata", "modified", "version") VALUES (?, ?, ?, ?, ?, 1)
+			ON CONFLICT ("key") DO NOTHING`,
+		migrationLock: `SELECT pg_advisory_xact_lock(hashtext('%s'))`,
+		numbered:      true,
+	},
+}
+
+// rewrite formats table into statement and adapts its placeholders and quotes to the dialect
+func (d sqlDialect) rewrite(statement string, table string) string {
+	statement = fmt.Sprintf(statement, table)
+	if d.numbered {
+		var b strings.Builder
+		n := 0
+		for _, r := range statement {
+			if r == '?' {
+				n++
+				b.WriteString("$" + strconv.Itoa(n))
+				continue
+			}
+			b.WriteRune(r)
+		}
+		statement = b.String()
+	}
+	return statement
+}
+
+// sqlObjectMeta is stored JSON encoded in the metadata column
+type sqlObjectMeta struct {
+	ContentType string            `json:"content_type,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	Checksum    string            `json:"sha256,omitempty"`
+}
+
+// sqlExecer is implemented by sql.DB and sql.Tx
+type sqlExecer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+type SQLOptions struct {
+	Logger *zap.SugaredLogger
+	// DB is an opened database, the driver must be registered by the caller
+	DB *sql.DB
+	// Dialect of the database: sqlite or postgres
+	Dialect string
+	// Table objects are stored in. Defaults to DefaultSQLTable
+	Table string
+	// SkipMigrations leaves the schema to be managed externally
+	SkipMigrations bool
+}
+
+// SQLStorage stores objects as table rows with their metadata, modification time and version.
+// Version grows with every write of an object, it starts over once the object is deleted
+type SQLStorage struct {
+	logger  *zap.SugaredLogger
+	db      *sql.DB
+	dialect sqlDialect
+	table   string
+}
+
+func NewSQLStorage(opts SQLOptions) (*SQLStorage, error) {
+	if opts.Logger == nil {
+		opts.Logger = zap.S()
+	}
+
+	if opts.DB == nil {
+		return nil, fmt.Errorf("sql database must be specified")
+	}
+	dialect, ok := sqlDialects[opts.Dialect]
+	if !ok {
+		return nil, fmt.Errorf("unsupported sql dialect: %s", opts.Dialect)
+	}
+	if opts.Table == "" {
+		opts.Table = DefaultSQLTable
+	}
+	if !sqlTableName.MatchString(opts.Table) {
+		return nil, fmt.Errorf("invalid sql table name: %s", opts.Table)
+	}
+
+	s := &SQLStorage{
+		logger:  opts.Logger,
+		db:      opts.DB,
+		dialect: dialect,
+		table:   opts.Table,
+	}
+	if !opts.SkipMigrations {
+		if err := s.migrate(context.Background()); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// migrate applies migrations newer than the version recorded in the migrations table.
+// Pending migrations are applied in a single transaction, so processes starting concurrently
+// either wait for the migrating one or fail the transaction and find the schema migrated
+func (s *SQLStorage) migrate(ctx context.Context) error {
+	migrationsTable := s.table + "_migrations"
+
+	var current int
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		if s.dialect.migrationLock != "" {
+			if _, err := tx.ExecContext(ctx, s.dialect.rewrite(s.dialect.migrationLock, s.table)); err != nil {
+				return err
+			}
+		}
+
+		_, err := tx.ExecContext(ctx, s.dialect.rewrite(
+			`CREATE TABLE IF NOT EXISTS "%s" ("version" INTEGER NOT NULL PRIMARY KEY, "applied" BIGINT NOT NULL)`,
+			migrationsTable,
+		))
+		if err != nil {
+			return fmt.Errorf("unable to create sql migrations table: %w", err)
+		}
+
+		err = tx.QueryRowContext(ctx, s.dialect.rewrite(`SELECT COALESCE(MAX("version"), 0) FROM "%s"`, migrationsTable)).Scan(&current)
+		if err != nil {
+			return fmt.Errorf("unable to read sql schema version: %w", err)
+		}
+
+		for version := current + 1; version <= len(s.dialect.migrations); version++ {
+			for _, statement := range s.dialect.migrations[version-1] {
+				if _, err := tx.ExecContext(ctx, s.dialect.rewrite(statement, s.table)); err != nil {
+					return fmt.Errorf("unable to apply sql migration %d: %w", version, err)
+				}
+			}
+			_, err := tx.ExecContext(ctx, s.dialect.rewrite(`INSERT INTO "%s" ("version", "applied") VALUES (?, ?)`, migrationsTable),
+				version, time.Now().Unix())
+			if err != nil {
+				return fmt.Errorf("unable to record sql migration %d: %w", version, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		// migrated by a concurrent process
+		var applied int
+		readErr := s.db.QueryRowContext(ctx, s.dialect.rewrite(`SELECT COALESCE(MAX("version"), 0) FROM "%s"`, migrationsTable)).Scan(&applied)
+		if readErr == nil && applied == len(s.dialect.migrations) {
+			return nil
+		}
+		return err
+	}
+
+	for version := current + 1; version <= len(s.dialect.migrations); version++ {
+		s.logger.Infof("applied sql migration %d to table %s", version, s.table)
+	}
+	return nil
+}
+
+// ListObjects scans the directory index, so nested objects are not read
+func (s *SQLStorage) ListObjects(prefix string) ([]Object, error) {
+	var objects []Object
+	prefix, err := defaultKeyRules.validatePrefix(prefix)
+	if err != nil {
+		return objects, err
+	}
+
+	rows, err := s.db.Query(s.query(`SELECT "key", "modified" FROM "%s" WHERE "dir" = ? ORDER BY "key"`), prefix)
+	if err != nil {
+		return objects, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key string
+		var modified int64
+		if err := rows.Scan(&key, &modified); err != nil {
+			return objects, err
+		}
+		objects = append(objects, Object{
+			Path:         removePrefixFromObjectPath(prefix, key),
+			Data:         []byte{},
+			LastModified: time.Unix(0, modified),
+		})
+	}
+	return objects, rows.Err()
+}
+
+func (s *SQLStorage) GetObject(key string) (Object, error) {
+	object, err := s.getObject(key, true)
+	if err != nil {
+		return object, err
+	}
+
+	checksum, err := objectChecksum(object.Path, object.Data, object.Meta.Checksum)
+	if err != nil {
+		return Object{Path: key}, err
+	}
+	object.Meta.Checksum = checksum
+	return object, nil
+}
+
+// StatObject returns object metadata without reading the data
+func (s *SQLStorage) StatObject(key string) (Object, error) {
+	return s.getObject(key, false)
+}
+
+func (s *SQLStorage) getObject(key string, withData bool) (Object, error) {
+	object := Object{Path: key, Data: []byte{}}
+	normalized, err := defaultKeyRules.validate(key)
+	if err != nil {
+		return object, err
+	}
+
+	var encoded string
+	var modified, version int64
+	dest := []interface{}{&encoded, &modified, &version}
+	columns := `"metadata", "modified", "version"`
+	if withData {
+		dest = append(dest, &object.Data)
+		columns += `, "data"`
+	}
+	err = s.db.QueryRow(s.query(`SELECT `+columns+` FROM "%s" WHERE "key" = ?`), normalized).Scan(dest...)
+	if err == sql.ErrNoRows {
+		return object, &os.PathError{Op: "open", Path: normalized, Err: os.ErrNotExist}
+	}
+	if err != nil {
+		return object, err
+	}
+
+	var meta sqlObjectMeta
+	if err := json.Unmarshal([]byte(encoded), &meta); err != nil {
+		return object, fmt.Errorf("invalid metadata of object %s: %w", normalized, err)
+	}
+	if object.Data == nil {
+		object.Data = []byte{}
+	}
+	object.Meta = Metadata{
+		Name:         path.Base(normalized),
+		Version:      strconv.FormatInt(version, 10),
+		ContentType:  meta.ContentType,
+		UserMetadata: meta.Metadata,
+		Checksum:     meta.Checksum,
+	}
+	object.LastModified = time.Unix(0, modified)
+	return object, nil
+}
+
+func (s *SQLStorage) PutObject(key string, data []byte) error {
+	key, err := defaultKeyRules.validate(key)
+	if err != nil {
+		return err
+	}
+	return s.put(context.Background(), s.db, key, data, sqlObjectMeta{})
+}
+
+// PutObjectWithMetadata writes an object with content type, user metadata and SHA-256 checksum
+// stored in the metadata column
+func (s *SQLStorage) PutObjectWithMetadata(key string, data []byte, meta Metadata) error {
+	key, err := defaultKeyRules.validate(key)
+	if err != nil {
+		return err
+	}
+	checksum, err := objectChecksum(key, data, meta.Checksum)
+	if err != nil {
+		return err
+	}
+	return s.put(context.Background(), s.db, key, data, sqlObjectMeta{
+		ContentType: meta.ContentType,
+		Metadata:    meta.UserMetadata,
+		Checksum:    checksum,
+	})
+}
+
+// PutObjectIfVersion replaces the object if its version column is version, keeping its metadata.
+// With empty version the object is inserted if it does not exist
+func (s *SQLStorage) PutObjectIfVersion(key string, data []byte, version string) error {
+	key, err := defaultKeyRules.validate(key)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		data = []byte{}
+	}
+
+	var res sql.Result
+	if version == "" {
+		res, err = s.db.Exec(s.query(s.dialect.insert), key, sqlDir(key), data, "{}", time.Now().UnixNano())
+	} else {
+		expected, parseErr := strconv.ParseInt(version, 10, 64)
+		if parseErr != nil {
+			return s.versionMismatch(key, version)
+		}
+
+		var encoded string
+		err = s.db.QueryRow(s.query(`SELECT "metadata" FROM "%s" WHERE "key" = ? AND "version" = ?`), key, expected).Scan(&encoded)
+		if err == sql.ErrNoRows {
+			return s.versionMismatch(key, version)
+		}
+		if err != nil {
+			return err
+		}
+		var meta sqlObjectMeta
+		if err := json.Unmarshal([]byte(encoded), &meta); err != nil {
+			return fmt.Errorf("invalid metadata of object %s: %w", key, err)
+		}
+		// the stored checksum is of the replaced data
+		if meta.Checksum != "" {
+			meta.Checksum = sha256Digest(data)
+		}
+		updated, err := json.Marshal(meta)
+		if err != nil {
+			return err
+		}
+
+		// the version condition fails the update if the object has been written since the metadata was read
+		res, err = s.db.Exec(s.query(`UPDATE "%[1]s" SET "data" = ?, "metadata" = ?, "modified" = ?, "version" = "version" + 1
+			WHERE "key" = ? AND "version" = ?`), data, string(updated), time.Now().UnixNano(), key, expected)
+	}
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		if err != nil {
+			return err
+		}
+		return s.versionMismatch(key, version)
+	}
+	return nil
+}
+
+func (s *SQLStorage) DeleteObject(key string) error {
+	key, err := defaultKeyRules.validate(key)
+	if err != nil {
+		return err
+	}
+
+	res, err := s.db.Exec(s.query(`DELETE FROM "%s" WHERE "key" = ?`), key)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		if err != nil {
+			return err
+		}
+		return &os.PathError{Op: "remove", Path: key, Err: os.ErrNotExist}
+	}
+	return nil
+}
+
+// DeleteObjectIfVersion deletes the object if its version column is version
+func (s *SQLStorage) DeleteObjectIfVersion(key string, version string) error {
+	key, err := defaultKeyRules.validate(key)
+	if err != nil {
+		return err
+	}
+	expected, err := strconv.ParseInt(version, 10, 64)
+	if err != nil {
+		return s.versionMismatch(key, version)
+	}
+
+	res, err := s.db.Exec(s.query(`DELETE FROM "%s" WHERE "key" = ? AND "version" = ?`), key, expected)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		if err != nil {
+			return err
+		}
+		return s.versionMismatch(key, version)
+	}
+	return nil
+}
+
+// DeletePrefix deletes the key range of the prefix, '0' follows '/' in byte order
+func (s *SQLStorage) DeletePrefix(prefix string) error {
+	prefix, err := defaultKeyRules.validate(prefix)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(s.query(`DELETE FROM "%s" WHERE "key" >= ? AND "key" < ?`), prefix+"/", prefix+"0")
+	return err
+}
+
+// CommitBatch applies the batch in a single transaction,
+// deletes of missing objects are ignored
+func (s *SQLStorage) CommitBatch(ctx context.Context, batch *Batch) error {
+	batch, err := defaultKeyRules.validateBatch(batch)
+	if err != nil {
+		return err
+	}
+
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		for _, op := range batch.Ops() {
+			if op.Delete {
+				if _, err := tx.ExecContext(ctx, s.query(`DELETE FROM "%s" WHERE "key" = ?`), op.Key); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := s.put(ctx, tx, op.Key, op.Data, sqlObjectMeta{}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Watch polls objects at prefix every DefaultPollInterval
+func (s *SQLStorage) Watch(ctx context.Context, prefix string) <-chan Event {
+	return PollObjects(ctx, s, prefix, DefaultPollInterval)
+}
+
+func (s *SQLStorage) put(ctx context.Context, db sqlExecer, key string, data []byte, meta sqlObjectMeta) error {
+	encoded, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		data = []byte{}
+	}
+	_, err = db.ExecContext(ctx, s.query(s.dialect.upsert), key, sqlDir(key), data, string(encoded), time.Now().UnixNano())
+	return err
+}
+
+// versionMismatch reads the current version of a key for the error of a failed conditional write
+func (s *SQLStorage) versionMismatch(key string, expected string) error {
+	var actual int64
+	err := s.db.QueryRow(s.query(`SELECT "version" FROM "%s" WHERE "key" = ?`), key).Scan(&actual)
+	switch {
+	case err == sql.ErrNoRows:
+		return &VersionMismatchError{Key: key, Expected: expected}
+	case err != nil:
+		return err
+	}
+	return &VersionMismatchError{Key: key, Expected: expected, Actual: strconv.FormatInt(actual, 10)}
+}
+
+func (s *SQLStorage) withTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil && !errors.Is(rollbackErr, sql.ErrTxDone) {
+			s.logger.Warnf("unable to rollback sql transaction: %v", rollbackErr)
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+// query adapts a statement on the objects table to the dialect
+func (s *SQLStorage) query(statement string) string {
+	return s.dialect.rewrite(statement, s.table)
+}
+
+// sqlDir returns the prefix of a normalized key, the value of its dir column
+func sqlDir(key string) string {
+	if dir := path.Dir(key); dir != "." {
+		return dir
+	}
+	return ""
+}
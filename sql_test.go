@@ -0,0 +1,271 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	_ "modernc.org/sqlite"
+)
+
+// openSQLiteDB opens a SQLite database file with the pure Go driver. Transactions take the write lock
+// when they begin and a single connection avoids busy errors of concurrent writers
+func openSQLiteDB(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_txlock=immediate")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	return db, nil
+}
+
+type SQLTestSuite struct {
+	suite.Suite
+	Fixture *testFixture
+	DB      *sql.DB
+	Backend *SQLStorage
+}
+
+func (suite *SQLTestSuite) SetupTest() {
+	suite.Fixture = newTestFixture("sql")
+	suite.Nil(os.MkdirAll(suite.Fixture.Dir, 0777))
+	db, err := openSQLiteDB(path.Join(suite.Fixture.Dir, "storage.db"))
+	suite.Nil(err)
+	suite.DB = db
+
+	backend, err := NewSQLStorage(SQLOptions{DB: db, Dialect: "sqlite"})
+	suite.Nil(err)
+	suite.Backend = backend
+}
+
+func (suite *SQLTestSuite) TearDownTest() {
+	if suite.DB != nil {
+		suite.DB.Close()
+	}
+	suite.Fixture.Close()
+}
+
+func (suite *SQLTestSuite) TestNewSQLStorage() {
+	_, err := NewSQLStorage(SQLOptions{Dialect: "sqlite"})
+	suite.NotNil(err, "database is required")
+
+	_, err = NewSQLStorage(SQLOptions{DB: suite.DB, Dialect: "oracle"})
+	suite.NotNil(err, "unsupported dialect")
+
+	_, err = NewSQLStorage(SQLOptions{DB: suite.DB, Dialect: "sqlite", Table: "objects; DROP TABLE objects"})
+	suite.NotNil(err, "table name is validated")
+}
+
+func (suite *SQLTestSuite) TestMigrations() {
+	_, err := NewSQLStorage(SQLOptions{DB: suite.DB, Dialect: "sqlite"})
+	suite.Nil(err, "migrated schema is kept")
+
+	var applied int
+	suite.Nil(suite.DB.QueryRow(`SELECT COUNT(*) FROM objects_migrations`).Scan(&applied))
+	suite.Equal(len(sqlDialects["sqlite"].migrations), applied, "every migration applied once")
+
+	_, err = NewSQLStorage(SQLOptions{DB: suite.DB, Dialect: "sqlite", Table: "charts", SkipMigrations: true})
+	suite.Nil(err)
+	var tables int
+	suite.Nil(suite.DB.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE name LIKE 'charts%'`).Scan(&tables))
+	suite.Zero(tables, "migrations skipped")
+}
+
+func (suite *SQLTestSuite) TestConcurrentMigrations() {
+	dbPath := path.Join(suite.Fixture.Dir, "concurrent.db")
+	errs := make(chan error)
+	for i := 0; i < 4; i++ {
+		go func() {
+			db, err := openSQLiteDB(dbPath)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer db.Close()
+			_, err = NewSQLStorage(SQLOptions{DB: db, Dialect: "sqlite"})
+			errs <- err
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		suite.Nil(<-errs, "processes starting concurrently migrate the schema once")
+	}
+
+	db, err := openSQLiteDB(dbPath)
+	suite.Nil(err)
+	defer db.Close()
+	var applied int
+	suite.Nil(db.QueryRow(`SELECT COUNT(*) FROM objects_migrations`).Scan(&applied))
+	suite.Equal(len(sqlDialects["sqlite"].migrations), applied)
+}
+
+func (suite *SQLTestSuite) TestDialects() {
+	statement := `UPDATE "%s" SET "data" = ? WHERE "key" = ?`
+	suite.Equal(`UPDATE "objects" SET "data" = $1 WHERE "key" = $2`, sqlDialects["postgres"].rewrite(statement, "objects"))
+	suite.Equal(`UPDATE "objects" SET "data" = ? WHERE "key" = ?`, sqlDialects["sqlite"].rewrite(statement, "objects"))
+}
+
+func (suite *SQLTestSuite) TestPutGetObject() {
+	suite.Nil(suite.Backend.PutObject("charts/index.yaml", []byte("apiVersion: v1")))
+
+	object, err := suite.Backend.GetObject("charts/index.yaml")
+	suite.Nil(err)
+	suite.Equal([]byte("apiVersion: v1"), object.Data)
+	suite.Equal("index.yaml", object.Meta.Name)
+	suite.Equal("1", object.Meta.Version)
+	suite.WithinDuration(time.Now(), object.LastModified, time.Second)
+
+	suite.Nil(suite.Backend.PutObject("charts/index.yaml", []byte("apiVersion: v2")))
+	object, err = suite.Backend.GetObject("charts/index.yaml")
+	suite.Nil(err)
+	suite.Equal([]byte("apiVersion: v2"), object.Data)
+	suite.Equal("2", object.Meta.Version, "version grows with every write")
+
+	suite.Nil(suite.Backend.PutObject("empty.txt", nil))
+	object, err = suite.Backend.GetObject("empty.txt")
+	suite.Nil(err)
+	suite.Empty(object.Data)
+
+	_, err = suite.Backend.GetObject("charts")
+	suite.True(os.IsNotExist(err))
+}
+
+func (suite *SQLTestSuite) TestListObjects() {
+	objects, err := suite.Backend.ListObjects("missing")
+	suite.Nil(err)
+	suite.Empty(objects)
+
+	for _, key := range []string{"b.txt", "a.txt", "charts/c.tgz", "charts/nested/d.tgz", "chartsmuseum.txt"} {
+		suite.Nil(suite.Backend.PutObject(key, []byte(key)))
+	}
+
+	objects, err = suite.Backend.ListObjects("")
+	suite.Nil(err)
+	suite.Len(objects, 3, "nested objects are not listed")
+	suite.Equal("a.txt", objects[0].Path)
+	suite.Equal("b.txt", objects[1].Path)
+	suite.Equal("chartsmuseum.txt", objects[2].Path)
+
+	objects, err = suite.Backend.ListObjects("/charts/")
+	suite.Nil(err)
+	suite.Len(objects, 1)
+	suite.Equal("c.tgz", objects[0].Path)
+	suite.False(objects[0].LastModified.IsZero())
+
+	_, err = suite.Backend.ListObjects("../escape")
+	suite.True(errors.Is(err, ErrInvalidKey))
+}
+
+func (suite *SQLTestSuite) TestObjectMetadata() {
+	suite.Nil(suite.Backend.PutObjectWithMetadata("chart.tgz", []byte("chart"), Metadata{
+		ContentType:  "application/gzip",
+		UserMetadata: map[string]string{"owner": "ops"},
+	}))
+
+	object, err := suite.Backend.StatObject("chart.tgz")
+	suite.Nil(err)
+	suite.Empty(object.Data)
+	suite.Equal("application/gzip", object.Meta.ContentType)
+	suite.Equal(map[string]string{"owner": "ops"}, object.Meta.UserMetadata)
+	suite.Equal(sha256Digest([]byte("chart")), object.Meta.Checksum)
+
+	_, err = suite.DB.Exec(`UPDATE objects SET data = ? WHERE key = ?`, []byte("tampered"), "chart.tgz")
+	suite.Nil(err)
+	_, err = suite.Backend.GetObject("chart.tgz")
+	var mismatch *DigestMismatchError
+	suite.True(errors.As(err, &mismatch), "stored checksum is verified")
+}
+
+func (suite *SQLTestSuite) TestConditionalWrites() {
+	var backend ConditionalBackend = suite.Backend
+
+	suite.Nil(backend.PutObjectIfVersion("index.yaml", []byte("v1"), ""))
+	err := backend.PutObjectIfVersion("index.yaml", []byte("v1"), "")
+	suite.True(errors.Is(err, ErrVersionMismatch), "object exists")
+
+	object, err := backend.GetObject("index.yaml")
+	suite.Nil(err)
+	suite.Nil(backend.PutObjectIfVersion("index.yaml", []byte("v2"), object.Meta.Version))
+
+	err = backend.PutObjectIfVersion("index.yaml", []byte("stale"), object.Meta.Version)
+	var mismatch *VersionMismatchError
+	suite.True(errors.As(err, &mismatch), "stale version rejected")
+	suite.Equal("2", mismatch.Actual)
+
+	suite.Nil(suite.Backend.PutObjectWithMetadata("chart.tgz", []byte("v1"), Metadata{ContentType: "application/gzip"}))
+	chart, err := suite.Backend.GetObject("chart.tgz")
+	suite.Nil(err)
+	suite.Nil(backend.PutObjectIfVersion("chart.tgz", []byte("v2"), chart.Meta.Version))
+	chart, err = suite.Backend.GetObject("chart.tgz")
+	suite.Nil(err, "checksum of the new data stored")
+	suite.Equal([]byte("v2"), chart.Data)
+	suite.Equal("application/gzip", chart.Meta.ContentType, "metadata kept")
+
+	err = backend.DeleteObjectIfVersion("index.yaml", object.Meta.Version)
+	suite.True(errors.Is(err, ErrVersionMismatch))
+	suite.Nil(backend.DeleteObjectIfVersion("index.yaml", "2"))
+
+	err = backend.PutObjectIfVersion("index.yaml", []byte("v3"), "2")
+	suite.True(errors.As(err, &mismatch), "deleted object")
+	suite.Empty(mismatch.Actual)
+}
+
+func (suite *SQLTestSuite) TestDeleteObject() {
+	suite.Nil(suite.Backend.PutObject("deleteme.txt", []byte("content")))
+	suite.Nil(suite.Backend.DeleteObject("deleteme.txt"))
+
+	_, err := suite.Backend.GetObject("deleteme.txt")
+	suite.True(os.IsNotExist(err))
+	suite.True(os.IsNotExist(suite.Backend.DeleteObject("deleteme.txt")))
+}
+
+func (suite *SQLTestSuite) TestDeletePrefix() {
+	for _, key := range []string{"charts/a.tgz", "charts/nested/b.tgz", "charts-old/c.tgz", "chartsmuseum.txt", "charts0.txt"} {
+		suite.Nil(suite.Backend.PutObject(key, []byte(key)))
+	}
+
+	suite.Nil(suite.Backend.DeletePrefix("charts"))
+
+	_, err := suite.Backend.GetObject("charts/nested/b.tgz")
+	suite.True(os.IsNotExist(err))
+	for _, key := range []string{"charts-old/c.tgz", "chartsmuseum.txt", "charts0.txt"} {
+		_, err = suite.Backend.GetObject(key)
+		suite.Nil(err, "keys out of the prefix range are kept")
+	}
+
+	suite.True(errors.Is(suite.Backend.DeletePrefix(""), ErrInvalidKey))
+}
+
+func (suite *SQLTestSuite) TestCommitBatch() {
+	suite.Nil(suite.Backend.PutObject("old.txt", []byte("old")))
+
+	batch := NewBatch()
+	batch.Put("charts/a.tgz", []byte("a"))
+	batch.Put("charts/b.tgz", []byte("b"))
+	batch.Delete("old.txt")
+	batch.Delete("missing.txt")
+	suite.Nil(suite.Backend.CommitBatch(context.Background(), batch))
+
+	objects, err := suite.Backend.ListObjects("charts")
+	suite.Nil(err)
+	suite.Len(objects, 2)
+	_, err = suite.Backend.GetObject("old.txt")
+	suite.True(os.IsNotExist(err))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	batch = NewBatch()
+	batch.Put("charts/c.tgz", []byte("c"))
+	suite.NotNil(suite.Backend.CommitBatch(ctx, batch))
+
+	_, err = suite.Backend.GetObject("charts/c.tgz")
+	suite.True(os.IsNotExist(err), "canceled batch is not committed")
+}
+
+func TestSQLStorageTestSuite(t *testing.T) {
+	suite.Run(t, new(SQLTestSuite))
+}
@@ -11,26 +11,21 @@ import (
 type StorageTestSuite struct {
 	suite.Suite
 	StorageBackends map[string]Backend
-	TempDirectory   string
+	Fixture         *testFixture
 }
 
 func (suite *StorageTestSuite) setupStorageBackends() {
-	timestamp := time.Now().Format("20060102150405")
-	suite.TempDirectory = fmt.Sprintf("../../.test/storage-storage/%s", timestamp)
-	suite.StorageBackends = make(map[string]Backend)
-	ls, err := NewDirStorage(suite.TempDirectory)
-	if err != nil {
-		suite.Error(err)
-	}
-	suite.StorageBackends["LocalFilesystem"] = Backend(ls)
+	suite.Fixture = newTestFixture("storage")
+	suite.Nil(suite.Fixture.StartBackends(), "No error starting test backends")
+	suite.StorageBackends = suite.Fixture.Backends
 
 	// create empty dir in local storage to make sure it doesnt end up in ListObjects
-	if err := os.MkdirAll(fmt.Sprintf("%s/%s", suite.TempDirectory, "ignoreme"), 0777); err != nil {
+	if err := os.MkdirAll(suite.Fixture.Path("local", "ignoreme"), 0777); err != nil {
 		suite.Nil(err, "No error creating ignored dir in local storage")
 	}
 
 	if os.Getenv("TEST_CLOUD_STORAGE") == "1" {
-		prefix := fmt.Sprintf("unittest/%s", timestamp)
+		prefix := fmt.Sprintf("unittest/%s", suite.Fixture.timestamp)
 		s3Bucket := os.Getenv("TEST_STORAGE_AWS_BUCKET")
 		s3Region := os.Getenv("TEST_STORAGE_AWS_REGION")
 		gcsBucket := os.Getenv("TEST_STORAGE_GOOGLE_BUCKET")
@@ -77,7 +72,7 @@ func (suite *StorageTestSuite) SetupSuite() {
 }
 
 func (suite *StorageTestSuite) TearDownSuite() {
-	defer os.RemoveAll(suite.TempDirectory)
+	defer suite.Fixture.Close()
 
 	for i := 1; i <= 9; i++ {
 		path := fmt.Sprintf("test%d.txt", i)
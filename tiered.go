@@ -0,0 +1,240 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type TieredOptions struct {
+	Logger *zap.SugaredLogger
+	// Hot tier receives all writes, e.g. DirStorage or etcd
+	Hot Backend
+	// Cold tier receives objects older than MaxAge, e.g. S3 or GCS
+	Cold Backend
+	// MaxAge is the age after which objects are moved to the cold tier
+	MaxAge time.Duration
+	// Interval between background migrations, defaults to one minute
+	Interval time.Duration
+	// Prefixes to look up objects for migration at, defaults to the root
+	Prefixes []string
+}
+
+// TieredBackend writes objects to the hot tier and moves them to the cold tier
+// once they get older than the policy age. Reads are served from whichever tier holds the object
+type TieredBackend struct {
+	logger   *zap.SugaredLogger
+	hot      Backend
+	cold     Backend
+	maxAge   time.Duration
+	interval time.Duration
+	prefixes []string
+
+	// mu serializes writes with migration, so a fresh write is never removed from the hot tier
+	mu sync.Mutex
+}
+
+func NewTieredBackend(opts TieredOptions) (*TieredBackend, error) {
+	if opts.Hot == nil || opts.Cold == nil {
+		return nil, fmt.Errorf("both hot and cold tiers must be specified")
+	}
+
+	if opts.MaxAge <= 0 {
+		return nil, fmt.Errorf("max age must be positive")
+	}
+
+	if opts.Logger == nil {
+		opts.Logger = zap.S()
+	}
+
+	if opts.Interval <= 0 {
+		opts.Interval = time.Minute
+	}
+
+	if len(opts.Prefixes) == 0 {
+		opts.Prefixes = []string{""}
+	}
+
+	return &TieredBackend{
+		logger:   opts.Logger,
+		hot:      opts.Hot,
+		cold:     opts.Cold,
+		maxAge:   opts.MaxAge,
+		interval: opts.Interval,
+		prefixes: opts.Prefixes,
+	}, nil
+}
+
+// GetObject reads the cold tier only if the hot tier does not have the object
+func (s *TieredBackend) GetObject(key string) (Object, error) {
+	object, err := s.hot.GetObject(key)
+	if !errors.Is(err, os.ErrNotExist) {
+		return object, err
+	}
+
+	return s.cold.GetObject(key)
+}
+
+// ListObjects merges objects of both tiers, hot tier wins for objects present in both
+func (s *TieredBackend) ListObjects(prefix string) ([]Object, error) {
+	hotObjects, err := s.hot.ListObjects(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	coldObjects, err := s.cold.ListObjects(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var objects []Object
+	for _, o := range hotObjects {
+		seen[o.Path] = true
+		objects = append(objects, o)
+	}
+	for _, o := range coldObjects {
+		if !seen[o.Path] {
+			objects = append(objects, o)
+		}
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Path < objects[j].Path
+	})
+
+	return objects, nil
+}
+
+func (s *TieredBackend) PutObject(key string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hot.PutObject(key, data)
+}
+
+// DeleteObject removes an object from both tiers, the object missing in one of them is not an error.
+// Not found is returned only if neither tier has the object
+func (s *TieredBackend) DeleteObject(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hotErr := s.hot.DeleteObject(key)
+	if hotErr != nil && !errors.Is(hotErr, os.ErrNotExist) {
+		return hotErr
+	}
+	coldErr := s.cold.DeleteObject(key)
+	if coldErr != nil && !errors.Is(coldErr, os.ErrNotExist) {
+		return coldErr
+	}
+	if hotErr != nil && coldErr != nil {
+		return coldErr
+	}
+
+	return nil
+}
+
+// DeletePrefix removes prefix from both tiers, which must support prefix deletes
+func (s *TieredBackend) DeletePrefix(prefix string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := deletePrefix(s.hot, prefix); err != nil {
+		return err
+	}
+	return deletePrefix(s.cold, prefix)
+}
+
+// Migrate moves objects at prefix older than the policy age to the cold tier
+func (s *TieredBackend) Migrate(prefix string) ([]string, error) {
+	objects, err := s.hot.ListObjects(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var migrated []string
+	for _, o := range objects {
+		if time.Since(o.LastModified) < s.maxAge {
+			continue
+		}
+
+		key := joinObjectPath(prefix, o.Path)
+		ok, err := s.migrateObject(key)
+		if err != nil {
+			return migrated, fmt.Errorf("unable to migrate %s: %w", key, err)
+		}
+		if ok {
+			migrated = append(migrated, key)
+		}
+	}
+
+	return migrated, nil
+}
+
+// migrateObject uploads the object to the cold tier without holding the lock
+// and removes it from the hot tier unless it has been overwritten or removed meanwhile
+func (s *TieredBackend) migrateObject(key string) (bool, error) {
+	// object could be overwritten since it has been listed
+	s.mu.Lock()
+	object, err := s.hot.GetObject(key)
+	s.mu.Unlock()
+	if err != nil {
+		return false, err
+	}
+	if time.Since(object.LastModified) < s.maxAge {
+		return false, nil
+	}
+
+	if err := s.cold.PutObject(key, object.Data); err != nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, err := s.hot.GetObject(key)
+	if errors.Is(err, os.ErrNotExist) {
+		// removed during the upload, the copy must not bring it back
+		return false, s.cold.DeleteObject(key)
+	}
+	if err != nil {
+		return false, err
+	}
+	if !current.LastModified.Equal(object.LastModified) || !bytes.Equal(current.Data, object.Data) {
+		// overwritten during the upload, the hot tier wins until the next migration
+		return false, nil
+	}
+
+	return true, s.hot.DeleteObject(key)
+}
+
+// Start runs background migrations until the context is canceled
+func (s *TieredBackend) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				for _, prefix := range s.prefixes {
+					migrated, err := s.Migrate(prefix)
+					if err != nil {
+						s.logger.Errorf("Unable to migrate objects at '%s' to cold tier: %s", prefix, err)
+					}
+					if len(migrated) > 0 {
+						s.logger.Debugf("Migrated %d objects at '%s' to cold tier", len(migrated), prefix)
+					}
+				}
+			}
+		}
+	}()
+}
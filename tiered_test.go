@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// blockingBackend holds puts until released, used to emulate a slow upload
+type blockingBackend struct {
+	Backend
+	started chan string
+	release chan struct{}
+}
+
+func (b *blockingBackend) PutObject(key string, data []byte) error {
+	b.started <- key
+	<-b.release
+	return b.Backend.PutObject(key, data)
+}
+
+type TieredTestSuite struct {
+	suite.Suite
+	Fixture *testFixture
+	Hot     *DirStorage
+	Cold    *DirStorage
+	Tiered  *TieredBackend
+}
+
+func (suite *TieredTestSuite) SetupTest() {
+	suite.Fixture = newTestFixture("tiered")
+
+	hot, err := suite.Fixture.DirStorage("hot")
+	suite.Nil(err)
+	suite.Hot = hot
+
+	cold, err := suite.Fixture.DirStorage("cold")
+	suite.Nil(err)
+	suite.Cold = cold
+
+	tiered, err := NewTieredBackend(TieredOptions{
+		Hot:    hot,
+		Cold:   cold,
+		MaxAge: time.Hour,
+	})
+	suite.Nil(err)
+	suite.Tiered = tiered
+}
+
+func (suite *TieredTestSuite) TearDownTest() {
+	suite.Fixture.Close()
+}
+
+func (suite *TieredTestSuite) age(backend *DirStorage, key string) {
+	past := time.Now().Add(-2 * time.Hour)
+	suite.Nil(os.Chtimes(path.Join(backend.rootDir, key), past, past))
+}
+
+func (suite *TieredTestSuite) TestNewTieredBackend() {
+	_, err := NewTieredBackend(TieredOptions{Hot: suite.Hot, MaxAge: time.Hour})
+	suite.NotNil(err, "cannot create tiered backend without cold tier")
+
+	_, err = NewTieredBackend(TieredOptions{Hot: suite.Hot, Cold: suite.Cold})
+	suite.NotNil(err, "cannot create tiered backend without max age")
+}
+
+func (suite *TieredTestSuite) TestMigrate() {
+	suite.Nil(suite.Tiered.PutObject("old.txt", []byte("old content")))
+	suite.Nil(suite.Tiered.PutObject("new.txt", []byte("new content")))
+	suite.age(suite.Hot, "old.txt")
+
+	migrated, err := suite.Tiered.Migrate("")
+	suite.Nil(err)
+	suite.Equal([]string{"old.txt"}, migrated, "only old objects migrated")
+
+	_, err = suite.Hot.GetObject("old.txt")
+	suite.NotNil(err, "migrated object removed from hot tier")
+
+	object, err := suite.Cold.GetObject("old.txt")
+	suite.Nil(err, "migrated object stored in cold tier")
+	suite.Equal([]byte("old content"), object.Data)
+
+	object, err = suite.Tiered.GetObject("old.txt")
+	suite.Nil(err, "migrated object served from cold tier")
+	suite.Equal([]byte("old content"), object.Data)
+
+	object, err = suite.Tiered.GetObject("new.txt")
+	suite.Nil(err, "fresh object served from hot tier")
+	suite.Equal([]byte("new content"), object.Data)
+}
+
+func (suite *TieredTestSuite) TestListObjects() {
+	suite.Nil(suite.Hot.PutObject("both.txt", []byte("hot content")))
+	suite.Nil(suite.Cold.PutObject("both.txt", []byte("cold content")))
+	suite.Nil(suite.Hot.PutObject("hot.txt", []byte("hot content")))
+	suite.Nil(suite.Cold.PutObject("cold.txt", []byte("cold content")))
+
+	objects, err := suite.Tiered.ListObjects("")
+	suite.Nil(err)
+	var paths []string
+	for _, o := range objects {
+		paths = append(paths, o.Path)
+	}
+	suite.Equal([]string{"both.txt", "cold.txt", "hot.txt"}, paths, "tiers merged without duplicates")
+
+	object, err := suite.Tiered.GetObject("both.txt")
+	suite.Nil(err)
+	suite.Equal([]byte("hot content"), object.Data, "hot tier wins")
+}
+
+func (suite *TieredTestSuite) TestDeleteObject() {
+	suite.Nil(suite.Cold.PutObject("cold.txt", []byte("cold content")))
+	suite.Nil(suite.Tiered.DeleteObject("cold.txt"), "object removed from cold tier")
+	suite.NotNil(suite.Tiered.DeleteObject("cold.txt"), "cannot remove object missing in both tiers")
+}
+
+func (suite *TieredTestSuite) TestHotTierFailure() {
+	suite.Nil(suite.Cold.PutObject("test.txt", []byte("cold content")))
+	tiered, err := NewTieredBackend(TieredOptions{Hot: brokenBackend{}, Cold: suite.Cold, MaxAge: time.Hour})
+	suite.Nil(err)
+
+	_, err = tiered.GetObject("test.txt")
+	suite.NotNil(err, "hot tier failure returned instead of a cold copy")
+	suite.NotNil(tiered.DeleteObject("test.txt"), "failed hot delete returned")
+	suite.True(errors.Is(suite.Tiered.DeleteObject("missing.txt"), os.ErrNotExist))
+}
+
+func (suite *TieredTestSuite) TestMigrateUnlocked() {
+	cold := &blockingBackend{Backend: suite.Cold, started: make(chan string), release: make(chan struct{})}
+	tiered, err := NewTieredBackend(TieredOptions{Hot: suite.Hot, Cold: cold, MaxAge: time.Hour})
+	suite.Nil(err)
+
+	suite.Nil(tiered.PutObject("updated.txt", []byte("old content")))
+	suite.Nil(tiered.PutObject("deleted.txt", []byte("old content")))
+	suite.age(suite.Hot, "updated.txt")
+	suite.age(suite.Hot, "deleted.txt")
+
+	done := make(chan []string)
+	go func() {
+		migrated, err := tiered.Migrate("")
+		suite.Nil(err)
+		done <- migrated
+	}()
+
+	suite.Equal("deleted.txt", <-cold.started)
+	suite.Nil(tiered.DeleteObject("deleted.txt"), "writes are not blocked by the upload")
+	cold.release <- struct{}{}
+	suite.Equal("updated.txt", <-cold.started)
+	suite.Nil(tiered.PutObject("updated.txt", []byte("new content")))
+	cold.release <- struct{}{}
+	suite.Empty(<-done, "objects changed during upload are not migrated")
+
+	_, err = tiered.GetObject("deleted.txt")
+	suite.True(errors.Is(err, os.ErrNotExist), "deleted object not brought back")
+	object, err := tiered.GetObject("updated.txt")
+	suite.Nil(err)
+	suite.Equal([]byte("new content"), object.Data)
+}
+
+func TestTieredTestSuite(t *testing.T) {
+	suite.Run(t, new(TieredTestSuite))
+}
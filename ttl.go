@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// expiresMetadataKey is the user metadata key holding expiration time of cloud storage objects
+const expiresMetadataKey = "Storage-Expires"
+
+// ExpiringBackend is implemented by backends able to store objects with time-to-live.
+// Expired objects are invisible to GetObject even before they are removed, and to ListObjects
+// of every backend but S3, where it is enabled with AWSOptions.HideExpiredOnList
+type ExpiringBackend interface {
+	Backend
+	PutObjectWithTTL(key string, data []byte, ttl time.Duration) error
+}
+
+// Sweeper is implemented by expiring backends that keep expired objects until they are swept
+type Sweeper interface {
+	// SweepExpired removes expired objects right under prefix and returns their keys
+	SweepExpired(prefix string) ([]string, error)
+}
+
+// RunJanitor sweeps expired objects at prefixes every interval until the context is canceled
+func RunJanitor(ctx context.Context, sweeper Sweeper, interval time.Duration, prefixes ...string) {
+	if len(prefixes) == 0 {
+		prefixes = []string{""}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, prefix := range prefixes {
+				swept, err := sweeper.SweepExpired(prefix)
+				if err != nil {
+					zap.S().Errorf("Unable to sweep expired objects at '%s': %s", prefix, err)
+				}
+				if len(swept) > 0 {
+					zap.S().Debugf("Swept %d expired objects at '%s'", len(swept), prefix)
+				}
+			}
+		}
+	}
+}
+
+func expiresAt(ttl time.Duration) (time.Time, error) {
+	if ttl <= 0 {
+		return time.Time{}, fmt.Errorf("ttl must be positive, got %s", ttl)
+	}
+	return time.Now().Add(ttl).UTC(), nil
+}
+
+func isExpired(expires time.Time) bool {
+	return !expires.IsZero() && !time.Now().Before(expires)
+}
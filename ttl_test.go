@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type TTLTestSuite struct {
+	BackendsTestSuite
+}
+
+func isExpiringBackend(b Backend) bool {
+	_, ok := b.(ExpiringBackend)
+	return ok
+}
+
+func (suite *TTLTestSuite) TestPutObjectWithTTL() {
+	suite.EachBackend(isExpiringBackend, func(b Backend) {
+		backend := b.(ExpiringBackend)
+		suite.NotNil(backend.PutObjectWithTTL("token", []byte("secret"), 0), "ttl must be positive")
+
+		// etcd leases are granted in whole seconds
+		suite.Nil(backend.PutObjectWithTTL("tokens/short", []byte("secret"), time.Second))
+		suite.Nil(backend.PutObjectWithTTL("tokens/long", []byte("secret"), time.Hour))
+		suite.Nil(backend.PutObject("tokens/permanent", []byte("secret")))
+
+		object, err := backend.GetObject("tokens/short")
+		suite.Nil(err, "object visible before expiration")
+		suite.Equal([]byte("secret"), object.Data)
+
+		suite.Eventually(func() bool {
+			_, err := backend.GetObject("tokens/short")
+			return errors.Is(err, os.ErrNotExist)
+		}, 10*time.Second, 50*time.Millisecond, "expired object invisible to get")
+
+		objects, err := backend.ListObjects("tokens")
+		suite.Nil(err)
+		if s3, ok := backend.(*AWSStorage); ok && !s3.hideExpired {
+			suite.Len(objects, 3, "expired S3 object listed until swept")
+		} else {
+			suite.Len(objects, 2, "expired object invisible to list")
+			for _, o := range objects {
+				suite.NotEqual("short", o.Path)
+			}
+		}
+
+		if sweeper, ok := backend.(Sweeper); ok {
+			swept, err := sweeper.SweepExpired("tokens")
+			suite.Nil(err)
+			suite.Equal([]string{"tokens/short"}, swept, "expired object swept")
+		}
+	})
+}
+
+func (suite *TTLTestSuite) TestPutObjectOverridesTTL() {
+	suite.EachBackend(isExpiringBackend, func(b Backend) {
+		backend := b.(ExpiringBackend)
+		suite.Nil(backend.PutObjectWithTTL("override", []byte("secret"), time.Second))
+		suite.Nil(backend.PutObject("override", []byte("permanent")))
+
+		time.Sleep(1500 * time.Millisecond)
+
+		object, err := backend.GetObject("override")
+		suite.Nil(err, "object overwritten without ttl does not expire")
+		suite.Equal([]byte("permanent"), object.Data)
+	})
+}
+
+func (suite *TTLTestSuite) TestDirOverwriteExpired() {
+	dir := suite.Dir()
+	for i := 0; i < 50; i++ {
+		suite.Nil(dir.PutObjectWithTTL("overwrite/expired", []byte("expired"), time.Nanosecond))
+
+		stop := make(chan struct{})
+		resurrected := make(chan bool)
+		go func() {
+			found := false
+			for {
+				select {
+				case <-stop:
+					resurrected <- found
+					return
+				default:
+				}
+				object, err := dir.GetObject("overwrite/expired")
+				found = found || err == nil && string(object.Data) == "expired"
+			}
+		}()
+
+		suite.Nil(dir.PutObject("overwrite/expired", []byte("permanent")))
+		close(stop)
+		suite.False(<-resurrected, "expired object never read without its ttl")
+
+		object, err := dir.GetObject("overwrite/expired")
+		suite.Nil(err)
+		suite.Equal([]byte("permanent"), object.Data)
+	}
+}
+
+func (suite *TTLTestSuite) TestSweepExpiredRemovesFile() {
+	dir := suite.Dir()
+	suite.Nil(dir.PutObjectWithTTL("sweep/short", []byte("secret"), 10*time.Millisecond))
+	time.Sleep(50 * time.Millisecond)
+
+	swept, err := dir.SweepExpired("sweep")
+	suite.Nil(err)
+	suite.Equal([]string{"sweep/short"}, swept)
+
+	_, err = os.Stat(dir.rootDir + "/sweep/short")
+	suite.True(os.IsNotExist(err), "expired file removed")
+}
+
+func (suite *TTLTestSuite) TestRunJanitor() {
+	dir := suite.Dir()
+	suite.Nil(dir.PutObjectWithTTL("cache/build", []byte("artifact"), 10*time.Millisecond))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		RunJanitor(ctx, dir, 20*time.Millisecond, "cache")
+		close(done)
+	}()
+
+	suite.Eventually(func() bool {
+		_, err := os.Stat(dir.rootDir + "/cache/build")
+		return os.IsNotExist(err)
+	}, 5*time.Second, 10*time.Millisecond, "janitor removes expired objects")
+
+	cancel()
+	<-done
+}
+
+func TestTTLTestSuite(t *testing.T) {
+	suite.Run(t, &TTLTestSuite{BackendsTestSuite: BackendsTestSuite{Name: "ttl"}})
+}
@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// EventType describes the kind of an object change
+type EventType string
+
+const (
+	EventCreated EventType = "created"
+	EventUpdated EventType = "updated"
+	EventDeleted EventType = "deleted"
+)
+
+// DefaultPollInterval is used by backends without native change notifications
+var DefaultPollInterval = 30 * time.Second
+
+// Event is a change of an object, object path is relative to the watched prefix
+type Event struct {
+	Type   EventType
+	Object Object
+	// Revision is the etcd revision or the Consul ModifyIndex of the change, zero for other backends
+	Revision int64
+}
+
+// Watcher is implemented by backends able to notify about object changes.
+// Events channel is closed when the context is canceled
+type Watcher interface {
+	Watch(ctx context.Context, prefix string) <-chan Event
+}
+
+// PollObjects watches objects at prefix by listing them every interval
+// and comparing with the previous listing using GetObjectSliceDiff
+func PollObjects(ctx context.Context, backend Backend, prefix string, interval time.Duration) <-chan Event {
+	events := make(chan Event)
+
+	go func() {
+		defer close(events)
+
+		prev, err := backend.ListObjects(prefix)
+		if err != nil {
+			zap.S().Errorf("Unable to list objects at '%s': %s", prefix, err)
+		}
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			curr, err := backend.ListObjects(prefix)
+			if err != nil {
+				// keep the previous listing, so changes are reported on the next successful one
+				zap.S().Errorf("Unable to list objects at '%s': %s", prefix, err)
+				continue
+			}
+
+			diff := GetObjectSliceDiff(prev, curr, 0)
+			prev = curr
+			if !diff.Change {
+				continue
+			}
+
+			for _, changes := range []struct {
+				eventType EventType
+				objects   []Object
+			}{
+				{EventCreated, diff.Added},
+				{EventUpdated, diff.Updated},
+				{EventDeleted, diff.Removed},
+			} {
+				for _, o := range changes.objects {
+					select {
+					case events <- Event{Type: changes.eventType, Object: o}:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}
+	}()
+
+	return events
+}
@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type WatchTestSuite struct {
+	BackendsTestSuite
+	pollInterval time.Duration
+}
+
+func (suite *WatchTestSuite) SetupSuite() {
+	// polling backends report changes on the next listing
+	suite.pollInterval = DefaultPollInterval
+	DefaultPollInterval = 20 * time.Millisecond
+	suite.BackendsTestSuite.SetupSuite()
+}
+
+func (suite *WatchTestSuite) TearDownSuite() {
+	DefaultPollInterval = suite.pollInterval
+	suite.BackendsTestSuite.TearDownSuite()
+}
+
+// nextEvent skips events of other objects, fsnotify may report several writes per put
+func (suite *WatchTestSuite) nextEvent(events <-chan Event, eventType EventType, path string) {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e, ok := <-events:
+			suite.True(ok, "events channel open")
+			if !ok {
+				return
+			}
+			if e.Type == eventType && e.Object.Path == path {
+				return
+			}
+		case <-timeout:
+			suite.FailNow(fmt.Sprintf("%s event of %s not received", eventType, path))
+		}
+	}
+}
+
+func (suite *WatchTestSuite) TestPollObjects() {
+	dir := suite.Dir()
+	ctx, cancel := context.WithCancel(context.Background())
+	suite.Nil(dir.PutObject("poll/existing.yaml", []byte("existing")))
+
+	events := PollObjects(ctx, dir, "poll", 20*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+
+	suite.Nil(dir.PutObject("poll/new.yaml", []byte("new")))
+	suite.nextEvent(events, EventCreated, "new.yaml")
+
+	future := time.Now().Add(time.Minute)
+	suite.Nil(os.Chtimes(dir.rootDir+"/poll/existing.yaml", future, future))
+	suite.nextEvent(events, EventUpdated, "existing.yaml")
+
+	suite.Nil(dir.DeleteObject("poll/new.yaml"))
+	suite.nextEvent(events, EventDeleted, "new.yaml")
+
+	cancel()
+	for range events {
+	}
+}
+
+func (suite *WatchTestSuite) TestWatch() {
+	suite.EachBackend(func(b Backend) bool {
+		_, ok := b.(Watcher)
+		return ok
+	}, func(backend Backend) {
+		ctx, cancel := context.WithCancel(context.Background())
+		events := backend.(Watcher).Watch(ctx, "config")
+		// let the watch start before the first change
+		time.Sleep(50 * time.Millisecond)
+
+		suite.Nil(backend.PutObject("config/app.yaml", []byte("created")))
+		suite.nextEvent(events, EventCreated, "app.yaml")
+
+		suite.Nil(backend.DeleteObject("config/app.yaml"))
+		suite.nextEvent(events, EventDeleted, "app.yaml")
+
+		suite.Nil(backend.PutObject("config/app.yaml", []byte("recreated")))
+		suite.nextEvent(events, EventCreated, "app.yaml")
+
+		cancel()
+		for range events {
+		}
+	})
+}
+
+func (suite *WatchTestSuite) TestDirWatchUpdate() {
+	dir := suite.Dir()
+	ctx, cancel := context.WithCancel(context.Background())
+	events := dir.Watch(ctx, "update")
+
+	suite.Nil(dir.PutObject("update/app.yaml", []byte("created")))
+	suite.nextEvent(events, EventCreated, "app.yaml")
+
+	suite.Nil(dir.PutObject("update/app.yaml", []byte("updated")))
+	suite.nextEvent(events, EventUpdated, "app.yaml")
+
+	cancel()
+	for range events {
+	}
+}
+
+func TestWatchTestSuite(t *testing.T) {
+	suite.Run(t, &WatchTestSuite{BackendsTestSuite: BackendsTestSuite{Name: "watch"}})
+}
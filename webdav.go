@@ -0,0 +1,295 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// webdavPropfindBody requests the properties ListObjects needs
+const webdavPropfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:"><D:prop><D:resourcetype/><D:getlastmodified/></D:prop></D:propfind>`
+
+type WebDAVOptions struct {
+	Logger *zap.SugaredLogger
+	// URL of the collection objects are stored under
+	URL string
+	// User and Password are sent with basic authentication if User is set
+	User     string
+	Password string
+	// HTTPClient defaults to http.DefaultClient
+	HTTPClient *http.Client
+}
+
+// WebDAVStorage stores objects as resources of a WebDAV collection,
+// keys are paths relative to the collection URL
+type WebDAVStorage struct {
+	logger   *zap.SugaredLogger
+	base     *url.URL
+	user     string
+	password string
+	client   *http.Client
+}
+
+func NewWebDAVStorage(opts WebDAVOptions) (*WebDAVStorage, error) {
+	if opts.Logger == nil {
+		opts.Logger = zap.S()
+	}
+
+	if opts.URL == "" {
+		return nil, fmt.Errorf("webdav url must be specified")
+	}
+	base, err := url.Parse(opts.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webdav url: %w", err)
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return nil, fmt.Errorf("invalid webdav url scheme: %s", base.Scheme)
+	}
+	base.Path = strings.TrimSuffix(base.Path, "/")
+	base.RawPath = ""
+
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = http.DefaultClient
+	}
+
+	return &WebDAVStorage{
+		logger:   opts.Logger,
+		base:     base,
+		user:     opts.User,
+		password: opts.Password,
+		client:   opts.HTTPClient,
+	}, nil
+}
+
+// webdavMultistatus is the PROPFIND response body
+type webdavMultistatus struct {
+	Responses []struct {
+		Href     string `xml:"href"`
+		Propstat []struct {
+			Prop struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"collection"`
+				} `xml:"resourcetype"`
+				LastModified string `xml:"getlastmodified"`
+			} `xml:"prop"`
+			Status string `xml:"status"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+// ListObjects lists non-collection members of the prefix collection with a depth 1 PROPFIND
+func (s *WebDAVStorage) ListObjects(prefix string) ([]Object, error) {
+	var objects []Object
+	prefix, err := defaultKeyRules.validatePrefix(prefix)
+	if err != nil {
+		return objects, err
+	}
+
+	collection := s.url(prefix) + "/"
+	header := http.Header{
+		"Depth":        {"1"},
+		"Content-Type": {"application/xml; charset=utf-8"},
+	}
+	res, err := s.do("PROPFIND", collection, header, []byte(webdavPropfindBody))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) { // OK if the collection doesnt exist yet
+			err = nil
+		}
+		return objects, err
+	}
+	defer res.Body.Close()
+
+	var multistatus webdavMultistatus
+	if err := xml.NewDecoder(res.Body).Decode(&multistatus); err != nil {
+		return objects, fmt.Errorf("unable to decode webdav multistatus: %w", err)
+	}
+
+	collectionPath := path.Join("/", s.base.Path, prefix)
+	for _, r := range multistatus.Responses {
+		href, err := url.Parse(r.Href)
+		if err != nil {
+			return objects, fmt.Errorf("invalid webdav href %q: %w", r.Href, err)
+		}
+		hrefPath := path.Join("/", href.Path)
+		if hrefPath == collectionPath || path.Dir(hrefPath) != collectionPath {
+			continue
+		}
+
+		object := Object{Path: path.Base(hrefPath), Data: []byte{}}
+		collection := false
+		for _, propstat := range r.Propstat {
+			if !strings.Contains(propstat.Status, " 200 ") {
+				continue
+			}
+			collection = collection || propstat.Prop.ResourceType.Collection != nil
+			if propstat.Prop.LastModified != "" {
+				object.LastModified, _ = http.ParseTime(propstat.Prop.LastModified)
+			}
+		}
+		if collection {
+			continue
+		}
+		objects = append(objects, object)
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Path < objects[j].Path
+	})
+	return objects, nil
+}
+
+func (s *WebDAVStorage) GetObject(key string) (Object, error) {
+	object := Object{Path: key}
+	normalized, err := defaultKeyRules.validate(key)
+	if err != nil {
+		return object, err
+	}
+
+	res, err := s.do(http.MethodGet, s.url(normalized), nil, nil)
+	if err != nil {
+		return object, err
+	}
+	content, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return object, err
+	}
+
+	object.Meta = Metadata{
+		Name:        path.Base(normalized),
+		Version:     res.Header.Get("ETag"),
+		ContentType: res.Header.Get("Content-Type"),
+	}
+	object.Data = content
+	object.LastModified, _ = http.ParseTime(res.Header.Get("Last-Modified"))
+	return object, nil
+}
+
+// PutObject uploads the object, creating missing parent collections with MKCOL
+// if the server rejects the upload for them
+func (s *WebDAVStorage) PutObject(key string, data []byte) error {
+	key, err := defaultKeyRules.validate(key)
+	if err != nil {
+		return err
+	}
+
+	res, err := s.do(http.MethodPut, s.url(key), nil, data)
+	if isMissingCollection(err) && path.Dir(key) != "." {
+		if err := s.mkcolAll(path.Dir(key)); err != nil {
+			return err
+		}
+		res, err = s.do(http.MethodPut, s.url(key), nil, data)
+	}
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+func (s *WebDAVStorage) DeleteObject(key string) error {
+	key, err := defaultKeyRules.validate(key)
+	if err != nil {
+		return err
+	}
+
+	res, err := s.do(http.MethodDelete, s.url(key), nil, nil)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// DeletePrefix removes the prefix collection, servers delete collections with their members
+func (s *WebDAVStorage) DeletePrefix(prefix string) error {
+	prefix, err := defaultKeyRules.validate(prefix)
+	if err != nil {
+		return err
+	}
+
+	res, err := s.do(http.MethodDelete, s.url(prefix)+"/", nil, nil)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// Watch polls objects at prefix every DefaultPollInterval
+func (s *WebDAVStorage) Watch(ctx context.Context, prefix string) <-chan Event {
+	return PollObjects(ctx, s, prefix, DefaultPollInterval)
+}
+
+// mkcolAll creates collection dir and its parents below the base collection,
+// existing collections are answered with 405 Method Not Allowed
+func (s *WebDAVStorage) mkcolAll(dir string) error {
+	segments := strings.Split(dir, "/")
+	for i := range segments {
+		res, err := s.do("MKCOL", s.url(path.Join(segments[:i+1]...))+"/", nil, nil)
+		if err != nil {
+			if httpErr, ok := err.(*HTTPError); ok && httpErr.StatusCode == http.StatusMethodNotAllowed {
+				continue
+			}
+			return err
+		}
+		res.Body.Close()
+	}
+	return nil
+}
+
+// url returns the escaped URL of a normalized key
+func (s *WebDAVStorage) url(key string) string {
+	u := *s.base
+	u.Path = path.Join(u.Path, key)
+	return u.String()
+}
+
+// do sends a request, responses with error status are returned as HTTPError
+func (s *WebDAVStorage) do(method string, target string, header http.Header, body []byte) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, target, reader)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if s.user != "" {
+		req.SetBasicAuth(s.user, s.password)
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 300 {
+		return res, nil
+	}
+
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 64*1024))
+	res.Body.Close()
+	return nil, &HTTPError{Method: method, URL: target, StatusCode: res.StatusCode}
+}
+
+// isMissingCollection reports whether a PUT failed for a missing parent collection,
+// RFC 4918 requires 409 Conflict, some servers answer 404 Not Found
+func isMissingCollection(err error) bool {
+	httpErr, ok := err.(*HTTPError)
+	return ok && (httpErr.StatusCode == http.StatusConflict || httpErr.StatusCode == http.StatusNotFound)
+}
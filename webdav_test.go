@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/net/webdav"
+)
+
+const (
+	fakeWebDAVUser     = "charts"
+	fakeWebDAVPassword = "secret"
+)
+
+// newFakeWebDAVServer serves an in-memory WebDAV file system under /dav with basic authentication
+func newFakeWebDAVServer() *httptest.Server {
+	handler := &webdav.Handler{
+		Prefix:     "/dav",
+		FileSystem: webdav.NewMemFS(),
+		LockSystem: webdav.NewMemLS(),
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != fakeWebDAVUser || password != fakeWebDAVPassword {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+}
+
+type WebDAVTestSuite struct {
+	suite.Suite
+	server  *httptest.Server
+	Backend *WebDAVStorage
+}
+
+func (suite *WebDAVTestSuite) SetupTest() {
+	suite.server = newFakeWebDAVServer()
+
+	backend, err := NewWebDAVStorage(WebDAVOptions{
+		URL:      suite.server.URL + "/dav/",
+		User:     fakeWebDAVUser,
+		Password: fakeWebDAVPassword,
+	})
+	suite.Nil(err)
+	suite.Backend = backend
+}
+
+func (suite *WebDAVTestSuite) TearDownTest() {
+	suite.server.Close()
+}
+
+func (suite *WebDAVTestSuite) TestNewWebDAVStorage() {
+	_, err := NewWebDAVStorage(WebDAVOptions{})
+	suite.NotNil(err, "url is required")
+
+	_, err = NewWebDAVStorage(WebDAVOptions{URL: "ftp://example.com/dav"})
+	suite.NotNil(err, "only http and https urls are supported")
+}
+
+func (suite *WebDAVTestSuite) TestPutGetObject() {
+	suite.Nil(suite.Backend.PutObject("index.yaml", []byte("apiVersion: v1")))
+
+	object, err := suite.Backend.GetObject("index.yaml")
+	suite.Nil(err)
+	suite.Equal([]byte("apiVersion: v1"), object.Data)
+	suite.Equal("index.yaml", object.Meta.Name)
+	suite.NotEmpty(object.Meta.Version, "etag is the object version")
+	suite.WithinDuration(time.Now(), object.LastModified, 2*time.Second)
+
+	suite.Nil(suite.Backend.PutObject("index.yaml", []byte("apiVersion: v2")))
+	object, err = suite.Backend.GetObject("index.yaml")
+	suite.Nil(err)
+	suite.Equal([]byte("apiVersion: v2"), object.Data, "object replaced")
+}
+
+func (suite *WebDAVTestSuite) TestPutObjectCreatesCollections() {
+	suite.Nil(suite.Backend.PutObject("charts/stable/nginx-1.0.0.tgz", []byte("chart")))
+	suite.Nil(suite.Backend.PutObject("charts/incubator/redis-1.0.0.tgz", []byte("chart")), "existing parent collections are kept")
+
+	object, err := suite.Backend.GetObject("charts/stable/nginx-1.0.0.tgz")
+	suite.Nil(err)
+	suite.Equal([]byte("chart"), object.Data)
+}
+
+func (suite *WebDAVTestSuite) TestListObjects() {
+	objects, err := suite.Backend.ListObjects("missing")
+	suite.Nil(err, "list objects does not return error if collection does not exist")
+	suite.Empty(objects)
+
+	for _, key := range []string{"b.txt", "a.txt", "nested/c.txt", "with space.txt"} {
+		suite.Nil(suite.Backend.PutObject(key, []byte(key)))
+	}
+
+	objects, err = suite.Backend.ListObjects("")
+	suite.Nil(err)
+	suite.Len(objects, 3, "collections are not listed")
+	suite.Equal("a.txt", objects[0].Path)
+	suite.Equal("b.txt", objects[1].Path)
+	suite.Equal("with space.txt", objects[2].Path, "hrefs are unescaped")
+	for _, object := range objects {
+		suite.WithinDuration(time.Now(), object.LastModified, 2*time.Second, "getlastmodified parsed")
+	}
+
+	objects, err = suite.Backend.ListObjects("nested")
+	suite.Nil(err)
+	suite.Len(objects, 1)
+	suite.Equal("c.txt", objects[0].Path)
+
+	_, err = suite.Backend.ListObjects("../escape")
+	suite.True(errors.Is(err, ErrInvalidKey))
+}
+
+func (suite *WebDAVTestSuite) TestDeleteObject() {
+	suite.Nil(suite.Backend.PutObject("deleteme.txt", []byte("content")))
+	suite.Nil(suite.Backend.DeleteObject("deleteme.txt"))
+
+	_, err := suite.Backend.GetObject("deleteme.txt")
+	suite.True(errors.Is(err, os.ErrNotExist), "missing object matches os.ErrNotExist")
+
+	err = suite.Backend.DeleteObject("deleteme.txt")
+	suite.True(errors.Is(err, os.ErrNotExist))
+}
+
+func (suite *WebDAVTestSuite) TestUnauthorized() {
+	backend, err := NewWebDAVStorage(WebDAVOptions{URL: suite.server.URL + "/dav", User: fakeWebDAVUser})
+	suite.Nil(err)
+
+	err = backend.PutObject("index.yaml", []byte{})
+	suite.True(errors.Is(err, os.ErrPermission), "rejected credentials match os.ErrPermission")
+
+	var httpErr *HTTPError
+	suite.True(errors.As(err, &httpErr))
+	suite.Equal(http.StatusUnauthorized, httpErr.StatusCode)
+}
+
+func TestWebDAVStorageTestSuite(t *testing.T) {
+	suite.Run(t, new(WebDAVTestSuite))
+}